@@ -10,9 +10,15 @@ type Config struct {
 	Env         string `json:"-"`
 	DatabaseDsn string `json:"-"`
 	Secret      []byte `json:"-"`
+	AdminToken  []byte `json:"-"`
 	Host        string `json:"host"`
 	Port        int    `json:"port"`
-	Lifetime    struct {
+	/* Адреса и подсети (CIDR) обратных прокси, от которых принимаются X-Forwarded-For и X-Real-IP.
+	 * Пусто - заголовки игнорируются и клиентом считается адрес соединения. */
+	TrustedProxies []string `json:"trusted_proxies"`
+	/* iss в токенах, если тенанты не настроены (у тенантов он задаётся в их issuer) */
+	Issuer   string `json:"issuer"`
+	Lifetime struct {
 		RefreshToken int64 `json:"refresh_token"`
 		AccessToken  int64 `json:"access_token"`
 		ExpiredToken int64 `json:"expired_token_hash"`
@@ -23,7 +29,235 @@ type Config struct {
 		Login    string `json:"login"`
 		Password string `json:"password"`
 		Email    string `json:"email"`
+		/* tls (TLS при подключении), starttls или none. Пустое - tls для порта 465, иначе starttls */
+		Security string `json:"security"`
+		/* plain, login, cram-md5 или none */
+		Auth      string `json:"auth"`
+		HelloName string `json:"hello_name"`
+		/* Сколько соединений держать открытыми между письмами */
+		PoolSize int `json:"pool_size"`
+		/* Таймауты в секундах: простоя соединения в пуле, подключения и отправки одного письма */
+		IdleTimeout int64 `json:"idle_timeout"`
+		DialTimeout int64 `json:"dial_timeout"`
+		Timeout     int64 `json:"timeout"`
 	} `json:"smtp"`
+	Password struct {
+		MinLength   int    `json:"min_length"`
+		Memory      uint32 `json:"memory"`
+		Iterations  uint32 `json:"iterations"`
+		Parallelism uint8  `json:"parallelism"`
+		SaltLength  uint32 `json:"salt_length"`
+		KeyLength   uint32 `json:"key_length"`
+	} `json:"password"`
+	MagicLink         Link `json:"magic_link"`
+	EmailVerification Link `json:"email_verification"`
+	PasswordReset     Link `json:"password_reset"`
+	TOTP              struct {
+		Issuer string `json:"issuer"`
+		/* Допустимое расхождение часов в шагах по 30 секунд */
+		Skew int64 `json:"skew"`
+		/* Сколько секунд после пароля даётся на ввод кода */
+		ChallengeLifetime int64 `json:"challenge_lifetime"`
+	} `json:"totp"`
+	WebAuthn struct {
+		RPID    string   `json:"rp_id"`
+		RPName  string   `json:"rp_name"`
+		Origins []string `json:"origins"`
+		/* Требовать проверку пользователя (PIN, биометрия) на аутентификаторе */
+		RequireUserVerification bool `json:"require_user_verification"`
+		/* Сколько секунд даётся на церемонию */
+		Timeout int64 `json:"timeout"`
+	} `json:"webauthn"`
+	/* Выдача токенов по одному GUID без проверки пароля (POST /user/tokens/create) */
+	AllowGuidGrant bool `json:"allow_guid_grant"`
+	/* Не выдавать токены пользователям с неподтверждённым email */
+	RequireVerifiedEmail bool `json:"require_verified_email"`
+	RateLimit            struct {
+		/* memory - в памяти процесса, postgres - общая таблица для нескольких реплик */
+		Store  string        `json:"store"`
+		IP     RateLimitRule `json:"ip"`
+		User   RateLimitRule `json:"user"`
+		Global RateLimitRule `json:"global"`
+	} `json:"rate_limit"`
+	Lockout struct {
+		/* Сколько неудачных попыток допускается до первой блокировки, 0 отключает блокировку */
+		Threshold int `json:"threshold"`
+		/* Длительность первой блокировки в секундах, каждая следующая неудача её удваивает */
+		Duration int64 `json:"duration"`
+		/* Предел удвоения в секундах, 0 - без предела */
+		MaxDuration int64 `json:"max_duration"`
+		/* Через сколько секунд без неудачных попыток счётчик начинается заново */
+		ResetAfter int64 `json:"reset_after"`
+	} `json:"lockout"`
+	/* Что делать, если refresh пришёл не с того IP, на который выданы токены */
+	IPPolicy struct {
+		/* strict, subnet, asn, country или notify */
+		Mode       string `json:"mode"`
+		IPv4Prefix int    `json:"ipv4_prefix"`
+		IPv6Prefix int    `json:"ipv6_prefix"`
+		/* Путь к базе GeoIP в формате MaxMind DB для режимов asn и country */
+		GeoDatabase string `json:"geo_database"`
+	} `json:"ip_policy"`
+	Notify struct {
+		/* Каналы, в каждый из которых уходит уведомление: smtp, log, file, webhook */
+		Channels []string `json:"channels"`
+		File     string   `json:"file"`
+		Webhook  struct {
+			URL     string `json:"url"`
+			Timeout int64  `json:"timeout"`
+		} `json:"webhook"`
+		/* Как часто в секундах проверяется очередь */
+		Interval    int64 `json:"interval"`
+		BatchSize   int   `json:"batch_size"`
+		MaxAttempts int   `json:"max_attempts"`
+		/* Задержка перед повтором в секундах удваивается с каждой попыткой, но не больше max_backoff */
+		Backoff    int64 `json:"backoff"`
+		MaxBackoff int64 `json:"max_backoff"`
+	} `json:"notify"`
+	/* Вебхуки событий безопасности и жизненного цикла токенов (см. notify.Event*).
+	 * Отправляются через outbox с теми же повторами, что и уведомления из секции notify. */
+	Events struct {
+		Webhooks []struct {
+			/* Имя вебхука, сообщения для него лежат в outbox под каналом event:<name> */
+			Name string `json:"name"`
+			URL  string `json:"url"`
+			/* Ключ HMAC-SHA256 подписи запросов */
+			Secret string `json:"secret"`
+			/* Типы событий, на которые подписан вебхук. Пусто - все, "security.*" - все с префиксом. */
+			Events  []string `json:"events"`
+			Timeout int64    `json:"timeout"`
+		} `json:"webhooks"`
+	} `json:"events"`
+	Mail struct {
+		/* Язык писем для пользователей, на чей язык нет шаблонов */
+		FallbackLocale string `json:"fallback_locale"`
+		/* Каталог с шаблонами, которые заменяют встроенные (см. internal/mailer/templates) */
+		TemplateDir string `json:"template_dir"`
+		/* Подпись писем DKIM. Пустой key_file отключает подпись. */
+		DKIM struct {
+			Domain   string `json:"domain"`
+			Selector string `json:"selector"`
+			/* PEM файл с закрытым ключом RSA или Ed25519 */
+			KeyFile string `json:"key_file"`
+		} `json:"dkim"`
+	} `json:"mail"`
+	OAuth struct {
+		/* Страница входа фронтенда. GET /oauth/authorize перенаправляет на неё с исходными параметрами,
+		 * а она после входа пользователя отправляет их в POST /oauth/authorize вместе с access токеном. */
+		LoginURL string `json:"login_url"`
+		/* Время жизни кода авторизации в секундах */
+		CodeLifetime int64 `json:"code_lifetime"`
+		/* Внешний адрес POST /oauth/token: клиенты с private_key_jwt указывают его в aud */
+		TokenURL string `json:"token_url"`
+		/* Страница фронтенда, где пользователь вводит user_code (verification_uri из RFC 8628).
+		 * Без неё device authorization grant выключен. */
+		DeviceVerificationURL string `json:"device_verification_url"`
+		/* Время жизни device_code в секундах */
+		DeviceCodeLifetime int64 `json:"device_code_lifetime"`
+		/* Интервал опроса токен-эндпоинта устройством в секундах */
+		DevicePollInterval int64 `json:"device_poll_interval"`
+		/* Scope, которые может получить клиент, зарегистрированный через /oauth/register */
+		RegistrationScopes []string `json:"registration_scopes"`
+		/* Private-use схемы redirect_uri нативных приложений (RFC 8252, 7.1), например com.example.app.
+		 * Кроме них в redirect_uri допустимы только https и http на loopback адресе. */
+		RedirectSchemes []string `json:"redirect_schemes"`
+	} `json:"oauth"`
+	/* Initial access token для динамической регистрации клиентов OAuth (RFC 7591), без него регистрация выключена */
+	RegistrationToken []byte `json:"-"`
+	Impersonation     struct {
+		/* Время жизни токена, выданного администратору от имени пользователя, в секундах.
+		 * Не больше lifetime.access_token тенанта. */
+		Lifetime int64 `json:"lifetime"`
+	} `json:"impersonation"`
+	/* Долгоживущие ключи пользователей для скриптов и CI */
+	APIKeys struct {
+		/* Начало каждого ключа, по нему ключ легко узнать в логах и найти сканером секретов. По умолчанию "ak". */
+		Prefix string `json:"prefix"`
+		/* Сколько ключей может быть у пользователя одновременно, 0 - без ограничения */
+		MaxPerUser int `json:"max_per_user"`
+		/* Время жизни access токена, выданного в обмен на ключ, в секундах. 0 - lifetime.access_token тенанта. */
+		TokenLifetime int64 `json:"token_lifetime"`
+	} `json:"api_keys"`
+	/* OpenID Connect: id_token в OAuth потоках со scope openid и /userinfo */
+	OIDC struct {
+		/* PEM файл с закрытым ключом RSA или EC P-256 для подписи id_token. Пустой - id_token не выдаются. */
+		KeyFile string `json:"key_file"`
+	} `json:"oidc"`
+	/* Вход через внешних провайдеров OpenID Connect ("войти через корпоративный аккаунт") */
+	Federation struct {
+		/* Сколько секунд пользователь может провести у провайдера между началом входа и возвратом. 0 - 600. */
+		StateLifetime int64 `json:"state_lifetime"`
+		/* Таймаут запросов к провайдерам в секундах. 0 - 10. */
+		Timeout   int64                `json:"timeout"`
+		Providers []FederationProvider `json:"providers"`
+	} `json:"federation"`
+	/* Несколько продуктов на одном развёртывании. Без тенантов сервис работает как единственный тенант default
+	 * с SECRET, lifetime и smtp.email из общих настроек. */
+	Tenancy struct {
+		/* Откуда берётся тенант: host (заголовок Host), header или path (первый сегмент пути, /acme/user/login) */
+		Resolve string `json:"resolve"`
+		/* Заголовок для resolve = header, по умолчанию X-Tenant-ID */
+		Header string `json:"header"`
+		/* Тенант для запросов, по которым тенант не определился. Пустой - на такие запросы отвечаем 404. */
+		Default string   `json:"default"`
+		Tenants []Tenant `json:"tenants"`
+	} `json:"tenancy"`
+}
+
+type Tenant struct {
+	ID string `json:"id"`
+	/* Хосты тенанта для resolve = host */
+	Hosts []string `json:"hosts"`
+	/* Значение iss в токенах тенанта */
+	Issuer string `json:"issuer"`
+	/* Время жизни токенов в секундах, 0 - значение из общей секции lifetime */
+	Lifetime struct {
+		RefreshToken int64 `json:"refresh_token"`
+		AccessToken  int64 `json:"access_token"`
+	} `json:"lifetime"`
+	/* Адрес отправителя писем, пустой - smtp.email */
+	MailFrom string `json:"mail_from"`
+	/* Переменная окружения с ключом подписи тенанта. Пустая - ключ выводится из SECRET. */
+	SecretEnv string `json:"secret_env"`
+	Secret    []byte `json:"-"`
+}
+
+type FederationProvider struct {
+	/* Имя провайдера в пути /user/login/federated/{id} */
+	ID string `json:"id"`
+	/* issuer провайдера. Незаданные адреса эндпоинтов берутся из <issuer>/.well-known/openid-configuration */
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	ClientID              string `json:"client_id"`
+	/* Переменная окружения с client_secret. Пустая - сервис входит к провайдеру как публичный клиент, только с PKCE. */
+	ClientSecretEnv string `json:"client_secret_env"`
+	ClientSecret    string `json:"-"`
+	/* Адрес возврата от провайдера: страница фронтенда, которая передаст code и state в callback */
+	RedirectURI string `json:"redirect_uri"`
+	/* Запрашиваемые у провайдера scope, по умолчанию openid email profile */
+	Scopes []string `json:"scopes"`
+	/* Создавать пользователя при первом входе (just-in-time provisioning) */
+	CreateUsers bool `json:"create_users"`
+	/* Привязывать внешний аккаунт к существующему пользователю с тем же email, если провайдер подтвердил email */
+	LinkByEmail bool `json:"link_by_email"`
+}
+
+/* Token bucket: burst запросов подряд, дальше rate запросов в секунду. rate = 0 отключает правило */
+type RateLimitRule struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+/* Настройки одноразовых ссылок, которые отправляются на почту */
+type Link struct {
+	/* Адрес страницы, к которому в письме добавляется ?token=... */
+	URL      string `json:"url"`
+	Lifetime int64  `json:"lifetime"`
+	/* Не больше rate_limit писем на один адрес за rate_window секунд */
+	RateLimit  int   `json:"rate_limit"`
+	RateWindow int64 `json:"rate_window"`
 }
 
 func MustLoad(filePath string) *Config {
@@ -39,6 +273,18 @@ func MustLoad(filePath string) *Config {
 	cfg.Env = os.Getenv("GO_ENV")
 	cfg.DatabaseDsn = os.Getenv("DATABASE_DSN")
 	cfg.Secret = []byte(os.Getenv("SECRET"))
+	cfg.AdminToken = []byte(os.Getenv("ADMIN_TOKEN"))
+	cfg.RegistrationToken = []byte(os.Getenv("OAUTH_REGISTRATION_TOKEN"))
+	for i := range cfg.Tenancy.Tenants {
+		if cfg.Tenancy.Tenants[i].SecretEnv != "" {
+			cfg.Tenancy.Tenants[i].Secret = []byte(os.Getenv(cfg.Tenancy.Tenants[i].SecretEnv))
+		}
+	}
+	for i := range cfg.Federation.Providers {
+		if cfg.Federation.Providers[i].ClientSecretEnv != "" {
+			cfg.Federation.Providers[i].ClientSecret = os.Getenv(cfg.Federation.Providers[i].ClientSecretEnv)
+		}
+	}
 	return cfg
 }
 
@@ -8,8 +8,12 @@ require (
 	github.com/joho/godotenv v1.5.1
 	github.com/kataras/jwt v0.1.12
 	github.com/lib/pq v1.10.9
+	github.com/oschwald/maxminddb-golang v1.13.1
 	go.uber.org/zap v1.27.0
 	golang.org/x/crypto v0.27.0
 )
 
-require go.uber.org/multierr v1.10.0 // indirect
+require (
+	go.uber.org/multierr v1.10.0 // indirect
+	golang.org/x/sys v0.25.0 // indirect
+)
@@ -3,16 +3,21 @@ package app
 import (
 	"database/sql"
 	"net/http"
-	"net/smtp"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/TooLazyToCreate/auth-service/config"
+	"github.com/TooLazyToCreate/auth-service/internal/federation"
+	"github.com/TooLazyToCreate/auth-service/internal/ippolicy"
+	"github.com/TooLazyToCreate/auth-service/internal/mailer"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/ratelimit"
 	"github.com/TooLazyToCreate/auth-service/internal/repository"
 	"github.com/TooLazyToCreate/auth-service/internal/service"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 	"go.uber.org/zap"
 )
 
@@ -32,36 +37,237 @@ func Run(logger *zap.Logger, cfg *config.Config) error {
 
 	userRepo := repository.NewUserRepository(logger, db)
 	tokenRepo := repository.NewTokenRepository(logger, db)
+	credentialRepo := repository.NewCredentialRepository(logger, db)
+	linkTokenRepo := repository.NewLinkTokenRepository(logger, db)
+	totpRepo := repository.NewTOTPRepository(logger, db)
+	webauthnRepo := repository.NewWebAuthnRepository(logger, db)
+	lockoutRepo := repository.NewLockoutRepository(logger, db)
+	authCodeRepo := repository.NewAuthorizationCodeRepository(logger, db)
+	deviceRepo := repository.NewDeviceAuthorizationRepository(logger, db)
+	roleRepo := repository.NewRoleRepository(logger, db)
+	impersonationRepo := repository.NewImpersonationRepository(logger, db)
+	apiKeyRepo := repository.NewAPIKeyRepository(logger, db)
+	federationRepo := repository.NewFederationRepository(logger, db)
+	replayRepo := repository.NewReplayRepository(logger, db)
+
+	/* Для нескольких реплик корзины лимитов должны быть общими, поэтому храним их в базе */
+	var rateLimitRepo repository.RateLimitRepository
+	var rateLimitStore ratelimit.Store
+	switch cfg.RateLimit.Store {
+	case "postgres":
+		rateLimitRepo = repository.NewRateLimitRepository(logger, db)
+		rateLimitStore = rateLimitRepo
+	case "", "memory":
+		rateLimitStore = ratelimit.NewMemoryStore()
+	default:
+		logger.Fatal("Unknown rate limit store", zap.String("store", cfg.RateLimit.Store))
+	}
+	limiter := ratelimit.NewLimiter(logger, rateLimitStore, rateLimitRule(cfg.RateLimit.IP),
+		rateLimitRule(cfg.RateLimit.User), rateLimitRule(cfg.RateLimit.Global))
+
+	tenants, err := tenancy.NewRegistry(cfg)
+	if err != nil {
+		logger.Fatal("Invalid tenancy settings", zap.Error(err))
+	}
 
 	/* Запускаем на фоне горутину с очисткой базы токенов раз в 5 секунд*/
 	tokenClearTicker := time.NewTicker(time.Duration(cfg.Lifetime.ExpiredToken * int64(time.Second)))
 	go func() {
 		for {
 			<-tokenClearTicker.C
-			err := tokenRepo.DeleteExpired(time.Unix(time.Now().Unix()-cfg.Lifetime.RefreshToken, 0))
-			if err == nil {
-				logger.Debug("Expired tokens have been deleted")
-			} else {
-				logger.Error("Failed to delete expired tokens", zap.Error(err))
+			for _, tenant := range tenants.All() {
+				err := tokenRepo.DeleteExpired(tenant.ID, time.Unix(time.Now().Unix()-tenant.RefreshTokenLifetime, 0))
+				if err == nil {
+					logger.Debug("Expired tokens have been deleted", zap.String("tenant", tenant.ID))
+				} else {
+					logger.Error("Failed to delete expired tokens", zap.Error(err), zap.String("tenant", tenant.ID))
+				}
+			}
+			/* Ссылки храним, пока они нужны для подсчёта лимита писем */
+			linkTokenAge := max(cfg.MagicLink.Lifetime, cfg.MagicLink.RateWindow,
+				cfg.EmailVerification.Lifetime, cfg.EmailVerification.RateWindow,
+				cfg.PasswordReset.Lifetime, cfg.PasswordReset.RateWindow)
+			err := linkTokenRepo.DeleteCreatedBefore(time.Unix(time.Now().Unix()-linkTokenAge, 0))
+			if err != nil {
+				logger.Error("Failed to delete expired link tokens", zap.Error(err))
+			}
+			if err = authCodeRepo.DeleteExpired(time.Now()); err != nil {
+				logger.Error("Failed to delete expired authorization codes", zap.Error(err))
+			}
+			if err = deviceRepo.DeleteExpired(time.Now()); err != nil {
+				logger.Error("Failed to delete expired device authorizations", zap.Error(err))
+			}
+			if err = webauthnRepo.DeleteExpiredSessions(time.Now()); err != nil {
+				logger.Error("Failed to delete expired WebAuthn sessions", zap.Error(err))
+			}
+			if err = federationRepo.DeleteExpiredStates(time.Now()); err != nil {
+				logger.Error("Failed to delete expired federation states", zap.Error(err))
+			}
+			if err = replayRepo.DeleteExpired(time.Now()); err != nil {
+				logger.Error("Failed to delete expired used token ids", zap.Error(err))
+			}
+			if cfg.Lockout.Threshold > 0 {
+				err = lockoutRepo.DeleteStale(time.Unix(time.Now().Unix()-cfg.Lockout.ResetAfter, 0))
+				if err != nil {
+					logger.Error("Failed to delete stale lockouts", zap.Error(err))
+				}
+			}
+			/* Корзина, которая успела наполниться, ничем не отличается от отсутствующей */
+			if rateLimitRepo != nil {
+				err = rateLimitRepo.DeleteUpdatedBefore(time.Now().Add(-rateLimitRefillTime(cfg)))
+				if err != nil {
+					logger.Error("Failed to delete idle rate limit buckets", zap.Error(err))
+				}
 			}
 		}
 	}()
 
-	smtpAuth := smtp.PlainAuth("", cfg.Smtp.Login, cfg.Smtp.Password, cfg.Smtp.Host)
-	authService := service.NewAuthService(logger, cfg, &smtpAuth, userRepo, tokenRepo)
+	/* База GeoIP открывается один раз и читается из памяти */
+	var geoDB *ippolicy.GeoDB
+	if cfg.IPPolicy.GeoDatabase != "" {
+		geoDB, err = ippolicy.OpenGeoDB(cfg.IPPolicy.GeoDatabase)
+		if err != nil {
+			logger.Fatal("Failed to open GeoIP database", zap.Error(err), zap.String("path", cfg.IPPolicy.GeoDatabase))
+		}
+		defer geoDB.Close()
+	}
+	trustedProxies, err := ippolicy.ParseProxies(cfg.TrustedProxies)
+	if err != nil {
+		logger.Fatal("Invalid trusted proxies", zap.Error(err))
+	}
+	ipPolicy, err := ippolicy.New(cfg.IPPolicy.Mode, cfg.IPPolicy.IPv4Prefix, cfg.IPPolicy.IPv6Prefix, geoDB)
+	if err != nil {
+		logger.Fatal("Invalid IP policy", zap.Error(err))
+	}
 
-	router := chi.NewRouter()
+	/* Уведомления уходят через outbox: обработчики только ставят их в очередь, отправляет воркер */
+	outboxRepo := repository.NewOutboxRepository(logger, db)
+	outbox := notify.NewOutbox(outboxRepo, cfg.Notify.Channels)
+	notifiers := make(map[string]notify.Notifier)
+	for _, channel := range cfg.Notify.Channels {
+		switch channel {
+		case "smtp":
+			transport, err := mailer.NewTransport(mailer.SMTPConfig{
+				Host:        cfg.Smtp.Host,
+				Port:        cfg.Smtp.Port,
+				Security:    cfg.Smtp.Security,
+				Auth:        cfg.Smtp.Auth,
+				Username:    cfg.Smtp.Login,
+				Password:    cfg.Smtp.Password,
+				HelloName:   cfg.Smtp.HelloName,
+				PoolSize:    cfg.Smtp.PoolSize,
+				IdleTimeout: time.Duration(cfg.Smtp.IdleTimeout) * time.Second,
+				DialTimeout: time.Duration(cfg.Smtp.DialTimeout) * time.Second,
+				Timeout:     time.Duration(cfg.Smtp.Timeout) * time.Second,
+			})
+			if err != nil {
+				logger.Fatal("Invalid SMTP settings", zap.Error(err))
+			}
+			defer transport.Close()
+			var dkim *mailer.DKIMSigner
+			if cfg.Mail.DKIM.KeyFile != "" {
+				dkim, err = mailer.LoadDKIMSigner(cfg.Mail.DKIM.Domain, cfg.Mail.DKIM.Selector, cfg.Mail.DKIM.KeyFile)
+				if err != nil {
+					logger.Fatal("Failed to load DKIM key", zap.Error(err))
+				}
+				/* Ключ один на все тенанты, так что и отправители у всех должны быть из домена подписи */
+				senders := []string{cfg.Smtp.Email}
+				for _, tenant := range tenants.All() {
+					senders = append(senders, tenant.MailFrom)
+				}
+				for _, sender := range senders {
+					if !dkim.Aligned(sender) {
+						logger.Fatal("Sender is outside of the DKIM domain",
+							zap.String("from", sender),
+							zap.String("dkim_domain", cfg.Mail.DKIM.Domain))
+					}
+				}
+			}
+			notifiers[channel] = notify.NewSMTPNotifier(transport, cfg.Smtp.Email, dkim)
+		case "log":
+			notifiers[channel] = notify.NewLogNotifier(logger)
+		case "file":
+			notifiers[channel] = notify.NewFileNotifier(cfg.Notify.File)
+		case "webhook":
+			notifiers[channel] = notify.NewWebhookNotifier(cfg.Notify.Webhook.URL,
+				time.Duration(cfg.Notify.Webhook.Timeout)*time.Second)
+		default:
+			logger.Fatal("Unknown notification channel", zap.String("channel", channel))
+		}
+	}
+	/* События безопасности идут через тот же outbox, но отдельными каналами event:<имя вебхука> */
+	webhooks := make(map[string]*notify.EventWebhook)
+	subscriptions := make([]notify.Subscription, 0, len(cfg.Events.Webhooks))
+	for _, webhook := range cfg.Events.Webhooks {
+		if webhook.Name == "" || webhook.URL == "" || webhook.Secret == "" {
+			logger.Fatal("Event webhook must have name, url and secret", zap.String("name", webhook.Name))
+		}
+		channel := notify.EventChannelPrefix + webhook.Name
+		if _, ok := webhooks[channel]; ok {
+			logger.Fatal("Duplicate event webhook name", zap.String("name", webhook.Name))
+		}
+		webhooks[channel] = notify.NewEventWebhook(webhook.URL, []byte(webhook.Secret),
+			time.Duration(webhook.Timeout)*time.Second)
+		subscriptions = append(subscriptions, notify.Subscription{Name: webhook.Name, Events: webhook.Events})
+	}
+	events := notify.NewEventPublisher(outboxRepo, subscriptions)
+
+	worker := notify.NewWorker(logger, outboxRepo, notifiers, webhooks, notify.WorkerConfig{
+		BatchSize:   max(cfg.Notify.BatchSize, 1),
+		MaxAttempts: max(cfg.Notify.MaxAttempts, 1),
+		Backoff:     time.Duration(cfg.Notify.Backoff) * time.Second,
+		MaxBackoff:  time.Duration(cfg.Notify.MaxBackoff) * time.Second,
+	})
+	go worker.Run(time.Duration(max(cfg.Notify.Interval, 1)) * time.Second)
 
-	// Это нагромождение выдаёт в RemoteAddr ip-адрес до переадресаций без порта
-	router.Use(middleware.RealIP)
-	router.Use(func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			port := strings.Index(r.RemoteAddr, ":")
-			if port != -1 {
-				r.RemoteAddr = r.RemoteAddr[:port]
+	templates, err := mailer.Load(cfg.Mail.TemplateDir, cfg.Mail.FallbackLocale)
+	if err != nil {
+		logger.Fatal("Failed to load email templates", zap.Error(err))
+	}
+
+	/* id_token выдаются, только если задан ключ подписи. iss в них обязателен, поэтому и у тенантов должен быть issuer */
+	var idTokens *token.IDTokenSigner
+	if cfg.OIDC.KeyFile != "" {
+		idTokens, err = token.LoadIDTokenSigner(cfg.OIDC.KeyFile)
+		if err != nil {
+			logger.Fatal("Failed to load ID token key", zap.Error(err))
+		}
+		for _, tenant := range tenants.All() {
+			if tenant.Issuer == "" {
+				logger.Fatal("Tenant must have an issuer to issue ID tokens", zap.String("tenant", tenant.ID))
 			}
-			next.ServeHTTP(w, r)
-		})
+		}
+	}
+
+	/* Провайдеры проверяются при запуске, а discovery и JWKS запрашиваются при первом входе */
+	federationTimeout := cfg.Federation.Timeout
+	if federationTimeout <= 0 {
+		federationTimeout = 10
+	}
+	providers, err := federation.Load(cfg.Federation.Providers, time.Duration(federationTimeout)*time.Second)
+	if err != nil {
+		logger.Fatal("Invalid federation settings", zap.Error(err))
+	}
+
+	clientRepo := repository.NewOAuthClientRepository(logger, db)
+	authService := service.NewAuthService(logger, cfg, outbox, events, templates, userRepo, tokenRepo, credentialRepo, linkTokenRepo, totpRepo,
+		webauthnRepo, lockoutRepo, authCodeRepo, clientRepo, deviceRepo, roleRepo, apiKeyRepo, federationRepo, replayRepo, limiter, ipPolicy, idTokens, providers)
+	adminService := service.NewAdminService(logger, cfg, outbox, events, templates, userRepo, tokenRepo, credentialRepo, totpRepo,
+		lockoutRepo, clientRepo, roleRepo, impersonationRepo)
+
+	router := chi.NewRouter()
+
+	/* В RemoteAddr оказывается IP клиента без порта; заголовкам прокси верим только от trusted_proxies */
+	router.Use(ippolicy.RemoteIP(trustedProxies))
+	/* Correlation ID связывает ответ с ошибкой и строки лога с подробностями */
+	router.Use(problem.Correlate)
+	/* Тенант определяется до маршрутизации: в режиме path из пути убирается его сегмент */
+	router.Use(tenants.Middleware)
+	router.NotFound(func(w http.ResponseWriter, req *http.Request) {
+		problem.Write(w, req, problem.NotFound)
+	})
+	router.MethodNotAllowed(func(w http.ResponseWriter, req *http.Request) {
+		problem.Write(w, req, problem.MethodNotAllowed)
 	})
 
 	/* Устанавливаем свой логгер запросов в дебаг режиме */
@@ -74,11 +280,143 @@ func Run(logger *zap.Logger, cfg *config.Config) error {
 		})
 	}
 
-	router.Post("/user/tokens/create", authService.HandleCreate)
-	router.Post("/user/tokens/refresh", authService.HandleRefresh)
+	/* Эндпоинты без аутентификации, через которые можно получить токены - под общим лимитом и лимитом по IP */
+	router.Group(func(r chi.Router) {
+		r.Use(limiter.Middleware)
+		if cfg.AllowGuidGrant {
+			r.Post("/user/tokens/create", authService.HandleCreate)
+		}
+		r.Post("/user/tokens/refresh", authService.HandleRefresh)
+		r.Post("/user/login", authService.HandleLogin)
+		r.Post("/user/login/mfa", authService.HandleMFA)
+		r.Post("/user/login/magic", authService.HandleMagicLinkRequest)
+		r.Get("/user/email/verify/confirm", authService.HandleEmailVerificationConfirm)
+		r.Post("/user/email/verify/confirm", authService.HandleEmailVerificationConfirm)
+		r.Post("/user/password/forgot", authService.HandlePasswordForgot)
+		r.Post("/user/password/reset", authService.HandlePasswordReset)
+		r.Post("/user/login/webauthn/begin", authService.HandleWebAuthnLoginBegin)
+		r.Post("/user/login/webauthn/finish", authService.HandleWebAuthnLoginFinish)
+		r.Get("/user/login/magic/verify", authService.HandleMagicLinkLogin)
+		r.Post("/user/login/magic/verify", authService.HandleMagicLinkLogin)
+		if len(providers) > 0 {
+			r.Get("/user/login/federated/{provider}", authService.HandleFederatedLoginBegin)
+			r.Post("/user/login/federated/{provider}", authService.HandleFederatedLoginBegin)
+			r.Get("/user/login/federated/{provider}/callback", authService.HandleFederatedLoginCallback)
+			r.Post("/user/login/federated/{provider}/callback", authService.HandleFederatedLoginCallback)
+		}
+		r.Post("/oauth/token", authService.HandleOAuthToken)
+		r.Post("/oauth/introspect", authService.HandleOAuthIntrospect)
+		/* Без страницы входа authorization code flow не пройти */
+		if cfg.OAuth.LoginURL != "" {
+			r.Get("/oauth/authorize", authService.HandleOAuthAuthorize)
+		}
+		if len(cfg.RegistrationToken) > 0 {
+			r.Post("/oauth/register", authService.HandleOAuthRegister)
+		}
+		/* Без страницы ввода user_code устройству некуда отправить пользователя */
+		if cfg.OAuth.DeviceVerificationURL != "" {
+			r.Post("/oauth/device_authorization", authService.HandleDeviceAuthorization)
+		}
+	})
+
+	/* Эндпоинты для пользователя с действующим access токеном */
+	router.Group(func(r chi.Router) {
+		r.Use(authService.Authenticate)
+		r.Post("/user/email/verify", authService.HandleEmailVerificationRequest)
+		r.Get("/user/webauthn/credentials", authService.HandleWebAuthnCredentialList)
+		r.Get("/userinfo", authService.HandleUserInfo)
+		r.Post("/userinfo", authService.HandleUserInfo)
+		if cfg.OAuth.DeviceVerificationURL != "" {
+			r.Get("/oauth/device", authService.HandleDeviceGet)
+		}
+
+		/* Приложению с токеном, выданным через OAuth, эти эндпоинты недоступны */
+		r.Group(func(r chi.Router) {
+			r.Use(authService.RejectDelegated)
+			r.Get("/user/api-keys", authService.HandleAPIKeyList)
+
+			/* Администратору под пользователем тоже */
+			r.Group(func(r chi.Router) {
+				r.Use(authService.RejectImpersonation)
+				r.Post("/user/2fa/totp/enroll", authService.HandleTOTPEnroll)
+				r.Post("/user/2fa/totp/confirm", authService.HandleTOTPConfirm)
+				r.Post("/user/2fa/totp/disable", authService.HandleTOTPDisable)
+				r.Post("/user/webauthn/register/begin", authService.HandleWebAuthnRegisterBegin)
+				r.Post("/user/webauthn/register/finish", authService.HandleWebAuthnRegisterFinish)
+				r.Delete("/user/webauthn/credentials/{id}", authService.HandleWebAuthnCredentialDelete)
+				r.Post("/user/api-keys", authService.HandleAPIKeyCreate)
+				r.Delete("/user/api-keys/{id}", authService.HandleAPIKeyDelete)
+				if cfg.OAuth.LoginURL != "" {
+					r.Post("/oauth/authorize", authService.HandleOAuthAuthorizeConsent)
+				}
+				if cfg.OAuth.DeviceVerificationURL != "" {
+					r.Post("/oauth/device", authService.HandleDeviceDecision)
+				}
+			})
+		})
+	})
+
+	/* Ключ для проверки id_token приложения запрашивают редко и кэшируют, лимит ему не нужен */
+	if idTokens != nil {
+		router.Get("/.well-known/jwks.json", authService.HandleJWKS)
+	}
+
+	/* Админское API поднимается, только если задан ADMIN_TOKEN */
+	if len(cfg.AdminToken) > 0 {
+		router.Route("/admin", func(r chi.Router) {
+			r.Use(adminService.Authenticate)
+			r.Get("/users", adminService.HandleUserList)
+			r.Post("/users", adminService.HandleUserCreate)
+			r.Get("/users/{guid}", adminService.HandleUserGet)
+			r.Patch("/users/{guid}", adminService.HandleUserUpdate)
+			r.Delete("/users/{guid}", adminService.HandleUserDelete)
+			r.Put("/users/{guid}/password", adminService.HandleUserPassword)
+			r.Delete("/users/{guid}/2fa", adminService.HandleUserTOTPReset)
+			r.Post("/users/{guid}/disable", adminService.HandleUserDisable)
+			r.Post("/users/{guid}/enable", adminService.HandleUserEnable)
+			r.Get("/users/{guid}/lockout", adminService.HandleUserLockoutGet)
+			r.Delete("/users/{guid}/lockout", adminService.HandleUserLockoutClear)
+			r.Get("/lockouts", adminService.HandleLockoutList)
+			r.Get("/oauth/clients", adminService.HandleClientList)
+			r.Post("/oauth/clients", adminService.HandleClientCreate)
+			r.Get("/oauth/clients/{client_id}", adminService.HandleClientGet)
+			r.Patch("/oauth/clients/{client_id}", adminService.HandleClientUpdate)
+			r.Delete("/oauth/clients/{client_id}", adminService.HandleClientDelete)
+			r.Post("/oauth/clients/{client_id}/secret", adminService.HandleClientSecret)
+			r.Get("/permissions", adminService.HandlePermissionList)
+			r.Post("/permissions", adminService.HandlePermissionCreate)
+			r.Delete("/permissions/{name}", adminService.HandlePermissionDelete)
+			r.Get("/roles", adminService.HandleRoleList)
+			r.Post("/roles", adminService.HandleRoleCreate)
+			r.Get("/roles/{name}", adminService.HandleRoleGet)
+			r.Patch("/roles/{name}", adminService.HandleRoleUpdate)
+			r.Delete("/roles/{name}", adminService.HandleRoleDelete)
+			r.Get("/users/{guid}/roles", adminService.HandleUserRolesGet)
+			r.Put("/users/{guid}/roles", adminService.HandleUserRolesSet)
+			r.Post("/users/{guid}/impersonate", adminService.HandleUserImpersonate)
+			r.Get("/impersonations", adminService.HandleImpersonationList)
+		})
+	} else {
+		logger.Warn("ADMIN_TOKEN is not set, admin API is disabled")
+	}
 
 	serverAddress := cfg.Host + ":" + strconv.Itoa(cfg.Port)
 
 	logger.Info("Will serve on " + serverAddress)
 	return http.ListenAndServe(serverAddress, router)
 }
+
+func rateLimitRule(rule config.RateLimitRule) ratelimit.Rule {
+	return ratelimit.Rule{Rate: rule.Rate, Burst: rule.Burst}
+}
+
+/* Время, за которое самая медленная корзина наполняется с нуля */
+func rateLimitRefillTime(cfg *config.Config) time.Duration {
+	var seconds float64
+	for _, rule := range []config.RateLimitRule{cfg.RateLimit.IP, cfg.RateLimit.User, cfg.RateLimit.Global} {
+		if rule.Rate > 0 {
+			seconds = max(seconds, float64(rule.Burst)/rule.Rate)
+		}
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
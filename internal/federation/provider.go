@@ -0,0 +1,312 @@
+package federation
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/config"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
+)
+
+/* Провайдер отказал во входе или прислал недействительный ответ. Остальные ошибки значат, что провайдер недоступен. */
+var ErrRejected = errors.New("identity provider rejected the sign-in")
+
+/* JWKS перечитывается при незнакомом kid, но не чаще этого: иначе поддельными kid можно заставить сервис
+ * постоянно ходить к провайдеру */
+const jwksRefreshInterval = time.Minute
+
+/* Ответы провайдера больше этого не читаются */
+const maxResponseSize = 1 << 20
+
+var defaultScopes = []string{"openid", "email", "profile"}
+
+/* Пользователь по данным из проверенного id_token провайдера */
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	GivenName     string
+	FamilyName    string
+	Locale        string
+}
+
+/* Адреса эндпоинтов провайдера (OpenID Connect Discovery 1.0, 3) */
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+/* Внешний провайдер OpenID Connect, через которого пользователи входят authorization code flow с PKCE.
+ * Сервис для него - обычный OAuth клиент. Discovery запрашивается при первом входе, JWKS кэшируется. */
+type Provider struct {
+	cfg    config.FederationProvider
+	client *http.Client
+
+	metadataMu sync.Mutex
+	endpoints  *metadata
+
+	keysMu        sync.Mutex
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+}
+
+/* Проверяет настройки провайдеров и создаёт их по id */
+func Load(providers []config.FederationProvider, timeout time.Duration) (map[string]*Provider, error) {
+	result := make(map[string]*Provider, len(providers))
+	for _, cfg := range providers {
+		if _, ok := result[cfg.ID]; ok {
+			return nil, errors.New("duplicate federation provider " + cfg.ID)
+		}
+		provider, err := NewProvider(cfg, timeout)
+		if err != nil {
+			return nil, err
+		}
+		result[cfg.ID] = provider
+	}
+	return result, nil
+}
+
+func NewProvider(cfg config.FederationProvider, timeout time.Duration) (*Provider, error) {
+	switch {
+	case cfg.ID == "" || strings.Contains(cfg.ID, "/"):
+		return nil, errors.New("federation provider must have an id without slashes")
+	case cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURI == "":
+		return nil, errors.New("federation provider " + cfg.ID + " must have issuer, client_id and redirect_uri")
+	}
+	for _, endpoint := range []string{cfg.Issuer, cfg.AuthorizationEndpoint, cfg.TokenEndpoint, cfg.JWKSURI, cfg.RedirectURI} {
+		if endpoint == "" {
+			continue
+		}
+		if parsed, err := url.Parse(endpoint); err != nil || parsed.Host == "" {
+			return nil, errors.New("federation provider " + cfg.ID + " has an invalid URL " + endpoint)
+		}
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = defaultScopes
+	} else if !slices.Contains(cfg.Scopes, "openid") {
+		return nil, errors.New("federation provider " + cfg.ID + " scopes must include openid")
+	}
+	return &Provider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (provider *Provider) ID() string {
+	return provider.cfg.ID
+}
+
+func (provider *Provider) CreateUsers() bool {
+	return provider.cfg.CreateUsers
+}
+
+func (provider *Provider) LinkByEmail() bool {
+	return provider.cfg.LinkByEmail
+}
+
+/* Адрес, на который уходит браузер пользователя (RFC 6749, 4.1.1), с PKCE (RFC 7636) и nonce */
+func (provider *Provider) AuthorizationURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	endpoints, err := provider.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	location, err := url.Parse(endpoints.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	query := location.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.cfg.ClientID)
+	query.Set("redirect_uri", provider.cfg.RedirectURI)
+	query.Set("scope", strings.Join(provider.cfg.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+	location.RawQuery = query.Encode()
+	return location.String(), nil
+}
+
+/* Обменивает code на токены провайдера и проверяет id_token. nonce - тот, что ушёл провайдеру в начале входа. */
+func (provider *Provider) Exchange(ctx context.Context, code, codeVerifier, nonce string) (*Identity, error) {
+	endpoints, err := provider.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {provider.cfg.RedirectURI},
+		"code_verifier": {codeVerifier},
+	}
+	if provider.cfg.ClientSecret == "" {
+		form.Set("client_id", provider.cfg.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoints.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if provider.cfg.ClientSecret != "" {
+		/* client_secret_basic: id и секрет кодируются как в форме (RFC 6749, 2.3.1) */
+		req.SetBasicAuth(url.QueryEscape(provider.cfg.ClientID), url.QueryEscape(provider.cfg.ClientSecret))
+	}
+	resp, err := provider.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&result)
+	switch {
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized:
+		return nil, fmt.Errorf("%w: token endpoint responded with %s %s", ErrRejected, result.Error, result.ErrorDescription)
+	case resp.StatusCode != http.StatusOK:
+		return nil, errors.New("token endpoint responded with status " + strconv.Itoa(resp.StatusCode))
+	case decodeErr != nil:
+		return nil, decodeErr
+	case result.IDToken == "":
+		return nil, fmt.Errorf("%w: token response does not contain id_token", ErrRejected)
+	}
+
+	claims, err := provider.verify(ctx, []byte(result.IDToken))
+	if err != nil {
+		return nil, err
+	}
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return nil, fmt.Errorf("%w: nonce does not match", ErrRejected)
+	}
+	return identityFromClaims(claims), nil
+}
+
+/* Проверяет id_token ключами провайдера. Если ключа с таким kid нет, JWKS перечитывается один раз. */
+func (provider *Provider) verify(ctx context.Context, idToken []byte) (map[string]interface{}, error) {
+	keys, err := provider.jwks(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := token.VerifyIDToken(idToken, keys, provider.cfg.Issuer, provider.cfg.ClientID)
+	if errors.Is(err, token.ErrUnknownKeyID) {
+		if keys, err = provider.jwks(ctx, true); err != nil {
+			return nil, err
+		}
+		claims, err = token.VerifyIDToken(idToken, keys, provider.cfg.Issuer, provider.cfg.ClientID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRejected, err)
+	}
+	return claims, nil
+}
+
+/* Адреса эндпоинтов: заданные в настройках, остальные из discovery. Удачный ответ discovery запоминается. */
+func (provider *Provider) metadata(ctx context.Context) (*metadata, error) {
+	provider.metadataMu.Lock()
+	defer provider.metadataMu.Unlock()
+	if provider.endpoints != nil {
+		return provider.endpoints, nil
+	}
+	endpoints := &metadata{
+		Issuer:                provider.cfg.Issuer,
+		AuthorizationEndpoint: provider.cfg.AuthorizationEndpoint,
+		TokenEndpoint:         provider.cfg.TokenEndpoint,
+		JWKSURI:               provider.cfg.JWKSURI,
+	}
+	if endpoints.AuthorizationEndpoint == "" || endpoints.TokenEndpoint == "" || endpoints.JWKSURI == "" {
+		discovered := &metadata{}
+		err := provider.getJSON(ctx, strings.TrimSuffix(provider.cfg.Issuer, "/")+"/.well-known/openid-configuration", discovered)
+		if err != nil {
+			return nil, err
+		}
+		/* issuer из discovery должен совпадать с настроенным (OpenID Connect Discovery 1.0, 4.3) */
+		if discovered.Issuer != provider.cfg.Issuer {
+			return nil, errors.New("discovery issuer " + discovered.Issuer + " does not match " + provider.cfg.Issuer)
+		}
+		endpoints.AuthorizationEndpoint = cmp.Or(endpoints.AuthorizationEndpoint, discovered.AuthorizationEndpoint)
+		endpoints.TokenEndpoint = cmp.Or(endpoints.TokenEndpoint, discovered.TokenEndpoint)
+		endpoints.JWKSURI = cmp.Or(endpoints.JWKSURI, discovered.JWKSURI)
+		if endpoints.AuthorizationEndpoint == "" || endpoints.TokenEndpoint == "" || endpoints.JWKSURI == "" {
+			return nil, errors.New("discovery document of " + provider.cfg.Issuer + " lacks endpoints")
+		}
+	}
+	provider.endpoints = endpoints
+	return endpoints, nil
+}
+
+/* Ключи провайдера по kid. refresh - перечитать JWKS, если с прошлого чтения прошло достаточно времени. */
+func (provider *Provider) jwks(ctx context.Context, refresh bool) (map[string]interface{}, error) {
+	endpoints, err := provider.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider.keysMu.Lock()
+	defer provider.keysMu.Unlock()
+	if provider.keys != nil && (!refresh || time.Since(provider.keysFetchedAt) < jwksRefreshInterval) {
+		return provider.keys, nil
+	}
+	var raw json.RawMessage
+	if err = provider.getJSON(ctx, endpoints.JWKSURI, &raw); err != nil {
+		return nil, err
+	}
+	keys, err := token.ParseJWKS(raw)
+	if err != nil {
+		return nil, err
+	}
+	provider.keys = keys
+	provider.keysFetchedAt = time.Now()
+	return keys, nil
+}
+
+func (provider *Provider) getJSON(ctx context.Context, location string, dest interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := provider.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(location + " responded with status " + strconv.Itoa(resp.StatusCode))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(dest)
+}
+
+/* Стандартные claims (OpenID Connect Core 1.0, 5.1). Некоторые провайдеры отдают email_verified строкой. */
+func identityFromClaims(claims map[string]interface{}) *Identity {
+	identity := &Identity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.GivenName, _ = claims["given_name"].(string)
+	identity.FamilyName, _ = claims["family_name"].(string)
+	identity.Locale, _ = claims["locale"].(string)
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+	if identity.GivenName == "" && identity.FamilyName == "" {
+		identity.GivenName, _ = claims["name"].(string)
+	}
+	return identity
+}
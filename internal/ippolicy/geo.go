@@ -0,0 +1,51 @@
+package ippolicy
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+/* Локальная база GeoIP в формате MaxMind DB (GeoLite2-ASN, GeoLite2-Country, GeoLite2-City и совместимые).
+ * Из записи берутся только номер автономной системы и код страны. */
+type GeoDB struct {
+	reader *maxminddb.Reader
+}
+
+type geoRecord struct {
+	ASN     uint `maxminddb:"autonomous_system_number"`
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+func OpenGeoDB(path string) (*GeoDB, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoDB{reader}, nil
+}
+
+func (db *GeoDB) Close() error {
+	return db.reader.Close()
+}
+
+func (db *GeoDB) ASN(addr netip.Addr) (uint, bool) {
+	record, ok := db.lookup(addr)
+	return record.ASN, ok && record.ASN != 0
+}
+
+func (db *GeoDB) Country(addr netip.Addr) (string, bool) {
+	record, ok := db.lookup(addr)
+	return record.Country.ISOCode, ok && record.Country.ISOCode != ""
+}
+
+func (db *GeoDB) lookup(addr netip.Addr) (geoRecord, bool) {
+	record := geoRecord{}
+	if err := db.reader.Lookup(net.IP(addr.AsSlice()), &record); err != nil {
+		return record, false
+	}
+	return record, true
+}
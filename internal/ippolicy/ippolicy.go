@@ -0,0 +1,135 @@
+package ippolicy
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+)
+
+/* Что делать, если refresh пришёл с другого IP, чем был выдан access токен */
+const (
+	/* Любая смена IP считается компрометацией */
+	ModeStrict = "strict"
+	/* Разрешена смена IP внутри одной подсети (по умолчанию /24 для IPv4 и /64 для IPv6) */
+	ModeSubnet = "subnet"
+	/* Разрешена смена IP внутри одной автономной системы (нужна база GeoLite2-ASN) */
+	ModeASN = "asn"
+	/* Разрешена смена IP внутри одной страны (нужна база GeoLite2-Country или GeoLite2-City) */
+	ModeCountry = "country"
+	/* Смена IP разрешена всегда, пользователю только отправляется письмо */
+	ModeNotify = "notify"
+)
+
+const (
+	defaultIPv4Prefix = 24
+	defaultIPv6Prefix = 64
+)
+
+type Decision struct {
+	Changed bool
+	Allowed bool
+	/* Сообщить ли пользователю о смене IP */
+	Notify bool
+	Reason string
+}
+
+type Policy struct {
+	mode       string
+	ipv4Prefix int
+	ipv6Prefix int
+	geo        *GeoDB
+}
+
+/* Нулевые префиксы заменяются на значения по умолчанию. geo нужен только для режимов asn и country. */
+func New(mode string, ipv4Prefix int, ipv6Prefix int, geo *GeoDB) (*Policy, error) {
+	if ipv4Prefix == 0 {
+		ipv4Prefix = defaultIPv4Prefix
+	}
+	if ipv6Prefix == 0 {
+		ipv6Prefix = defaultIPv6Prefix
+	}
+	if ipv4Prefix < 0 || ipv4Prefix > 32 || ipv6Prefix < 0 || ipv6Prefix > 128 {
+		return nil, errors.New("subnet prefix is out of range")
+	}
+	switch mode {
+	case "":
+		mode = ModeStrict
+	case ModeStrict, ModeSubnet, ModeNotify:
+	case ModeASN, ModeCountry:
+		if geo == nil {
+			return nil, errors.New("mode " + mode + " requires a GeoIP database")
+		}
+	default:
+		return nil, errors.New("unknown IP policy mode: " + mode)
+	}
+	return &Policy{mode, ipv4Prefix, ipv6Prefix, geo}, nil
+}
+
+func (p *Policy) Evaluate(tokenIP string, requestIP string) Decision {
+	if tokenIP == requestIP {
+		return Decision{Allowed: true, Reason: "same ip"}
+	}
+
+	switch p.mode {
+	case ModeNotify:
+		return Decision{Changed: true, Allowed: true, Notify: true, Reason: "notify-only policy"}
+	case ModeStrict:
+		return denied("strict policy")
+	}
+
+	from, err := netip.ParseAddr(tokenIP)
+	if err != nil {
+		return denied("token ip is invalid")
+	}
+	to, err := netip.ParseAddr(requestIP)
+	if err != nil {
+		return denied("request ip is invalid")
+	}
+	from, to = from.Unmap(), to.Unmap()
+	if from.Is4() != to.Is4() {
+		return denied("address family changed")
+	}
+
+	switch p.mode {
+	case ModeSubnet:
+		bits := p.ipv6Prefix
+		if from.Is4() {
+			bits = p.ipv4Prefix
+		}
+		subnet := "/" + strconv.Itoa(bits) + " subnet"
+		prefix, _ := from.Prefix(bits)
+		if prefix.Contains(to) {
+			return allowed("same " + subnet)
+		}
+		return denied("different " + subnet)
+	case ModeASN:
+		fromASN, fromOk := p.geo.ASN(from)
+		toASN, toOk := p.geo.ASN(to)
+		if !fromOk || !toOk {
+			return denied("ASN is unknown")
+		}
+		if fromASN == toASN {
+			return allowed(fmt.Sprintf("same ASN %d", fromASN))
+		}
+		return denied(fmt.Sprintf("ASN changed from %d to %d", fromASN, toASN))
+	default:
+		fromCountry, fromOk := p.geo.Country(from)
+		toCountry, toOk := p.geo.Country(to)
+		if !fromOk || !toOk {
+			return denied("country is unknown")
+		}
+		if fromCountry == toCountry {
+			return allowed("same country " + fromCountry)
+		}
+		return denied("country changed from " + fromCountry + " to " + toCountry)
+	}
+}
+
+func allowed(reason string) Decision {
+	return Decision{Changed: true, Allowed: true, Reason: reason}
+}
+
+func denied(reason string) Decision {
+	return Decision{Changed: true, Notify: true, Reason: reason}
+}
@@ -0,0 +1,101 @@
+package ippolicy
+
+import "testing"
+
+func TestSubnetDefaultPrefixes(t *testing.T) {
+	policy, err := New(ModeSubnet, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		tokenIP string
+		ip      string
+		changed bool
+		allowed bool
+		notify  bool
+		reason  string
+	}{
+		{"same ip", "192.0.2.10", "192.0.2.10", false, true, false, "same ip"},
+		{"same /24", "192.0.2.10", "192.0.2.250", true, true, false, "same /24 subnet"},
+		{"/24 lower edge", "192.0.2.10", "192.0.2.0", true, true, false, "same /24 subnet"},
+		{"neighbour /24", "192.0.2.10", "192.0.3.10", true, false, true, "different /24 subnet"},
+		{"/24 upper edge", "192.0.2.255", "192.0.3.0", true, false, true, "different /24 subnet"},
+		{"same /64", "2001:db8:1:2::1", "2001:db8:1:2:ffff:ffff:ffff:ffff", true, true, false, "same /64 subnet"},
+		{"neighbour /64", "2001:db8:1:2::1", "2001:db8:1:3::1", true, false, true, "different /64 subnet"},
+		/* IPv4-mapped адрес сравнивается как обычный IPv4 */
+		{"mapped ipv4", "::ffff:192.0.2.10", "192.0.2.20", true, true, false, "same /24 subnet"},
+		{"family changed", "192.0.2.10", "2001:db8::1", true, false, true, "address family changed"},
+		{"invalid token ip", "not-an-ip", "192.0.2.10", true, false, true, "token ip is invalid"},
+		{"invalid request ip", "192.0.2.10", "192.0.2.300", true, false, true, "request ip is invalid"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision := policy.Evaluate(test.tokenIP, test.ip)
+			expected := Decision{test.changed, test.allowed, test.notify, test.reason}
+			if decision != expected {
+				t.Fatalf("Evaluate(%s, %s) = %+v, want %+v", test.tokenIP, test.ip, decision, expected)
+			}
+		})
+	}
+}
+
+func TestSubnetCustomPrefixes(t *testing.T) {
+	policy, err := New(ModeSubnet, 16, 48, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		tokenIP string
+		ip      string
+		allowed bool
+	}{
+		{"192.0.2.10", "192.0.200.1", true},
+		{"192.0.2.10", "192.1.2.10", false},
+		{"2001:db8:1:2::1", "2001:db8:1:ffff::1", true},
+		{"2001:db8:1:2::1", "2001:db8:2:2::1", false},
+	}
+	for _, test := range tests {
+		if decision := policy.Evaluate(test.tokenIP, test.ip); decision.Allowed != test.allowed {
+			t.Errorf("Evaluate(%s, %s) = %+v, want allowed %v", test.tokenIP, test.ip, decision, test.allowed)
+		}
+	}
+}
+
+func TestStrictAndNotify(t *testing.T) {
+	strict, err := New("", 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision := strict.Evaluate("192.0.2.10", "192.0.2.11"); decision.Allowed || !decision.Notify {
+		t.Fatalf("strict policy allowed a neighbour ip: %+v", decision)
+	}
+	notify, err := New(ModeNotify, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision := notify.Evaluate("192.0.2.10", "2001:db8::1"); !decision.Allowed || !decision.Notify {
+		t.Fatalf("notify policy = %+v", decision)
+	}
+}
+
+func TestNewRejected(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		ipv4Prefix int
+		ipv6Prefix int
+	}{
+		{"unknown mode", "city", 0, 0},
+		{"asn without database", ModeASN, 0, 0},
+		{"country without database", ModeCountry, 0, 0},
+		{"ipv4 prefix too long", ModeSubnet, 33, 0},
+		{"ipv6 prefix too long", ModeSubnet, 0, 129},
+		{"negative prefix", ModeSubnet, -1, 0},
+	}
+	for _, test := range tests {
+		if _, err := New(test.mode, test.ipv4Prefix, test.ipv6Prefix, nil); err == nil {
+			t.Errorf("%s: New must fail", test.name)
+		}
+	}
+}
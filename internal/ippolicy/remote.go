@@ -0,0 +1,102 @@
+package ippolicy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+/* Разбирает адреса и подсети обратных прокси в записи CIDR. Одиночный адрес - подсеть из одного адреса. */
+func ParseProxies(list []string) ([]netip.Prefix, error) {
+	proxies := make([]netip.Prefix, 0, len(list))
+	for _, item := range list {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, errors.New("invalid trusted proxy address: " + item)
+			}
+			addr = addr.Unmap()
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, errors.New("invalid trusted proxy network: " + item)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+/* Оставляет в RemoteAddr только IP клиента без порта: с ним сравниваются IP из токенов, по нему же
+ * считает лимиты ratelimit. У IPv6 адреса вид [2001:db8::1]:443, поэтому порт отрезается через net.SplitHostPort,
+ * а не по первому двоеточию - иначе от адреса осталась бы первая группа, общая для целых сетей.
+ * X-Forwarded-For и X-Real-IP учитываются, только если соединение пришло от одного из proxies: иначе любой клиент
+ * подставил бы в заголовок чужой адрес и обошёл лимиты и политику IP. */
+func RemoteIP(proxies []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			req.RemoteAddr = clientIP(req, proxies)
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+/* Каждый прокси дописывает в X-Forwarded-For адрес, от которого получил запрос, поэтому цепочка разбирается справа
+ * налево: клиент - первый адрес, не принадлежащий доверенным прокси. Левее него адреса мог написать кто угодно. */
+func clientIP(req *http.Request, proxies []netip.Prefix) string {
+	peer, ok := parseIP(req.RemoteAddr)
+	if !ok {
+		return hostOf(req.RemoteAddr)
+	}
+	if !trusted(peer, proxies) {
+		return peer.String()
+	}
+	if forwarded := req.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, ok := parseIP(strings.TrimSpace(hops[i]))
+			if !ok {
+				break
+			}
+			client = hop
+			if !trusted(hop, proxies) {
+				break
+			}
+		}
+		return client.String()
+	}
+	if realIP, ok := parseIP(req.Header.Get("X-Real-IP")); ok {
+		return realIP.String()
+	}
+	return peer.String()
+}
+
+func trusted(addr netip.Addr, proxies []netip.Prefix) bool {
+	for _, prefix := range proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+/* IP из адреса с портом или без. IPv4, записанный как IPv6 (::ffff:192.0.2.1), приводится к IPv4. */
+func parseIP(addr string) (netip.Addr, bool) {
+	ip, err := netip.ParseAddr(hostOf(addr))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap().WithZone(""), true
+}
+
+/* Адрес без порта. Адрес, пришедший без порта (например, из X-Forwarded-For), возвращается как есть. */
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
@@ -0,0 +1,69 @@
+package ippolicy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	proxies, err := ParseProxies([]string{"10.0.0.0/8", "2001:db8:ff::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		realIP       string
+		ip           string
+	}{
+		{"ipv4 with port", "192.0.2.1:51000", nil, "", "192.0.2.1"},
+		{"ipv6 with port", "[2001:db8:1:2::7]:443", nil, "", "2001:db8:1:2::7"},
+		{"loopback", "[::1]:8080", nil, "", "::1"},
+		{"without port", "192.0.2.1", nil, "", "192.0.2.1"},
+		{"ipv6 without port", "[2001:db8::1]", nil, "", "2001:db8::1"},
+		{"ipv4-mapped", "[::ffff:192.0.2.1]:443", nil, "", "192.0.2.1"},
+		/* Заголовки от клиента напрямую не учитываются */
+		{"untrusted forwarded for", "192.0.2.1:51000", []string{"198.51.100.7"}, "", "192.0.2.1"},
+		{"untrusted real ip", "192.0.2.1:51000", nil, "198.51.100.7", "192.0.2.1"},
+		{"trusted proxy", "10.1.2.3:51000", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"trusted ipv6 proxy", "[2001:db8:ff::1]:443", []string{"2001:db8:1:2::7"}, "", "2001:db8:1:2::7"},
+		{"trusted real ip", "10.1.2.3:51000", nil, "198.51.100.7", "198.51.100.7"},
+		/* Левее первого недоверенного адреса мог написать что угодно сам клиент */
+		{"spoofed hop", "10.1.2.3:51000", []string{"203.0.113.9, 198.51.100.7"}, "", "198.51.100.7"},
+		{"chain of proxies", "10.1.2.3:51000", []string{"198.51.100.7, 10.9.9.9"}, "", "198.51.100.7"},
+		{"several headers", "10.1.2.3:51000", []string{"203.0.113.9", "198.51.100.7"}, "", "198.51.100.7"},
+		{"only proxies", "10.1.2.3:51000", []string{"10.9.9.9"}, "", "10.9.9.9"},
+		{"garbage in chain", "10.1.2.3:51000", []string{"198.51.100.7, garbage"}, "", "10.1.2.3"},
+		{"garbage real ip", "10.1.2.3:51000", nil, "garbage", "10.1.2.3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var ip string
+			handler := RemoteIP(proxies)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				ip = req.RemoteAddr
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwardedFor {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if test.realIP != "" {
+				req.Header.Set("X-Real-IP", test.realIP)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			if ip != test.ip {
+				t.Errorf("RemoteIP(%s) = %s, want %s", test.remoteAddr, ip, test.ip)
+			}
+		})
+	}
+}
+
+func TestParseProxiesInvalid(t *testing.T) {
+	for _, item := range []string{"proxy.example", "10.0.0.0/33", "10.0.0.1:80"} {
+		if _, err := ParseProxies([]string{item}); err == nil {
+			t.Errorf("%s: want error", item)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Заголовки, которые попадают под подпись, если они есть в письме */
+var dkimSignedHeaders = []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding"}
+
+/* Подпись писем DKIM (RFC 6376) с канонизацией relaxed/relaxed. Поддерживаются ключи RSA (rsa-sha256)
+ * и Ed25519 (ed25519-sha256, RFC 8463). Открытый ключ публикуется в DNS записи <selector>._domainkey.<domain>. */
+type DKIMSigner struct {
+	domain    string
+	selector  string
+	key       crypto.Signer
+	algorithm string
+}
+
+/* Читает закрытый ключ из PEM файла в формате PKCS#8 или PKCS#1 (только RSA) */
+func LoadDKIMSigner(domain string, selector string, keyFile string) (*DKIMSigner, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("DKIM key file does not contain a PEM block")
+	}
+	var key interface{}
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("DKIM key is not a signing key")
+	}
+	return NewDKIMSigner(domain, selector, signer)
+}
+
+func NewDKIMSigner(domain string, selector string, key crypto.Signer) (*DKIMSigner, error) {
+	if domain == "" || selector == "" {
+		return nil, errors.New("DKIM domain and selector are required")
+	}
+	signer := &DKIMSigner{domain: domain, selector: selector, key: key}
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		signer.algorithm = "rsa-sha256"
+	case ed25519.PrivateKey:
+		signer.algorithm = "ed25519-sha256"
+	default:
+		return nil, errors.New("DKIM key must be RSA or Ed25519")
+	}
+	return signer, nil
+}
+
+/* Проверяет, что подпись подходит отправителю from. Получатели с DMARC засчитывают подпись, только если домен
+ * отправителя совпадает с d= подписи или является его поддоменом (relaxed alignment, RFC 7489, 3.1.1),
+ * иначе письмо с подписью чужого домена выглядит так же, как неподписанное. */
+func (signer *DKIMSigner) Aligned(from string) bool {
+	address, err := mail.ParseAddress(from)
+	if err != nil {
+		return false
+	}
+	at := strings.LastIndexByte(address.Address, '@')
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(address.Address[at+1:])
+	signed := strings.ToLower(signer.domain)
+	return domain == signed || strings.HasSuffix(domain, "."+signed)
+}
+
+/* Возвращает письмо с добавленным в начало заголовком DKIM-Signature */
+func (signer *DKIMSigner) Sign(message []byte, now time.Time) ([]byte, error) {
+	header, body, ok := bytes.Cut(message, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, errors.New("message has no body separator")
+	}
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	fields := parseHeader(header)
+
+	/* Если заголовок встречается несколько раз, подписывается последний (RFC 6376, 5.4.2) */
+	signed := make([]string, 0, len(dkimSignedHeaders))
+	hashed := &bytes.Buffer{}
+	for _, name := range dkimSignedHeaders {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fields[i].name, name) {
+				hashed.WriteString(relaxedHeader(fields[i].name, fields[i].value) + "\r\n")
+				signed = append(signed, strings.ToLower(name))
+				break
+			}
+		}
+	}
+
+	value := "v=1; a=" + signer.algorithm + "; c=relaxed/relaxed; d=" + signer.domain + "; s=" + signer.selector +
+		"; t=" + strconv.FormatInt(now.Unix(), 10) + "; h=" + strings.Join(signed, ":") +
+		"; bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+	/* Сам заголовок подписи хэшируется с пустым b= и без завершающего CRLF */
+	hashed.WriteString(relaxedHeader("DKIM-Signature", value))
+	digest := sha256.Sum256(hashed.Bytes())
+
+	var signature []byte
+	var err error
+	if signer.algorithm == "ed25519-sha256" {
+		/* RFC 8463: Ed25519 подписывает SHA-256 от данных, а не сами данные */
+		signature, err = signer.key.Sign(rand.Reader, digest[:], crypto.Hash(0))
+	} else {
+		signature, err = signer.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &bytes.Buffer{}
+	result.WriteString("DKIM-Signature: " + value + base64.StdEncoding.EncodeToString(signature) + "\r\n")
+	result.Write(message)
+	return result.Bytes(), nil
+}
+
+type headerField struct {
+	name  string
+	value string
+}
+
+/* Разбирает заголовки письма, склеивая перенесённые строки */
+func parseHeader(header []byte) []headerField {
+	fields := make([]headerField, 0, 10)
+	for _, line := range strings.Split(string(header), "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1].value += "\r\n" + line
+			continue
+		}
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			fields = append(fields, headerField{name, value})
+		}
+	}
+	return fields
+}
+
+/* Канонизация relaxed для заголовка: имя в нижнем регистре, переносы убраны,
+ * пробелы схлопнуты, по краям значения пробелов нет */
+func relaxedHeader(name string, value string) string {
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.Join(strings.Fields(value), " ")
+}
+
+/* Канонизация relaxed для тела: пробелы внутри строк схлопнуты, в конце строк убраны,
+ * пустые строки в конце тела отброшены */
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		lines[i] = strings.Join(strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' }), " ")
+		/* Пробелы в начале строки схлопываются до одного, а не убираются */
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			lines[i] = " " + lines[i]
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
@@ -0,0 +1,304 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* Проверка подписи написана отдельно от Sign, по RFC 6376 (раздел 3.4.2 и 6.1.3):
+ * заголовки и тело канонизируются заново по тегам из DKIM-Signature */
+
+var (
+	whitespace     = regexp.MustCompile(`[ \t]+`)
+	emptySignature = regexp.MustCompile(`(^|;)(\s*b=)[^;]*`)
+)
+
+func canonicalHeader(name string, value string) string {
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(whitespace.ReplaceAllString(value, " "))
+}
+
+func canonicalBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(whitespace.ReplaceAllString(lines[i], " "), " ")
+	}
+	canonical := strings.TrimRight(strings.Join(lines, "\r\n"), "\r\n")
+	if canonical == "" {
+		return ""
+	}
+	return canonical + "\r\n"
+}
+
+func dkimTags(value string) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(value, ";") {
+		name, content, _ := strings.Cut(tag, "=")
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(content), "")
+	}
+	return tags
+}
+
+func verifyDKIM(message []byte, public crypto.PublicKey) (map[string]string, error) {
+	header, body, ok := strings.Cut(string(message), "\r\n\r\n")
+	if !ok {
+		return nil, errors.New("no body")
+	}
+	var fields [][2]string
+	for _, line := range strings.Split(header, "\r\n") {
+		if line[0] == ' ' || line[0] == '\t' {
+			fields[len(fields)-1][1] += "\r\n" + line
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		fields = append(fields, [2]string{name, value})
+	}
+	if !strings.EqualFold(fields[0][0], "DKIM-Signature") {
+		return nil, errors.New("first header is not DKIM-Signature")
+	}
+	signature := fields[0][1]
+	tags := dkimTags(signature)
+	if tags["v"] != "1" || tags["c"] != "relaxed/relaxed" {
+		return tags, errors.New("unexpected v= or c=")
+	}
+
+	bodyHash := sha256.Sum256([]byte(canonicalBody(body)))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return tags, errors.New("body hash mismatch")
+	}
+
+	/* Каждое имя из h= берёт следующий снизу ещё не использованный экземпляр заголовка */
+	hashed := &bytes.Buffer{}
+	used := map[int]bool{}
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i > 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i][0], name) {
+				used[i] = true
+				hashed.WriteString(canonicalHeader(fields[i][0], fields[i][1]) + "\r\n")
+				break
+			}
+		}
+	}
+	hashed.WriteString(canonicalHeader(fields[0][0], emptySignature.ReplaceAllString(signature, "$1$2")))
+	digest := sha256.Sum256(hashed.Bytes())
+
+	b, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return tags, err
+	}
+	switch tags["a"] {
+	case "rsa-sha256":
+		err = rsa.VerifyPKCS1v15(public.(*rsa.PublicKey), crypto.SHA256, digest[:], b)
+	case "ed25519-sha256":
+		if !ed25519.Verify(public.(ed25519.PublicKey), digest[:], b) {
+			err = errors.New("ed25519 signature mismatch")
+		}
+	default:
+		err = errors.New("unexpected a=" + tags["a"])
+	}
+	return tags, err
+}
+
+func testDKIMKeys(t *testing.T) map[string]crypto.Signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"rsa-sha256": rsaKey, "ed25519-sha256": ed25519Key}
+}
+
+/* Заголовки с переносами, повтором и лишними пробелами, тело с пробелами и пустыми строками в конце */
+const awkwardMessage = "From: Auth Service <noreply@example.com>\r\n" +
+	"To:   ivan@example.com\r\n" +
+	"Subject: first\r\n" +
+	"Subject: Password\r\n\t  reset  requested\r\n" +
+	"X-Unsigned: whatever\r\n" +
+	"Date: Tue, 14 Nov 2023 22:13:20 +0000\r\n" +
+	"\r\n" +
+	"Hello,  Ivan \t\r\n" +
+	"  indented line\r\n" +
+	"\r\n" +
+	"\r\n"
+
+func TestDKIMSign(t *testing.T) {
+	built, err := Build("noreply@example.com", "ivan@example.com",
+		&Content{Subject: "Сброс пароля", Text: "Ссылка: https://example.com/reset", HTML: "<p>Ссылка</p>"},
+		time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for algorithm, key := range testDKIMKeys(t) {
+		signer, err := NewDKIMSigner("example.com", "mail", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, message := range map[string][]byte{"built": built, "awkward": []byte(awkwardMessage)} {
+			signed, err := signer.Sign(message, time.Unix(1700000000, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(signed, message) {
+				t.Fatalf("%s %s: message was changed by signing", algorithm, name)
+			}
+			tags, err := verifyDKIM(signed, key.Public())
+			if err != nil {
+				t.Fatalf("%s %s: %v", algorithm, name, err)
+			}
+			if tags["a"] != algorithm || tags["d"] != "example.com" || tags["s"] != "mail" || tags["t"] != "1700000000" {
+				t.Fatalf("%s %s: unexpected tags %v", algorithm, name, tags)
+			}
+		}
+
+		signed, _ := signer.Sign(built, time.Now())
+		if tags, _ := verifyDKIM(signed, key.Public()); tags["h"] !=
+			"from:to:subject:date:message-id:mime-version:content-type" {
+			t.Fatalf("%s: h=%s", algorithm, tags["h"])
+		}
+	}
+}
+
+func TestDKIMTampering(t *testing.T) {
+	keys := testDKIMKeys(t)
+	for algorithm, key := range keys {
+		signer, err := NewDKIMSigner("example.com", "mail", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := signer.Sign([]byte(awkwardMessage), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		text := string(signed)
+		tests := []struct {
+			name    string
+			message string
+			valid   bool
+		}{
+			/* relaxed канонизация переживает правку пробелов при пересылке */
+			{"whitespace in body", strings.Replace(text, "Hello,  Ivan", "Hello, \t Ivan", 1) + "\r\n\r\n", true},
+			{"whitespace in header", strings.Replace(text, "To:   ivan", "To: ivan", 1), true},
+			{"unsigned header", strings.Replace(text, "X-Unsigned: whatever", "X-Unsigned: changed", 1), true},
+			{"body", strings.Replace(text, "Ivan", "Petr", 1), false},
+			{"signed header", strings.Replace(text, "reset  requested", "reset cancelled", 1), false},
+			{"earlier duplicate header", strings.Replace(text, "Subject: first", "Subject: second", 1), true},
+			{"added signed header", strings.Replace(text, "X-Unsigned:", "Subject: spoofed\r\nX-Unsigned:", 1), false},
+		}
+		for _, test := range tests {
+			if _, err := verifyDKIM([]byte(test.message), key.Public()); (err == nil) != test.valid {
+				t.Errorf("%s %s: verify error %v, want valid %v", algorithm, test.name, err, test.valid)
+			}
+		}
+
+		/* Подпись не проверяется чужим ключом того же типа */
+		other := testDKIMKeys(t)[algorithm]
+		if _, err := verifyDKIM(signed, other.Public()); err == nil {
+			t.Errorf("%s: signature verified with another key", algorithm)
+		}
+	}
+}
+
+/* Тело письма из примеров RFC 8463, приложение A, и его bh= оттуда же */
+func TestRelaxedBodyVector(t *testing.T) {
+	body := "Hi.\r\n\r\nWe lost the game.  Are you hungry yet?\r\n\r\nJoe.\r\n"
+	hash := sha256.Sum256(relaxedBody([]byte(body)))
+	if encoded := base64.StdEncoding.EncodeToString(hash[:]); encoded != "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=" {
+		t.Fatalf("bh = %s", encoded)
+	}
+	if relaxedBody([]byte("\r\n\r\n")) != nil || canonicalBody("\r\n\r\n") != "" {
+		t.Fatal("empty body must canonicalize to nothing")
+	}
+}
+
+func TestLoadDKIMSigner(t *testing.T) {
+	keys := testDKIMKeys(t)
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(keys["rsa-sha256"].(*rsa.PrivateKey))})
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(keys["ed25519-sha256"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaPKCS8, err := x509.MarshalPKCS8PrivateKey(ecdsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		content   []byte
+		algorithm string
+	}{
+		{"pkcs1 rsa", pkcs1, "rsa-sha256"},
+		{"pkcs8 ed25519", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), "ed25519-sha256"},
+		{"pkcs8 ecdsa", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecdsaPKCS8}), ""},
+		{"not pem", []byte("not a key"), ""},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "dkim.pem")
+		if err := os.WriteFile(path, test.content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		signer, err := LoadDKIMSigner("example.com", "mail", path)
+		if test.algorithm == "" {
+			if err == nil {
+				t.Errorf("%s: LoadDKIMSigner must fail", test.name)
+			}
+			continue
+		}
+		if err != nil || signer.algorithm != test.algorithm {
+			t.Errorf("%s: %v, %v", test.name, signer, err)
+		}
+	}
+
+	if _, err := NewDKIMSigner("", "mail", keys["rsa-sha256"]); err == nil {
+		t.Error("empty domain must be rejected")
+	}
+}
+
+func TestDKIMAligned(t *testing.T) {
+	signer, err := NewDKIMSigner("Example.com", "mail", testDKIMKeys(t)["ed25519-sha256"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		from    string
+		aligned bool
+	}{
+		{"noreply@example.com", true},
+		{"Auth Service <noreply@EXAMPLE.COM>", true},
+		{"noreply@mail.example.com", true},
+		{"noreply@example.org", false},
+		{"noreply@notexample.com", false},
+		{"noreply@example.com.evil.test", false},
+		{"", false},
+		{"not an address", false},
+	}
+	for _, test := range tests {
+		if aligned := signer.Aligned(test.from); aligned != test.aligned {
+			t.Errorf("%q: aligned = %v", test.from, aligned)
+		}
+	}
+}
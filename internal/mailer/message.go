@@ -0,0 +1,90 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+/* Собирает письмо в формате RFC 5322: заголовки, тема в кодировке RFC 2047 и тело в quoted-printable.
+ * Если есть HTML, письмо становится multipart/alternative с текстовой и HTML частями. */
+func Build(from string, to string, content *Content, now time.Time) ([]byte, error) {
+	messageID, err := newMessageID(from)
+	if err != nil {
+		return nil, err
+	}
+	message := &bytes.Buffer{}
+	writeHeader(message, "From", (&mail.Address{Address: from}).String())
+	writeHeader(message, "To", (&mail.Address{Address: to}).String())
+	writeHeader(message, "Subject", mime.BEncoding.Encode("UTF-8", content.Subject))
+	writeHeader(message, "Date", now.Format(time.RFC1123Z))
+	writeHeader(message, "Message-ID", messageID)
+	writeHeader(message, "MIME-Version", "1.0")
+
+	if content.HTML == "" {
+		writeHeader(message, "Content-Type", "text/plain; charset=UTF-8")
+		writeHeader(message, "Content-Transfer-Encoding", "quoted-printable")
+		message.WriteString("\r\n")
+		if err = writeQuotedPrintable(message, content.Text); err != nil {
+			return nil, err
+		}
+		return message.Bytes(), nil
+	}
+
+	body := &bytes.Buffer{}
+	parts := multipart.NewWriter(body)
+	writeHeader(message, "Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	message.WriteString("\r\n")
+	for _, part := range []struct{ contentType, text string }{
+		{"text/plain; charset=UTF-8", content.Text},
+		{"text/html; charset=UTF-8", content.HTML},
+	} {
+		writer, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = writeQuotedPrintable(writer, part.text); err != nil {
+			return nil, err
+		}
+	}
+	if err = parts.Close(); err != nil {
+		return nil, err
+	}
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
+
+func writeHeader(message *bytes.Buffer, name string, value string) {
+	message.WriteString(name + ": " + value + "\r\n")
+}
+
+func writeQuotedPrintable(w interface{ Write([]byte) (int, error) }, text string) error {
+	writer := quotedprintable.NewWriter(w)
+	if _, err := writer.Write([]byte(text)); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+/* Message-ID вида <случайные байты@домен отправителя> */
+func newMessageID(from string) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at != -1 {
+		domain = from[at+1:]
+	}
+	return "<" + hex.EncodeToString(random) + "@" + domain + ">", nil
+}
@@ -0,0 +1,84 @@
+package mailer
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readMessage(t *testing.T, content *Content) *mail.Message {
+	t.Helper()
+	data, err := Build("noreply@example.com", "ivan@example.com", content, time.Unix(1700000000, 0).UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func decodeQuotedPrintable(t *testing.T, reader io.Reader) string {
+	t.Helper()
+	decoded, err := io.ReadAll(quotedprintable.NewReader(reader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(decoded)
+}
+
+func TestBuildText(t *testing.T) {
+	text := "Здравствуйте! Ссылка для входа: https://example.com/login?token=" + strings.Repeat("a", 100)
+	message := readMessage(t, &Content{Subject: "Вход в аккаунт", Text: text})
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	if err != nil || subject != "Вход в аккаунт" {
+		t.Fatalf("Subject = %q, %v", subject, err)
+	}
+	if message.Header.Get("Date") != "Tue, 14 Nov 2023 22:13:20 +0000" ||
+		!strings.HasSuffix(message.Header.Get("Message-ID"), "@example.com>") {
+		t.Fatalf("unexpected header: %v", message.Header)
+	}
+	if message.Header.Get("Content-Type") != "text/plain; charset=UTF-8" {
+		t.Fatalf("Content-Type = %s", message.Header.Get("Content-Type"))
+	}
+	if body := decodeQuotedPrintable(t, message.Body); body != text {
+		t.Fatalf("body = %q", body)
+	}
+}
+
+func TestBuildAlternative(t *testing.T) {
+	message := readMessage(t, &Content{Subject: "Reset", Text: "plain text", HTML: "<p>html</p>"})
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %s, %v", mediaType, err)
+	}
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	for _, expected := range []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", "plain text"},
+		{"text/html; charset=UTF-8", "<p>html</p>"},
+	} {
+		/* NextRawPart не декодирует quoted-printable сам, чтобы проверить заголовок части */
+		part, err := reader.NextRawPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.Header.Get("Content-Type") != expected.contentType ||
+			part.Header.Get("Content-Transfer-Encoding") != "quoted-printable" {
+			t.Fatalf("unexpected part header: %v", part.Header)
+		}
+		if body := decodeQuotedPrintable(t, part); body != expected.body {
+			t.Fatalf("part body = %q, want %q", body, expected.body)
+		}
+	}
+	if _, err = reader.NextPart(); err != io.EOF {
+		t.Fatalf("expected two parts, got %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Способ шифрования соединения с SMTP сервером */
+const (
+	/* TLS сразу при подключении, обычно порт 465 */
+	SecurityTLS = "tls"
+	/* Обычное подключение с переходом на TLS командой STARTTLS, обычно порт 587 */
+	SecuritySTARTTLS = "starttls"
+	/* Без шифрования, только для локальной разработки */
+	SecurityNone = "none"
+)
+
+/* Механизм аутентификации на SMTP сервере */
+const (
+	AuthPlain   = "plain"
+	AuthLogin   = "login"
+	AuthCRAMMD5 = "cram-md5"
+	AuthNone    = "none"
+)
+
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Security string
+	Auth     string
+	Username string
+	Password string
+	/* Имя, которым клиент представляется в EHLO. Пустое - "localhost". */
+	HelloName string
+	/* Сколько простаивающих соединений держать открытыми. 0 - соединение закрывается после каждого письма. */
+	PoolSize int
+	/* Простаивающее дольше соединение закрывается, а не переиспользуется */
+	IdleTimeout time.Duration
+	DialTimeout time.Duration
+	/* Ограничение на отправку одного письма, включая подключение к серверу */
+	Timeout time.Duration
+	/* Для тестов с локальным сервером и самоподписанным сертификатом */
+	TLSConfig *tls.Config
+}
+
+type pooledClient struct {
+	client   *smtp.Client
+	conn     net.Conn
+	lastUsed time.Time
+}
+
+/* SMTP клиент с пулом соединений. В отличие от smtp.SendMail умеет TLS при подключении
+ * и переиспользует соединение для нескольких писем подряд. */
+type Transport struct {
+	cfg  SMTPConfig
+	auth smtp.Auth
+	mu   sync.Mutex
+	idle []*pooledClient
+}
+
+func NewTransport(cfg SMTPConfig) (*Transport, error) {
+	switch cfg.Security {
+	case "":
+		/* Порт 465 зарезервирован под TLS при подключении, остальные обычно ждут STARTTLS */
+		cfg.Security = SecuritySTARTTLS
+		if cfg.Port == 465 {
+			cfg.Security = SecurityTLS
+		}
+	case SecurityTLS, SecuritySTARTTLS, SecurityNone:
+	default:
+		return nil, errors.New("unknown SMTP security: " + cfg.Security)
+	}
+
+	var auth smtp.Auth
+	switch cfg.Auth {
+	case AuthPlain:
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	case AuthLogin:
+		auth = &loginAuth{cfg.Username, cfg.Password, cfg.Host}
+	case AuthCRAMMD5:
+		auth = smtp.CRAMMD5Auth(cfg.Username, cfg.Password)
+	case AuthNone, "":
+	default:
+		return nil, errors.New("unknown SMTP auth mechanism: " + cfg.Auth)
+	}
+
+	if cfg.TLSConfig == nil {
+		cfg.TLSConfig = &tls.Config{ServerName: cfg.Host}
+	}
+	return &Transport{cfg: cfg, auth: auth}, nil
+}
+
+func (transport *Transport) Send(from string, to []string, message []byte) error {
+	pooled, err := transport.get()
+	if err != nil {
+		return err
+	}
+	if err = transport.send(pooled, from, to, message); err != nil {
+		_ = pooled.client.Close()
+		return err
+	}
+	transport.put(pooled)
+	return nil
+}
+
+/* Закрывает простаивающие соединения */
+func (transport *Transport) Close() error {
+	transport.mu.Lock()
+	idle := transport.idle
+	transport.idle = nil
+	transport.mu.Unlock()
+
+	var errs []error
+	for _, pooled := range idle {
+		errs = append(errs, pooled.client.Quit())
+	}
+	return errors.Join(errs...)
+}
+
+func (transport *Transport) send(pooled *pooledClient, from string, to []string, message []byte) error {
+	if err := pooled.conn.SetDeadline(transport.deadline()); err != nil {
+		return err
+	}
+	if err := pooled.client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := pooled.client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := pooled.client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(message); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+/* Берёт живое соединение из пула или открывает новое. Перед переиспользованием
+ * соединение проверяется командой RSET: сервер мог закрыть его по своему таймауту. */
+func (transport *Transport) get() (*pooledClient, error) {
+	for {
+		transport.mu.Lock()
+		if len(transport.idle) == 0 {
+			transport.mu.Unlock()
+			return transport.dial()
+		}
+		pooled := transport.idle[len(transport.idle)-1]
+		transport.idle = transport.idle[:len(transport.idle)-1]
+		transport.mu.Unlock()
+
+		if transport.cfg.IdleTimeout > 0 && time.Since(pooled.lastUsed) > transport.cfg.IdleTimeout {
+			_ = pooled.client.Close()
+			continue
+		}
+		err := pooled.conn.SetDeadline(transport.deadline())
+		if err == nil {
+			err = pooled.client.Reset()
+		}
+		if err != nil {
+			_ = pooled.client.Close()
+			continue
+		}
+		return pooled, nil
+	}
+}
+
+func (transport *Transport) put(pooled *pooledClient) {
+	pooled.lastUsed = time.Now()
+	transport.mu.Lock()
+	if len(transport.idle) < transport.cfg.PoolSize {
+		transport.idle = append(transport.idle, pooled)
+		transport.mu.Unlock()
+		return
+	}
+	transport.mu.Unlock()
+	_ = pooled.client.Quit()
+}
+
+func (transport *Transport) dial() (*pooledClient, error) {
+	cfg := transport.cfg
+	address := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	dialer := &net.Dialer{Timeout: cfg.DialTimeout}
+	var conn net.Conn
+	var err error
+	if cfg.Security == SecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, cfg.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.SetDeadline(transport.deadline()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	client, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = transport.handshake(client); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return &pooledClient{client: client, conn: conn}, nil
+}
+
+/* Без заданного таймаута операции ничем не ограничены */
+func (transport *Transport) deadline() time.Time {
+	if transport.cfg.Timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(transport.cfg.Timeout)
+}
+
+func (transport *Transport) handshake(client *smtp.Client) error {
+	cfg := transport.cfg
+	if cfg.HelloName != "" {
+		if err := client.Hello(cfg.HelloName); err != nil {
+			return err
+		}
+	}
+	if cfg.Security == SecuritySTARTTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("SMTP server does not support STARTTLS")
+		}
+		if err := client.StartTLS(cfg.TLSConfig); err != nil {
+			return err
+		}
+	}
+	if transport.auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("SMTP server does not support AUTH")
+		}
+		if err := client.Auth(transport.auth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* AUTH LOGIN: сервер по очереди спрашивает имя и пароль. В net/smtp его нет,
+ * но некоторые серверы (например, старые Exchange) другого не умеют. */
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (auth *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	/* Как и smtp.PlainAuth, не отправляем пароль открытым текстом никуда, кроме localhost */
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != auth.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (auth *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	challenge := strings.ToLower(strings.TrimSpace(string(fromServer)))
+	switch {
+	case strings.HasPrefix(challenge, "user"):
+		return []byte(auth.username), nil
+	case strings.HasPrefix(challenge, "pass"):
+		return []byte(auth.password), nil
+	}
+	return nil, errors.New("unexpected LOGIN challenge: " + string(fromServer))
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,395 @@
+package mailer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeUsername = "ivan"
+	fakePassword = "secret"
+)
+
+type fakeMessage struct {
+	from string
+	to   []string
+	data string
+	tls  bool
+	user string
+}
+
+/* SMTP сервер на net.Listener: умеет TLS при подключении, STARTTLS, AUTH PLAIN, LOGIN и CRAM-MD5
+ * и записывает принятые письма */
+type fakeSMTP struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	startTLS  bool
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	accepted int
+	messages []fakeMessage
+}
+
+func newFakeSMTP(t *testing.T, security string) (*fakeSMTP, *tls.Config) {
+	serverTLS, clientTLS := testCertificate(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if security == SecurityTLS {
+		listener = tls.NewListener(listener, serverTLS)
+	}
+	server := &fakeSMTP{listener: listener, tlsConfig: serverTLS, startTLS: security == SecuritySTARTTLS}
+	t.Cleanup(func() {
+		listener.Close()
+		server.dropConnections()
+	})
+	go server.acceptLoop()
+	return server, clientTLS
+}
+
+func (server *fakeSMTP) port() int {
+	return server.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (server *fakeSMTP) acceptLoop() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.mu.Lock()
+		server.accepted++
+		server.conns = append(server.conns, conn)
+		server.mu.Unlock()
+		go server.serve(conn)
+	}
+}
+
+/* Сервер закрывает соединения, как это делают настоящие серверы по таймауту простоя */
+func (server *fakeSMTP) dropConnections() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for _, conn := range server.conns {
+		conn.Close()
+	}
+	server.conns = nil
+}
+
+func (server *fakeSMTP) stats() (int, []fakeMessage) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.accepted, slices.Clone(server.messages)
+}
+
+func (server *fakeSMTP) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	_, secure := conn.(*tls.Conn)
+	text := textproto.NewConn(conn)
+	reply := func(format string, args ...interface{}) {
+		_ = text.PrintfLine(format, args...)
+	}
+	reply("220 fake ESMTP")
+
+	user := ""
+	message := fakeMessage{}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, argument, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			extensions := []string{"fake.test"}
+			if server.startTLS && !secure {
+				extensions = append(extensions, "STARTTLS")
+			}
+			extensions = append(extensions, "AUTH PLAIN LOGIN CRAM-MD5")
+			for i, extension := range extensions {
+				separator := "-"
+				if i == len(extensions)-1 {
+					separator = " "
+				}
+				reply("250%s%s", separator, extension)
+			}
+		case "STARTTLS":
+			reply("220 ready to start TLS")
+			tlsConn := tls.Server(conn, server.tlsConfig)
+			if err = tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, secure, text = tlsConn, true, textproto.NewConn(tlsConn)
+		case "AUTH":
+			if user = server.authenticate(text, argument); user == "" {
+				reply("535 authentication failed")
+				continue
+			}
+			reply("235 authenticated")
+		case "MAIL":
+			address := strings.TrimSuffix(strings.TrimPrefix(argument, "FROM:<"), ">")
+			message = fakeMessage{from: address, tls: secure, user: user}
+			reply("250 ok")
+		case "RCPT":
+			message.to = append(message.to, strings.TrimSuffix(strings.TrimPrefix(argument, "TO:<"), ">"))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			/* ReadDotBytes заменяет CRLF на LF */
+			message.data = string(data)
+			server.mu.Lock()
+			server.messages = append(server.messages, message)
+			server.mu.Unlock()
+			reply("250 queued")
+		case "RSET":
+			message = fakeMessage{}
+			reply("250 ok")
+		case "NOOP":
+			reply("250 ok")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unknown command")
+		}
+	}
+}
+
+/* Возвращает имя пользователя при верном пароле и пустую строку иначе */
+func (server *fakeSMTP) authenticate(text *textproto.Conn, argument string) string {
+	mechanism, initial, _ := strings.Cut(argument, " ")
+	challenge := func(prompt string) string {
+		_ = text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+		line, _ := text.ReadLine()
+		decoded, _ := base64.StdEncoding.DecodeString(line)
+		return string(decoded)
+	}
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		decoded, _ := base64.StdEncoding.DecodeString(initial)
+		parts := strings.Split(string(decoded), "\x00")
+		if len(parts) == 3 && parts[1] == fakeUsername && parts[2] == fakePassword {
+			return parts[1]
+		}
+	case "LOGIN":
+		username := challenge("Username:")
+		password := challenge("Password:")
+		if username == fakeUsername && password == fakePassword {
+			return username
+		}
+	case "CRAM-MD5":
+		nonce := "<1896.697170952@fake.test>"
+		username, digest, _ := strings.Cut(challenge(nonce), " ")
+		mac := hmac.New(md5.New, []byte(fakePassword))
+		mac.Write([]byte(nonce))
+		if username == fakeUsername && digest == hex.EncodeToString(mac.Sum(nil)) {
+			return username
+		}
+	}
+	return ""
+}
+
+/* Самоподписанный сертификат на 127.0.0.1 и конфигурации TLS для сервера и клиента */
+func testCertificate(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate)
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client := &tls.Config{ServerName: "127.0.0.1", RootCAs: roots}
+	return server, client
+}
+
+func newTestTransport(t *testing.T, server *fakeSMTP, clientTLS *tls.Config, cfg SMTPConfig) *Transport {
+	cfg.Host = "127.0.0.1"
+	cfg.Port = server.port()
+	cfg.TLSConfig = clientTLS
+	cfg.Timeout = 5 * time.Second
+	transport, err := NewTransport(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = transport.Close() })
+	return transport
+}
+
+func sendTestMessage(t *testing.T, transport *Transport, subject string) {
+	t.Helper()
+	err := transport.Send("noreply@example.com", []string{"ivan@example.com"},
+		[]byte("Subject: "+subject+"\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransportSecurity(t *testing.T) {
+	tests := []struct {
+		security string
+		tls      bool
+	}{
+		{SecurityTLS, true},
+		{SecuritySTARTTLS, true},
+		{SecurityNone, false},
+	}
+	for _, test := range tests {
+		t.Run(test.security, func(t *testing.T) {
+			server, clientTLS := newFakeSMTP(t, test.security)
+			transport := newTestTransport(t, server, clientTLS, SMTPConfig{Security: test.security})
+			sendTestMessage(t, transport, "security")
+
+			_, messages := server.stats()
+			if len(messages) != 1 {
+				t.Fatalf("server received %d messages", len(messages))
+			}
+			message := messages[0]
+			if message.tls != test.tls || message.from != "noreply@example.com" ||
+				!slices.Equal(message.to, []string{"ivan@example.com"}) || message.data != "Subject: security\n\nHello\n" {
+				t.Fatalf("unexpected message: %+v", message)
+			}
+		})
+	}
+}
+
+/* Сервер без STARTTLS: письмо не должно уйти открытым текстом */
+func TestTransportSTARTTLSRequired(t *testing.T) {
+	server, clientTLS := newFakeSMTP(t, SecurityNone)
+	transport := newTestTransport(t, server, clientTLS, SMTPConfig{Security: SecuritySTARTTLS})
+	if err := transport.Send("noreply@example.com", []string{"ivan@example.com"}, []byte("\r\n")); err == nil {
+		t.Fatal("Send must fail without STARTTLS")
+	}
+	if _, messages := server.stats(); len(messages) != 0 {
+		t.Fatal("message was sent in plaintext")
+	}
+}
+
+func TestTransportAuth(t *testing.T) {
+	for _, mechanism := range []string{AuthPlain, AuthLogin, AuthCRAMMD5} {
+		t.Run(mechanism, func(t *testing.T) {
+			server, clientTLS := newFakeSMTP(t, SecuritySTARTTLS)
+			transport := newTestTransport(t, server, clientTLS, SMTPConfig{
+				Security: SecuritySTARTTLS,
+				Auth:     mechanism,
+				Username: fakeUsername,
+				Password: fakePassword,
+			})
+			sendTestMessage(t, transport, mechanism)
+			if _, messages := server.stats(); len(messages) != 1 || messages[0].user != fakeUsername {
+				t.Fatalf("unexpected messages: %+v", messages)
+			}
+
+			wrong := newTestTransport(t, server, clientTLS, SMTPConfig{
+				Security: SecuritySTARTTLS,
+				Auth:     mechanism,
+				Username: fakeUsername,
+				Password: "wrong",
+			})
+			if err := wrong.Send("noreply@example.com", []string{"ivan@example.com"}, []byte("\r\n")); err == nil {
+				t.Fatal("Send with a wrong password must fail")
+			}
+		})
+	}
+}
+
+func TestLoginAuthRequiresTLS(t *testing.T) {
+	auth := &loginAuth{fakeUsername, fakePassword, "smtp.example.com"}
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com"}); err == nil {
+		t.Fatal("LOGIN must not be used over an unencrypted connection")
+	}
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "mail.example.org", TLS: true}); err == nil {
+		t.Fatal("LOGIN must not be used with another host")
+	}
+	if mechanism, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true}); err != nil || mechanism != "LOGIN" {
+		t.Fatalf("Start = %s, %v", mechanism, err)
+	}
+}
+
+func TestTransportPool(t *testing.T) {
+	tests := []struct {
+		poolSize    int
+		connections int
+	}{
+		{0, 3},
+		{1, 1},
+	}
+	for _, test := range tests {
+		server, clientTLS := newFakeSMTP(t, SecurityNone)
+		transport := newTestTransport(t, server, clientTLS, SMTPConfig{Security: SecurityNone, PoolSize: test.poolSize})
+		for i := 0; i < 3; i++ {
+			sendTestMessage(t, transport, "pool")
+		}
+		if accepted, messages := server.stats(); accepted != test.connections || len(messages) != 3 {
+			t.Errorf("pool size %d: %d connections, %d messages; want %d, 3",
+				test.poolSize, accepted, len(messages), test.connections)
+		}
+	}
+}
+
+/* Сервер закрыл простаивающее соединение: RSET не проходит, и транспорт подключается заново */
+func TestTransportReconnectsAfterServerDrop(t *testing.T) {
+	server, clientTLS := newFakeSMTP(t, SecurityTLS)
+	transport := newTestTransport(t, server, clientTLS, SMTPConfig{Security: SecurityTLS, PoolSize: 1})
+	sendTestMessage(t, transport, "first")
+	server.dropConnections()
+	sendTestMessage(t, transport, "second")
+
+	accepted, messages := server.stats()
+	if accepted != 2 || len(messages) != 2 || !strings.Contains(messages[1].data, "second") {
+		t.Fatalf("%d connections, messages %+v", accepted, messages)
+	}
+}
+
+func TestTransportIdleTimeout(t *testing.T) {
+	server, clientTLS := newFakeSMTP(t, SecurityNone)
+	transport := newTestTransport(t, server, clientTLS, SMTPConfig{
+		Security:    SecurityNone,
+		PoolSize:    1,
+		IdleTimeout: 10 * time.Millisecond,
+	})
+	sendTestMessage(t, transport, "first")
+	time.Sleep(50 * time.Millisecond)
+	sendTestMessage(t, transport, "second")
+	if accepted, _ := server.stats(); accepted != 2 {
+		t.Fatalf("idle connection was reused: %d connections", accepted)
+	}
+}
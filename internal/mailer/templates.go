@@ -0,0 +1,205 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+)
+
+/* Встроенные шаблоны. Раскладка: layout.html - общая обёртка HTML писем,
+ * <язык>/<вид>.txt - тема (блок "subject") и текст письма, <язык>/<вид>.html - блок "content" для обёртки. */
+//go:embed templates
+var builtinTemplates embed.FS
+
+/* Язык писем, если в конфиге он не задан */
+const defaultLocale = "ru"
+
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)
+
+/* Проверяет, что строка похожа на языковой тег BCP 47 ("ru", "en-US") */
+func ValidLocale(locale string) bool {
+	return localePattern.MatchString(locale)
+}
+
+/* Данные, доступные в шаблонах писем */
+type Data struct {
+	Locale    string
+	FirstName string
+	LastName  string
+	Email     string
+	/* IP адрес, с которого пришёл запрос */
+	IP string
+	/* Ссылка из письма и срок её действия в минутах */
+	Link     string
+	Lifetime int64
+	/* Число неудачных попыток входа перед блокировкой */
+	Failures int
+}
+
+/* Готовое письмо. HTML пустой, если для вида письма нет HTML шаблона. */
+type Content struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+type Templates struct {
+	fallback string
+	text     map[string]*texttemplate.Template
+	html     map[string]*htmltemplate.Template
+}
+
+/* Загружает встроенные шаблоны, поверх которых кладутся файлы из dir (если он задан).
+ * Файл из dir заменяет встроенный с тем же путём, так можно поменять оформление или добавить язык.
+ * fallback - язык для пользователей, на чей язык писем нет. */
+func Load(dir string, fallback string) (*Templates, error) {
+	if fallback == "" {
+		fallback = defaultLocale
+	}
+	builtin, err := fs.Sub(builtinTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+	layers := []fs.FS{builtin}
+	if dir != "" {
+		layers = append([]fs.FS{os.DirFS(dir)}, layers...)
+	}
+	files, err := collectFiles(layers)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := &Templates{
+		fallback: fallback,
+		text:     make(map[string]*texttemplate.Template),
+		html:     make(map[string]*htmltemplate.Template),
+	}
+	layout, hasLayout := files["layout.html"]
+	for name, content := range files {
+		locale, file, ok := strings.Cut(name, "/")
+		if !ok || strings.Contains(file, "/") {
+			continue
+		}
+		key := locale + "/" + strings.TrimSuffix(file, path.Ext(file))
+		switch path.Ext(file) {
+		case ".txt":
+			tmpl, err := texttemplate.New(name).Option("missingkey=error").Parse(string(content))
+			if err != nil {
+				return nil, err
+			}
+			if tmpl.Lookup("subject") == nil {
+				return nil, errors.New("template " + name + " has no subject block")
+			}
+			templates.text[key] = tmpl
+		case ".html":
+			if !hasLayout {
+				return nil, errors.New("layout.html is missing")
+			}
+			tmpl, err := htmltemplate.New("layout.html").Option("missingkey=error").Parse(string(layout))
+			if err == nil {
+				_, err = tmpl.New(name).Parse(string(content))
+			}
+			if err != nil {
+				return nil, err
+			}
+			templates.html[key] = tmpl
+		}
+	}
+	if _, ok := templates.locale("", ""); !ok && len(templates.text) > 0 {
+		return nil, errors.New("there are no templates for fallback locale " + fallback)
+	}
+	return templates, nil
+}
+
+/* Собирает письмо вида kind на языке locale. Если такого языка нет, пробуется язык без региона
+ * ("en" для "en-US"), затем язык по умолчанию. */
+func (templates *Templates) Render(kind string, locale string, data Data) (*Content, error) {
+	locale, ok := templates.locale(kind, locale)
+	if !ok {
+		return nil, errors.New("there is no template for " + kind)
+	}
+	key := locale + "/" + kind
+	data.Locale = locale
+
+	content := &Content{}
+	buffer := &bytes.Buffer{}
+	text := templates.text[key]
+	if err := text.ExecuteTemplate(buffer, "subject", data); err != nil {
+		return nil, err
+	}
+	/* Перевод строки в теме сломал бы заголовки письма */
+	content.Subject = strings.Join(strings.Fields(buffer.String()), " ")
+	buffer.Reset()
+	if err := text.Execute(buffer, data); err != nil {
+		return nil, err
+	}
+	content.Text = strings.TrimSpace(buffer.String()) + "\n"
+
+	if html, ok := templates.html[key]; ok {
+		buffer.Reset()
+		if err := html.Execute(buffer, data); err != nil {
+			return nil, err
+		}
+		content.HTML = buffer.String()
+	}
+	return content, nil
+}
+
+/* Подбирает язык, для которого есть шаблон kind. При пустом kind проверяется только наличие языка. */
+func (templates *Templates) locale(kind string, locale string) (string, bool) {
+	base, _, _ := strings.Cut(locale, "-")
+	for _, candidate := range []string{locale, base, templates.fallback} {
+		if candidate == "" {
+			continue
+		}
+		candidate = strings.ToLower(candidate)
+		if kind != "" {
+			if _, ok := templates.text[candidate+"/"+kind]; ok {
+				return candidate, true
+			}
+			continue
+		}
+		for key := range templates.text {
+			if strings.HasPrefix(key, candidate+"/") {
+				return candidate, true
+			}
+		}
+	}
+	return "", false
+}
+
+/* Читает файлы из всех слоёв, первый слой важнее следующих. Каталоги языков приводятся к нижнему регистру. */
+func collectFiles(layers []fs.FS) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for _, layer := range layers {
+		err := fs.WalkDir(layer, ".", func(name string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			key := name
+			if dir, file, ok := strings.Cut(name, "/"); ok {
+				key = strings.ToLower(dir) + "/" + file
+			}
+			if _, ok := files[key]; ok {
+				return nil
+			}
+			content, err := fs.ReadFile(layer, name)
+			if err != nil {
+				return err
+			}
+			files[key] = content
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
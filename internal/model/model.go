@@ -3,10 +3,28 @@ package model
 import "time"
 
 type User struct {
-	GUID      string
-	FirstName string
-	LastName  string
-	Email     string
+	GUID          string `json:"guid"`
+	FirstName     string `json:"first_name"`
+	LastName      string `json:"last_name"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Disabled      bool   `json:"disabled"`
+	/* Язык писем, например "ru" или "en-US". Пустой - язык по умолчанию из config.json */
+	Locale string `json:"locale"`
+}
+
+/* Право - значение scope. Пользователь получает его в access токене через одну из своих ролей. */
+type Permission struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type Role struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
 }
 
 type Token struct {
@@ -14,3 +32,181 @@ type Token struct {
 	Hash      string
 	CreatedAt time.Time
 }
+
+type Credential struct {
+	UserGUID  string
+	Hash      string
+	UpdatedAt time.Time
+}
+
+/* Одноразовая ссылка из письма. Purpose отличает ссылки для входа от прочих. */
+type LinkToken struct {
+	Hash      string
+	Purpose   string
+	UserGUID  string
+	Email     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+/* Второй фактор TOTP. Secret хранится зашифрованным, LastStep - последний принятый шаг,
+ * коды с шагом не больше него повторно не принимаются. */
+type TOTP struct {
+	UserGUID  string
+	Secret    []byte
+	Confirmed bool
+	LastStep  int64
+	CreatedAt time.Time
+}
+
+/* Ключ аутентификатора (passkey), зарегистрированный пользователем. PublicKey хранится в формате COSE. */
+type WebAuthnCredential struct {
+	ID         []byte
+	UserGUID   string
+	Name       string
+	PublicKey  []byte
+	SignCount  uint32
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+/* Выданный браузеру challenge. UserGUID пустой, если при входе пользователь не указан. */
+type WebAuthnSession struct {
+	ChallengeHash string
+	Purpose       string
+	UserGUID      string
+	ExpiresAt     time.Time
+}
+
+/* Счётчик неудачных попыток входа в аккаунт. LockedUntil пустой, если аккаунт ещё не блокировался. */
+type Lockout struct {
+	UserGUID      string     `json:"user_guid"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+/* Уведомление в очереди на отправку. Payload - сериализованное notify.Message,
+ * DeadAt заполняется, когда попытки отправки закончились. */
+type OutboxMessage struct {
+	ID            int64
+	Channel       string
+	Payload       []byte
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+	DeadAt        *time.Time
+}
+
+/* Клиент OAuth 2.0. AuthMethod - способ аутентификации на токен-эндпоинте (token_endpoint_auth_method из RFC 7591):
+ * none у публичных клиентов, которые вместо секрета используют PKCE, client_secret_basic или private_key_jwt.
+ * Секрет хранится в виде sha256, PublicKey - PEM открытого ключа для private_key_jwt. */
+type OAuthClient struct {
+	ID           string   `json:"client_id"`
+	Name         string   `json:"client_name"`
+	SecretHash   string   `json:"-"`
+	AuthMethod   string   `json:"token_endpoint_auth_method"`
+	PublicKey    string   `json:"public_key,omitempty"`
+	RedirectURIs []string `json:"redirect_uris"`
+	GrantTypes   []string `json:"grant_types"`
+	Scopes       []string `json:"scopes"`
+	/* Время жизни токенов client_credentials в секундах, 0 - lifetime.access_token */
+	TokenLifetime int64     `json:"token_lifetime"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+/* Состояния запроса авторизации устройства */
+const (
+	DeviceAuthorizationPending  = "pending"
+	DeviceAuthorizationApproved = "approved"
+	DeviceAuthorizationDenied   = "denied"
+)
+
+/* Запрос авторизации устройства (RFC 8628). Хранится только sha256 от device_code, а user_code человек
+ * вводит руками, он короткий и хранится как есть. UserGUID, AMR и AuthTime заполняются, когда пользователь разрешил доступ. */
+type DeviceAuthorization struct {
+	DeviceCodeHash string
+	UserCode       string
+	ClientID       string
+	Scope          string
+	Status         string
+	UserGUID       string
+	AMR            []string
+	/* Когда пользователь, разрешивший доступ, входил в аккаунт (auth_time из его access токена) */
+	AuthTime *time.Time
+	/* Минимальный интервал опроса в секундах, растёт на 5 при каждом slow_down */
+	Interval     int64
+	LastPolledAt *time.Time
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+/* Код авторизации OAuth 2.0. Хранится только sha256 от кода, код одноразовый.
+ * CodeChallenge - BASE64URL(SHA256(code_verifier)) из запроса авторизации (PKCE, RFC 7636). */
+type AuthorizationCode struct {
+	Hash          string
+	ClientID      string
+	UserGUID      string
+	RedirectURI   string
+	CodeChallenge string
+	Scope         string
+	/* Способы входа из access токена, с которым пользователь разрешил доступ, и время этого входа */
+	AMR      []string
+	AuthTime time.Time
+	/* nonce из запроса авторизации, возвращается приложению в id_token */
+	Nonce     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+/* Запись аудита: администратор Actor получил access токен пользователя, чтобы увидеть сервис его глазами.
+ * JTI - идентификатор выданного токена, по нему запись находится из логов сервисов, принявших токен.
+ * Actor - произвольный текст от админки, сервис его не проверяет. Проверено только то, что запрос пришёл
+ * с IP и с ADMIN_TOKEN, отпечаток которого записан в Credential. */
+type Impersonation struct {
+	ID         int64     `json:"id"`
+	UserGUID   string    `json:"user_guid"`
+	Actor      string    `json:"actor"`
+	Reason     string    `json:"reason"`
+	JTI        string    `json:"jti"`
+	IP         string    `json:"ip"`
+	Credential string    `json:"credential"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+/* Ключ API пользователя. Сам ключ выдаётся один раз при создании, хранится sha256 от него,
+ * а ID - открытая часть ключа, по которой он находится в базе. ExpiresAt пустой у бессрочных ключей. */
+type APIKey struct {
+	ID         string     `json:"id"`
+	UserGUID   string     `json:"-"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+/* Аккаунт у внешнего провайдера OpenID Connect, привязанный к пользователю. Subject - sub из id_token провайдера,
+ * Email - адрес, с которым аккаунт привязан (только для справки, вход идёт по Subject). */
+type FederatedIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	UserGUID  string    `json:"user_guid"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+/* Начатый вход через внешнего провайдера. state хранится в виде sha256, nonce и code_verifier
+ * понадобятся, когда пользователь вернётся от провайдера. */
+type FederationState struct {
+	StateHash    string
+	TenantID     string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
@@ -0,0 +1,182 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+)
+
+/* Типы событий для вебхуков. События security.* - подозрительные ситуации, token.* - жизненный цикл токенов. */
+const (
+	EventTokenIssued      = "token.issued"
+	EventTokenRefreshed   = "token.refreshed"
+	EventTokenRevoked     = "token.revoked"
+	EventTokenCompromised = "security.token_compromised"
+	EventIPMismatch       = "security.ip_mismatch"
+	EventRefreshReuse     = "security.refresh_reuse"
+	EventImpersonation    = "security.impersonation"
+	EventIdentityLinked   = "security.identity_linked"
+)
+
+/* Каналы событий в outbox называются event:<имя вебхука>, чтобы не пересекаться с каналами писем */
+const EventChannelPrefix = "event:"
+
+/* Заголовки запроса вебхука */
+const (
+	EventIDHeader        = "X-Event-ID"
+	EventTimestampHeader = "X-Event-Timestamp"
+	EventSignatureHeader = "X-Event-Signature"
+)
+
+/* Событие безопасности. ID не меняется между повторными отправками, по нему получатель отбрасывает дубликаты. */
+type Event struct {
+	ID       string            `json:"id"`
+	Type     string            `json:"type"`
+	Time     int64             `json:"time"`
+	Tenant   string            `json:"tenant"`
+	UserGUID string            `json:"user_guid,omitempty"`
+	IP       string            `json:"ip,omitempty"`
+	Details  map[string]string `json:"details,omitempty"`
+}
+
+/* Подписка вебхука. Пустой Events - все события, "security.*" - все события с этим префиксом. */
+type Subscription struct {
+	Name   string
+	Events []string
+}
+
+func (subscription *Subscription) matches(eventType string) bool {
+	if len(subscription.Events) == 0 {
+		return true
+	}
+	for _, pattern := range subscription.Events {
+		if pattern == eventType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(eventType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Ставит события в outbox, как Outbox ставит письма: отдельной строкой на каждый подписанный вебхук */
+type EventPublisher struct {
+	repo          repository.OutboxRepository
+	subscriptions []Subscription
+}
+
+func NewEventPublisher(repo repository.OutboxRepository, subscriptions []Subscription) *EventPublisher {
+	return &EventPublisher{
+		repo,
+		subscriptions,
+	}
+}
+
+/* Заполняет ID и время события, если они не заданы, и ставит его в очередь */
+func (publisher *EventPublisher) Publish(event *Event) error {
+	if event.ID == "" {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			return err
+		}
+		event.ID = hex.EncodeToString(random)
+	}
+	if event.Time == 0 {
+		event.Time = time.Now().Unix()
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i := range publisher.subscriptions {
+		if publisher.subscriptions[i].matches(event.Type) {
+			errs = append(errs, publisher.repo.Create(&model.OutboxMessage{
+				Channel: EventChannelPrefix + publisher.subscriptions[i].Name,
+				Payload: payload,
+			}))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+/* Отправляет событие POST запросом с JSON телом. Тело подписывается HMAC-SHA256 вместе с временем отправки:
+ * X-Event-Signature: v1=hex(HMAC(secret, "<X-Event-Timestamp>.<тело>")). Время ставится заново при каждой попытке,
+ * поэтому получатель может отвергать запросы старше нескольких минут, а повторы одного события отсекать по X-Event-ID. */
+type EventWebhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func NewEventWebhook(url string, secret []byte, timeout time.Duration) *EventWebhook {
+	return &EventWebhook{
+		url,
+		secret,
+		&http.Client{Timeout: timeout},
+	}
+}
+
+func (webhook *EventWebhook) Send(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, webhook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, event.ID)
+	req.Header.Set(EventTimestampHeader, timestamp)
+	req.Header.Set(EventSignatureHeader, SignEvent(webhook.secret, timestamp, body))
+	resp, err := webhook.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("event webhook responded with status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+func SignEvent(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/* Проверка подписи на стороне получателя. Запросы с временем дальше tolerance от now отвергаются,
+ * чтобы перехваченный запрос нельзя было отправить повторно позже. Внутри tolerance повтор проходит проверку,
+ * а повторная доставка события приходит с новым временем и подписью, так что получатель обязан сам отбрасывать
+ * уже обработанные X-Event-ID: VerifyEvent дубликаты не отсекает. */
+func VerifyEvent(secret []byte, timestamp string, signature string, body []byte, tolerance time.Duration, now time.Time) error {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid event timestamp")
+	}
+	if diff := now.Sub(time.Unix(unix, 0)); diff > tolerance || diff < -tolerance {
+		return errors.New("event timestamp is outside of tolerance")
+	}
+	if !hmac.Equal([]byte(signature), []byte(SignEvent(secret, timestamp, body))) {
+		return errors.New("invalid event signature")
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package notify
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testEventSecret = []byte("webhook-secret")
+
+func TestVerifyEvent(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	body := []byte(`{"id":"1","type":"security.refresh_reuse","time":1700000000,"tenant":"acme"}`)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := SignEvent(testEventSecret, timestamp, body)
+
+	tests := []struct {
+		name      string
+		secret    []byte
+		timestamp string
+		signature string
+		body      []byte
+		now       time.Time
+		valid     bool
+	}{
+		{"valid", testEventSecret, timestamp, signature, body, now, true},
+		{"within tolerance", testEventSecret, timestamp, signature, body, now.Add(4 * time.Minute), true},
+		{"stale timestamp", testEventSecret, timestamp, signature, body, now.Add(6 * time.Minute), false},
+		{"future timestamp", testEventSecret, timestamp, signature, body, now.Add(-6 * time.Minute), false},
+		{"invalid timestamp", testEventSecret, "yesterday", signature, body, now, false},
+		/* Время подписано вместе с телом: свежий timestamp к старой подписи не подставить */
+		{"tampered timestamp", testEventSecret, strconv.FormatInt(now.Unix()+1, 10), signature, body, now, false},
+		{"tampered body", testEventSecret, timestamp, signature,
+			[]byte(`{"id":"1","type":"security.refresh_reuse","time":1700000000,"tenant":"globex"}`), now, false},
+		{"wrong secret", []byte("other-secret"), timestamp, signature, body, now, false},
+		{"empty signature", testEventSecret, timestamp, "", body, now, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := VerifyEvent(test.secret, test.timestamp, test.signature, test.body, 5*time.Minute, test.now)
+			if test.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("event is accepted")
+			}
+		})
+	}
+}
+
+func TestEventWebhookSend(t *testing.T) {
+	var header http.Header
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header.Clone()
+		body, _ = io.ReadAll(req.Body)
+	}))
+	defer server.Close()
+
+	webhook := NewEventWebhook(server.URL, testEventSecret, time.Second)
+	event := &Event{ID: "event-id", Type: EventRefreshReuse, Time: time.Now().Unix(), Tenant: "acme"}
+	if err := webhook.Send(event); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get(EventIDHeader) != "event-id" {
+		t.Fatalf("%s: %q", EventIDHeader, header.Get(EventIDHeader))
+	}
+	err := VerifyEvent(testEventSecret, header.Get(EventTimestampHeader), header.Get(EventSignatureHeader), body,
+		5*time.Minute, time.Now())
+	if err != nil {
+		t.Fatalf("signature of a sent event: %v", err)
+	}
+}
+
+func TestEventWebhookSendStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	webhook := NewEventWebhook(server.URL, testEventSecret, time.Second)
+	if err := webhook.Send(&Event{ID: "event-id", Type: EventRefreshReuse}); err == nil {
+		t.Fatal("non-2xx response is treated as delivered")
+	}
+}
@@ -0,0 +1,56 @@
+package notify
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+/* Пишет уведомления в лог. Удобно при разработке, когда SMTP нет. */
+type LogNotifier struct {
+	logger *zap.Logger
+}
+
+func NewLogNotifier(logger *zap.Logger) *LogNotifier {
+	return &LogNotifier{logger}
+}
+
+func (notifier *LogNotifier) Notify(message *Message) error {
+	notifier.logger.Info("Notification",
+		zap.String("kind", message.Kind),
+		zap.String("to", message.To),
+		zap.String("user_guid", message.UserGUID),
+		zap.String("subject", message.Subject),
+		zap.String("text", message.Text))
+	return nil
+}
+
+/* Дописывает уведомления в файл, по одному JSON объекту на строку */
+type FileNotifier struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{path: path}
+}
+
+func (notifier *FileNotifier) Notify(message *Message) error {
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	file, err := os.OpenFile(notifier.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
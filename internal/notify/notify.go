@@ -0,0 +1,64 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+)
+
+/* Виды уведомлений. По ним получатель (например, вебхук) может отличать письма друг от друга,
+ * и по ним же выбирается шаблон письма. Для писем со ссылками вид совпадает с назначением ссылки. */
+const (
+	KindMagicLink         = "magic_login"
+	KindEmailVerification = "email_verification"
+	KindPasswordReset     = "password_reset"
+	KindIPChange          = "ip_change"
+	KindCompromise        = "compromise"
+	KindLockout           = "lockout"
+	KindUnlock            = "unlock"
+)
+
+/* Письмо уже собрано по шаблону, каналы только доставляют его */
+type Message struct {
+	Kind string `json:"kind"`
+	/* Отправитель, пустой - адрес по умолчанию из настроек канала */
+	From     string `json:"from,omitempty"`
+	To       string `json:"to"`
+	UserGUID string `json:"user_guid,omitempty"`
+	Subject  string `json:"subject"`
+	Text     string `json:"text"`
+	HTML     string `json:"html,omitempty"`
+}
+
+type Notifier interface {
+	Notify(message *Message) error
+}
+
+/* Очередь уведомлений. Обработчики запросов только кладут в неё сообщения,
+ * отправкой занимается Worker. Сообщение ставится отдельно в каждый канал,
+ * чтобы повторная отправка в один канал не дублировала его в остальных. */
+type Outbox struct {
+	repo     repository.OutboxRepository
+	channels []string
+}
+
+func NewOutbox(repo repository.OutboxRepository, channels []string) *Outbox {
+	return &Outbox{
+		repo,
+		channels,
+	}
+}
+
+func (outbox *Outbox) Enqueue(message *Message) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, channel := range outbox.channels {
+		errs = append(errs, outbox.repo.Create(&model.OutboxMessage{Channel: channel, Payload: payload}))
+	}
+	return errors.Join(errs...)
+}
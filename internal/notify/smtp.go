@@ -0,0 +1,41 @@
+package notify
+
+import (
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/mailer"
+)
+
+type SMTPNotifier struct {
+	transport *mailer.Transport
+	from      string
+	/* nil, если подпись DKIM не настроена */
+	dkim *mailer.DKIMSigner
+}
+
+func NewSMTPNotifier(transport *mailer.Transport, from string, dkim *mailer.DKIMSigner) *SMTPNotifier {
+	return &SMTPNotifier{
+		transport,
+		from,
+		dkim,
+	}
+}
+
+func (notifier *SMTPNotifier) Notify(message *Message) error {
+	content := &mailer.Content{Subject: message.Subject, Text: message.Text, HTML: message.HTML}
+	from := notifier.from
+	if message.From != "" {
+		from = message.From
+	}
+	now := time.Now()
+	body, err := mailer.Build(from, message.To, content, now)
+	if err != nil {
+		return err
+	}
+	if notifier.dkim != nil {
+		if body, err = notifier.dkim.Sign(body, now); err != nil {
+			return err
+		}
+	}
+	return notifier.transport.Send(from, []string{message.To}, body)
+}
@@ -0,0 +1,41 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/* Отправляет уведомление POST запросом с JSON телом. Любой ответ кроме 2xx считается ошибкой. */
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookNotifier(url string, timeout time.Duration) *WebhookNotifier {
+	return &WebhookNotifier{
+		url,
+		&http.Client{Timeout: timeout},
+	}
+}
+
+func (notifier *WebhookNotifier) Notify(message *Message) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	resp, err := notifier.client.Post(notifier.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("webhook responded with status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"go.uber.org/zap"
+)
+
+/* На это время забранное сообщение скрыто от других реплик. Если реплика упадёт во время отправки,
+ * по истечении этого времени сообщение заберёт кто-то другой. */
+const claimLease = 5 * time.Minute
+
+type WorkerConfig struct {
+	BatchSize   int
+	MaxAttempts int
+	/* Задержка перед повтором: Backoff * 2^(попытка-1), но не больше MaxBackoff */
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+/* Фоновая отправка сообщений из outbox с повторами. Отправленное сообщение удаляется вместе с содержимым.
+ * Сообщения, которые так и не удалось отправить за MaxAttempts попыток, остаются в таблице с заполненным dead_at,
+ * но у писем стирается текст: в нём могут быть ещё действующие ссылки с токенами.
+ * Письма уходят через notifiers, события безопасности - через webhooks (ключ - канал event:<имя>). */
+type Worker struct {
+	logger    *zap.Logger
+	repo      repository.OutboxRepository
+	notifiers map[string]Notifier
+	webhooks  map[string]*EventWebhook
+	cfg       WorkerConfig
+}
+
+func NewWorker(logger *zap.Logger, repo repository.OutboxRepository, notifiers map[string]Notifier,
+	webhooks map[string]*EventWebhook, cfg WorkerConfig) *Worker {
+	return &Worker{
+		logger,
+		repo,
+		notifiers,
+		webhooks,
+		cfg,
+	}
+}
+
+func (worker *Worker) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		<-ticker.C
+		/* Пока очередь отдаёт полные пачки, разбираем её без пауз */
+		for worker.deliverBatch() == worker.cfg.BatchSize {
+			continue
+		}
+	}
+}
+
+func (worker *Worker) deliverBatch() int {
+	messages, err := worker.repo.Claim(worker.cfg.BatchSize, claimLease)
+	if err != nil {
+		worker.logger.Error("Failed to claim outbox messages", zap.Error(err))
+		return 0
+	}
+	for i := range messages {
+		worker.deliver(&messages[i])
+	}
+	return len(messages)
+}
+
+func (worker *Worker) deliver(outboxMessage *model.OutboxMessage) {
+	kind, err := worker.send(outboxMessage)
+	if err == nil {
+		if err = worker.repo.Delete(outboxMessage.ID); err != nil {
+			worker.logger.Error("Failed to delete sent outbox message", zap.Error(err), zap.Int64("id", outboxMessage.ID))
+		}
+		worker.logger.Debug("Notification has been sent",
+			zap.Int64("id", outboxMessage.ID),
+			zap.String("channel", outboxMessage.Channel),
+			zap.String("kind", kind))
+		return
+	}
+
+	if outboxMessage.Attempts >= worker.cfg.MaxAttempts {
+		worker.logger.Error("Notification has been dead-lettered", zap.Error(err),
+			zap.Int64("id", outboxMessage.ID),
+			zap.String("channel", outboxMessage.Channel),
+			zap.String("kind", kind),
+			zap.Int("attempts", outboxMessage.Attempts))
+		if err = worker.repo.MarkDead(outboxMessage.ID, err.Error(), redactPayload(outboxMessage)); err != nil {
+			worker.logger.Error("Failed to dead-letter outbox message", zap.Error(err), zap.Int64("id", outboxMessage.ID))
+		}
+		return
+	}
+
+	delay := min(worker.cfg.Backoff<<min(outboxMessage.Attempts-1, 16), worker.cfg.MaxBackoff)
+	worker.logger.Warn("Notification delivery failed, will retry", zap.Error(err),
+		zap.Int64("id", outboxMessage.ID),
+		zap.String("channel", outboxMessage.Channel),
+		zap.Int("attempts", outboxMessage.Attempts),
+		zap.Duration("retry_in", delay))
+	if err = worker.repo.Retry(outboxMessage.ID, err.Error(), time.Now().Add(delay)); err != nil {
+		worker.logger.Error("Failed to reschedule outbox message", zap.Error(err), zap.Int64("id", outboxMessage.ID))
+	}
+}
+
+/* Отправляет сообщение в его канал и возвращает вид письма или тип события для логов */
+func (worker *Worker) send(outboxMessage *model.OutboxMessage) (string, error) {
+	if strings.HasPrefix(outboxMessage.Channel, EventChannelPrefix) {
+		event := &Event{}
+		if err := json.Unmarshal(outboxMessage.Payload, event); err != nil {
+			return "", err
+		}
+		webhook, ok := worker.webhooks[outboxMessage.Channel]
+		if !ok {
+			return event.Type, errors.New("event webhook is not configured")
+		}
+		return event.Type, webhook.Send(event)
+	}
+
+	message := &Message{}
+	if err := json.Unmarshal(outboxMessage.Payload, message); err != nil {
+		return "", err
+	}
+	notifier, ok := worker.notifiers[outboxMessage.Channel]
+	if !ok {
+		return message.Kind, errors.New("notification channel is not configured")
+	}
+	return message.Kind, notifier.Notify(message)
+}
+
+/* Содержимое неотправленного сообщения, которое остаётся в outbox. События не содержат секретов и сохраняются
+ * целиком, у писем остаются только вид, адреса и тема. Нечитаемый payload заменяется пустым объектом. */
+func redactPayload(outboxMessage *model.OutboxMessage) []byte {
+	if strings.HasPrefix(outboxMessage.Channel, EventChannelPrefix) {
+		return outboxMessage.Payload
+	}
+	message := &Message{}
+	if err := json.Unmarshal(outboxMessage.Payload, message); err != nil {
+		return []byte("{}")
+	}
+	message.Text, message.HTML = "", ""
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return []byte("{}")
+	}
+	return payload
+}
@@ -0,0 +1,210 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"go.uber.org/zap"
+)
+
+/* Outbox в памяти. Claim отдаёт все живые сообщения без оглядки на next_attempt_at,
+ * как будто между вызовами прошло достаточно времени. */
+type memOutbox struct {
+	repository.OutboxRepository
+	messages map[int64]*model.OutboxMessage
+	deleted  []int64
+	retries  []time.Time
+}
+
+func newMemOutbox(messages ...model.OutboxMessage) *memOutbox {
+	repo := &memOutbox{messages: map[int64]*model.OutboxMessage{}}
+	for i := range messages {
+		repo.messages[messages[i].ID] = &messages[i]
+	}
+	return repo
+}
+
+func (repo *memOutbox) Claim(limit int, lease time.Duration) ([]model.OutboxMessage, error) {
+	var claimed []model.OutboxMessage
+	for _, message := range repo.messages {
+		if message.DeadAt != nil || len(claimed) == limit {
+			continue
+		}
+		message.Attempts++
+		claimed = append(claimed, *message)
+	}
+	return claimed, nil
+}
+
+func (repo *memOutbox) Delete(id int64) error {
+	delete(repo.messages, id)
+	repo.deleted = append(repo.deleted, id)
+	return nil
+}
+
+func (repo *memOutbox) Retry(id int64, lastError string, nextAttemptAt time.Time) error {
+	repo.messages[id].LastError = lastError
+	repo.messages[id].NextAttemptAt = nextAttemptAt
+	repo.retries = append(repo.retries, nextAttemptAt)
+	return nil
+}
+
+func (repo *memOutbox) MarkDead(id int64, lastError string, payload []byte) error {
+	now := time.Now()
+	repo.messages[id].LastError = lastError
+	repo.messages[id].Payload = payload
+	repo.messages[id].DeadAt = &now
+	return nil
+}
+
+/* Канал, который отказывает первые failures раз */
+type flakyNotifier struct {
+	failures int
+	sent     []*Message
+}
+
+func (notifier *flakyNotifier) Notify(message *Message) error {
+	if notifier.failures > 0 {
+		notifier.failures--
+		return errors.New("smtp is unavailable")
+	}
+	notifier.sent = append(notifier.sent, message)
+	return nil
+}
+
+var testWorkerConfig = WorkerConfig{
+	BatchSize:   10,
+	MaxAttempts: 4,
+	Backoff:     10 * time.Second,
+	MaxBackoff:  30 * time.Second,
+}
+
+func mailMessage(t *testing.T, id int64) model.OutboxMessage {
+	payload, err := json.Marshal(&Message{
+		Kind:     KindPasswordReset,
+		To:       "user@example.com",
+		UserGUID: "user-guid",
+		Subject:  "Password reset",
+		Text:     "https://auth.example.com/reset?token=live-token",
+		HTML:     `<a href="https://auth.example.com/reset?token=live-token">reset</a>`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return model.OutboxMessage{ID: id, Channel: "smtp", Payload: payload}
+}
+
+func TestWorkerDelivered(t *testing.T) {
+	repo := newMemOutbox(mailMessage(t, 1))
+	notifier := &flakyNotifier{}
+	worker := NewWorker(zap.NewNop(), repo, map[string]Notifier{"smtp": notifier}, nil, testWorkerConfig)
+
+	if n := worker.deliverBatch(); n != 1 {
+		t.Fatalf("claimed %d messages, want 1", n)
+	}
+	if len(notifier.sent) != 1 || notifier.sent[0].To != "user@example.com" {
+		t.Fatalf("sent %+v", notifier.sent)
+	}
+	/* Отправленное письмо со ссылкой не должно оставаться в базе */
+	if len(repo.deleted) != 1 || repo.deleted[0] != 1 || len(repo.messages) != 0 {
+		t.Fatalf("deleted %v, left %d messages", repo.deleted, len(repo.messages))
+	}
+	if len(repo.retries) != 0 {
+		t.Fatalf("delivered message was rescheduled: %v", repo.retries)
+	}
+}
+
+func TestWorkerRetryAndDeadLetter(t *testing.T) {
+	repo := newMemOutbox(mailMessage(t, 1))
+	notifier := &flakyNotifier{failures: 100}
+	worker := NewWorker(zap.NewNop(), repo, map[string]Notifier{"smtp": notifier}, nil, testWorkerConfig)
+
+	/* 10s, 20s, затем упор в MaxBackoff */
+	for attempt, delay := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second} {
+		before := time.Now()
+		worker.deliverBatch()
+		after := time.Now()
+
+		if len(repo.retries) != attempt+1 {
+			t.Fatalf("attempt %d: %d retries scheduled", attempt+1, len(repo.retries))
+		}
+		next := repo.retries[attempt]
+		if next.Before(before.Add(delay)) || next.After(after.Add(delay)) {
+			t.Fatalf("attempt %d: retry in %s, want %s", attempt+1, next.Sub(before), delay)
+		}
+		if repo.messages[1].DeadAt != nil {
+			t.Fatalf("attempt %d: message is dead before max_attempts", attempt+1)
+		}
+	}
+
+	worker.deliverBatch()
+	message := repo.messages[1]
+	if message.DeadAt == nil {
+		t.Fatal("message is not dead-lettered after max_attempts")
+	}
+	if len(repo.retries) != 3 {
+		t.Fatalf("dead message was rescheduled: %d retries", len(repo.retries))
+	}
+	if message.LastError != "smtp is unavailable" {
+		t.Fatalf("last_error %q", message.LastError)
+	}
+	if strings.Contains(string(message.Payload), "live-token") {
+		t.Fatalf("dead-lettered payload keeps the link: %s", message.Payload)
+	}
+	redacted := &Message{}
+	if err := json.Unmarshal(message.Payload, redacted); err != nil {
+		t.Fatal(err)
+	}
+	if redacted.Kind != KindPasswordReset || redacted.To != "user@example.com" || redacted.Subject != "Password reset" ||
+		redacted.Text != "" || redacted.HTML != "" {
+		t.Fatalf("redacted payload %+v", redacted)
+	}
+
+	/* Мёртвое сообщение больше не забирается */
+	if n := worker.deliverBatch(); n != 0 {
+		t.Fatalf("claimed %d messages after dead-letter", n)
+	}
+	if len(notifier.sent) != 0 {
+		t.Fatalf("failing notifier sent %+v", notifier.sent)
+	}
+}
+
+func TestWorkerRecoversAfterFailure(t *testing.T) {
+	repo := newMemOutbox(mailMessage(t, 1))
+	notifier := &flakyNotifier{failures: 1}
+	worker := NewWorker(zap.NewNop(), repo, map[string]Notifier{"smtp": notifier}, nil, testWorkerConfig)
+
+	worker.deliverBatch()
+	if len(repo.retries) != 1 || len(repo.deleted) != 0 {
+		t.Fatalf("after failure: retries %v, deleted %v", repo.retries, repo.deleted)
+	}
+	worker.deliverBatch()
+	if len(notifier.sent) != 1 || len(repo.deleted) != 1 || len(repo.messages) != 0 {
+		t.Fatalf("after retry: sent %d, deleted %v", len(notifier.sent), repo.deleted)
+	}
+}
+
+func TestWorkerUnknownChannel(t *testing.T) {
+	repo := newMemOutbox(mailMessage(t, 1))
+	worker := NewWorker(zap.NewNop(), repo, map[string]Notifier{}, nil, testWorkerConfig)
+
+	worker.deliverBatch()
+	if len(repo.retries) != 1 || repo.messages[1].LastError != "notification channel is not configured" {
+		t.Fatalf("retries %v, last_error %q", repo.retries, repo.messages[1].LastError)
+	}
+}
+
+func TestRedactPayload(t *testing.T) {
+	event := []byte(`{"id":"1","type":"security.refresh_reuse","time":1,"tenant":"acme"}`)
+	if got := redactPayload(&model.OutboxMessage{Channel: EventChannelPrefix + "siem", Payload: event}); string(got) != string(event) {
+		t.Fatalf("event payload changed: %s", got)
+	}
+	if got := redactPayload(&model.OutboxMessage{Channel: "smtp", Payload: []byte("not json")}); string(got) != "{}" {
+		t.Fatalf("broken payload: %s", got)
+	}
+}
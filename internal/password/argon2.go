@@ -0,0 +1,105 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var ErrInvalidHash = errors.New("password hash is not in argon2id PHC format")
+
+/* Параметры argon2id. Memory задаётся в KiB. Нулевые поля заменяются значениями по умолчанию. */
+type Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+/* Минимальная длина пароля, если в конфиге она не задана */
+const DefaultMinLength = 8
+
+var DefaultParams = Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func (p Params) withDefaults() Params {
+	if p.Memory == 0 {
+		p.Memory = DefaultParams.Memory
+	}
+	if p.Iterations == 0 {
+		p.Iterations = DefaultParams.Iterations
+	}
+	if p.Parallelism == 0 {
+		p.Parallelism = DefaultParams.Parallelism
+	}
+	if p.SaltLength == 0 {
+		p.SaltLength = DefaultParams.SaltLength
+	}
+	if p.KeyLength == 0 {
+		p.KeyLength = DefaultParams.KeyLength
+	}
+	return p
+}
+
+/* Хэш возвращается в формате PHC: $argon2id$v=19$m=65536,t=3,p=2$<соль>$<хэш> */
+func Hash(password string, params Params) (string, error) {
+	params = params.withDefaults()
+	salt := make([]byte, params.SaltLength)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+/* Проверяет пароль по хэшу. rehash = true, если хэш посчитан с параметрами,
+ * отличными от текущих, и его стоит пересчитать, пока пароль на руках. */
+func Verify(password string, encoded string, params Params) (match bool, rehash bool, err error) {
+	params = params.withDefaults()
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return false, false, ErrInvalidHash
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false, ErrInvalidHash
+	}
+	stored := Params{}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &stored.Memory, &stored.Iterations, &stored.Parallelism); err != nil ||
+		stored.Iterations == 0 || stored.Parallelism == 0 {
+		/* argon2.IDKey паникует на нулевых t и p */
+		return false, false, ErrInvalidHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, ErrInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, false, ErrInvalidHash
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, stored.Iterations, stored.Memory, stored.Parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, computed) != 1 {
+		return false, false, nil
+	}
+	rehash = stored.Memory != params.Memory || stored.Iterations != params.Iterations ||
+		stored.Parallelism != params.Parallelism ||
+		uint32(len(salt)) != params.SaltLength || uint32(len(key)) != params.KeyLength
+	return true, rehash, nil
+}
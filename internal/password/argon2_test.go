@@ -0,0 +1,98 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+/* Маленькие параметры, чтобы тесты не тратили по 64 MiB на каждый хэш */
+var testParams = Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 8, KeyLength: 16}
+
+func TestHashVerify(t *testing.T) {
+	hash, err := Hash("correct horse", testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("unexpected hash format: %s", hash)
+	}
+
+	match, rehash, err := Verify("correct horse", hash, testParams)
+	if err != nil || !match || rehash {
+		t.Fatalf("Verify(correct) = %v, %v, %v; want true, false, nil", match, rehash, err)
+	}
+	match, _, err = Verify("correct horsE", hash, testParams)
+	if err != nil || match {
+		t.Fatalf("Verify(wrong) = %v, %v; want false, nil", match, err)
+	}
+
+	other, err := Hash("correct horse", testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == hash {
+		t.Fatal("two hashes of the same password must have different salts")
+	}
+}
+
+/* Эталон из тестов референсной реализации argon2 (github.com/P-H-C/phc-winner-argon2) */
+func TestVerifyReferenceVector(t *testing.T) {
+	const encoded = "$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc"
+	params := Params{Memory: 65536, Iterations: 2, Parallelism: 1, SaltLength: 8, KeyLength: 32}
+	match, rehash, err := Verify("password", encoded, params)
+	if err != nil || !match || rehash {
+		t.Fatalf("Verify = %v, %v, %v; want true, false, nil", match, rehash, err)
+	}
+}
+
+func TestVerifyRehash(t *testing.T) {
+	hash, err := Hash("secret", testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		params Params
+		rehash bool
+	}{
+		{"same params", testParams, false},
+		{"more memory", Params{Memory: 128, Iterations: 1, Parallelism: 1, SaltLength: 8, KeyLength: 16}, true},
+		{"more iterations", Params{Memory: 64, Iterations: 2, Parallelism: 1, SaltLength: 8, KeyLength: 16}, true},
+		{"more parallelism", Params{Memory: 64, Iterations: 1, Parallelism: 2, SaltLength: 8, KeyLength: 16}, true},
+		{"longer salt", Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 16}, true},
+		{"longer key", Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 8, KeyLength: 32}, true},
+		{"defaults", Params{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			match, rehash, err := Verify("secret", hash, test.params)
+			if err != nil || !match {
+				t.Fatalf("Verify = %v, %v; want true, nil", match, err)
+			}
+			if rehash != test.rehash {
+				t.Fatalf("rehash = %v, want %v", rehash, test.rehash)
+			}
+		})
+	}
+}
+
+func TestVerifyInvalidHash(t *testing.T) {
+	for _, encoded := range []string{
+		"",
+		"plain",
+		"$2a$10$abcdefghijklmnopqrstuv",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=64,t=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$!!!$a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$",
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=64,t=1,p=0$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5",
+	} {
+		match, _, err := Verify("secret", encoded, testParams)
+		if match || !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("Verify(%q) = %v, %v; want false, ErrInvalidHash", encoded, match, err)
+		}
+	}
+}
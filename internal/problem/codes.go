@@ -0,0 +1,109 @@
+package problem
+
+import "net/http"
+
+/* Коды ошибок. Коды - часть API: клиенты на них опираются, поэтому существующие коды не переименовываются,
+ * а для новых ситуаций заводятся новые. Пояснения можно уточнять через With. */
+var (
+	/* Общие */
+	Internal         = &Problem{http.StatusInternalServerError, "internal_error", "The server failed to process the request"}
+	MalformedJSON    = &Problem{http.StatusBadRequest, "malformed_json", "Request body is not valid JSON of the expected shape"}
+	MalformedRequest = &Problem{http.StatusBadRequest, "malformed_request", "Request parameters are missing or invalid"}
+	NotFound         = &Problem{http.StatusNotFound, "not_found", "Resource not found"}
+	MethodNotAllowed = &Problem{http.StatusMethodNotAllowed, "method_not_allowed", "Method is not allowed for this resource"}
+	RateLimited      = &Problem{http.StatusTooManyRequests, "rate_limited", "Too many requests, retry after the time in Retry-After"}
+	Unauthorized     = &Problem{http.StatusUnauthorized, "unauthorized", "Authentication is required"}
+	TenantNotFound   = &Problem{http.StatusNotFound, "tenant_not_found", "Tenant is unknown"}
+
+	/* Вход и пользователь */
+	InvalidCredentials = &Problem{http.StatusUnauthorized, "invalid_credentials", "Email or password is wrong"}
+	UserUnavailable    = &Problem{http.StatusUnauthorized, "user_unavailable", "User does not exist or is disabled"}
+	AccountLocked      = &Problem{http.StatusLocked, "account_locked", "Too many failed attempts, retry after the time in Retry-After"}
+	EmailNotVerified   = &Problem{http.StatusForbidden, "email_not_verified", "Email address has to be verified first"}
+	PasswordTooShort   = &Problem{http.StatusBadRequest, "password_too_short", "Password is too short"}
+	MFARequired        = &Problem{http.StatusUnauthorized, "mfa_required", "Second factor is required, exchange mfa_token with a code"}
+	MFATokenInvalid    = &Problem{http.StatusUnauthorized, "mfa_token_invalid", "MFA token is invalid or expired"}
+	InvalidCode        = &Problem{http.StatusUnauthorized, "invalid_code", "Code is wrong or already used"}
+
+	/* Токены */
+	AccessTokenMissing    = &Problem{http.StatusUnauthorized, "access_token_missing", "Bearer access token is required"}
+	AccessTokenInvalid    = &Problem{http.StatusUnauthorized, "access_token_invalid", "Access token is invalid"}
+	AccessTokenMalformed  = &Problem{http.StatusBadRequest, "access_token_malformed", "Access token cannot be decoded"}
+	AccessTokenExpired    = &Problem{http.StatusUnauthorized, "access_token_expired", "Access token is expired"}
+	RefreshTokenMalformed = &Problem{http.StatusBadRequest, "refresh_token_malformed", "Refresh token cannot be decoded"}
+	RefreshTokenExpired   = &Problem{http.StatusBadRequest, "refresh_token_expired", "Refresh token is expired"}
+	RefreshTokenInvalid   = &Problem{http.StatusUnauthorized, "refresh_token_invalid", "Refresh token is unknown, already used or revoked"}
+	TokenPairMismatch     = &Problem{http.StatusBadRequest, "token_pair_mismatch", "Access and refresh tokens do not belong together"}
+	IPMismatch            = &Problem{http.StatusUnauthorized, "ip_mismatch", "Tokens were issued to another IP address"}
+
+	/* Ссылки из писем */
+	LinkInvalid          = &Problem{http.StatusUnauthorized, "link_invalid", "Link is invalid, expired or already used"}
+	LinkOutdated         = &Problem{http.StatusGone, "link_outdated", "Account has changed since the link was sent"}
+	EmailAlreadyVerified = &Problem{http.StatusConflict, "email_already_verified", "Email address is already verified"}
+
+	/* TOTP */
+	TOTPAlreadyEnabled    = &Problem{http.StatusConflict, "totp_already_enabled", "Two-factor authentication is already enabled"}
+	TOTPEnrollmentMissing = &Problem{http.StatusConflict, "totp_enrollment_missing", "There is no pending TOTP enrollment"}
+	TOTPNotEnabled        = &Problem{http.StatusUnauthorized, "totp_not_enabled", "Two-factor authentication is not enabled"}
+
+	/* WebAuthn */
+	WebAuthnChallengeInvalid   = &Problem{http.StatusUnauthorized, "webauthn_challenge_invalid", "Challenge is unknown, expired or already used"}
+	WebAuthnRegistrationFailed = &Problem{http.StatusBadRequest, "webauthn_registration_failed", "Credential could not be registered"}
+	WebAuthnCredentialExists   = &Problem{http.StatusConflict, "webauthn_credential_exists", "Credential is already registered"}
+	WebAuthnCredentialUnknown  = &Problem{http.StatusUnauthorized, "webauthn_credential_unknown", "Credential is not registered"}
+	WebAuthnAssertionFailed    = &Problem{http.StatusUnauthorized, "webauthn_assertion_failed", "Credential assertion could not be verified"}
+
+	/* OAuth 2.0: код совпадает с полем error из RFC 6749 */
+	OAuthInvalidRequest          = &Problem{http.StatusBadRequest, "invalid_request", "OAuth request is missing a parameter or has an invalid one"}
+	OAuthInvalidClient           = &Problem{http.StatusUnauthorized, "invalid_client", "Client is unknown or client authentication failed"}
+	OAuthInvalidGrant            = &Problem{http.StatusBadRequest, "invalid_grant", "Authorization grant is invalid, expired or already used"}
+	OAuthUnsupportedGrantType    = &Problem{http.StatusBadRequest, "unsupported_grant_type", "Grant type is not supported"}
+	OAuthInvalidScope            = &Problem{http.StatusBadRequest, "invalid_scope", "Requested scope is not allowed for the client"}
+	OAuthUnauthorizedClient      = &Problem{http.StatusBadRequest, "unauthorized_client", "Client is not allowed to use this grant type"}
+	OAuthInvalidRedirectURI      = &Problem{http.StatusBadRequest, "invalid_redirect_uri", "Redirect URI is invalid"}
+	OAuthInvalidClientMetadata   = &Problem{http.StatusBadRequest, "invalid_client_metadata", "Client metadata is invalid"}
+	OAuthUnsupportedResponseType = &Problem{http.StatusBadRequest, "unsupported_response_type", "Only response_type=code is supported"}
+
+	/* Device authorization grant: код совпадает с полем error из RFC 8628, 3.5 */
+	OAuthAuthorizationPending = &Problem{http.StatusBadRequest, "authorization_pending", "User has not yet approved the device"}
+	OAuthSlowDown             = &Problem{http.StatusBadRequest, "slow_down", "Polling too fast, increase the interval by 5 seconds"}
+	OAuthAccessDenied         = &Problem{http.StatusBadRequest, "access_denied", "User denied the authorization request"}
+	OAuthExpiredToken         = &Problem{http.StatusBadRequest, "expired_token", "Device code has expired"}
+	UserCodeInvalid           = &Problem{http.StatusNotFound, "user_code_invalid", "User code is unknown, expired or already used"}
+
+	/* Админское API */
+	UserNotFound   = &Problem{http.StatusNotFound, "user_not_found", "User not found"}
+	EmailTaken     = &Problem{http.StatusConflict, "email_taken", "User with this email already exists"}
+	InvalidEmail   = &Problem{http.StatusBadRequest, "invalid_email", "Email address is invalid"}
+	InvalidLocale  = &Problem{http.StatusBadRequest, "invalid_locale", "Locale is not a valid language tag"}
+	ClientNotFound = &Problem{http.StatusNotFound, "client_not_found", "OAuth client not found"}
+	ClientIDTaken  = &Problem{http.StatusConflict, "client_id_taken", "OAuth client with this client_id already exists"}
+
+	/* Роли и права */
+	RoleNotFound       = &Problem{http.StatusNotFound, "role_not_found", "Role not found"}
+	RoleExists         = &Problem{http.StatusConflict, "role_exists", "Role with this name already exists"}
+	PermissionNotFound = &Problem{http.StatusNotFound, "permission_not_found", "Permission not found"}
+	PermissionExists   = &Problem{http.StatusConflict, "permission_exists", "Permission with this name already exists"}
+	UnknownPermission  = &Problem{http.StatusBadRequest, "unknown_permission", "Some of the permissions do not exist"}
+	UnknownRole        = &Problem{http.StatusBadRequest, "unknown_role", "Some of the roles do not exist"}
+
+	/* API ключи */
+	APIKeyNotFound      = &Problem{http.StatusNotFound, "api_key_not_found", "API key not found"}
+	APIKeyLimitExceeded = &Problem{http.StatusConflict, "api_key_limit_exceeded", "Too many API keys, revoke unused ones first"}
+
+	/* Вход администратора под пользователем */
+	ImpersonationForbidden = &Problem{http.StatusForbidden, "impersonation_forbidden", "Impersonated session cannot change credentials or grant access"}
+
+	/* Токен, выданный приложению через OAuth */
+	DelegatedTokenForbidden = &Problem{http.StatusForbidden, "delegated_token_forbidden", "Token issued to an application or for an API key cannot change credentials or grant access"}
+
+	/* Вход через внешнего провайдера OpenID Connect */
+	FederationProviderUnknown = &Problem{http.StatusNotFound, "federation_provider_unknown", "Identity provider is not configured"}
+	FederationStateInvalid    = &Problem{http.StatusUnauthorized, "federation_state_invalid", "State is unknown, expired or already used"}
+	FederationRejected        = &Problem{http.StatusUnauthorized, "federation_rejected", "Identity provider did not confirm the sign-in"}
+	FederationUnavailable     = &Problem{http.StatusBadGateway, "federation_unavailable", "Identity provider is unavailable"}
+	FederatedAccountNotLinked = &Problem{http.StatusForbidden, "federated_account_not_linked", "External account is not linked to a user"}
+
+	/* OpenID Connect: код совпадает с полем error из RFC 6750, 3.1 */
+	InsufficientScope = &Problem{http.StatusForbidden, "insufficient_scope", "Access token does not have the required scope"}
+)
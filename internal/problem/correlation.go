@@ -0,0 +1,37 @@
+package problem
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+/* Заголовок с идентификатором запроса. Если клиент или прокси его прислал, используем его значение,
+ * иначе генерируем своё. В ответе заголовок есть всегда. */
+const CorrelationHeader = "X-Correlation-ID"
+
+var correlationPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type correlationKey struct{}
+
+/* Middleware, который присваивает запросу correlation ID. По нему ответ с ошибкой
+ * сопоставляется со строками лога, в которых записаны подробности. */
+func Correlate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(CorrelationHeader)
+		if !correlationPattern.MatchString(id) {
+			random := make([]byte, 16)
+			_, _ = rand.Read(random)
+			id = hex.EncodeToString(random)
+		}
+		w.Header().Set(CorrelationHeader, id)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), correlationKey{}, id)))
+	})
+}
+
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
@@ -0,0 +1,60 @@
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+/* Префикс поля type: по нему и по code клиенты отличают ошибки друг от друга */
+const typePrefix = "urn:auth-service:problem:"
+
+/* Ошибка API в формате RFC 7807 (application/problem+json).
+ * Code - стабильный машиночитаемый код, Detail - пояснение для человека. Клиенту уходят только они,
+ * а подробности (ошибки SQL, содержимое токенов) пишутся в лог вместе с correlation_id. */
+type Problem struct {
+	Status int
+	Code   string
+	Detail string
+}
+
+func (problem *Problem) Error() string {
+	return problem.Code + ": " + problem.Detail
+}
+
+/* Та же ошибка с другим пояснением, код и статус не меняются */
+func (problem *Problem) With(detail string) *Problem {
+	return &Problem{problem.Status, problem.Code, detail}
+}
+
+func Write(w http.ResponseWriter, req *http.Request, problem *Problem) {
+	WriteWith(w, req, problem, nil)
+}
+
+/* Пишет ошибку с дополнительными полями (RFC 7807, 3.2), например mfa_token в ответе mfa_required.
+ * Стандартные поля дополнительными не перезаписываются. */
+func WriteWith(w http.ResponseWriter, req *http.Request, problem *Problem, extensions map[string]interface{}) {
+	members := make(map[string]interface{}, len(extensions)+7)
+	for key, value := range extensions {
+		members[key] = value
+	}
+	members["type"] = typePrefix + problem.Code
+	members["title"] = http.StatusText(problem.Status)
+	members["status"] = problem.Status
+	members["code"] = problem.Code
+	members["instance"] = req.URL.Path
+	if problem.Detail != "" {
+		members["detail"] = problem.Detail
+	}
+	if id := CorrelationID(req.Context()); id != "" {
+		members["correlation_id"] = id
+	}
+	result, err := json.Marshal(members)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	w.Write(result)
+}
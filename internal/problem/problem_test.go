@@ -0,0 +1,139 @@
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func decode(t *testing.T, recorder *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	if recorder.Header().Get("Content-Type") != "application/problem+json" ||
+		recorder.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("unexpected headers: %v", recorder.Header())
+	}
+	members := map[string]interface{}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &members); err != nil {
+		t.Fatal(err)
+	}
+	return members
+}
+
+func TestWrite(t *testing.T) {
+	handler := Correlate(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		Write(w, req, RefreshTokenExpired)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/users/tokens/refresh?debug=1", nil)
+	req.Header.Set(CorrelationHeader, "req-42")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d", recorder.Code)
+	}
+	expected := map[string]interface{}{
+		"type":           "urn:auth-service:problem:refresh_token_expired",
+		"title":          "Bad Request",
+		"status":         float64(http.StatusBadRequest),
+		"code":           "refresh_token_expired",
+		"detail":         "Refresh token is expired",
+		"instance":       "/users/tokens/refresh",
+		"correlation_id": "req-42",
+	}
+	members := decode(t, recorder)
+	if len(members) != len(expected) {
+		t.Fatalf("members = %v", members)
+	}
+	for key, value := range expected {
+		if members[key] != value {
+			t.Errorf("%s = %v, want %v", key, members[key], value)
+		}
+	}
+}
+
+/* Без Correlate и без пояснения лишних полей в ответе нет */
+func TestWriteMinimal(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	Write(recorder, httptest.NewRequest(http.MethodGet, "/", nil), NotFound.With(""))
+	members := decode(t, recorder)
+	if _, ok := members["detail"]; ok {
+		t.Fatal("empty detail must be omitted")
+	}
+	if _, ok := members["correlation_id"]; ok {
+		t.Fatal("correlation_id without Correlate must be omitted")
+	}
+}
+
+func TestWriteWith(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	WriteWith(recorder, httptest.NewRequest(http.MethodPost, "/user/login", nil), MFARequired, map[string]interface{}{
+		"mfa_token": "token",
+		/* Стандартные поля не перезаписываются */
+		"code":   "ok",
+		"status": 200,
+	})
+	members := decode(t, recorder)
+	if recorder.Code != http.StatusUnauthorized || members["mfa_token"] != "token" ||
+		members["code"] != "mfa_required" || members["status"] != float64(http.StatusUnauthorized) {
+		t.Fatalf("%d %v", recorder.Code, members)
+	}
+}
+
+func TestWith(t *testing.T) {
+	changed := OAuthInvalidRequest.With("redirect_uri is required")
+	if changed.Status != OAuthInvalidRequest.Status || changed.Code != OAuthInvalidRequest.Code ||
+		changed.Detail != "redirect_uri is required" {
+		t.Fatalf("With = %+v", changed)
+	}
+	if OAuthInvalidRequest.Detail == changed.Detail {
+		t.Fatal("With must not change the shared problem")
+	}
+	if changed.Error() != "invalid_request: redirect_uri is required" {
+		t.Fatalf("Error() = %s", changed.Error())
+	}
+}
+
+func TestCorrelate(t *testing.T) {
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+	tests := []struct {
+		name     string
+		incoming string
+		kept     bool
+	}{
+		{"valid", "3f2a9c.trace-1_x", true},
+		{"longest", strings.Repeat("a", 64), true},
+		{"missing", "", false},
+		{"too long", strings.Repeat("a", 65), false},
+		/* Значение попадает в лог и в ответ, поэтому посторонние символы не принимаются */
+		{"forbidden characters", "id\"; drop", false},
+		{"newline", "id\nX-Injected: 1", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var fromContext string
+			handler := Correlate(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				fromContext = CorrelationID(req.Context())
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.incoming != "" {
+				req.Header.Set(CorrelationHeader, test.incoming)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+
+			id := recorder.Header().Get(CorrelationHeader)
+			if id != fromContext {
+				t.Fatalf("response id %q differs from context id %q", id, fromContext)
+			}
+			if test.kept && id != test.incoming {
+				t.Fatalf("id = %q, want %q", id, test.incoming)
+			}
+			if !test.kept && !generated.MatchString(id) {
+				t.Fatalf("id = %q, want a generated one", id)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+const memoryCleanupInterval = time.Minute
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+/* Корзины в памяти процесса. Подходит, когда реплика одна. */
+type MemoryStore struct {
+	mu          sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+	/* Часы подменяются в тестах */
+	now func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:     make(map[string]*bucket),
+		lastCleanup: time.Now(),
+		now:         time.Now,
+	}
+}
+
+func (s *MemoryStore) Take(key string, rate float64, burst int) (bool, time.Duration, error) {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanup(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), updated: now}
+		s.buckets[key] = b
+	}
+	tokens, allowed, retryAfter := Take(b.tokens, now.Sub(b.updated), rate, burst)
+	b.tokens = tokens
+	b.updated = now
+	/* Запоминаем, когда корзина снова наполнится - после этого её можно просто удалить */
+	b.full = now.Add(time.Duration((float64(burst) - tokens) / rate * float64(time.Second)))
+	return allowed, retryAfter, nil
+}
+
+func (s *MemoryStore) cleanup(now time.Time) {
+	if now.Sub(s.lastCleanup) < memoryCleanupInterval {
+		return
+	}
+	for key, b := range s.buckets {
+		if now.After(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastCleanup = now
+}
@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"go.uber.org/zap"
+)
+
+/* Ограничение частоты запросов по алгоритму token bucket: в корзине помещается Burst токенов,
+ * они восстанавливаются со скоростью Rate в секунду, каждый запрос забирает один токен.
+ * Правило с Rate = 0 отключено. */
+type Rule struct {
+	Rate  float64
+	Burst int
+}
+
+func (rule Rule) enabled() bool {
+	return rule.Rate > 0 && rule.Burst > 0
+}
+
+/* Хранилище корзин. В памяти для одной реплики, в общей базе - для нескольких. */
+type Store interface {
+	Take(key string, rate float64, burst int) (allowed bool, retryAfter time.Duration, err error)
+}
+
+type Limiter struct {
+	logger *zap.Logger
+	store  Store
+	ip     Rule
+	user   Rule
+	global Rule
+}
+
+func NewLimiter(logger *zap.Logger, store Store, ip Rule, user Rule, global Rule) *Limiter {
+	return &Limiter{
+		logger,
+		store,
+		ip,
+		user,
+		global,
+	}
+}
+
+/* Общий лимит на сервис и лимит по IP. Подключается к эндпоинтам выдачи токенов. */
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if allowed, retryAfter := l.take("global", l.global); !allowed {
+			TooManyRequests(w, req, retryAfter)
+			l.logger.Warn("Global rate limit exceeded", zap.String("ip", req.RemoteAddr))
+			return
+		}
+		if allowed, retryAfter := l.take(ipKey(req.RemoteAddr), l.ip); !allowed {
+			TooManyRequests(w, req, retryAfter)
+			l.logger.Warn("IP rate limit exceeded", zap.String("ip", req.RemoteAddr))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+/* Ключ корзины по IP клиента. Порт отбрасывается, иначе каждое новое соединение получало бы свою корзину.
+ * IPv6 клиенту провайдер выдаёт целую /64 и адреса в ней можно менять свободно, поэтому IPv6 считается по сети /64. */
+func ipKey(remoteAddr string) string {
+	host := remoteAddr
+	if withoutPort, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = withoutPort
+	}
+	ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	if err != nil {
+		return "ip:" + remoteAddr
+	}
+	ip = ip.Unmap().WithZone("")
+	if ip.Is4() {
+		return "ip:" + ip.String()
+	}
+	return "ip:" + netip.PrefixFrom(ip, 64).Masked().String()
+}
+
+/* Лимит по GUID пользователя. Проверяется в обработчиках, как только GUID становится известен. */
+func (l *Limiter) AllowUser(userGUID string) (bool, time.Duration) {
+	return l.take("user:"+userGUID, l.user)
+}
+
+/* При ошибке хранилища пропускаем запрос: недоступность лимитера не должна ронять вход */
+func (l *Limiter) take(key string, rule Rule) (bool, time.Duration) {
+	if !rule.enabled() {
+		return true, 0
+	}
+	allowed, retryAfter, err := l.store.Take(key, rule.Rate, rule.Burst)
+	if err != nil {
+		l.logger.Error("Rate limit store failure", zap.Error(err), zap.String("key", key))
+		return true, 0
+	}
+	return allowed, retryAfter
+}
+
+func TooManyRequests(w http.ResponseWriter, req *http.Request, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	problem.Write(w, req, problem.RateLimited)
+}
+
+/* Пополняет корзину за прошедшее время и пытается забрать из неё токен.
+ * Общая логика для всех хранилищ, чтобы они считали одинаково. */
+func Take(tokens float64, elapsed time.Duration, rate float64, burst int) (remaining float64, allowed bool, retryAfter time.Duration) {
+	tokens = math.Min(float64(burst), tokens+elapsed.Seconds()*rate)
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	return tokens, false, time.Duration((1 - tokens) / rate * float64(time.Second))
+}
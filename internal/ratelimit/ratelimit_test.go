@@ -0,0 +1,211 @@
+package ratelimit
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestTake(t *testing.T) {
+	tests := []struct {
+		name       string
+		tokens     float64
+		elapsed    time.Duration
+		rate       float64
+		burst      int
+		remaining  float64
+		allowed    bool
+		retryAfter time.Duration
+	}{
+		{"full bucket", 5, 0, 1, 5, 4, true, 0},
+		{"last token", 1, 0, 1, 5, 0, true, 0},
+		{"empty bucket", 0, 0, 1, 5, 0, false, time.Second},
+		{"refill one token", 0, time.Second, 1, 5, 0, true, 0},
+		{"refill is capped by burst", 0, time.Hour, 1, 5, 4, true, 0},
+		{"partial refill", 0, 500 * time.Millisecond, 1, 5, 0.5, false, 500 * time.Millisecond},
+		{"slow rate", 0, 0, 0.1, 5, 0, false, 10 * time.Second},
+		{"slow rate partial", 0.25, 0, 0.5, 5, 0.25, false, 1500 * time.Millisecond},
+		{"fast rate", 0, 100 * time.Millisecond, 20, 3, 1, true, 0},
+		{"burst of one", 1, 0, 1, 1, 0, true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remaining, allowed, retryAfter := Take(test.tokens, test.elapsed, test.rate, test.burst)
+			if allowed != test.allowed || retryAfter != test.retryAfter || !almostEqual(remaining, test.remaining) {
+				t.Fatalf("Take = %v, %v, %v; want %v, %v, %v",
+					remaining, allowed, retryAfter, test.remaining, test.allowed, test.retryAfter)
+			}
+		})
+	}
+}
+
+func TestTooManyRequestsRetryAfter(t *testing.T) {
+	tests := []struct {
+		retryAfter time.Duration
+		header     string
+	}{
+		{0, "0"},
+		{time.Millisecond, "1"},
+		{300 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1001 * time.Millisecond, "2"},
+		{1500 * time.Millisecond, "2"},
+		{10 * time.Second, "10"},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		TooManyRequests(recorder, httptest.NewRequest(http.MethodPost, "/", nil), test.retryAfter)
+		if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != test.header {
+			t.Errorf("retryAfter %v: %d, Retry-After %q; want 429, %q",
+				test.retryAfter, recorder.Code, recorder.Header().Get("Retry-After"), test.header)
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	store := NewMemoryStore()
+	store.now = func() time.Time { return now }
+	store.lastCleanup = now
+
+	/* Полная корзина отдаёт burst запросов подряд */
+	for i := 0; i < 3; i++ {
+		if allowed, _, _ := store.Take("ip:a", 1, 3); !allowed {
+			t.Fatalf("request %d within burst was rejected", i+1)
+		}
+	}
+	allowed, retryAfter, err := store.Take("ip:a", 1, 3)
+	if allowed || retryAfter != time.Second || err != nil {
+		t.Fatalf("request over burst = %v, %v, %v; want false, 1s, nil", allowed, retryAfter, err)
+	}
+	/* У другого ключа своя корзина */
+	if allowed, _, _ := store.Take("ip:b", 1, 3); !allowed {
+		t.Fatal("other key must not share the bucket")
+	}
+
+	now = now.Add(400 * time.Millisecond)
+	if allowed, retryAfter, _ := store.Take("ip:a", 1, 3); allowed || retryAfter != 600*time.Millisecond {
+		t.Fatalf("partially refilled = %v, %v; want false, 600ms", allowed, retryAfter)
+	}
+	now = now.Add(600 * time.Millisecond)
+	if allowed, _, _ := store.Take("ip:a", 1, 3); !allowed {
+		t.Fatal("token must be refilled after a second")
+	}
+
+	/* Наполнившиеся корзины удаляются при очистке */
+	now = now.Add(memoryCleanupInterval + time.Second)
+	store.Take("ip:c", 1, 3)
+	if _, ok := store.buckets["ip:a"]; ok {
+		t.Fatal("full bucket must be removed by cleanup")
+	}
+	if _, ok := store.buckets["ip:c"]; !ok {
+		t.Fatal("bucket in use must stay")
+	}
+}
+
+/* Хранилище, которое записывает ключи и отказывает по списку */
+type recordingStore struct {
+	keys   []string
+	reject map[string]bool
+	err    error
+}
+
+func (s *recordingStore) Take(key string, rate float64, burst int) (bool, time.Duration, error) {
+	s.keys = append(s.keys, key)
+	if s.reject[key] {
+		return false, 2 * time.Second, s.err
+	}
+	return true, 0, s.err
+}
+
+func TestLimiterKeys(t *testing.T) {
+	rule := Rule{Rate: 1, Burst: 1}
+	tests := []struct {
+		name   string
+		ip     Rule
+		global Rule
+		reject map[string]bool
+		err    error
+		keys   []string
+		status int
+	}{
+		{"both pass", rule, rule, nil, nil, []string{"global", "ip:192.0.2.1"}, http.StatusOK},
+		/* Общий лимит проверяется первым, и корзина IP при отказе не тратится */
+		{"global rejects", rule, rule, map[string]bool{"global": true}, nil, []string{"global"}, http.StatusTooManyRequests},
+		{"ip rejects", rule, rule, map[string]bool{"ip:192.0.2.1": true}, nil,
+			[]string{"global", "ip:192.0.2.1"}, http.StatusTooManyRequests},
+		{"global disabled", rule, Rule{}, nil, nil, []string{"ip:192.0.2.1"}, http.StatusOK},
+		{"ip disabled", Rule{Rate: 0, Burst: 5}, rule, nil, nil, []string{"global"}, http.StatusOK},
+		{"store failure lets requests through", rule, rule, map[string]bool{"global": true}, errors.New("down"),
+			[]string{"global", "ip:192.0.2.1"}, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := &recordingStore{reject: test.reject, err: test.err}
+			limiter := NewLimiter(zap.NewNop(), store, test.ip, rule, test.global)
+			handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+			req := httptest.NewRequest(http.MethodPost, "/users/tokens/create", nil)
+			req.RemoteAddr = "192.0.2.1"
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			if recorder.Code != test.status || !slices.Equal(store.keys, test.keys) {
+				t.Fatalf("status %d, keys %v; want %d, %v", recorder.Code, store.keys, test.status, test.keys)
+			}
+			if test.status == http.StatusTooManyRequests && recorder.Header().Get("Retry-After") != "2" {
+				t.Fatalf("Retry-After = %q, want 2", recorder.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestIPKey(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		key        string
+	}{
+		{"192.0.2.1", "ip:192.0.2.1"},
+		/* Порт не даёт новой корзины */
+		{"192.0.2.1:51000", "ip:192.0.2.1"},
+		{"[::ffff:192.0.2.1]:443", "ip:192.0.2.1"},
+		/* Адреса одной /64 делят корзину */
+		{"2001:db8:1:2::7", "ip:2001:db8:1:2::/64"},
+		{"[2001:db8:1:2:aaaa::9]:443", "ip:2001:db8:1:2::/64"},
+		{"2001:db8:1:3::7", "ip:2001:db8:1:3::/64"},
+	}
+	for _, test := range tests {
+		if key := ipKey(test.remoteAddr); key != test.key {
+			t.Errorf("ipKey(%s) = %s, want %s", test.remoteAddr, key, test.key)
+		}
+	}
+}
+
+func TestLimiterAllowUser(t *testing.T) {
+	store := &recordingStore{reject: map[string]bool{"user:blocked": true}}
+	limiter := NewLimiter(zap.NewNop(), store, Rule{}, Rule{Rate: 1, Burst: 1}, Rule{})
+	if allowed, _ := limiter.AllowUser("ok"); !allowed {
+		t.Fatal("user within the limit was rejected")
+	}
+	if allowed, retryAfter := limiter.AllowUser("blocked"); allowed || retryAfter != 2*time.Second {
+		t.Fatalf("AllowUser = %v, %v; want false, 2s", allowed, retryAfter)
+	}
+	if !slices.Equal(store.keys, []string{"user:ok", "user:blocked"}) {
+		t.Fatalf("keys = %v", store.keys)
+	}
+
+	/* Лимит на пользователя не задан: хранилище не трогаем */
+	store = &recordingStore{}
+	limiter = NewLimiter(zap.NewNop(), store, Rule{Rate: 1, Burst: 1}, Rule{}, Rule{Rate: 1, Burst: 1})
+	if allowed, _ := limiter.AllowUser("ok"); !allowed || len(store.keys) != 0 {
+		t.Fatalf("disabled user rule: allowed %v, keys %v", allowed, store.keys)
+	}
+}
+
+func almostEqual(a float64, b float64) bool {
+	const epsilon = 1e-9
+	return a-b < epsilon && b-a < epsilon
+}
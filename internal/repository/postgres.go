@@ -2,8 +2,13 @@ package repository
 
 import (
 	"database/sql"
+	"errors"
 	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/ratelimit"
+	"github.com/lib/pq"
 	"go.uber.org/zap"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,14 +24,15 @@ func NewTokenRepository(logger *zap.Logger, db *sql.DB) TokenRepository {
 	}
 }
 
-func (r *tokenRepo) Create(hash string, userGUID string) error {
-	_, err := r.db.Exec(`INSERT INTO tokens (hash, user_guid) VALUES ($1, $2)`, hash, userGUID)
+func (r *tokenRepo) Create(tenantID string, hash string, userGUID string) error {
+	_, err := r.db.Exec(`INSERT INTO tokens (tenant_id, hash, user_guid) VALUES ($1, $2, $3)`, tenantID, hash, userGUID)
 	return err
 }
 
-func (r *tokenRepo) GetByGUID(userGUID string) ([]model.Token, error) {
+func (r *tokenRepo) GetByGUID(tenantID string, userGUID string) ([]model.Token, error) {
 	result := make([]model.Token, 0, 10)
-	rows, err := r.db.Query(`SELECT * FROM tokens WHERE user_guid::text = $1;`, userGUID)
+	rows, err := r.db.Query(`SELECT user_guid, hash, created_at FROM tokens WHERE tenant_id = $1 AND user_guid::text = $2;`,
+		tenantID, userGUID)
 	if err != nil {
 		return nil, err
 	}
@@ -41,13 +47,18 @@ func (r *tokenRepo) GetByGUID(userGUID string) ([]model.Token, error) {
 	return result, nil
 }
 
-func (r *tokenRepo) DeleteByHash(hash string) error {
-	_, err := r.db.Query(`DELETE FROM tokens WHERE hash = $1;`, hash)
+func (r *tokenRepo) DeleteByHash(tenantID string, hash string) error {
+	_, err := r.db.Exec(`DELETE FROM tokens WHERE tenant_id = $1 AND hash = $2;`, tenantID, hash)
 	return err
 }
 
-func (r *tokenRepo) DeleteExpired(minCreatedAt time.Time) error {
-	_, err := r.db.Query(`DELETE FROM tokens WHERE created_at < $1;`, minCreatedAt)
+func (r *tokenRepo) DeleteByUserGUID(tenantID string, userGUID string) error {
+	_, err := r.db.Exec(`DELETE FROM tokens WHERE tenant_id = $1 AND user_guid::text = $2;`, tenantID, userGUID)
+	return err
+}
+
+func (r *tokenRepo) DeleteExpired(tenantID string, minCreatedAt time.Time) error {
+	_, err := r.db.Exec(`DELETE FROM tokens WHERE tenant_id = $1 AND created_at < $2;`, tenantID, minCreatedAt)
 	return err
 }
 
@@ -63,8 +74,1133 @@ func NewUserRepository(logger *zap.Logger, db *sql.DB) UserRepository {
 	}
 }
 
-func (r *userRepo) GetByGUID(guid string) (*model.User, error) {
+const userColumns = `guid, first_name, last_name, email, email_verified, disabled, locale`
+
+func scanUser(row interface{ Scan(...interface{}) error }, user *model.User) error {
+	return row.Scan(&user.GUID, &user.FirstName, &user.LastName, &user.Email, &user.EmailVerified, &user.Disabled, &user.Locale)
+}
+
+func (r *userRepo) GetByGUID(tenantID string, guid string) (*model.User, error) {
+	user := &model.User{}
+	query := `SELECT ` + userColumns + ` FROM users WHERE tenant_id = $1 AND guid::text = $2`
+	return user, scanUser(r.db.QueryRow(query, tenantID, guid), user)
+}
+
+func (r *userRepo) GetByEmail(tenantID string, email string) (*model.User, error) {
 	user := &model.User{}
-	query := `SELECT * FROM users WHERE guid::text = $1`
-	return user, r.db.QueryRow(query, guid).Scan(&user.GUID, &user.FirstName, &user.LastName, &user.Email)
+	query := `SELECT ` + userColumns + ` FROM users WHERE tenant_id = $1 AND lower(email) = lower($2)`
+	return user, scanUser(r.db.QueryRow(query, tenantID, email), user)
+}
+
+func (r *userRepo) List(tenantID string, filter UserFilter) ([]model.User, int, error) {
+	/* Собираем условия выборки, номера плейсхолдеров считаем по количеству аргументов */
+	conditions := []string{`tenant_id = $1`}
+	args := []interface{}{tenantID}
+	if filter.Email != "" {
+		args = append(args, likePattern(filter.Email))
+		conditions = append(conditions, `email ILIKE $`+strconv.Itoa(len(args)))
+	}
+	if filter.Name != "" {
+		args = append(args, likePattern(filter.Name))
+		conditions = append(conditions, `(first_name || ' ' || last_name) ILIKE $`+strconv.Itoa(len(args)))
+	}
+	where := ` WHERE ` + strings.Join(conditions, ` AND `)
+
+	total := 0
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM users`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+	query := `SELECT ` + userColumns + ` FROM users` + where +
+		` ORDER BY last_name, first_name, guid LIMIT $` + strconv.Itoa(len(args)-1) + ` OFFSET $` + strconv.Itoa(len(args))
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	result := make([]model.User, 0, filter.Limit)
+	for rows.Next() {
+		temp := model.User{}
+		if err := scanUser(rows, &temp); err != nil {
+			return nil, 0, err
+		}
+		result = append(result, temp)
+	}
+	return result, total, rows.Err()
+}
+
+func (r *userRepo) Create(tenantID string, user *model.User) error {
+	query := `INSERT INTO users (tenant_id, first_name, last_name, email, email_verified, disabled, locale)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING guid`
+	err := r.db.QueryRow(query, tenantID, user.FirstName, user.LastName, user.Email, user.EmailVerified, user.Disabled,
+		user.Locale).Scan(&user.GUID)
+	return translateError(err)
+}
+
+func (r *userRepo) Update(tenantID string, user *model.User) error {
+	query := `UPDATE users SET first_name = $3, last_name = $4, email = $5, email_verified = $6, locale = $7
+		WHERE tenant_id = $1 AND guid::text = $2`
+	result, err := r.db.Exec(query, tenantID, user.GUID, user.FirstName, user.LastName, user.Email, user.EmailVerified, user.Locale)
+	return affectedOne(result, translateError(err))
+}
+
+func (r *userRepo) SetEmailVerified(tenantID string, guid string, email string) error {
+	result, err := r.db.Exec(`UPDATE users SET email_verified = true
+		WHERE tenant_id = $1 AND guid::text = $2 AND lower(email) = lower($3)`, tenantID, guid, email)
+	return affectedOne(result, err)
+}
+
+func (r *userRepo) SetDisabled(tenantID string, guid string, disabled bool) error {
+	result, err := r.db.Exec(`UPDATE users SET disabled = $3 WHERE tenant_id = $1 AND guid::text = $2`, tenantID, guid, disabled)
+	return affectedOne(result, err)
+}
+
+/* Таблицы, где хранятся данные пользователя. Журнал входов под пользователем (impersonations) не трогаем:
+ * это аудит, он нужен и после удаления. */
+var userDataTables = []string{`tokens`, `credentials`, `link_tokens`, `recovery_codes`, `totp`, `webauthn_credentials`,
+	`webauthn_sessions`, `lockouts`, `oauth_codes`, `user_roles`, `device_authorizations`, `api_keys`, `federated_identities`}
+
+func (r *userRepo) Delete(tenantID string, guid string) error {
+	/* Пользователь и всё, что к нему относится, удаляются вместе, чтобы ошибка посередине не оставила
+	 * пароль или ключи без пользователя */
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`DELETE FROM users WHERE tenant_id = $1 AND guid::text = $2`, tenantID, guid)
+	if err = affectedOne(result, err); err != nil {
+		return err
+	}
+	for _, table := range userDataTables {
+		if _, err = tx.Exec(`DELETE FROM `+table+` WHERE tenant_id = $1 AND user_guid::text = $2`, tenantID, guid); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type credentialRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewCredentialRepository(logger *zap.Logger, db *sql.DB) CredentialRepository {
+	return &credentialRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *credentialRepo) GetByUserGUID(tenantID string, userGUID string) (*model.Credential, error) {
+	credential := &model.Credential{}
+	query := `SELECT user_guid, hash, updated_at FROM credentials WHERE tenant_id = $1 AND user_guid::text = $2`
+	return credential, r.db.QueryRow(query, tenantID, userGUID).Scan(&credential.UserGUID, &credential.Hash, &credential.UpdatedAt)
+}
+
+func (r *credentialRepo) Set(tenantID string, userGUID string, hash string) error {
+	_, err := r.db.Exec(`INSERT INTO credentials (tenant_id, user_guid, hash) VALUES ($1, $2, $3)
+		ON CONFLICT (user_guid) DO UPDATE SET hash = EXCLUDED.hash, updated_at = current_timestamp`, tenantID, userGUID, hash)
+	return err
+}
+
+type linkTokenRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewLinkTokenRepository(logger *zap.Logger, db *sql.DB) LinkTokenRepository {
+	return &linkTokenRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *linkTokenRepo) Create(tenantID string, linkToken *model.LinkToken) error {
+	query := `INSERT INTO link_tokens (tenant_id, hash, purpose, user_guid, email, expires_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := r.db.Exec(query, tenantID, linkToken.Hash, linkToken.Purpose, linkToken.UserGUID, linkToken.Email,
+		linkToken.ExpiresAt)
+	return err
+}
+
+func (r *linkTokenRepo) Consume(tenantID string, hash string, purpose string) (*model.LinkToken, error) {
+	/* Проверка и пометка в одном UPDATE, чтобы ссылку нельзя было использовать дважды параллельными запросами */
+	linkToken := &model.LinkToken{}
+	query := `UPDATE link_tokens SET used_at = current_timestamp
+		WHERE tenant_id = $1 AND hash = $2 AND purpose = $3 AND used_at IS NULL AND expires_at > current_timestamp
+		RETURNING hash, purpose, user_guid, email, created_at, expires_at, used_at`
+	return linkToken, r.db.QueryRow(query, tenantID, hash, purpose).Scan(&linkToken.Hash, &linkToken.Purpose,
+		&linkToken.UserGUID, &linkToken.Email, &linkToken.CreatedAt, &linkToken.ExpiresAt, &linkToken.UsedAt)
+}
+
+func (r *linkTokenRepo) CountSince(tenantID string, purpose string, email string, since time.Time) (int, error) {
+	count := 0
+	query := `SELECT COUNT(*) FROM link_tokens
+		WHERE tenant_id = $1 AND purpose = $2 AND lower(email) = lower($3) AND created_at >= $4`
+	return count, r.db.QueryRow(query, tenantID, purpose, email, since).Scan(&count)
+}
+
+func (r *linkTokenRepo) DeleteCreatedBefore(before time.Time) error {
+	_, err := r.db.Exec(`DELETE FROM link_tokens WHERE created_at < $1`, before)
+	return err
+}
+
+type totpRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewTOTPRepository(logger *zap.Logger, db *sql.DB) TOTPRepository {
+	return &totpRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *totpRepo) GetByUserGUID(tenantID string, userGUID string) (*model.TOTP, error) {
+	totp := &model.TOTP{}
+	query := `SELECT user_guid, secret, confirmed, last_step, created_at FROM totp WHERE tenant_id = $1 AND user_guid::text = $2`
+	return totp, r.db.QueryRow(query, tenantID, userGUID).Scan(&totp.UserGUID, &totp.Secret, &totp.Confirmed, &totp.LastStep,
+		&totp.CreatedAt)
+}
+
+func (r *totpRepo) Save(tenantID string, totp *model.TOTP) error {
+	_, err := r.db.Exec(`INSERT INTO totp (tenant_id, user_guid, secret) VALUES ($1, $2, $3)
+		ON CONFLICT (user_guid) DO UPDATE SET secret = EXCLUDED.secret, confirmed = false, last_step = 0,
+		created_at = current_timestamp`, tenantID, totp.UserGUID, totp.Secret)
+	return err
+}
+
+func (r *totpRepo) Confirm(tenantID string, userGUID string, step int64) error {
+	result, err := r.db.Exec(`UPDATE totp SET confirmed = true, last_step = $3
+		WHERE tenant_id = $1 AND user_guid::text = $2 AND NOT confirmed`, tenantID, userGUID, step)
+	return affectedOne(result, err)
+}
+
+func (r *totpRepo) UseStep(tenantID string, userGUID string, step int64) error {
+	result, err := r.db.Exec(`UPDATE totp SET last_step = $3
+		WHERE tenant_id = $1 AND user_guid::text = $2 AND last_step < $3`, tenantID, userGUID, step)
+	return affectedOne(result, err)
+}
+
+func (r *totpRepo) Delete(tenantID string, userGUID string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`DELETE FROM recovery_codes WHERE tenant_id = $1 AND user_guid::text = $2`, tenantID, userGUID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM totp WHERE tenant_id = $1 AND user_guid::text = $2`, tenantID, userGUID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *totpRepo) ReplaceRecoveryCodes(tenantID string, userGUID string, hashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`DELETE FROM recovery_codes WHERE tenant_id = $1 AND user_guid::text = $2`, tenantID, userGUID); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		_, err = tx.Exec(`INSERT INTO recovery_codes (tenant_id, user_guid, hash) VALUES ($1, $2, $3)`, tenantID, userGUID, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *totpRepo) UseRecoveryCode(tenantID string, userGUID string, hash string) error {
+	result, err := r.db.Exec(`UPDATE recovery_codes SET used_at = current_timestamp
+		WHERE tenant_id = $1 AND user_guid::text = $2 AND hash = $3 AND used_at IS NULL`, tenantID, userGUID, hash)
+	return affectedOne(result, err)
+}
+
+type webauthnRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewWebAuthnRepository(logger *zap.Logger, db *sql.DB) WebAuthnRepository {
+	return &webauthnRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+const webauthnCredentialColumns = `id, user_guid, name, public_key, sign_count, created_at, last_used_at`
+
+func scanWebAuthnCredential(row interface{ Scan(...interface{}) error }, credential *model.WebAuthnCredential) error {
+	return row.Scan(&credential.ID, &credential.UserGUID, &credential.Name, &credential.PublicKey,
+		&credential.SignCount, &credential.CreatedAt, &credential.LastUsedAt)
+}
+
+func (r *webauthnRepo) CreateCredential(tenantID string, credential *model.WebAuthnCredential) error {
+	query := `INSERT INTO webauthn_credentials (tenant_id, id, user_guid, name, public_key, sign_count)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := r.db.Exec(query, tenantID, credential.ID, credential.UserGUID, credential.Name, credential.PublicKey,
+		credential.SignCount)
+	return translateError(err)
+}
+
+func (r *webauthnRepo) GetCredential(tenantID string, id []byte) (*model.WebAuthnCredential, error) {
+	credential := &model.WebAuthnCredential{}
+	query := `SELECT ` + webauthnCredentialColumns + ` FROM webauthn_credentials WHERE tenant_id = $1 AND id = $2`
+	return credential, scanWebAuthnCredential(r.db.QueryRow(query, tenantID, id), credential)
+}
+
+func (r *webauthnRepo) ListCredentials(tenantID string, userGUID string) ([]model.WebAuthnCredential, error) {
+	query := `SELECT ` + webauthnCredentialColumns + ` FROM webauthn_credentials
+		WHERE tenant_id = $1 AND user_guid::text = $2 ORDER BY created_at`
+	rows, err := r.db.Query(query, tenantID, userGUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]model.WebAuthnCredential, 0, 4)
+	for rows.Next() {
+		temp := model.WebAuthnCredential{}
+		if err := scanWebAuthnCredential(rows, &temp); err != nil {
+			return nil, err
+		}
+		result = append(result, temp)
+	}
+	return result, rows.Err()
+}
+
+func (r *webauthnRepo) UpdateSignCount(tenantID string, id []byte, signCount uint32) error {
+	result, err := r.db.Exec(`UPDATE webauthn_credentials SET sign_count = $3, last_used_at = current_timestamp
+		WHERE tenant_id = $1 AND id = $2`, tenantID, id, signCount)
+	return affectedOne(result, err)
+}
+
+func (r *webauthnRepo) DeleteCredential(tenantID string, userGUID string, id []byte) error {
+	result, err := r.db.Exec(`DELETE FROM webauthn_credentials WHERE tenant_id = $1 AND user_guid::text = $2 AND id = $3`,
+		tenantID, userGUID, id)
+	return affectedOne(result, err)
+}
+
+func (r *webauthnRepo) CreateSession(tenantID string, session *model.WebAuthnSession) error {
+	userGUID := sql.NullString{String: session.UserGUID, Valid: session.UserGUID != ""}
+	query := `INSERT INTO webauthn_sessions (tenant_id, challenge_hash, purpose, user_guid, expires_at) VALUES ($1, $2, $3, $4, $5)`
+	_, err := r.db.Exec(query, tenantID, session.ChallengeHash, session.Purpose, userGUID, session.ExpiresAt)
+	return err
+}
+
+func (r *webauthnRepo) ConsumeSession(tenantID string, challengeHash string, purpose string) (*model.WebAuthnSession, error) {
+	/* DELETE ... RETURNING делает challenge одноразовым даже при параллельных запросах */
+	session := &model.WebAuthnSession{}
+	userGUID := sql.NullString{}
+	query := `DELETE FROM webauthn_sessions
+		WHERE tenant_id = $1 AND challenge_hash = $2 AND purpose = $3 AND expires_at > current_timestamp
+		RETURNING challenge_hash, purpose, user_guid, expires_at`
+	err := r.db.QueryRow(query, tenantID, challengeHash, purpose).Scan(&session.ChallengeHash, &session.Purpose, &userGUID,
+		&session.ExpiresAt)
+	session.UserGUID = userGUID.String
+	return session, err
+}
+
+func (r *webauthnRepo) DeleteExpiredSessions(before time.Time) error {
+	_, err := r.db.Exec(`DELETE FROM webauthn_sessions WHERE expires_at < $1`, before)
+	return err
+}
+
+type rateLimitRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewRateLimitRepository(logger *zap.Logger, db *sql.DB) RateLimitRepository {
+	return &rateLimitRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+/* Строка корзины блокируется на время транзакции, поэтому реплики не могут одновременно
+ * забрать один и тот же токен. Время берём из базы, чтобы не зависеть от часов реплик. */
+func (r *rateLimitRepo) Take(key string, rate float64, burst int) (bool, time.Duration, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO rate_limits (key, tokens, updated_at) VALUES ($1, $2, now())
+		ON CONFLICT (key) DO NOTHING`, key, burst)
+	if err != nil {
+		return false, 0, err
+	}
+	var tokens, elapsed float64
+	err = tx.QueryRow(`SELECT tokens, EXTRACT(EPOCH FROM now() - updated_at) FROM rate_limits
+		WHERE key = $1 FOR UPDATE`, key).Scan(&tokens, &elapsed)
+	if err != nil {
+		return false, 0, err
+	}
+	tokens, allowed, retryAfter := ratelimit.Take(tokens, time.Duration(elapsed*float64(time.Second)), rate, burst)
+	_, err = tx.Exec(`UPDATE rate_limits SET tokens = $2, updated_at = now() WHERE key = $1`, key, tokens)
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, retryAfter, tx.Commit()
+}
+
+func (r *rateLimitRepo) DeleteUpdatedBefore(before time.Time) error {
+	_, err := r.db.Exec(`DELETE FROM rate_limits WHERE updated_at < $1`, before)
+	return err
+}
+
+type lockoutRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewLockoutRepository(logger *zap.Logger, db *sql.DB) LockoutRepository {
+	return &lockoutRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+const lockoutColumns = `user_guid, failures, last_failure_at, locked_until`
+
+func scanLockout(row interface{ Scan(...interface{}) error }, lockout *model.Lockout) error {
+	return row.Scan(&lockout.UserGUID, &lockout.Failures, &lockout.LastFailureAt, &lockout.LockedUntil)
+}
+
+func (r *lockoutRepo) Get(tenantID string, userGUID string) (*model.Lockout, error) {
+	lockout := &model.Lockout{}
+	err := scanLockout(r.db.QueryRow(`SELECT `+lockoutColumns+` FROM lockouts WHERE tenant_id = $1 AND user_guid::text = $2`,
+		tenantID, userGUID), lockout)
+	return lockout, err
+}
+
+/* Счётчик увеличивается одним запросом, чтобы параллельные попытки не терялись */
+func (r *lockoutRepo) AddFailure(tenantID string, userGUID string, resetBefore time.Time) (*model.Lockout, error) {
+	lockout := &model.Lockout{}
+	err := scanLockout(r.db.QueryRow(`INSERT INTO lockouts (tenant_id, user_guid, failures, last_failure_at)
+		VALUES ($1, $2, 1, now())
+		ON CONFLICT (user_guid) DO UPDATE SET
+			failures = CASE WHEN lockouts.last_failure_at < $3 THEN 1 ELSE lockouts.failures + 1 END,
+			last_failure_at = now()
+		RETURNING `+lockoutColumns, tenantID, userGUID, resetBefore), lockout)
+	return lockout, err
+}
+
+func (r *lockoutRepo) Lock(tenantID string, userGUID string, until time.Time) error {
+	return affectedOne(r.db.Exec(`UPDATE lockouts SET locked_until = $3 WHERE tenant_id = $1 AND user_guid::text = $2`,
+		tenantID, userGUID, until))
+}
+
+func (r *lockoutRepo) List(tenantID string, limit int, offset int) ([]model.Lockout, int, error) {
+	total := 0
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM lockouts WHERE tenant_id = $1`, tenantID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := r.db.Query(`SELECT `+lockoutColumns+` FROM lockouts WHERE tenant_id = $1
+		ORDER BY last_failure_at DESC, user_guid LIMIT $2 OFFSET $3`, tenantID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	result := make([]model.Lockout, 0, limit)
+	for rows.Next() {
+		lockout := model.Lockout{}
+		if err := scanLockout(rows, &lockout); err != nil {
+			return nil, 0, err
+		}
+		result = append(result, lockout)
+	}
+	return result, total, rows.Err()
+}
+
+func (r *lockoutRepo) Delete(tenantID string, userGUID string) error {
+	return affectedOne(r.db.Exec(`DELETE FROM lockouts WHERE tenant_id = $1 AND user_guid::text = $2`, tenantID, userGUID))
+}
+
+func (r *lockoutRepo) DeleteStale(before time.Time) error {
+	_, err := r.db.Exec(`DELETE FROM lockouts WHERE last_failure_at < $1
+		AND (locked_until IS NULL OR locked_until < now())`, before)
+	return err
+}
+
+type outboxRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewOutboxRepository(logger *zap.Logger, db *sql.DB) OutboxRepository {
+	return &outboxRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+/* pq передаёт []byte как bytea, поэтому JSON отправляем строкой */
+func (r *outboxRepo) Create(message *model.OutboxMessage) error {
+	query := `INSERT INTO outbox (channel, payload) VALUES ($1, $2) RETURNING id, next_attempt_at, created_at`
+	return r.db.QueryRow(query, message.Channel, string(message.Payload)).Scan(&message.ID, &message.NextAttemptAt, &message.CreatedAt)
+}
+
+/* SKIP LOCKED пропускает строки, которые в этот момент забирает другая реплика */
+func (r *outboxRepo) Claim(limit int, lease time.Duration) ([]model.OutboxMessage, error) {
+	rows, err := r.db.Query(`UPDATE outbox SET attempts = attempts + 1, next_attempt_at = now() + $2 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM outbox WHERE dead_at IS NULL AND next_attempt_at <= now()
+			ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, channel, payload, attempts, next_attempt_at, COALESCE(last_error, ''), created_at, dead_at`,
+		limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]model.OutboxMessage, 0, limit)
+	for rows.Next() {
+		message := model.OutboxMessage{}
+		err := rows.Scan(&message.ID, &message.Channel, &message.Payload, &message.Attempts, &message.NextAttemptAt,
+			&message.LastError, &message.CreatedAt, &message.DeadAt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, message)
+	}
+	return result, rows.Err()
+}
+
+func (r *outboxRepo) Delete(id int64) error {
+	_, err := r.db.Exec(`DELETE FROM outbox WHERE id = $1`, id)
+	return err
+}
+
+func (r *outboxRepo) Retry(id int64, lastError string, nextAttemptAt time.Time) error {
+	_, err := r.db.Exec(`UPDATE outbox SET last_error = $2, next_attempt_at = $3 WHERE id = $1`, id, lastError, nextAttemptAt)
+	return err
+}
+
+func (r *outboxRepo) MarkDead(id int64, lastError string, payload []byte) error {
+	_, err := r.db.Exec(`UPDATE outbox SET last_error = $2, payload = $3, dead_at = now() WHERE id = $1`, id, lastError, payload)
+	return err
+}
+
+/* Экранируем спецсимволы LIKE, чтобы поиск шёл по обычной подстроке */
+func likePattern(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+	return "%" + s + "%"
+}
+
+/* Превращаем нарушение уникальности в ErrAlreadyExists, остальные ошибки отдаём как есть */
+func translateError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+/* UPDATE и DELETE не возвращают ошибку, если запись не найдена, поэтому
+ * отдаём sql.ErrNoRows сами - так же, как это делает QueryRow */
+func affectedOne(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+type authorizationCodeRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewAuthorizationCodeRepository(logger *zap.Logger, db *sql.DB) AuthorizationCodeRepository {
+	return &authorizationCodeRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *authorizationCodeRepo) Create(tenantID string, code *model.AuthorizationCode) error {
+	query := `INSERT INTO oauth_codes (tenant_id, hash, client_id, user_guid, redirect_uri, code_challenge, scope, amr, nonce,
+			auth_time, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+	_, err := r.db.Exec(query, tenantID, code.Hash, code.ClientID, code.UserGUID, code.RedirectURI, code.CodeChallenge,
+		code.Scope, pq.Array(code.AMR), code.Nonce, code.AuthTime, code.ExpiresAt)
+	return err
+}
+
+func (r *authorizationCodeRepo) Consume(tenantID string, hash string) (*model.AuthorizationCode, error) {
+	/* Удаление и выборка в одном запросе: из двух параллельных обменов одного кода пройдёт только один */
+	code := &model.AuthorizationCode{}
+	query := `DELETE FROM oauth_codes WHERE tenant_id = $1 AND hash = $2 AND expires_at > current_timestamp
+		RETURNING hash, client_id, user_guid, redirect_uri, code_challenge, scope, amr, nonce, auth_time, created_at, expires_at`
+	return code, r.db.QueryRow(query, tenantID, hash).Scan(&code.Hash, &code.ClientID, &code.UserGUID, &code.RedirectURI,
+		&code.CodeChallenge, &code.Scope, pq.Array(&code.AMR), &code.Nonce, &code.AuthTime, &code.CreatedAt, &code.ExpiresAt)
+}
+
+func (r *authorizationCodeRepo) DeleteExpired(before time.Time) error {
+	_, err := r.db.Exec(`DELETE FROM oauth_codes WHERE expires_at < $1`, before)
+	return err
+}
+
+type replayRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewReplayRepository(logger *zap.Logger, db *sql.DB) ReplayRepository {
+	return &replayRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *replayRepo) Use(tenantID string, purpose string, jti string, expiresAt time.Time) error {
+	/* Вставка атомарна: из двух параллельных запросов с одним jti пройдёт только один.
+	 * Истёкшая запись, до которой ещё не дошла очистка, перезаписывается. */
+	query := `INSERT INTO used_jtis (tenant_id, purpose, jti, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant_id, purpose, jti) DO UPDATE SET expires_at = EXCLUDED.expires_at
+		WHERE used_jtis.expires_at < current_timestamp`
+	result, err := r.db.Exec(query, tenantID, purpose, jti, expiresAt)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+func (r *replayRepo) DeleteExpired(before time.Time) error {
+	_, err := r.db.Exec(`DELETE FROM used_jtis WHERE expires_at < $1`, before)
+	return err
+}
+
+type roleRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewRoleRepository(logger *zap.Logger, db *sql.DB) RoleRepository {
+	return &roleRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+/* Права роли собираются в массив, у роли без прав он пустой */
+const roleSelect = `SELECT r.name, r.description, r.created_at,
+	COALESCE(array_agg(rp.permission ORDER BY rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}')
+	FROM roles r LEFT JOIN role_permissions rp ON rp.tenant_id = r.tenant_id AND rp.role = r.name`
+
+func scanRole(row interface{ Scan(...interface{}) error }, role *model.Role) error {
+	return row.Scan(&role.Name, &role.Description, &role.CreatedAt, pq.Array(&role.Permissions))
+}
+
+func (r *roleRepo) ListPermissions() ([]model.Permission, error) {
+	rows, err := r.db.Query(`SELECT name, description, created_at FROM permissions ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	permissions := []model.Permission{}
+	for rows.Next() {
+		permission := model.Permission{}
+		if err = rows.Scan(&permission.Name, &permission.Description, &permission.CreatedAt); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	return permissions, rows.Err()
+}
+
+func (r *roleRepo) CreatePermission(permission *model.Permission) error {
+	err := r.db.QueryRow(`INSERT INTO permissions (name, description) VALUES ($1, $2) RETURNING created_at`,
+		permission.Name, permission.Description).Scan(&permission.CreatedAt)
+	return translateError(err)
+}
+
+/* Права общие, поэтому право убирается из ролей всех тенантов */
+func (r *roleRepo) DeletePermission(name string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`DELETE FROM role_permissions WHERE permission = $1`, name); err != nil {
+		return err
+	}
+	if err = affectedOne(tx.Exec(`DELETE FROM permissions WHERE name = $1`, name)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *roleRepo) List(tenantID string) ([]model.Role, error) {
+	rows, err := r.db.Query(roleSelect+` WHERE r.tenant_id = $1 GROUP BY r.tenant_id, r.name ORDER BY r.name`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRoles(rows)
+}
+
+func (r *roleRepo) GetByName(tenantID string, name string) (*model.Role, error) {
+	role := &model.Role{}
+	return role, scanRole(r.db.QueryRow(roleSelect+` WHERE r.tenant_id = $1 AND r.name = $2 GROUP BY r.tenant_id, r.name`,
+		tenantID, name), role)
+}
+
+func (r *roleRepo) Create(tenantID string, role *model.Role) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(`INSERT INTO roles (tenant_id, name, description) VALUES ($1, $2, $3) RETURNING created_at`,
+		tenantID, role.Name, role.Description).Scan(&role.CreatedAt)
+	if err != nil {
+		return translateError(err)
+	}
+	if err = replaceRolePermissions(tx, tenantID, role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *roleRepo) Update(tenantID string, role *model.Role) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = affectedOne(tx.Exec(`UPDATE roles SET description = $3 WHERE tenant_id = $1 AND name = $2`,
+		tenantID, role.Name, role.Description))
+	if err != nil {
+		return err
+	}
+	if err = replaceRolePermissions(tx, tenantID, role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *roleRepo) Delete(tenantID string, name string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`DELETE FROM user_roles WHERE tenant_id = $1 AND role = $2`, tenantID, name); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM role_permissions WHERE tenant_id = $1 AND role = $2`, tenantID, name); err != nil {
+		return err
+	}
+	if err = affectedOne(tx.Exec(`DELETE FROM roles WHERE tenant_id = $1 AND name = $2`, tenantID, name)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *roleRepo) GetUserRoles(tenantID string, userGUID string) ([]model.Role, error) {
+	rows, err := r.db.Query(roleSelect+` JOIN user_roles ur ON ur.tenant_id = r.tenant_id AND ur.role = r.name
+		WHERE r.tenant_id = $1 AND ur.user_guid::text = $2 GROUP BY r.tenant_id, r.name ORDER BY r.name`, tenantID, userGUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRoles(rows)
+}
+
+func (r *roleRepo) SetUserRoles(tenantID string, userGUID string, roles []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = requireExisting(tx, roles, `SELECT COUNT(*) FROM roles WHERE tenant_id = $1 AND name = ANY($2)`, tenantID)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM user_roles WHERE tenant_id = $1 AND user_guid::text = $2`, tenantID, userGUID); err != nil {
+		return err
+	}
+	for _, role := range roles {
+		_, err = tx.Exec(`INSERT INTO user_roles (tenant_id, user_guid, role) VALUES ($1, $2, $3)`, tenantID, userGUID, role)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func scanRoles(rows *sql.Rows) ([]model.Role, error) {
+	roles := []model.Role{}
+	for rows.Next() {
+		role := model.Role{}
+		if err := scanRole(rows, &role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func replaceRolePermissions(tx *sql.Tx, tenantID string, role *model.Role) error {
+	err := requireExisting(tx, role.Permissions, `SELECT COUNT(*) FROM permissions WHERE name = ANY($1)`)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM role_permissions WHERE tenant_id = $1 AND role = $2`, tenantID, role.Name); err != nil {
+		return err
+	}
+	for _, permission := range role.Permissions {
+		if _, err = tx.Exec(`INSERT INTO role_permissions (tenant_id, role, permission) VALUES ($1, $2, $3)`,
+			tenantID, role.Name, permission); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Внешних ключей в схеме нет, поэтому существование прав и ролей проверяем сами. Имена не должны повторяться.
+ * count считает найденные имена, массив имён передаётся в него последним аргументом. */
+func requireExisting(tx *sql.Tx, names []string, count string, args ...interface{}) error {
+	if len(names) == 0 {
+		return nil
+	}
+	var found int
+	if err := tx.QueryRow(count, append(args, pq.Array(names))...).Scan(&found); err != nil {
+		return err
+	}
+	if found != len(names) {
+		return ErrUnknownReference
+	}
+	return nil
+}
+
+type deviceAuthorizationRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewDeviceAuthorizationRepository(logger *zap.Logger, db *sql.DB) DeviceAuthorizationRepository {
+	return &deviceAuthorizationRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+const deviceAuthorizationColumns = `device_code_hash, user_code, client_id, scope, status, COALESCE(user_guid::text, ''), amr,
+	auth_time, poll_interval, last_polled_at, created_at, expires_at`
+
+func scanDeviceAuthorization(row interface{ Scan(...interface{}) error }) (*model.DeviceAuthorization, error) {
+	device := &model.DeviceAuthorization{}
+	err := row.Scan(&device.DeviceCodeHash, &device.UserCode, &device.ClientID, &device.Scope, &device.Status,
+		&device.UserGUID, pq.Array(&device.AMR), &device.AuthTime, &device.Interval, &device.LastPolledAt, &device.CreatedAt, &device.ExpiresAt)
+	return device, err
+}
+
+func (r *deviceAuthorizationRepo) Create(tenantID string, device *model.DeviceAuthorization) error {
+	query := `INSERT INTO device_authorizations (tenant_id, device_code_hash, user_code, client_id, scope, status,
+			poll_interval, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err := r.db.Exec(query, tenantID, device.DeviceCodeHash, device.UserCode, device.ClientID, device.Scope, device.Status,
+		device.Interval, device.ExpiresAt)
+	return translateError(err)
+}
+
+func (r *deviceAuthorizationRepo) GetByDeviceCode(tenantID string, deviceCodeHash string) (*model.DeviceAuthorization, error) {
+	return scanDeviceAuthorization(r.db.QueryRow(`SELECT `+deviceAuthorizationColumns+`
+		FROM device_authorizations WHERE tenant_id = $1 AND device_code_hash = $2`, tenantID, deviceCodeHash))
+}
+
+func (r *deviceAuthorizationRepo) GetPendingByUserCode(tenantID string, userCode string) (*model.DeviceAuthorization, error) {
+	return scanDeviceAuthorization(r.db.QueryRow(`SELECT `+deviceAuthorizationColumns+`
+		FROM device_authorizations
+		WHERE tenant_id = $1 AND user_code = $2 AND status = $3 AND expires_at > current_timestamp`,
+		tenantID, userCode, model.DeviceAuthorizationPending))
+}
+
+func (r *deviceAuthorizationRepo) Decide(tenantID string, userCode string, status string, userGUID string, amr []string,
+	authTime *time.Time) error {
+	/* Условие на status в том же запросе: из двух параллельных решений пройдёт только первое */
+	result, err := r.db.Exec(`UPDATE device_authorizations SET status = $3, user_guid = $4, amr = $5, auth_time = $6
+		WHERE tenant_id = $1 AND user_code = $2 AND status = $7 AND expires_at > current_timestamp`,
+		tenantID, userCode, status, userGUID, pq.Array(amr), authTime, model.DeviceAuthorizationPending)
+	return affectedOne(result, err)
+}
+
+func (r *deviceAuthorizationRepo) Polled(tenantID string, deviceCodeHash string, polledAt time.Time, interval int64) error {
+	_, err := r.db.Exec(`UPDATE device_authorizations SET last_polled_at = $3, poll_interval = $4
+		WHERE tenant_id = $1 AND device_code_hash = $2`, tenantID, deviceCodeHash, polledAt, interval)
+	return err
+}
+
+func (r *deviceAuthorizationRepo) ConsumeApproved(tenantID string, deviceCodeHash string) (*model.DeviceAuthorization, error) {
+	return scanDeviceAuthorization(r.db.QueryRow(`DELETE FROM device_authorizations
+		WHERE tenant_id = $1 AND device_code_hash = $2 AND status = $3 AND expires_at > current_timestamp
+		RETURNING `+deviceAuthorizationColumns, tenantID, deviceCodeHash, model.DeviceAuthorizationApproved))
+}
+
+func (r *deviceAuthorizationRepo) Delete(tenantID string, deviceCodeHash string) error {
+	_, err := r.db.Exec(`DELETE FROM device_authorizations WHERE tenant_id = $1 AND device_code_hash = $2`,
+		tenantID, deviceCodeHash)
+	return err
+}
+
+func (r *deviceAuthorizationRepo) DeleteExpired(before time.Time) error {
+	_, err := r.db.Exec(`DELETE FROM device_authorizations WHERE expires_at < $1`, before)
+	return err
+}
+
+type oauthClientRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewOAuthClientRepository(logger *zap.Logger, db *sql.DB) OAuthClientRepository {
+	return &oauthClientRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+const oauthClientColumns = `client_id, name, COALESCE(secret_hash, ''), auth_method, COALESCE(public_key, ''),
+	redirect_uris, grant_types, scopes, token_lifetime, created_at`
+
+func scanOAuthClient(row interface{ Scan(...interface{}) error }, client *model.OAuthClient) error {
+	return row.Scan(&client.ID, &client.Name, &client.SecretHash, &client.AuthMethod, &client.PublicKey,
+		pq.Array(&client.RedirectURIs), pq.Array(&client.GrantTypes), pq.Array(&client.Scopes),
+		&client.TokenLifetime, &client.CreatedAt)
+}
+
+func (r *oauthClientRepo) GetByID(tenantID string, clientID string) (*model.OAuthClient, error) {
+	client := &model.OAuthClient{}
+	err := scanOAuthClient(r.db.QueryRow(`SELECT `+oauthClientColumns+` FROM oauth_clients
+		WHERE tenant_id = $1 AND client_id = $2`, tenantID, clientID), client)
+	return client, err
+}
+
+func (r *oauthClientRepo) List(tenantID string, limit int, offset int) ([]model.OAuthClient, int, error) {
+	total := 0
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM oauth_clients WHERE tenant_id = $1`, tenantID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := r.db.Query(`SELECT `+oauthClientColumns+` FROM oauth_clients WHERE tenant_id = $1
+		ORDER BY created_at, client_id LIMIT $2 OFFSET $3`, tenantID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	result := make([]model.OAuthClient, 0, limit)
+	for rows.Next() {
+		client := model.OAuthClient{}
+		if err := scanOAuthClient(rows, &client); err != nil {
+			return nil, 0, err
+		}
+		result = append(result, client)
+	}
+	return result, total, rows.Err()
+}
+
+func (r *oauthClientRepo) Create(tenantID string, client *model.OAuthClient) error {
+	query := `INSERT INTO oauth_clients (tenant_id, client_id, name, secret_hash, auth_method, public_key,
+			redirect_uris, grant_types, scopes, token_lifetime)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, NULLIF($6, ''), $7, $8, $9, $10) RETURNING created_at`
+	err := r.db.QueryRow(query, tenantID, client.ID, client.Name, client.SecretHash, client.AuthMethod, client.PublicKey,
+		pq.Array(client.RedirectURIs), pq.Array(client.GrantTypes), pq.Array(client.Scopes),
+		client.TokenLifetime).Scan(&client.CreatedAt)
+	return translateError(err)
+}
+
+func (r *oauthClientRepo) Update(tenantID string, client *model.OAuthClient) error {
+	query := `UPDATE oauth_clients SET name = $3, secret_hash = NULLIF($4, ''), auth_method = $5,
+			public_key = NULLIF($6, ''), redirect_uris = $7, grant_types = $8, scopes = $9, token_lifetime = $10
+		WHERE tenant_id = $1 AND client_id = $2`
+	return affectedOne(r.db.Exec(query, tenantID, client.ID, client.Name, client.SecretHash, client.AuthMethod, client.PublicKey,
+		pq.Array(client.RedirectURIs), pq.Array(client.GrantTypes), pq.Array(client.Scopes), client.TokenLifetime))
+}
+
+func (r *oauthClientRepo) Delete(tenantID string, clientID string) error {
+	return affectedOne(r.db.Exec(`DELETE FROM oauth_clients WHERE tenant_id = $1 AND client_id = $2`, tenantID, clientID))
+}
+
+type impersonationRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewImpersonationRepository(logger *zap.Logger, db *sql.DB) ImpersonationRepository {
+	return &impersonationRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+const impersonationColumns = `id, user_guid, actor, reason, jti, ip, credential, created_at, expires_at`
+
+func (r *impersonationRepo) Create(tenantID string, impersonation *model.Impersonation) error {
+	query := `INSERT INTO impersonations (tenant_id, user_guid, actor, reason, jti, ip, credential, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`
+	return r.db.QueryRow(query, tenantID, impersonation.UserGUID, impersonation.Actor, impersonation.Reason,
+		impersonation.JTI, impersonation.IP, impersonation.Credential, impersonation.ExpiresAt).
+		Scan(&impersonation.ID, &impersonation.CreatedAt)
+}
+
+func (r *impersonationRepo) List(tenantID string, userGUID string, limit int, offset int) ([]model.Impersonation, int, error) {
+	where := ` WHERE tenant_id = $1 AND ($2 = '' OR user_guid::text = $2)`
+	total := 0
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM impersonations`+where, tenantID, userGUID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := r.db.Query(`SELECT `+impersonationColumns+` FROM impersonations`+where+`
+		ORDER BY created_at DESC, id DESC LIMIT $3 OFFSET $4`, tenantID, userGUID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	result := make([]model.Impersonation, 0, limit)
+	for rows.Next() {
+		temp := model.Impersonation{}
+		err := rows.Scan(&temp.ID, &temp.UserGUID, &temp.Actor, &temp.Reason, &temp.JTI, &temp.IP, &temp.Credential,
+			&temp.CreatedAt, &temp.ExpiresAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		result = append(result, temp)
+	}
+	return result, total, rows.Err()
+}
+
+type apiKeyRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewAPIKeyRepository(logger *zap.Logger, db *sql.DB) APIKeyRepository {
+	return &apiKeyRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+const apiKeyColumns = `id, user_guid, name, hash, scopes, created_at, expires_at, last_used_at`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }, key *model.APIKey) error {
+	return row.Scan(&key.ID, &key.UserGUID, &key.Name, &key.Hash, pq.Array(&key.Scopes),
+		&key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt)
+}
+
+func (r *apiKeyRepo) Create(tenantID string, key *model.APIKey) error {
+	query := `INSERT INTO api_keys (id, tenant_id, user_guid, name, hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING created_at`
+	err := r.db.QueryRow(query, key.ID, tenantID, key.UserGUID, key.Name, key.Hash, pq.Array(key.Scopes),
+		key.ExpiresAt).Scan(&key.CreatedAt)
+	return translateError(err)
+}
+
+func (r *apiKeyRepo) GetByID(tenantID string, id string) (*model.APIKey, error) {
+	key := &model.APIKey{}
+	err := scanAPIKey(r.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE tenant_id = $1 AND id = $2`,
+		tenantID, id), key)
+	return key, err
+}
+
+func (r *apiKeyRepo) ListByUserGUID(tenantID string, userGUID string) ([]model.APIKey, error) {
+	rows, err := r.db.Query(`SELECT `+apiKeyColumns+` FROM api_keys
+		WHERE tenant_id = $1 AND user_guid::text = $2 ORDER BY created_at, id`, tenantID, userGUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]model.APIKey, 0, 4)
+	for rows.Next() {
+		temp := model.APIKey{}
+		if err := scanAPIKey(rows, &temp); err != nil {
+			return nil, err
+		}
+		result = append(result, temp)
+	}
+	return result, rows.Err()
+}
+
+func (r *apiKeyRepo) Touch(tenantID string, id string, usedAt time.Time) error {
+	return affectedOne(r.db.Exec(`UPDATE api_keys SET last_used_at = $3 WHERE tenant_id = $1 AND id = $2`,
+		tenantID, id, usedAt))
+}
+
+func (r *apiKeyRepo) Delete(tenantID string, userGUID string, id string) error {
+	return affectedOne(r.db.Exec(`DELETE FROM api_keys WHERE tenant_id = $1 AND user_guid::text = $2 AND id = $3`,
+		tenantID, userGUID, id))
+}
+
+type federationRepo struct {
+	db     *sql.DB
+	logger *zap.Logger
+}
+
+func NewFederationRepository(logger *zap.Logger, db *sql.DB) FederationRepository {
+	return &federationRepo{
+		db:     db,
+		logger: logger,
+	}
+}
+
+func (r *federationRepo) GetIdentity(tenantID string, provider string, subject string) (*model.FederatedIdentity, error) {
+	identity := &model.FederatedIdentity{}
+	query := `SELECT provider, subject, user_guid, email, created_at FROM federated_identities
+		WHERE tenant_id = $1 AND provider = $2 AND subject = $3`
+	err := r.db.QueryRow(query, tenantID, provider, subject).Scan(&identity.Provider, &identity.Subject,
+		&identity.UserGUID, &identity.Email, &identity.CreatedAt)
+	return identity, err
+}
+
+func (r *federationRepo) CreateIdentity(tenantID string, identity *model.FederatedIdentity) error {
+	query := `INSERT INTO federated_identities (tenant_id, provider, subject, user_guid, email)
+		VALUES ($1, $2, $3, $4, $5) RETURNING created_at`
+	err := r.db.QueryRow(query, tenantID, identity.Provider, identity.Subject, identity.UserGUID,
+		identity.Email).Scan(&identity.CreatedAt)
+	return translateError(err)
+}
+
+func (r *federationRepo) CreateState(state *model.FederationState) error {
+	query := `INSERT INTO federation_states (state_hash, tenant_id, provider, nonce, code_verifier, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := r.db.Exec(query, state.StateHash, state.TenantID, state.Provider, state.Nonce, state.CodeVerifier,
+		state.ExpiresAt)
+	return err
+}
+
+func (r *federationRepo) ConsumeState(stateHash string) (*model.FederationState, error) {
+	/* DELETE ... RETURNING делает state одноразовым даже при параллельных запросах */
+	state := &model.FederationState{}
+	query := `DELETE FROM federation_states WHERE state_hash = $1 AND expires_at > current_timestamp
+		RETURNING state_hash, tenant_id, provider, nonce, code_verifier, expires_at`
+	err := r.db.QueryRow(query, stateHash).Scan(&state.StateHash, &state.TenantID, &state.Provider, &state.Nonce,
+		&state.CodeVerifier, &state.ExpiresAt)
+	return state, err
+}
+
+func (r *federationRepo) DeleteExpiredStates(before time.Time) error {
+	_, err := r.db.Exec(`DELETE FROM federation_states WHERE expires_at < $1`, before)
+	return err
 }
@@ -1,20 +1,219 @@
 package repository
 
 import (
+	"errors"
 	"github.com/TooLazyToCreate/auth-service/internal/model"
 	"time"
 )
 
+/* Возвращается, если запись нарушает ограничение уникальности (например, email уже занят) */
+var (
+	ErrAlreadyExists = errors.New("record already exists")
+	/* Запись ссылается на право или роль, которых нет */
+	ErrUnknownReference = errors.New("referenced record does not exist")
+)
+
+/* Параметры выборки пользователей. Пустые Email и Name не фильтруют выдачу,
+ * поиск по ним идёт по подстроке без учёта регистра. */
+type UserFilter struct {
+	Email  string
+	Name   string
+	Limit  int
+	Offset int
+}
+
+/* Пользователи и всё, что к ним относится, принадлежат тенанту: все запросы к ним идут с tenantID,
+ * так что запись чужого тенанта не найдётся, даже если известен её guid. */
 type UserRepository interface {
-	GetByGUID(guid string) (*model.User, error)
+	GetByGUID(tenantID string, guid string) (*model.User, error)
+	GetByEmail(tenantID string, email string) (*model.User, error)
+	List(tenantID string, filter UserFilter) (users []model.User, total int, err error)
+	Create(tenantID string, user *model.User) error
+	Update(tenantID string, user *model.User) error
+	SetDisabled(tenantID string, guid string, disabled bool) error
+	/* Помечает email подтверждённым, только если у пользователя всё ещё этот email.
+	 * Иначе возвращается sql.ErrNoRows. */
+	SetEmailVerified(tenantID string, guid string, email string) error
+	/* Удаляет пользователя вместе с паролем, 2FA, ключами, ролями, refresh токенами и прочими его данными
+	 * в одной транзакции. Если пользователя нет, возвращается sql.ErrNoRows. */
+	Delete(tenantID string, guid string) error
 }
 
 /* Для токенов я бы предложил использовать Redis, потому что:
  * 1. Лучше подходит для хранения key:value пар;
  * 2. Можно использовать команду EXPIRE, чтобы токены сами удалялись. */
 type TokenRepository interface {
-	Create(hash string, userGUID string) error
-	GetByGUID(userGUID string) ([]model.Token, error)
-	DeleteByHash(hash string) error
-	DeleteExpired(maxLifeTime time.Time) error
+	Create(tenantID string, hash string, userGUID string) error
+	GetByGUID(tenantID string, userGUID string) ([]model.Token, error)
+	DeleteByHash(tenantID string, hash string) error
+	DeleteByUserGUID(tenantID string, userGUID string) error
+	/* У тенантов разное время жизни refresh токенов, поэтому очистка тоже идёт по тенанту */
+	DeleteExpired(tenantID string, maxLifeTime time.Time) error
+}
+
+/* Хэши паролей лежат отдельно от пользователей: не у всех пользователей есть пароль,
+ * и так их сложнее случайно отдать наружу вместе с model.User. */
+type CredentialRepository interface {
+	GetByUserGUID(tenantID string, userGUID string) (*model.Credential, error)
+	Set(tenantID string, userGUID string, hash string) error
+}
+
+type LinkTokenRepository interface {
+	Create(tenantID string, linkToken *model.LinkToken) error
+	/* Помечает ссылку использованной и возвращает её. Если ссылки нет, она уже использована
+	 * или истекла, возвращается sql.ErrNoRows. */
+	Consume(tenantID string, hash string, purpose string) (*model.LinkToken, error)
+	CountSince(tenantID string, purpose string, email string, since time.Time) (int, error)
+	DeleteCreatedBefore(before time.Time) error
+}
+
+type TOTPRepository interface {
+	GetByUserGUID(tenantID string, userGUID string) (*model.TOTP, error)
+	/* Сохраняет новый неподтверждённый секрет, заменяя старый */
+	Save(tenantID string, totp *model.TOTP) error
+	Confirm(tenantID string, userGUID string, step int64) error
+	/* Сдвигает LastStep вперёд. Если шаг уже использован, возвращается sql.ErrNoRows. */
+	UseStep(tenantID string, userGUID string, step int64) error
+	Delete(tenantID string, userGUID string) error
+
+	/* Резервные коды хранятся в виде хэшей, каждый можно использовать один раз */
+	ReplaceRecoveryCodes(tenantID string, userGUID string, hashes []string) error
+	UseRecoveryCode(tenantID string, userGUID string, hash string) error
+}
+
+type WebAuthnRepository interface {
+	CreateCredential(tenantID string, credential *model.WebAuthnCredential) error
+	GetCredential(tenantID string, id []byte) (*model.WebAuthnCredential, error)
+	ListCredentials(tenantID string, userGUID string) ([]model.WebAuthnCredential, error)
+	UpdateSignCount(tenantID string, id []byte, signCount uint32) error
+	DeleteCredential(tenantID string, userGUID string, id []byte) error
+
+	CreateSession(tenantID string, session *model.WebAuthnSession) error
+	/* Удаляет и возвращает сессию. Если её нет или она истекла, возвращается sql.ErrNoRows. */
+	ConsumeSession(tenantID string, challengeHash string, purpose string) (*model.WebAuthnSession, error)
+	DeleteExpiredSessions(before time.Time) error
+}
+
+/* Общее хранилище корзин ограничителя частоты для нескольких реплик, реализует ratelimit.Store */
+type RateLimitRepository interface {
+	Take(key string, rate float64, burst int) (allowed bool, retryAfter time.Duration, err error)
+	DeleteUpdatedBefore(before time.Time) error
+}
+
+type LockoutRepository interface {
+	Get(tenantID string, userGUID string) (*model.Lockout, error)
+	/* Увеличивает счётчик неудач и возвращает его. Если прошлая неудача была раньше resetBefore,
+	 * счёт начинается заново. */
+	AddFailure(tenantID string, userGUID string, resetBefore time.Time) (*model.Lockout, error)
+	Lock(tenantID string, userGUID string, until time.Time) error
+	/* Счётчики, отсортированные по времени последней неудачи, начиная с самых свежих */
+	List(tenantID string, limit int, offset int) (lockouts []model.Lockout, total int, err error)
+	Delete(tenantID string, userGUID string) error
+	/* Удаляет счётчики без неудач после before, у которых не идёт блокировка */
+	DeleteStale(before time.Time) error
+}
+
+/* Идентификаторы (jti) одноразовых подписанных токенов, которые уже приняты: mfa_token, client assertion.
+ * jti хватает помнить до истечения токена - дальше токен отклоняется и так. */
+type ReplayRepository interface {
+	/* Запоминает jti до expiresAt. Если он уже использован, возвращается ErrAlreadyExists. */
+	Use(tenantID string, purpose string, jti string, expiresAt time.Time) error
+	DeleteExpired(before time.Time) error
+}
+
+type AuthorizationCodeRepository interface {
+	Create(tenantID string, code *model.AuthorizationCode) error
+	/* Удаляет и возвращает код. Если кода нет или он истёк, возвращается sql.ErrNoRows. */
+	Consume(tenantID string, hash string) (*model.AuthorizationCode, error)
+	DeleteExpired(before time.Time) error
+}
+
+/* Справочник прав общий для всех тенантов, а роли и их назначение пользователям у каждого тенанта свои */
+type RoleRepository interface {
+	ListPermissions() ([]model.Permission, error)
+	/* Если право уже есть, возвращается ErrAlreadyExists */
+	CreatePermission(permission *model.Permission) error
+	/* Право убирается и из всех ролей */
+	DeletePermission(name string) error
+	/* Роли вместе с их правами, по имени */
+	List(tenantID string) ([]model.Role, error)
+	GetByName(tenantID string, name string) (*model.Role, error)
+	/* Если роль уже есть, возвращается ErrAlreadyExists, если какого-то права нет - ErrUnknownReference */
+	Create(tenantID string, role *model.Role) error
+	/* Меняет описание и заменяет права роли. Если какого-то права нет, возвращается ErrUnknownReference. */
+	Update(tenantID string, role *model.Role) error
+	/* Роль снимается и со всех пользователей */
+	Delete(tenantID string, name string) error
+	/* Роли пользователя вместе с их правами */
+	GetUserRoles(tenantID string, userGUID string) ([]model.Role, error)
+	/* Заменяет роли пользователя. Если какой-то роли нет, возвращается ErrUnknownReference. */
+	SetUserRoles(tenantID string, userGUID string, roles []string) error
+}
+
+type DeviceAuthorizationRepository interface {
+	/* Если user_code уже занят, возвращается ErrAlreadyExists */
+	Create(tenantID string, device *model.DeviceAuthorization) error
+	GetByDeviceCode(tenantID string, deviceCodeHash string) (*model.DeviceAuthorization, error)
+	/* Только ожидающий решения и не истёкший запрос, иначе sql.ErrNoRows */
+	GetPendingByUserCode(tenantID string, userCode string) (*model.DeviceAuthorization, error)
+	/* Записывает решение пользователя. Если запрос уже решён или истёк, возвращается sql.ErrNoRows. */
+	Decide(tenantID string, userCode string, status string, userGUID string, amr []string, authTime *time.Time) error
+	/* Запоминает время опроса и интервал, с которым устройству можно приходить дальше */
+	Polled(tenantID string, deviceCodeHash string, polledAt time.Time, interval int64) error
+	/* Удаляет и возвращает разрешённый запрос: токены по нему выдаются один раз. Иначе sql.ErrNoRows. */
+	ConsumeApproved(tenantID string, deviceCodeHash string) (*model.DeviceAuthorization, error)
+	Delete(tenantID string, deviceCodeHash string) error
+	DeleteExpired(before time.Time) error
+}
+
+type OAuthClientRepository interface {
+	GetByID(tenantID string, clientID string) (*model.OAuthClient, error)
+	List(tenantID string, limit int, offset int) (clients []model.OAuthClient, total int, err error)
+	/* client_id уникален среди всех тенантов. Если он занят, возвращается ErrAlreadyExists. */
+	Create(tenantID string, client *model.OAuthClient) error
+	Update(tenantID string, client *model.OAuthClient) error
+	Delete(tenantID string, clientID string) error
+}
+
+/* Журнал входов администраторов под пользователями. Записи только добавляются, так что их нельзя подчистить через API. */
+type ImpersonationRepository interface {
+	Create(tenantID string, impersonation *model.Impersonation) error
+	/* Записи тенанта от новых к старым. Пустой userGUID - записи по всем пользователям. */
+	List(tenantID string, userGUID string, limit int, offset int) (impersonations []model.Impersonation, total int, err error)
+}
+
+/* Ключи API принадлежат пользователю тенанта. Delete удаляет только ключ этого пользователя. */
+type APIKeyRepository interface {
+	Create(tenantID string, key *model.APIKey) error
+	GetByID(tenantID string, id string) (*model.APIKey, error)
+	/* Ключи пользователя, от старых к новым */
+	ListByUserGUID(tenantID string, userGUID string) ([]model.APIKey, error)
+	/* Запоминает время последнего использования ключа */
+	Touch(tenantID string, id string, usedAt time.Time) error
+	Delete(tenantID string, userGUID string, id string) error
+}
+
+/* Привязки внешних аккаунтов к пользователям тенанта и начатые входы через внешних провайдеров */
+type FederationRepository interface {
+	/* Если аккаунт не привязан, возвращается sql.ErrNoRows */
+	GetIdentity(tenantID string, provider string, subject string) (*model.FederatedIdentity, error)
+	/* Если аккаунт уже привязан, возвращается ErrAlreadyExists */
+	CreateIdentity(tenantID string, identity *model.FederatedIdentity) error
+
+	CreateState(state *model.FederationState) error
+	/* Удаляет и возвращает state. Если его нет или он истёк, возвращается sql.ErrNoRows. */
+	ConsumeState(stateHash string) (*model.FederationState, error)
+	DeleteExpiredStates(before time.Time) error
+}
+
+type OutboxRepository interface {
+	Create(message *model.OutboxMessage) error
+	/* Забирает до limit сообщений, которые пора отправлять, увеличивает им счётчик попыток
+	 * и откладывает на lease, чтобы другие реплики не взяли их одновременно */
+	Claim(limit int, lease time.Duration) ([]model.OutboxMessage, error)
+	/* Отправленное сообщение удаляется из очереди */
+	Delete(id int64) error
+	Retry(id int64, lastError string, nextAttemptAt time.Time) error
+	/* Помечает сообщение неотправленным и заменяет его содержимое на payload, из которого убраны ссылки с токенами */
+	MarkDead(id int64, lastError string, payload []byte) error
 }
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/TooLazyToCreate/auth-service/config"
+	"github.com/TooLazyToCreate/auth-service/internal/mailer"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"go.uber.org/zap"
+)
+
+type AdminService struct {
+	logger            *zap.Logger
+	cfg               *config.Config
+	userRepo          repository.UserRepository
+	tokenRepo         repository.TokenRepository
+	credentialRepo    repository.CredentialRepository
+	totpRepo          repository.TOTPRepository
+	lockoutRepo       repository.LockoutRepository
+	clientRepo        repository.OAuthClientRepository
+	roleRepo          repository.RoleRepository
+	impersonationRepo repository.ImpersonationRepository
+	outbox            *notify.Outbox
+	events            *notify.EventPublisher
+	templates         *mailer.Templates
+}
+
+func NewAdminService(logger *zap.Logger, cfg *config.Config, outbox *notify.Outbox, events *notify.EventPublisher,
+	templates *mailer.Templates,
+	userRepo repository.UserRepository,
+	tokenRepo repository.TokenRepository, credentialRepo repository.CredentialRepository,
+	totpRepo repository.TOTPRepository, lockoutRepo repository.LockoutRepository,
+	clientRepo repository.OAuthClientRepository, roleRepo repository.RoleRepository,
+	impersonationRepo repository.ImpersonationRepository) *AdminService {
+	return &AdminService{
+		logger,
+		cfg,
+		userRepo,
+		tokenRepo,
+		credentialRepo,
+		totpRepo,
+		lockoutRepo,
+		clientRepo,
+		roleRepo,
+		impersonationRepo,
+		outbox,
+		events,
+		templates,
+	}
+}
+
+/* Пропускает дальше только запросы с заголовком "Authorization: Bearer <ADMIN_TOKEN>" */
+func (service *AdminService) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		bearer, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || len(service.cfg.AdminToken) == 0 ||
+			subtle.ConstantTimeCompare([]byte(bearer), service.cfg.AdminToken) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			service.fail(w, req, problem.Unauthorized, "Admin authentication failed", zap.String("ip", req.RemoteAddr))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+/* Отпечаток ADMIN_TOKEN для журнала: по нему видно, каким токеном сделан запрос, если токен меняли.
+ * Сам токен в журнал не попадает. */
+func adminCredentialID(adminToken []byte) string {
+	sum := sha256.Sum256(adminToken)
+	return "admin_token:" + hex.EncodeToString(sum[:8])
+}
+
+func (service *AdminService) fail(w http.ResponseWriter, req *http.Request, failure *problem.Problem,
+	message string, fields ...zap.Field) {
+	fail(service.logger, w, req, failure, message, fields...)
+}
+
+func writeJson(w http.ResponseWriter, status int, value interface{}) error {
+	result, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(result)
+	return err
+}
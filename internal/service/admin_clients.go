@@ -0,0 +1,246 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+/* Поля-указатели и nil-срезы позволяют отличить "не передано" от пустого значения при частичном обновлении */
+type clientRequest struct {
+	ID            *string  `json:"client_id"`
+	Name          *string  `json:"client_name"`
+	AuthMethod    *string  `json:"token_endpoint_auth_method"`
+	PublicKey     *string  `json:"public_key"`
+	RedirectURIs  []string `json:"redirect_uris"`
+	GrantTypes    []string `json:"grant_types"`
+	Scopes        []string `json:"scopes"`
+	TokenLifetime *int64   `json:"token_lifetime"`
+}
+
+/* Секрет виден только в ответе на создание клиента и смену секрета */
+type clientResponse struct {
+	*model.OAuthClient
+	Secret string `json:"client_secret,omitempty"`
+}
+
+type clientListResponse struct {
+	Clients []model.OAuthClient `json:"clients"`
+	Total   int                 `json:"total"`
+	Limit   int                 `json:"limit"`
+	Offset  int                 `json:"offset"`
+}
+
+func (service *AdminService) HandleClientList(w http.ResponseWriter, req *http.Request) {
+	limit, offset, ok := service.pageFromQuery(w, req)
+	if !ok {
+		return
+	}
+	clients, total, err := service.clientRepo.List(tenancy.FromContext(req.Context()).ID, limit, offset)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	if err = writeJson(w, http.StatusOK, &clientListResponse{clients, total, limit, offset}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+func (service *AdminService) HandleClientGet(w http.ResponseWriter, req *http.Request) {
+	client, ok := service.clientFromPath(w, req)
+	if !ok {
+		return
+	}
+	if err := writeJson(w, http.StatusOK, client); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* client_id можно задать самому (например, "spa"), иначе он генерируется.
+ * Клиенту с client_secret_basic секрет выдаётся сразу. */
+func (service *AdminService) HandleClientCreate(w http.ResponseWriter, req *http.Request) {
+	body := clientRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err))
+		return
+	}
+	client := &model.OAuthClient{
+		AuthMethod:   authMethodSecretBasic,
+		RedirectURIs: []string{},
+		GrantTypes:   []string{grantAuthorizationCode},
+		Scopes:       []string{},
+	}
+	if body.ID != nil && *body.ID != "" {
+		client.ID = *body.ID
+	} else {
+		var err error
+		if client.ID, err = newClientID(); err != nil {
+			service.fail(w, req, problem.Internal, "Failed to generate client_id", zap.Error(err))
+			return
+		}
+	}
+	applyClientRequest(client, &body)
+	if failure := validateClient(service.cfg, client); failure != nil {
+		service.fail(w, req, failure, "Bad request: invalid client metadata", zap.String("client_id", client.ID))
+		return
+	}
+	secret, ok := service.issueSecretIfNeeded(w, req, client)
+	if !ok {
+		return
+	}
+	if err := service.clientRepo.Create(tenancy.FromContext(req.Context()).ID, client); err != nil {
+		service.writeClientError(w, req, err, client.ID)
+		return
+	}
+	service.logger.Info("OAuth client has been created",
+		zap.String("client_id", client.ID),
+		zap.Strings("grant_types", client.GrantTypes))
+	if err := writeJson(w, http.StatusCreated, &clientResponse{client, secret}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Если клиент переходит на client_secret_basic, секрет выдаётся в ответе; при переходе на другой способ секрет удаляется */
+func (service *AdminService) HandleClientUpdate(w http.ResponseWriter, req *http.Request) {
+	client, ok := service.clientFromPath(w, req)
+	if !ok {
+		return
+	}
+	body := clientRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err))
+		return
+	}
+	if body.ID != nil && *body.ID != client.ID {
+		service.fail(w, req, problem.OAuthInvalidClientMetadata.With("client_id cannot be changed"),
+			"Bad request: client_id change", zap.String("client_id", client.ID))
+		return
+	}
+	applyClientRequest(client, &body)
+	if failure := validateClient(service.cfg, client); failure != nil {
+		service.fail(w, req, failure, "Bad request: invalid client metadata", zap.String("client_id", client.ID))
+		return
+	}
+	if client.AuthMethod != authMethodSecretBasic {
+		client.SecretHash = ""
+	}
+	secret, ok := service.issueSecretIfNeeded(w, req, client)
+	if !ok {
+		return
+	}
+	if err := service.clientRepo.Update(tenancy.FromContext(req.Context()).ID, client); err != nil {
+		service.writeClientError(w, req, err, client.ID)
+		return
+	}
+	service.logger.Info("OAuth client has been updated", zap.String("client_id", client.ID))
+	if err := writeJson(w, http.StatusOK, &clientResponse{client, secret}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Новый секрет сразу заменяет старый: сервисы клиента нужно перенастроить до вызова */
+func (service *AdminService) HandleClientSecret(w http.ResponseWriter, req *http.Request) {
+	client, ok := service.clientFromPath(w, req)
+	if !ok {
+		return
+	}
+	if client.AuthMethod != authMethodSecretBasic {
+		service.fail(w, req, problem.OAuthInvalidClientMetadata.With("Client does not use client_secret_basic"),
+			"Bad request: client has no secret", zap.String("client_id", client.ID))
+		return
+	}
+	client.SecretHash = ""
+	secret, ok := service.issueSecretIfNeeded(w, req, client)
+	if !ok {
+		return
+	}
+	if err := service.clientRepo.Update(tenancy.FromContext(req.Context()).ID, client); err != nil {
+		service.writeClientError(w, req, err, client.ID)
+		return
+	}
+	service.logger.Info("OAuth client secret has been changed", zap.String("client_id", client.ID))
+	if err := writeJson(w, http.StatusOK, &clientResponse{client, secret}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+func (service *AdminService) HandleClientDelete(w http.ResponseWriter, req *http.Request) {
+	clientID := chi.URLParam(req, "client_id")
+	if err := service.clientRepo.Delete(tenancy.FromContext(req.Context()).ID, clientID); err != nil {
+		service.writeClientError(w, req, err, clientID)
+		return
+	}
+	service.logger.Info("OAuth client has been deleted", zap.String("client_id", clientID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* Выдаёт секрет клиенту с client_secret_basic, у которого его ещё нет. Возвращает открытый секрет
+ * (пустой, если он не нужен). Если что-то пошло не так, ответ клиенту уже записан и возвращается false. */
+func (service *AdminService) issueSecretIfNeeded(w http.ResponseWriter, req *http.Request,
+	client *model.OAuthClient) (string, bool) {
+	if client.AuthMethod != authMethodSecretBasic || client.SecretHash != "" {
+		return "", true
+	}
+	secret, hash, err := newClientSecret()
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to generate client secret", zap.Error(err))
+		return "", false
+	}
+	client.SecretHash = hash
+	return secret, true
+}
+
+/* Достаёт клиента по client_id из пути запроса. Если что-то пошло не так,
+ * ответ клиенту уже записан и возвращается false. */
+func (service *AdminService) clientFromPath(w http.ResponseWriter, req *http.Request) (*model.OAuthClient, bool) {
+	clientID := chi.URLParam(req, "client_id")
+	client, err := service.clientRepo.GetByID(tenancy.FromContext(req.Context()).ID, clientID)
+	if err != nil {
+		service.writeClientError(w, req, err, clientID)
+		return nil, false
+	}
+	return client, true
+}
+
+func (service *AdminService) writeClientError(w http.ResponseWriter, req *http.Request, err error, clientID string) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		service.fail(w, req, problem.ClientNotFound, "OAuth client not found", zap.String("client_id", clientID))
+	case errors.Is(err, repository.ErrAlreadyExists):
+		service.fail(w, req, problem.ClientIDTaken, "OAuth client already exists", zap.String("client_id", clientID))
+	default:
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("client_id", clientID))
+	}
+}
+
+func applyClientRequest(client *model.OAuthClient, body *clientRequest) {
+	if body.Name != nil {
+		client.Name = *body.Name
+	}
+	if body.AuthMethod != nil {
+		client.AuthMethod = *body.AuthMethod
+	}
+	if body.PublicKey != nil {
+		client.PublicKey = *body.PublicKey
+	}
+	if body.RedirectURIs != nil {
+		client.RedirectURIs = body.RedirectURIs
+	}
+	if body.GrantTypes != nil {
+		client.GrantTypes = body.GrantTypes
+	}
+	if body.Scopes != nil {
+		client.Scopes = body.Scopes
+	}
+	if body.TokenLifetime != nil {
+		client.TokenLifetime = *body.TokenLifetime
+	}
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultImpersonationLifetime = 900
+	maxActorLength               = 256
+)
+
+type impersonationRequest struct {
+	/* Кто из сотрудников входит под пользователем. ADMIN_TOKEN общий, поэтому имя передаёт админка,
+	 * и сервис его не проверяет: в журнал рядом с ним пишутся IP и отпечаток ADMIN_TOKEN. */
+	Actor  string `json:"actor"`
+	Reason string `json:"reason"`
+	/* Необязательные scope через пробел, сужаются до прав пользователя */
+	Scope *string `json:"scope"`
+}
+
+type impersonationListResponse struct {
+	Impersonations []model.Impersonation `json:"impersonations"`
+	Total          int                   `json:"total"`
+	Limit          int                   `json:"limit"`
+	Offset         int                   `json:"offset"`
+}
+
+/* Выдаёт администратору короткоживущий access токен пользователя без refresh токена. В токене есть claim act
+ * (RFC 8693, 4.1) с именем администратора, по нему сервисы отличают такую сессию от входа самого пользователя.
+ * Выдача попадает в журнал до того, как токен отдан: без записи в журнале токена не будет. */
+func (service *AdminService) HandleUserImpersonate(w http.ResponseWriter, req *http.Request) {
+	user, ok := service.userFromPath(w, req)
+	if !ok {
+		return
+	}
+	body := impersonationRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err))
+		return
+	}
+	body.Actor = strings.TrimSpace(body.Actor)
+	body.Reason = strings.TrimSpace(body.Reason)
+	if body.Actor == "" || body.Reason == "" || utf8.RuneCountInString(body.Actor) > maxActorLength {
+		service.fail(w, req, problem.MalformedRequest.With("actor (up to 256 characters) and reason are required"),
+			"Bad request: impersonation without actor or reason", zap.String("user_guid", user.GUID))
+		return
+	}
+	if user.Disabled {
+		service.fail(w, req, problem.UserUnavailable, "Impersonation of a disabled user",
+			zap.String("actor", body.Actor),
+			zap.String("user_guid", user.GUID))
+		return
+	}
+
+	tenant := tenancy.FromContext(req.Context())
+	grant, err := userGrant(service.roleRepo, tenant.ID, user.GUID, body.Scope)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("user_guid", user.GUID))
+		return
+	}
+	lifetime := service.cfg.Impersonation.Lifetime
+	if lifetime <= 0 {
+		lifetime = defaultImpersonationLifetime
+	}
+	lifetime = min(lifetime, tenant.AccessTokenLifetime)
+
+	/* Те же claims, что у обычного access токена, плюс act и exp. amr нет: пользователь не входил. */
+	now := time.Now()
+	claims := map[string]interface{}{
+		"guid":  user.GUID,
+		"tid":   tenant.ID,
+		"ip":    req.RemoteAddr,
+		"iat":   now.Unix(),
+		"exp":   now.Unix() + lifetime,
+		"roles": grant.Roles,
+		"scope": grant.Scope,
+		"act":   map[string]interface{}{"sub": body.Actor},
+	}
+	if tenant.Issuer != "" {
+		claims["iss"] = tenant.Issuer
+	}
+	accessToken, err := token.NewAccessToken(tenant.Secret, claims)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to generate token", zap.Error(err),
+			zap.String("user_guid", user.GUID))
+		return
+	}
+	pair := &token.Pair{Access: accessToken}
+	/* jti генерирует token.NewAccessToken, для журнала достаём его из готового токена */
+	issued, err := pair.AccessTokenPayload(tenant.Secret)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to read generated token", zap.Error(err),
+			zap.String("user_guid", user.GUID))
+		return
+	}
+	jti, _ := issued["jti"].(string)
+
+	impersonation := &model.Impersonation{
+		UserGUID:   user.GUID,
+		Actor:      body.Actor,
+		Reason:     body.Reason,
+		JTI:        jti,
+		IP:         req.RemoteAddr,
+		Credential: adminCredentialID(service.cfg.AdminToken),
+		ExpiresAt:  now.Add(time.Duration(lifetime) * time.Second),
+	}
+	if err = service.impersonationRepo.Create(tenant.ID, impersonation); err != nil {
+		service.fail(w, req, problem.Internal, "Failed to record impersonation", zap.Error(err),
+			zap.String("actor", body.Actor),
+			zap.String("user_guid", user.GUID))
+		return
+	}
+	service.logger.Warn("Admin has impersonated user",
+		zap.String("actor", body.Actor),
+		zap.String("reason", body.Reason),
+		zap.String("user_guid", user.GUID),
+		zap.String("jti", jti),
+		zap.String("ip", req.RemoteAddr),
+		zap.String("credential", impersonation.Credential))
+	publishEvent(service.logger, service.events, notify.EventImpersonation, user.GUID, req, map[string]string{
+		"actor":  body.Actor,
+		"reason": body.Reason,
+		"jti":    jti,
+	})
+
+	result, err := pair.ToOAuthJson(lifetime, grant.Scope)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "JSON failure", zap.Error(err))
+		return
+	}
+	writeTokenResponse(w, result)
+}
+
+/* Журнал входов под пользователями, необязательный фильтр user_guid */
+func (service *AdminService) HandleImpersonationList(w http.ResponseWriter, req *http.Request) {
+	limit, offset, ok := service.pageFromQuery(w, req)
+	if !ok {
+		return
+	}
+	userGUID := req.URL.Query().Get("user_guid")
+	if userGUID != "" {
+		if _, err := uuid.Parse(userGUID); err != nil {
+			service.fail(w, req, problem.MalformedRequest.With("user_guid must be a UUID"), "Bad request", zap.Error(err))
+			return
+		}
+	}
+	impersonations, total, err := service.impersonationRepo.List(tenancy.FromContext(req.Context()).ID, userGUID, limit, offset)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	err = writeJson(w, http.StatusOK, &impersonationListResponse{impersonations, total, limit, offset})
+	if err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
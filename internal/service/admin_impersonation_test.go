@@ -0,0 +1,167 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"go.uber.org/zap"
+)
+
+const testAdminToken = "admin-token"
+
+type memImpersonations struct {
+	repository.ImpersonationRepository
+	records []model.Impersonation
+	failure error
+}
+
+func (repo *memImpersonations) Create(tenantID string, impersonation *model.Impersonation) error {
+	if repo.failure != nil {
+		return repo.failure
+	}
+	impersonation.ID = int64(len(repo.records) + 1)
+	impersonation.CreatedAt = time.Now()
+	repo.records = append(repo.records, *impersonation)
+	return nil
+}
+
+/* Админка поверх той же обвязки: POST /admin/users/{guid}/impersonate под ADMIN_TOKEN */
+func newImpersonationEnv(t *testing.T) (*testEnv, *memImpersonations) {
+	env := newTestEnv(t)
+	env.cfg.AdminToken = []byte(testAdminToken)
+	env.cfg.Impersonation.Lifetime = 120
+	impersonations := &memImpersonations{}
+	admin := NewAdminService(zap.NewNop(), env.cfg, env.service.outbox, env.service.events, env.service.templates,
+		env.users, env.tokens, env.credentials, nil, nil, nil, noRoles{}, impersonations)
+	env.router.With(admin.Authenticate).Post("/admin/users/{guid}/impersonate", admin.HandleUserImpersonate)
+	return env, impersonations
+}
+
+func TestImpersonationToken(t *testing.T) {
+	env, impersonations := newImpersonationEnv(t)
+	user := env.addUser("acme", "user@example.com")
+
+	before := time.Now().Unix()
+	recorder := env.do("acme", http.MethodPost, "/admin/users/"+user.GUID+"/impersonate",
+		`{"actor": "support@example.com", "reason": "ticket 42"}`, testAdminToken)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("impersonate: %d %s", recorder.Code, recorder.Body.String())
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := response["refresh_token"]; ok {
+		t.Fatalf("impersonation issued a refresh token: %s", recorder.Body.String())
+	}
+	if response["expires_in"] != float64(120) {
+		t.Fatalf("expires_in %v, want the configured 120", response["expires_in"])
+	}
+
+	accessToken, _ := response["access_token"].(string)
+	claims := env.accessClaims("acme", accessToken)
+	act, _ := claims["act"].(map[string]interface{})
+	if act["sub"] != "support@example.com" {
+		t.Fatalf("act claim %v", claims["act"])
+	}
+	if claims["guid"] != user.GUID {
+		t.Fatalf("token is issued for %v", claims["guid"])
+	}
+	exp, _ := claimInt64(claims["exp"])
+	if exp > time.Now().Unix()+120 || exp < before+120 {
+		t.Fatalf("exp %d is not within the configured lifetime", exp)
+	}
+	if _, ok := claims["amr"]; ok {
+		t.Fatal("impersonation token claims the user has authenticated")
+	}
+
+	if len(impersonations.records) != 1 {
+		t.Fatalf("%d audit records", len(impersonations.records))
+	}
+	record := impersonations.records[0]
+	if record.UserGUID != user.GUID || record.Actor != "support@example.com" || record.Reason != "ticket 42" ||
+		record.JTI != claims["jti"] || record.IP != "192.0.2.1" || record.ExpiresAt.Unix() != exp {
+		t.Fatalf("audit record %+v", record)
+	}
+	if record.Credential != adminCredentialID([]byte(testAdminToken)) ||
+		strings.Contains(record.Credential, testAdminToken) {
+		t.Fatalf("audit credential %q", record.Credential)
+	}
+	if events := env.events(notify.EventImpersonation); len(events) != 1 || events[0].Details["jti"] != record.JTI {
+		t.Fatalf("impersonation events %+v", events)
+	}
+}
+
+/* impersonation.lifetime не продлевает токен дольше обычного access токена тенанта */
+func TestImpersonationLifetimeCapped(t *testing.T) {
+	env, _ := newImpersonationEnv(t)
+	env.cfg.Impersonation.Lifetime = 3600
+	user := env.addUser("acme", "user@example.com")
+
+	recorder := env.do("acme", http.MethodPost, "/admin/users/"+user.GUID+"/impersonate",
+		`{"actor": "support@example.com", "reason": "ticket 42"}`, testAdminToken)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("impersonate: %d %s", recorder.Code, recorder.Body.String())
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response["expires_in"] != float64(env.tenant("acme").AccessTokenLifetime) {
+		t.Fatalf("expires_in %v, want access token lifetime %d", response["expires_in"], env.tenant("acme").AccessTokenLifetime)
+	}
+}
+
+/* Без записи в журнале токена нет */
+func TestImpersonationWithoutAudit(t *testing.T) {
+	env, impersonations := newImpersonationEnv(t)
+	impersonations.failure = errors.New("connection refused")
+	user := env.addUser("acme", "user@example.com")
+
+	recorder := env.do("acme", http.MethodPost, "/admin/users/"+user.GUID+"/impersonate",
+		`{"actor": "support@example.com", "reason": "ticket 42"}`, testAdminToken)
+	if recorder.Code != http.StatusInternalServerError || strings.Contains(recorder.Body.String(), "access_token") {
+		t.Fatalf("impersonate without audit: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if events := env.events(notify.EventImpersonation); len(events) != 0 {
+		t.Fatalf("impersonation events %+v", events)
+	}
+}
+
+func TestImpersonationRejected(t *testing.T) {
+	env, impersonations := newImpersonationEnv(t)
+	user := env.addUser("acme", "user@example.com")
+	path := "/admin/users/" + user.GUID + "/impersonate"
+
+	tests := []struct {
+		name   string
+		tenant string
+		body   string
+		bearer string
+		status int
+	}{
+		{"no admin token", "acme", `{"actor": "support", "reason": "ticket"}`, "", http.StatusUnauthorized},
+		{"wrong admin token", "acme", `{"actor": "support", "reason": "ticket"}`, "other", http.StatusUnauthorized},
+		{"no actor", "acme", `{"reason": "ticket"}`, testAdminToken, http.StatusBadRequest},
+		{"no reason", "acme", `{"actor": "support", "reason": "  "}`, testAdminToken, http.StatusBadRequest},
+		{"other tenant", "globex", `{"actor": "support", "reason": "ticket"}`, testAdminToken, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := env.do(test.tenant, http.MethodPost, path, test.body, test.bearer)
+			if recorder.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", recorder.Code, test.status, recorder.Body.String())
+			}
+		})
+	}
+	if len(impersonations.records) != 0 {
+		t.Fatalf("rejected requests were recorded: %+v", impersonations.records)
+	}
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/mailer"
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"go.uber.org/zap"
+)
+
+type lockoutListResponse struct {
+	Lockouts []model.Lockout `json:"lockouts"`
+	Total    int             `json:"total"`
+	Limit    int             `json:"limit"`
+	Offset   int             `json:"offset"`
+}
+
+func (service *AdminService) HandleLockoutList(w http.ResponseWriter, req *http.Request) {
+	limit, offset, ok := service.pageFromQuery(w, req)
+	if !ok {
+		return
+	}
+	lockouts, total, err := service.lockoutRepo.List(tenancy.FromContext(req.Context()).ID, limit, offset)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	if err = writeJson(w, http.StatusOK, &lockoutListResponse{lockouts, total, limit, offset}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+func (service *AdminService) HandleUserLockoutGet(w http.ResponseWriter, req *http.Request) {
+	user, ok := service.userFromPath(w, req)
+	if !ok {
+		return
+	}
+	lockout, err := service.lockoutRepo.Get(tenancy.FromContext(req.Context()).ID, user.GUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			problem.Write(w, req, problem.NotFound.With("User has no failed login attempts"))
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("user_guid", user.GUID))
+		}
+		return
+	}
+	if err = writeJson(w, http.StatusOK, lockout); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Снимает блокировку и обнуляет счётчик неудач. Если блокировка действовала, пользователю уходит письмо. */
+func (service *AdminService) HandleUserLockoutClear(w http.ResponseWriter, req *http.Request) {
+	user, ok := service.userFromPath(w, req)
+	if !ok {
+		return
+	}
+	tenantID := tenancy.FromContext(req.Context()).ID
+	lockout, err := service.lockoutRepo.Get(tenantID, user.GUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err == nil {
+		err = service.lockoutRepo.Delete(tenantID, user.GUID)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("user_guid", user.GUID))
+		return
+	}
+
+	wasLocked := lockout.LockedUntil != nil && lockout.LockedUntil.After(time.Now())
+	service.logger.Info("User lockout has been cleared by admin",
+		zap.String("user_guid", user.GUID),
+		zap.Int("failures", lockout.Failures),
+		zap.Bool("was_locked", wasLocked))
+	if wasLocked {
+		enqueueNotification(service.logger, service.outbox, service.templates, tenancy.FromContext(req.Context()), user, notify.KindUnlock, mailer.Data{})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,258 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+/* Право попадает в scope (значения через пробел), а имя роли - в путь запроса, поэтому набор символов ограничен */
+var roleNamePattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+type permissionRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type permissionListResponse struct {
+	Permissions []model.Permission `json:"permissions"`
+}
+
+/* Поля-указатели и nil-срезы позволяют отличить "не передано" от пустого значения при частичном обновлении */
+type roleRequest struct {
+	Name        string   `json:"name"`
+	Description *string  `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+type roleListResponse struct {
+	Roles []model.Role `json:"roles"`
+}
+
+type userRolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+func (service *AdminService) HandlePermissionList(w http.ResponseWriter, req *http.Request) {
+	permissions, err := service.roleRepo.ListPermissions()
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	if err = writeJson(w, http.StatusOK, &permissionListResponse{permissions}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+func (service *AdminService) HandlePermissionCreate(w http.ResponseWriter, req *http.Request) {
+	body := permissionRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err))
+		return
+	}
+	if !roleNamePattern.MatchString(body.Name) {
+		service.fail(w, req, problem.MalformedRequest.With("name must be 1-64 letters, digits or ._:-"),
+			"Bad request: invalid permission name", zap.String("permission", body.Name))
+		return
+	}
+	permission := &model.Permission{Name: body.Name, Description: body.Description}
+	if err := service.roleRepo.CreatePermission(permission); err != nil {
+		if errors.Is(err, repository.ErrAlreadyExists) {
+			service.fail(w, req, problem.PermissionExists, "Permission already exists", zap.String("permission", body.Name))
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return
+	}
+	service.logger.Info("Permission has been created", zap.String("permission", permission.Name))
+	if err := writeJson(w, http.StatusCreated, permission); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Право убирается из всех ролей. Из уже выданных токенов оно пропадёт при следующем обновлении. */
+func (service *AdminService) HandlePermissionDelete(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if err := service.roleRepo.DeletePermission(name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			service.fail(w, req, problem.PermissionNotFound, "Permission not found", zap.String("permission", name))
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return
+	}
+	service.logger.Info("Permission has been deleted", zap.String("permission", name))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (service *AdminService) HandleRoleList(w http.ResponseWriter, req *http.Request) {
+	roles, err := service.roleRepo.List(tenancy.FromContext(req.Context()).ID)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	if err = writeJson(w, http.StatusOK, &roleListResponse{roles}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+func (service *AdminService) HandleRoleGet(w http.ResponseWriter, req *http.Request) {
+	role, ok := service.roleFromPath(w, req)
+	if !ok {
+		return
+	}
+	if err := writeJson(w, http.StatusOK, role); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+func (service *AdminService) HandleRoleCreate(w http.ResponseWriter, req *http.Request) {
+	body := roleRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err))
+		return
+	}
+	if !roleNamePattern.MatchString(body.Name) {
+		service.fail(w, req, problem.MalformedRequest.With("name must be 1-64 letters, digits or ._:-"),
+			"Bad request: invalid role name", zap.String("role", body.Name))
+		return
+	}
+	role := &model.Role{Name: body.Name, Permissions: []string{}}
+	applyRoleRequest(role, &body)
+	if err := service.roleRepo.Create(tenancy.FromContext(req.Context()).ID, role); err != nil {
+		service.writeRoleError(w, req, err, role.Name)
+		return
+	}
+	service.logger.Info("Role has been created",
+		zap.String("role", role.Name),
+		zap.Strings("permissions", role.Permissions))
+	if err := writeJson(w, http.StatusCreated, role); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* permissions заменяют права роли целиком. Пользователи получат изменения при следующем выпуске или обновлении токенов. */
+func (service *AdminService) HandleRoleUpdate(w http.ResponseWriter, req *http.Request) {
+	role, ok := service.roleFromPath(w, req)
+	if !ok {
+		return
+	}
+	body := roleRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err))
+		return
+	}
+	if body.Name != "" && body.Name != role.Name {
+		service.fail(w, req, problem.MalformedRequest.With("Role cannot be renamed"), "Bad request: role rename",
+			zap.String("role", role.Name))
+		return
+	}
+	applyRoleRequest(role, &body)
+	if err := service.roleRepo.Update(tenancy.FromContext(req.Context()).ID, role); err != nil {
+		service.writeRoleError(w, req, err, role.Name)
+		return
+	}
+	service.logger.Info("Role has been updated",
+		zap.String("role", role.Name),
+		zap.Strings("permissions", role.Permissions))
+	if err := writeJson(w, http.StatusOK, role); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Роль снимается со всех пользователей */
+func (service *AdminService) HandleRoleDelete(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	if err := service.roleRepo.Delete(tenancy.FromContext(req.Context()).ID, name); err != nil {
+		service.writeRoleError(w, req, err, name)
+		return
+	}
+	service.logger.Info("Role has been deleted", zap.String("role", name))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (service *AdminService) HandleUserRolesGet(w http.ResponseWriter, req *http.Request) {
+	user, ok := service.userFromPath(w, req)
+	if !ok {
+		return
+	}
+	roles, err := service.roleRepo.GetUserRoles(tenancy.FromContext(req.Context()).ID, user.GUID)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("user_guid", user.GUID))
+		return
+	}
+	if err = writeJson(w, http.StatusOK, &roleListResponse{roles}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Заменяет роли пользователя целиком, пустой список снимает все роли */
+func (service *AdminService) HandleUserRolesSet(w http.ResponseWriter, req *http.Request) {
+	user, ok := service.userFromPath(w, req)
+	if !ok {
+		return
+	}
+	body := userRolesRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Roles == nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err))
+		return
+	}
+	roleNames := uniqueSorted(body.Roles)
+	if err := service.roleRepo.SetUserRoles(tenancy.FromContext(req.Context()).ID, user.GUID, roleNames); err != nil {
+		if errors.Is(err, repository.ErrUnknownReference) {
+			service.fail(w, req, problem.UnknownRole, "Bad request: unknown role",
+				zap.String("user_guid", user.GUID),
+				zap.Strings("roles", roleNames))
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("user_guid", user.GUID))
+		}
+		return
+	}
+	service.logger.Info("User roles have been changed by admin",
+		zap.String("user_guid", user.GUID),
+		zap.Strings("roles", roleNames))
+	service.HandleUserRolesGet(w, req)
+}
+
+/* Достаёт роль по имени из пути запроса. Если что-то пошло не так,
+ * ответ клиенту уже записан и возвращается false. */
+func (service *AdminService) roleFromPath(w http.ResponseWriter, req *http.Request) (*model.Role, bool) {
+	name := chi.URLParam(req, "name")
+	role, err := service.roleRepo.GetByName(tenancy.FromContext(req.Context()).ID, name)
+	if err != nil {
+		service.writeRoleError(w, req, err, name)
+		return nil, false
+	}
+	return role, true
+}
+
+func (service *AdminService) writeRoleError(w http.ResponseWriter, req *http.Request, err error, name string) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		service.fail(w, req, problem.RoleNotFound, "Role not found", zap.String("role", name))
+	case errors.Is(err, repository.ErrAlreadyExists):
+		service.fail(w, req, problem.RoleExists, "Role already exists", zap.String("role", name))
+	case errors.Is(err, repository.ErrUnknownReference):
+		service.fail(w, req, problem.UnknownPermission, "Bad request: unknown permission", zap.String("role", name))
+	default:
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("role", name))
+	}
+}
+
+func applyRoleRequest(role *model.Role, body *roleRequest) {
+	if body.Description != nil {
+		role.Description = *body.Description
+	}
+	if body.Permissions != nil {
+		role.Permissions = uniqueSorted(body.Permissions)
+	}
+}
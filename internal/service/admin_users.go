@@ -0,0 +1,335 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strconv"
+
+	"github.com/TooLazyToCreate/auth-service/internal/mailer"
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/password"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+/* Поля-указатели позволяют отличить "не передано" от пустого значения при частичном обновлении */
+type userRequest struct {
+	FirstName     *string `json:"first_name"`
+	LastName      *string `json:"last_name"`
+	Email         *string `json:"email"`
+	EmailVerified *bool   `json:"email_verified"`
+	Locale        *string `json:"locale"`
+	Password      *string `json:"password"`
+}
+
+type passwordRequest struct {
+	Password string `json:"password"`
+}
+
+type userListResponse struct {
+	Users  []model.User `json:"users"`
+	Total  int          `json:"total"`
+	Limit  int          `json:"limit"`
+	Offset int          `json:"offset"`
+}
+
+func (service *AdminService) HandleUserList(w http.ResponseWriter, req *http.Request) {
+	filter := repository.UserFilter{
+		Email: req.URL.Query().Get("email"),
+		Name:  req.URL.Query().Get("name"),
+	}
+	var ok bool
+	if filter.Limit, filter.Offset, ok = service.pageFromQuery(w, req); !ok {
+		return
+	}
+
+	users, total, err := service.userRepo.List(tenancy.FromContext(req.Context()).ID, filter)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	if err = writeJson(w, http.StatusOK, &userListResponse{users, total, filter.Limit, filter.Offset}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+func (service *AdminService) HandleUserGet(w http.ResponseWriter, req *http.Request) {
+	user, ok := service.userFromPath(w, req)
+	if !ok {
+		return
+	}
+	if err := writeJson(w, http.StatusOK, user); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+func (service *AdminService) HandleUserCreate(w http.ResponseWriter, req *http.Request) {
+	body := userRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err))
+		return
+	}
+	if body.Email == nil {
+		service.fail(w, req, problem.InvalidEmail.With("Email is required"), "Bad request: email is required")
+		return
+	}
+
+	user := &model.User{}
+	if !service.applyUserRequest(w, req, user, &body) {
+		return
+	}
+	/* Хэш считаем до создания пользователя, чтобы не оставить его без пароля из-за ошибки */
+	var hash string
+	if body.Password != nil {
+		var ok bool
+		if hash, ok = service.hashPassword(w, req, *body.Password); !ok {
+			return
+		}
+	}
+	tenantID := tenancy.FromContext(req.Context()).ID
+	if err := service.userRepo.Create(tenantID, user); err != nil {
+		service.writeUserError(w, req, err, user.GUID)
+		return
+	}
+	if hash != "" {
+		if err := service.credentialRepo.Set(tenantID, user.GUID, hash); err != nil {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("user_guid", user.GUID))
+			return
+		}
+	}
+	service.logger.Info("User has been created", zap.String("user_guid", user.GUID))
+	if err := writeJson(w, http.StatusCreated, user); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+func (service *AdminService) HandleUserUpdate(w http.ResponseWriter, req *http.Request) {
+	user, ok := service.userFromPath(w, req)
+	if !ok {
+		return
+	}
+	body := userRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err))
+		return
+	}
+	if !service.applyUserRequest(w, req, user, &body) {
+		return
+	}
+	if err := service.userRepo.Update(tenancy.FromContext(req.Context()).ID, user); err != nil {
+		service.writeUserError(w, req, err, user.GUID)
+		return
+	}
+	service.logger.Info("User has been updated", zap.String("user_guid", user.GUID))
+	if err := writeJson(w, http.StatusOK, user); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+func (service *AdminService) HandleUserPassword(w http.ResponseWriter, req *http.Request) {
+	user, ok := service.userFromPath(w, req)
+	if !ok {
+		return
+	}
+	body := passwordRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err))
+		return
+	}
+	hash, ok := service.hashPassword(w, req, body.Password)
+	if !ok {
+		return
+	}
+	tenantID := tenancy.FromContext(req.Context()).ID
+	if err := service.credentialRepo.Set(tenantID, user.GUID, hash); err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("user_guid", user.GUID))
+		return
+	}
+	/* Как и при сбросе пароля: пароль меняют, когда старый мог попасть в чужие руки */
+	if err := service.tokenRepo.DeleteByUserGUID(tenantID, user.GUID); err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("user_guid", user.GUID))
+		return
+	}
+	publishEvent(service.logger, service.events, notify.EventTokenRevoked, user.GUID, req,
+		map[string]string{"reason": "password_changed"})
+	service.logger.Info("User password has been changed, refresh tokens revoked", zap.String("user_guid", user.GUID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* Сброс 2FA для пользователя, потерявшего и телефон, и резервные коды */
+func (service *AdminService) HandleUserTOTPReset(w http.ResponseWriter, req *http.Request) {
+	user, ok := service.userFromPath(w, req)
+	if !ok {
+		return
+	}
+	if err := service.totpRepo.Delete(tenancy.FromContext(req.Context()).ID, user.GUID); err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("user_guid", user.GUID))
+		return
+	}
+	service.logger.Info("User TOTP has been reset by admin", zap.String("user_guid", user.GUID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (service *AdminService) HandleUserDisable(w http.ResponseWriter, req *http.Request) {
+	service.setDisabled(w, req, true)
+}
+
+func (service *AdminService) HandleUserEnable(w http.ResponseWriter, req *http.Request) {
+	service.setDisabled(w, req, false)
+}
+
+func (service *AdminService) HandleUserDelete(w http.ResponseWriter, req *http.Request) {
+	user, ok := service.userFromPath(w, req)
+	if !ok {
+		return
+	}
+	/* Вместе с пользователем удаляются его refresh токены, пароль, 2FA, ключи и роли */
+	if err := service.userRepo.Delete(tenancy.FromContext(req.Context()).ID, user.GUID); err != nil {
+		service.writeUserError(w, req, err, user.GUID)
+		return
+	}
+	publishEvent(service.logger, service.events, notify.EventTokenRevoked, user.GUID, req,
+		map[string]string{"reason": "user_deleted"})
+	service.logger.Info("User has been deleted", zap.String("user_guid", user.GUID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (service *AdminService) setDisabled(w http.ResponseWriter, req *http.Request, disabled bool) {
+	user, ok := service.userFromPath(w, req)
+	if !ok {
+		return
+	}
+	tenantID := tenancy.FromContext(req.Context()).ID
+	if err := service.userRepo.SetDisabled(tenantID, user.GUID, disabled); err != nil {
+		service.writeUserError(w, req, err, user.GUID)
+		return
+	}
+	/* У заблокированного пользователя не должно остаться действующих refresh токенов */
+	if disabled {
+		if err := service.tokenRepo.DeleteByUserGUID(tenantID, user.GUID); err != nil {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+			return
+		}
+		publishEvent(service.logger, service.events, notify.EventTokenRevoked, user.GUID, req,
+			map[string]string{"reason": "user_disabled"})
+	}
+	user.Disabled = disabled
+	service.logger.Info("User disabled flag has been changed",
+		zap.String("user_guid", user.GUID),
+		zap.Bool("disabled", disabled))
+	if err := writeJson(w, http.StatusOK, user); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Разбирает параметры пагинации limit и offset. Если они неверные,
+ * ответ клиенту уже записан и возвращается false. */
+func (service *AdminService) pageFromQuery(w http.ResponseWriter, req *http.Request) (limit int, offset int, ok bool) {
+	limit = defaultPageLimit
+	var err error
+	if value := req.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			service.fail(w, req, problem.MalformedRequest.With("limit must be a number from 1 to 100"), "Bad request",
+				zap.Error(err), zap.String("limit", value))
+			return 0, 0, false
+		}
+	}
+	if value := req.URL.Query().Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			service.fail(w, req, problem.MalformedRequest.With("offset must be a non-negative number"), "Bad request",
+				zap.Error(err), zap.String("offset", value))
+			return 0, 0, false
+		}
+	}
+	return limit, offset, true
+}
+
+/* Достаёт пользователя по GUID из пути запроса. Если что-то пошло не так,
+ * ответ клиенту уже записан и возвращается false. */
+func (service *AdminService) userFromPath(w http.ResponseWriter, req *http.Request) (*model.User, bool) {
+	userGUID := chi.URLParam(req, "guid")
+	if _, err := uuid.Parse(userGUID); err != nil {
+		service.fail(w, req, problem.MalformedRequest.With("guid must be a UUID"), "Bad request", zap.Error(err))
+		return nil, false
+	}
+	user, err := service.userRepo.GetByGUID(tenancy.FromContext(req.Context()).ID, userGUID)
+	if err != nil {
+		service.writeUserError(w, req, err, userGUID)
+		return nil, false
+	}
+	return user, true
+}
+
+func (service *AdminService) applyUserRequest(w http.ResponseWriter, req *http.Request, user *model.User, body *userRequest) bool {
+	if body.FirstName != nil {
+		user.FirstName = *body.FirstName
+	}
+	if body.LastName != nil {
+		user.LastName = *body.LastName
+	}
+	if body.Email != nil {
+		address, err := mail.ParseAddress(*body.Email)
+		if err != nil || address.Address != *body.Email {
+			service.fail(w, req, problem.InvalidEmail, "Bad request: invalid email",
+				zap.Error(err), zap.String("email", *body.Email))
+			return false
+		}
+		/* Новый адрес ещё не подтверждён */
+		if user.Email != address.Address {
+			user.EmailVerified = false
+		}
+		user.Email = address.Address
+	}
+	if body.EmailVerified != nil {
+		user.EmailVerified = *body.EmailVerified
+	}
+	if body.Locale != nil {
+		if *body.Locale != "" && !mailer.ValidLocale(*body.Locale) {
+			service.fail(w, req, problem.InvalidLocale, "Bad request: invalid locale",
+				zap.String("locale", *body.Locale))
+			return false
+		}
+		user.Locale = *body.Locale
+	}
+	return true
+}
+
+func (service *AdminService) hashPassword(w http.ResponseWriter, req *http.Request, plain string) (string, bool) {
+	if !passwordAcceptable(service.cfg, plain) {
+		service.fail(w, req, problem.PasswordTooShort, "Bad request: password is too short")
+		return "", false
+	}
+	hash, err := password.Hash(plain, passwordParams(service.cfg))
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to hash password", zap.Error(err))
+		return "", false
+	}
+	return hash, true
+}
+
+func (service *AdminService) writeUserError(w http.ResponseWriter, req *http.Request, err error, userGUID string) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		service.fail(w, req, problem.UserNotFound, "User not found", zap.String("user_guid", userGUID))
+	case errors.Is(err, repository.ErrAlreadyExists):
+		service.fail(w, req, problem.EmailTaken, "User with this email already exists",
+			zap.String("user_guid", userGUID))
+	default:
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("user_guid", userGUID))
+	}
+}
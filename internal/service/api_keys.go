@@ -0,0 +1,315 @@
+package service
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	/* Обмен API ключа на access токен на /oauth/token, ключ передаётся в параметре api_key */
+	grantAPIKey         = "urn:auth-service:grant-type:api-key"
+	defaultAPIKeyPrefix = "ak"
+	/* ID ключа - 8 случайных байт в hex */
+	apiKeyIDLength      = 16
+	maxAPIKeyNameLength = 100
+)
+
+var errAPIKeyInvalid = errors.New("API key is unknown, expired or belongs to an unavailable user")
+
+type apiKeyRequest struct {
+	Name string `json:"name"`
+	/* Необязательные scope через пробел, сужаются до прав токена, которым создаётся ключ */
+	Scope *string `json:"scope"`
+	/* Через сколько секунд ключ истечёт, без него ключ бессрочный */
+	ExpiresIn *int64 `json:"expires_in"`
+}
+
+/* Сам ключ отдаётся только в ответе на создание */
+type apiKeyCreateResponse struct {
+	model.APIKey
+	Key string `json:"key"`
+}
+
+func (service *AuthService) HandleAPIKeyList(w http.ResponseWriter, req *http.Request) {
+	keys, err := service.apiKeyRepo.ListByUserGUID(tenancy.FromContext(req.Context()).ID, userGUIDFromContext(req.Context()))
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	if err = writeJson(w, http.StatusOK, keys); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Создаёт ключ для скриптов и CI. Права ключа не шире прав токена, которым он создаётся:
+ * иначе из токена с узким scope можно было бы получить ключ со всеми правами пользователя. */
+func (service *AuthService) HandleAPIKeyCreate(w http.ResponseWriter, req *http.Request) {
+	userGUID := userGUIDFromContext(req.Context())
+	body := apiKeyRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err))
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	if body.Name == "" || utf8.RuneCountInString(body.Name) > maxAPIKeyNameLength {
+		service.fail(w, req, problem.MalformedRequest.With("name is required and must be up to 100 characters"),
+			"Bad request: invalid API key name", zap.String("user_guid", userGUID))
+		return
+	}
+	if body.ExpiresIn != nil && *body.ExpiresIn <= 0 {
+		service.fail(w, req, problem.MalformedRequest.With("expires_in must be positive"),
+			"Bad request: invalid API key expiry", zap.String("user_guid", userGUID))
+		return
+	}
+
+	tenant := tenancy.FromContext(req.Context())
+	if service.cfg.APIKeys.MaxPerUser > 0 {
+		keys, err := service.apiKeyRepo.ListByUserGUID(tenant.ID, userGUID)
+		if err != nil {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+			return
+		}
+		if len(keys) >= service.cfg.APIKeys.MaxPerUser {
+			service.fail(w, req, problem.APIKeyLimitExceeded, "API key limit exceeded",
+				zap.String("user_guid", userGUID),
+				zap.Int("keys", len(keys)))
+			return
+		}
+	}
+	grant, err := userGrant(service.roleRepo, tenant.ID, userGUID, body.Scope)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("user_guid", userGUID))
+		return
+	}
+	scope := grant.Scope
+	if tokenScope := claimScope(accessClaimsFromContext(req.Context())["scope"]); tokenScope != nil {
+		scope = narrowScope(strings.Fields(*tokenScope), &scope)
+	}
+
+	key, id, err := service.newAPIKey()
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to generate API key", zap.Error(err))
+		return
+	}
+	apiKey := model.APIKey{
+		ID:       id,
+		UserGUID: userGUID,
+		Name:     body.Name,
+		Hash:     clientSecretHash(key),
+		Scopes:   strings.Fields(scope),
+	}
+	if body.ExpiresIn != nil {
+		expiresAt := time.Now().Add(time.Duration(*body.ExpiresIn) * time.Second)
+		apiKey.ExpiresAt = &expiresAt
+	}
+	if err = service.apiKeyRepo.Create(tenant.ID, &apiKey); err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	service.logger.Info("API key has been created",
+		zap.String("user_guid", userGUID),
+		zap.String("api_key_id", id),
+		zap.String("scope", scope))
+	w.Header().Set("Cache-Control", "no-store")
+	if err = writeJson(w, http.StatusCreated, &apiKeyCreateResponse{apiKey, key}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+func (service *AuthService) HandleAPIKeyDelete(w http.ResponseWriter, req *http.Request) {
+	userGUID := userGUIDFromContext(req.Context())
+	id := chi.URLParam(req, "id")
+	err := service.apiKeyRepo.Delete(tenancy.FromContext(req.Context()).ID, userGUID, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			service.fail(w, req, problem.APIKeyNotFound, "API key not found",
+				zap.String("user_guid", userGUID),
+				zap.String("api_key_id", id))
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return
+	}
+	service.logger.Info("API key has been revoked", zap.String("user_guid", userGUID), zap.String("api_key_id", id))
+	service.publishEvent(notify.EventTokenRevoked, userGUID, req, map[string]string{
+		"reason":     "api_key_revoked",
+		"api_key_id": id,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* Обмен ключа на короткоживущий access токен без refresh токена. Права берутся из ключа и сужаются до текущих
+ * прав пользователя, так что снятая с пользователя роль сразу пропадает и из токенов по ключу.
+ * Токен не переживает сам ключ: claim api_key_id показывает, по какому ключу он выдан, и после отзыва или истечения
+ * ключа Authenticate и introspection токен не принимают. */
+func (service *AuthService) exchangeAPIKey(w http.ResponseWriter, req *http.Request) {
+	tenant := tenancy.FromContext(req.Context())
+	key, user, err := service.lookupAPIKey(tenant.ID, req.PostForm.Get("api_key"))
+	if err != nil {
+		if errors.Is(err, errAPIKeyInvalid) {
+			service.oauthFail(w, req, problem.OAuthInvalidGrant, "API key is invalid", zap.Error(err),
+				zap.String("ip", req.RemoteAddr))
+		} else {
+			service.oauthFail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return
+	}
+	if !service.allowUser(user.GUID, w, req) {
+		return
+	}
+	grant, err := service.apiKeyGrant(tenant.ID, key, req.PostForm.Get("scope"))
+	if err != nil {
+		service.oauthFail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("user_guid", user.GUID))
+		return
+	}
+	lifetime := service.cfg.APIKeys.TokenLifetime
+	if lifetime <= 0 {
+		lifetime = tenant.AccessTokenLifetime
+	}
+	now := time.Now()
+	if key.ExpiresAt != nil {
+		lifetime = min(lifetime, int64(key.ExpiresAt.Sub(now)/time.Second))
+	}
+
+	claims := map[string]interface{}{
+		"guid":       user.GUID,
+		"tid":        tenant.ID,
+		"ip":         req.RemoteAddr,
+		"iat":        now.Unix(),
+		"exp":        now.Unix() + lifetime,
+		"roles":      grant.Roles,
+		"scope":      grant.Scope,
+		"api_key_id": key.ID,
+	}
+	if tenant.Issuer != "" {
+		claims["iss"] = tenant.Issuer
+	}
+	accessToken, err := token.NewAccessToken(tenant.Secret, claims)
+	if err != nil {
+		service.oauthFail(w, req, problem.Internal, "Failed to generate token", zap.Error(err),
+			zap.String("user_guid", user.GUID))
+		return
+	}
+	result, err := (&token.Pair{Access: accessToken}).ToOAuthJson(lifetime, grant.Scope)
+	if err != nil {
+		service.oauthFail(w, req, problem.Internal, "JSON failure", zap.Error(err))
+		return
+	}
+	service.logger.Info("API key has been exchanged for access token",
+		zap.String("user_guid", user.GUID),
+		zap.String("api_key_id", key.ID),
+		zap.String("ip", req.RemoteAddr))
+	service.publishEvent(notify.EventTokenIssued, user.GUID, req, map[string]string{
+		"grant_type": grantAPIKey,
+		"api_key_id": key.ID,
+		"scope":      grant.Scope,
+	})
+	writeTokenResponse(w, result)
+}
+
+/* Находит ключ и его владельца и отмечает использование ключа. Неизвестный или истёкший ключ, а также ключ
+ * удалённого или заблокированного пользователя дают errAPIKeyInvalid, остальные ошибки - ошибки базы. */
+func (service *AuthService) lookupAPIKey(tenantID string, raw string) (*model.APIKey, *model.User, error) {
+	id, ok := parseAPIKey(service.apiKeyPrefix(), raw)
+	if !ok {
+		return nil, nil, errAPIKeyInvalid
+	}
+	key, err := service.apiKeyRepo.GetByID(tenantID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, errAPIKeyInvalid
+	} else if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	if !clientSecretMatches(key.Hash, raw) || (key.ExpiresAt != nil && !now.Before(*key.ExpiresAt)) {
+		return nil, nil, errAPIKeyInvalid
+	}
+	user, err := service.userRepo.GetByGUID(tenantID, key.UserGUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, errAPIKeyInvalid
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if user.Disabled {
+		return nil, nil, errAPIKeyInvalid
+	}
+	/* Время использования нужно только для справки, ключ принимается и без него */
+	if err = service.apiKeyRepo.Touch(tenantID, key.ID, now); err != nil {
+		service.logger.Error("Failed to update API key last use", zap.Error(err), zap.String("api_key_id", key.ID))
+	}
+	return key, user, nil
+}
+
+/* Жив ли ключ, по которому выдан access токен. Токены без api_key_id к ключам не относятся, для них true. */
+func (service *AuthService) apiKeyAlive(tenantID string, claims map[string]interface{}) (bool, error) {
+	id, ok := claims["api_key_id"].(string)
+	if !ok {
+		return true, nil
+	}
+	key, err := service.apiKeyRepo.GetByID(tenantID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	userGUID, _ := claims["guid"].(string)
+	return key.UserGUID == userGUID && (key.ExpiresAt == nil || time.Now().Before(*key.ExpiresAt)), nil
+}
+
+/* Права ключа на текущий момент. requested - необязательные scope через пробел, которые сужают права ключа. */
+func (service *AuthService) apiKeyGrant(tenantID string, key *model.APIKey, requested string) (*accessGrant, error) {
+	scope := strings.Join(key.Scopes, " ")
+	grant, err := userGrant(service.roleRepo, tenantID, key.UserGUID, &scope)
+	if err == nil && requested != "" {
+		grant.Scope = narrowScope(strings.Fields(grant.Scope), &requested)
+	}
+	return grant, err
+}
+
+func (service *AuthService) apiKeyPrefix() string {
+	if service.cfg.APIKeys.Prefix != "" {
+		return service.cfg.APIKeys.Prefix
+	}
+	return defaultAPIKeyPrefix
+}
+
+/* Ключ выглядит как <prefix>_<id>_<secret>: по id он находится в базе, а хранится только sha256 от всего ключа,
+ * как и секреты клиентов OAuth. У ключа 256 бит случайности, поэтому медленный хэш ему не нужен. */
+func (service *AuthService) newAPIKey() (key string, id string, err error) {
+	random := make([]byte, apiKeyIDLength/2+32)
+	if _, err = rand.Read(random); err != nil {
+		return "", "", err
+	}
+	id = hex.EncodeToString(random[:apiKeyIDLength/2])
+	key = service.apiKeyPrefix() + "_" + id + "_" + base64.RawURLEncoding.EncodeToString(random[apiKeyIDLength/2:])
+	return key, id, nil
+}
+
+/* Достаёт id из ключа. Секрет в base64url может содержать "_", поэтому id отрезается по длине. */
+func parseAPIKey(prefix string, raw string) (string, bool) {
+	rest, ok := strings.CutPrefix(raw, prefix+"_")
+	if !ok || len(rest) <= apiKeyIDLength+1 || rest[apiKeyIDLength] != '_' {
+		return "", false
+	}
+	id := rest[:apiKeyIDLength]
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", false
+	}
+	return id, true
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+/* Меняет ключ на access токен через /oauth/token */
+func (env *testEnv) exchangeAPIKey(key string) string {
+	response := env.do("acme", http.MethodPost, "/oauth/token", url.Values{
+		"grant_type": {grantAPIKey},
+		"api_key":    {key},
+	}.Encode(), "")
+	if response.Code != http.StatusOK {
+		env.t.Fatalf("exchange: %d %s", response.Code, response.Body.String())
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+		env.t.Fatal(err)
+	}
+	accessToken, _ := result["access_token"].(string)
+	return accessToken
+}
+
+/* Токен по ключу годится для доступа к данным, но не для управления аккаунтом, и умирает вместе с ключом */
+func TestAPIKeyToken(t *testing.T) {
+	env, apiKeys := newIntrospectionEnv(t)
+	env.router.Post("/oauth/token", env.service.HandleOAuthToken)
+	reached := func(w http.ResponseWriter, req *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	env.router.Group(func(r chi.Router) {
+		r.Use(env.service.Authenticate)
+		r.Get("/userinfo", reached)
+		r.Group(func(r chi.Router) {
+			r.Use(env.service.RejectDelegated)
+			r.Post("/user/api-keys", reached)
+			r.Post("/user/webauthn/register/begin", reached)
+		})
+	})
+	user := env.addUser("acme", "ivan@acme.example")
+	key, id := env.addAPIKey(apiKeys, "acme", user)
+	keyToken := env.exchangeAPIKey(key)
+	if keyID := env.accessClaims("acme", keyToken)["api_key_id"]; keyID != id {
+		t.Fatalf("api_key_id = %v", keyID)
+	}
+
+	if response := env.do("acme", http.MethodGet, "/userinfo", "", keyToken); response.Code != http.StatusNoContent {
+		t.Fatalf("API key token must give access to the data: %d %s", response.Code, response.Body.String())
+	}
+	for _, path := range []string{"/user/api-keys", "/user/webauthn/register/begin"} {
+		response := env.do("acme", http.MethodPost, path, "", keyToken)
+		if response.Code != http.StatusForbidden || problemCode(t, response) != "delegated_token_forbidden" {
+			t.Errorf("POST %s: %d %s", path, response.Code, response.Body.String())
+		}
+	}
+
+	if err := apiKeys.Delete("acme", user.GUID, id); err != nil {
+		t.Fatal(err)
+	}
+	response := env.do("acme", http.MethodGet, "/userinfo", "", keyToken)
+	if response.Code != http.StatusUnauthorized || problemCode(t, response) != "access_token_invalid" {
+		t.Errorf("token of revoked key: %d %s", response.Code, response.Body.String())
+	}
+	if _, result := env.introspect("rs", "secret", keyToken); result["active"] != false {
+		t.Errorf("introspection of token of revoked key: %v", result)
+	}
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
+	"go.uber.org/zap"
+)
+
+type contextKey int
+
+const (
+	userGUIDKey contextKey = iota
+	accessClaimsKey
+)
+
+var errTenantMismatch = errors.New("token belongs to another tenant")
+
+/* Пропускает дальше только запросы с действующим access токеном тенанта запроса в заголовке
+ * "Authorization: Bearer <access_token>" и кладёт GUID пользователя в контекст запроса. */
+func (service *AuthService) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		bearer, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			service.fail(w, req, problem.AccessTokenMissing, "Access token is missing",
+				zap.String("ip", req.RemoteAddr))
+			return
+		}
+		tenant := tenancy.FromContext(req.Context())
+		pair := &token.Pair{Access: []byte(bearer)}
+		claims, err := pair.AccessTokenPayload(tenant.Secret)
+		if err == nil && !tokenOfTenant(claims, tenant) {
+			err = errTenantMismatch
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			service.fail(w, req, problem.AccessTokenInvalid, "Access token is invalid",
+				zap.Error(err), zap.String("ip", req.RemoteAddr))
+			return
+		}
+
+		/* exp в access токене нет, поэтому время жизни считаем от iat */
+		iat, ok := claimInt64(claims["iat"])
+		userGUID, guidOk := claims["guid"].(string)
+		if !ok || !guidOk || time.Now().Unix()-iat > tenant.AccessTokenLifetime {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			service.fail(w, req, problem.AccessTokenExpired, "Access token is expired",
+				zap.String("ip", req.RemoteAddr))
+			return
+		}
+		/* access токен нельзя отозвать, поэтому заблокированного или удалённого пользователя
+		 * отсекаем здесь, а не ждём, пока токен истечёт */
+		user, err := service.userRepo.GetByGUID(tenant.ID, userGUID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+			return
+		}
+		if err != nil || user.Disabled {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			service.fail(w, req, problem.UserUnavailable, "User not found or disabled",
+				zap.String("ip", req.RemoteAddr),
+				zap.String("user_guid", userGUID))
+			return
+		}
+		/* Токен, выданный по API ключу, отзывается вместе с ключом */
+		alive, err := service.apiKeyAlive(tenant.ID, claims)
+		if err != nil {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+			return
+		}
+		if !alive {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			service.fail(w, req, problem.AccessTokenInvalid, "API key of the access token has been revoked",
+				zap.String("ip", req.RemoteAddr),
+				zap.String("user_guid", userGUID),
+				zap.Any("api_key_id", claims["api_key_id"]))
+			return
+		}
+		ctx := context.WithValue(req.Context(), userGUIDKey, userGUID)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(ctx, accessClaimsKey, claims)))
+	})
+}
+
+/* Токен подписан ключом тенанта, так что чужой токен не пройдёт проверку подписи. tid проверяется на случай,
+ * когда у тенантов общий ключ (secret_env указывает на одну переменную). Токены без tid выпущены
+ * до появления тенантов и принадлежат тенанту default. */
+func tokenOfTenant(claims map[string]interface{}, tenant *tenancy.Tenant) bool {
+	tenantID, ok := claims["tid"].(string)
+	if !ok {
+		tenantID = tenancy.DefaultID
+	}
+	return tenantID == tenant.ID
+}
+
+/* Сессия администратора под пользователем (claim act) только смотрит: через неё нельзя менять способы входа
+ * и давать доступ приложениям, иначе администратор получил бы от имени пользователя долгоживущие токены. */
+func (service *AuthService) RejectImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if actor, ok := impersonatorFromContext(req.Context()); ok {
+			service.fail(w, req, problem.ImpersonationForbidden, "Impersonated session tried to change credentials",
+				zap.String("actor", actor),
+				zap.String("user_guid", userGUIDFromContext(req.Context())))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+/* Токен, который пользователь выдал приложению через OAuth (claim client_id), нужен приложению для доступа к данным.
+ * Завести через него passkey или API ключ либо разрешить доступ другому приложению значило бы отдать приложению
+ * весь аккаунт, поэтому на такие эндпоинты пускаем только токены самого пользователя. То же с токеном, полученным
+ * по API ключу (claim api_key_id): иначе утёкший ключ скрипта с узкими правами и сроком превращался бы
+ * в бессрочный доступ ко всему аккаунту. */
+func (service *AuthService) RejectDelegated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		claims := accessClaimsFromContext(req.Context())
+		if clientID, ok := claims["client_id"].(string); ok {
+			service.fail(w, req, problem.DelegatedTokenForbidden, "Application token tried to change credentials",
+				zap.String("client_id", clientID),
+				zap.String("user_guid", userGUIDFromContext(req.Context())))
+			return
+		}
+		if keyID, ok := claims["api_key_id"].(string); ok {
+			service.fail(w, req, problem.DelegatedTokenForbidden, "API key token tried to change credentials",
+				zap.String("api_key_id", keyID),
+				zap.String("user_guid", userGUIDFromContext(req.Context())))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+/* Имя администратора из claim act, если токен выдан через вход под пользователем */
+func impersonatorFromContext(ctx context.Context) (string, bool) {
+	act, ok := accessClaimsFromContext(ctx)["act"].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	actor, _ := act["sub"].(string)
+	return actor, true
+}
+
+func userGUIDFromContext(ctx context.Context) string {
+	userGUID, _ := ctx.Value(userGUIDKey).(string)
+	return userGUID
+}
+
+/* Все claims проверенного access токена */
+func accessClaimsFromContext(ctx context.Context) map[string]interface{} {
+	claims, _ := ctx.Value(accessClaimsKey).(map[string]interface{})
+	return claims
+}
+
+/* jwt декодирует claims с UseNumber, поэтому числа приходят как json.Number, а не float64 */
+func claimInt64(value interface{}) (int64, bool) {
+	switch number := value.(type) {
+	case json.Number:
+		result, err := number.Int64()
+		return result, err == nil
+	case float64:
+		return int64(number), true
+	}
+	return 0, false
+}
+
+/* Время входа пользователя из access токена. В токенах, выпущенных до появления auth_time, его нет,
+ * тогда берём iat: точнее время входа уже не узнать. */
+func claimAuthTime(claims map[string]interface{}) int64 {
+	if authTime, ok := claimInt64(claims["auth_time"]); ok {
+		return authTime
+	}
+	iat, _ := claimInt64(claims["iat"])
+	return iat
+}
+
+/* После json.Unmarshal в map массивы строк приходят как []interface{} */
+func claimStrings(value interface{}) []string {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		if str, ok := item.(string); ok {
+			result = append(result, str)
+		}
+	}
+	return result
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
+	"go.uber.org/zap"
+)
+
+const grantClientCredentials = "client_credentials"
+
+/* client_credentials (RFC 6749, 4.4): сервис получает токен для себя, а не для пользователя.
+ * sub и client_id в токене - идентификатор клиента, guid нет, поэтому пользовательские эндпоинты его не примут.
+ * Refresh токен не выдаётся: за новым токеном клиент просто приходит ещё раз. */
+func (service *AuthService) issueClientCredentials(w http.ResponseWriter, req *http.Request) {
+	client := service.authenticateClient(w, req, grantClientCredentials)
+	if client == nil {
+		return
+	}
+	scope, ok := grantedScope(client.Scopes, req.PostForm.Get("scope"))
+	if !ok {
+		service.oauthFail(w, req, problem.OAuthInvalidScope, "Requested scope is not allowed for the client",
+			zap.String("client_id", client.ID),
+			zap.String("scope", req.PostForm.Get("scope")))
+		return
+	}
+	tenant := tenancy.FromContext(req.Context())
+	lifetime := client.TokenLifetime
+	if lifetime <= 0 {
+		lifetime = tenant.AccessTokenLifetime
+	}
+
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"sub":       client.ID,
+		"client_id": client.ID,
+		"tid":       tenant.ID,
+		"scope":     scope,
+		"iat":       now,
+		"exp":       now + lifetime,
+	}
+	if tenant.Issuer != "" {
+		claims["iss"] = tenant.Issuer
+	}
+	accessToken, err := token.NewAccessToken(tenant.Secret, claims)
+	if err != nil {
+		service.oauthFail(w, req, problem.Internal, "Failed to generate token", zap.Error(err),
+			zap.String("client_id", client.ID))
+		return
+	}
+	result, err := (&token.Pair{Access: accessToken}).ToOAuthJson(lifetime, scope)
+	if err != nil {
+		service.oauthFail(w, req, problem.Internal, "JSON failure", zap.Error(err))
+		return
+	}
+	service.logger.Info("Client credentials token has been issued",
+		zap.String("client_id", client.ID),
+		zap.String("scope", scope),
+		zap.String("ip", req.RemoteAddr))
+	service.publishEvent(notify.EventTokenIssued, "", req, map[string]string{
+		"grant_type": grantClientCredentials,
+		"client_id":  client.ID,
+		"scope":      scope,
+	})
+	writeTokenResponse(w, result)
+}
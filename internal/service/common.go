@@ -1,79 +1,323 @@
 package service
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
 	"github.com/TooLazyToCreate/auth-service/config"
+	"github.com/TooLazyToCreate/auth-service/internal/federation"
+	"github.com/TooLazyToCreate/auth-service/internal/ippolicy"
+	"github.com/TooLazyToCreate/auth-service/internal/mailer"
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/password"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/ratelimit"
 	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
 	"github.com/TooLazyToCreate/auth-service/internal/token"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
-	"net/smtp"
+	"slices"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type AuthService struct {
-	logger    *zap.Logger
-	cfg       *config.Config
-	userRepo  repository.UserRepository
-	tokenRepo repository.TokenRepository
-	smtpAuth  *smtp.Auth
+	logger         *zap.Logger
+	cfg            *config.Config
+	userRepo       repository.UserRepository
+	tokenRepo      repository.TokenRepository
+	credentialRepo repository.CredentialRepository
+	linkTokenRepo  repository.LinkTokenRepository
+	totpRepo       repository.TOTPRepository
+	webauthnRepo   repository.WebAuthnRepository
+	lockoutRepo    repository.LockoutRepository
+	authCodeRepo   repository.AuthorizationCodeRepository
+	clientRepo     repository.OAuthClientRepository
+	deviceRepo     repository.DeviceAuthorizationRepository
+	roleRepo       repository.RoleRepository
+	apiKeyRepo     repository.APIKeyRepository
+	federationRepo repository.FederationRepository
+	replayRepo     repository.ReplayRepository
+	outbox         *notify.Outbox
+	events         *notify.EventPublisher
+	templates      *mailer.Templates
+	limiter        *ratelimit.Limiter
+	ipPolicy       *ippolicy.Policy
+	/* nil, если oidc.key_file не задан: тогда id_token не выдаются */
+	idTokens *token.IDTokenSigner
+	/* Внешние провайдеры OpenID Connect по id */
+	providers map[string]*federation.Provider
 }
 
-func NewAuthService(logger *zap.Logger, cfg *config.Config, smtpAuth *smtp.Auth, userRepo repository.UserRepository, tokenRepo repository.TokenRepository) *AuthService {
+func NewAuthService(logger *zap.Logger, cfg *config.Config, outbox *notify.Outbox, events *notify.EventPublisher,
+	templates *mailer.Templates,
+	userRepo repository.UserRepository,
+	tokenRepo repository.TokenRepository, credentialRepo repository.CredentialRepository,
+	linkTokenRepo repository.LinkTokenRepository, totpRepo repository.TOTPRepository,
+	webauthnRepo repository.WebAuthnRepository, lockoutRepo repository.LockoutRepository,
+	authCodeRepo repository.AuthorizationCodeRepository, clientRepo repository.OAuthClientRepository,
+	deviceRepo repository.DeviceAuthorizationRepository, roleRepo repository.RoleRepository,
+	apiKeyRepo repository.APIKeyRepository, federationRepo repository.FederationRepository,
+	replayRepo repository.ReplayRepository, limiter *ratelimit.Limiter,
+	ipPolicy *ippolicy.Policy, idTokens *token.IDTokenSigner, providers map[string]*federation.Provider) *AuthService {
 	return &AuthService{
 		logger,
 		cfg,
 		userRepo,
 		tokenRepo,
-		smtpAuth,
+		credentialRepo,
+		linkTokenRepo,
+		totpRepo,
+		webauthnRepo,
+		lockoutRepo,
+		authCodeRepo,
+		clientRepo,
+		deviceRepo,
+		roleRepo,
+		apiKeyRepo,
+		federationRepo,
+		replayRepo,
+		outbox,
+		events,
+		templates,
+		limiter,
+		ipPolicy,
+		idTokens,
+		providers,
 	}
 }
 
-func (service *AuthService) createTokens(userGUID string, w http.ResponseWriter, req *http.Request) {
-	/* В access токене содержится guid, ip-адрес и время выпуска + jti, который добавляется в token.NewPair;
-	 * В refresh токене содержится только ip-адрес и время выпуска. */
-	pair, err := token.NewPair(service.cfg.Secret, map[string]interface{}{
-		"guid": userGUID,
-		"ip":   req.RemoteAddr,
-		"iat":  time.Now().Unix(),
-	}, map[string]interface{}{"ip": req.RemoteAddr, "iat": time.Now().Unix()})
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		service.logger.Error("Failed to generate token", zap.Error(err),
+/* Лимит запросов на одного пользователя, чтобы нельзя было перебирать токены и пароли
+ * конкретного аккаунта с разных IP. Если лимит исчерпан, отвечаем 429 и возвращаем false. */
+func (service *AuthService) allowUser(userGUID string, w http.ResponseWriter, req *http.Request) bool {
+	allowed, retryAfter := service.limiter.AllowUser(userGUID)
+	if !allowed {
+		ratelimit.TooManyRequests(w, req, retryAfter)
+		service.logger.Warn("User rate limit exceeded", correlationField(req),
 			zap.String("ip", req.RemoteAddr),
 			zap.String("user_guid", userGUID))
-		return
 	}
+	return allowed
+}
 
-	/* Генерируем bcrypt хэш refresh токена */
-	refreshTokenHash, err := bcrypt.GenerateFromPassword(pair.Refresh, bcrypt.DefaultCost)
+func (service *AuthService) fail(w http.ResponseWriter, req *http.Request, failure *problem.Problem,
+	message string, fields ...zap.Field) {
+	fail(service.logger, w, req, failure, message, fields...)
+}
+
+/* Отвечает клиенту ошибкой failure (application/problem+json). Подробности - message и fields -
+ * клиент не видит, они пишутся только в лог вместе с correlation_id из ответа. */
+func fail(logger *zap.Logger, w http.ResponseWriter, req *http.Request, failure *problem.Problem,
+	message string, fields ...zap.Field) {
+	problem.Write(w, req, failure)
+	logger.Error(message, append(fields, correlationField(req))...)
+}
+
+/* bcrypt не принимает больше 72 байт, а refresh токен с IPv6 адресом длиннее, поэтому хэшируется sha256 от токена */
+func refreshTokenDigest(refresh []byte) []byte {
+	sum := sha256.Sum256(refresh)
+	return []byte(base64.RawStdEncoding.EncodeToString(sum[:]))
+}
+
+func correlationField(req *http.Request) zap.Field {
+	return zap.String("correlation_id", problem.CorrelationID(req.Context()))
+}
+
+func (service *AuthService) notifyUserByGUID(tenant *tenancy.Tenant, userGUID string, kind string, data mailer.Data) {
+	user, err := service.userRepo.GetByGUID(tenant.ID, userGUID)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		service.logger.Error("Failed to generate bcrypt hash", zap.Error(err),
-			zap.String("refresh_token", string(pair.Refresh)),
+		service.logger.Error("Could not notify user, user not found", zap.Error(err),
+			zap.String("kind", kind),
 			zap.String("user_guid", userGUID))
 		return
 	}
+	service.notifyUser(tenant, user, kind, data)
+}
 
-	/* Записываем хэш refresh токена и guid пользователя в таблицу tokens */
-	err = service.tokenRepo.Create(string(refreshTokenHash), userGUID)
+func (service *AuthService) notifyUser(tenant *tenancy.Tenant, user *model.User, kind string, data mailer.Data) {
+	enqueueNotification(service.logger, service.outbox, service.templates, tenant, user, kind, data)
+}
+
+/* Собирает письмо по шаблону kind на языке пользователя и ставит его в очередь от имени отправителя тенанта,
+ * отправит его notify.Worker. Ошибки только логируются: из-за недоставленного письма запрос пользователя не должен падать. */
+func enqueueNotification(logger *zap.Logger, outbox *notify.Outbox, templates *mailer.Templates,
+	tenant *tenancy.Tenant, user *model.User, kind string, data mailer.Data) {
+	data.FirstName = user.FirstName
+	data.LastName = user.LastName
+	data.Email = user.Email
+	content, err := templates.Render(kind, user.Locale, data)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		service.logger.Error("Failed to write bcrypt hash to database",
-			zap.Error(err), zap.String("ip", req.RemoteAddr),
+		logger.Error("Failed to render email template", zap.Error(err),
+			zap.String("kind", kind),
+			zap.String("locale", user.Locale))
+		return
+	}
+	err = outbox.Enqueue(&notify.Message{
+		Kind:     kind,
+		From:     tenant.MailFrom,
+		To:       user.Email,
+		UserGUID: user.GUID,
+		Subject:  content.Subject,
+		Text:     content.Text,
+		HTML:     content.HTML,
+	})
+	if err != nil {
+		logger.Error("Failed to enqueue notification", zap.Error(err),
+			zap.String("kind", kind),
+			zap.String("user_guid", user.GUID))
+	}
+}
+
+func (service *AuthService) publishEvent(eventType string, userGUID string, req *http.Request, details map[string]string) {
+	publishEvent(service.logger, service.events, eventType, userGUID, req, details)
+}
+
+/* Ставит событие в очередь вебхуков. Как и с письмами, ошибка только логируется. */
+func publishEvent(logger *zap.Logger, events *notify.EventPublisher, eventType string, userGUID string,
+	req *http.Request, details map[string]string) {
+	err := events.Publish(&notify.Event{
+		Type:     eventType,
+		Tenant:   tenancy.FromContext(req.Context()).ID,
+		UserGUID: userGUID,
+		IP:       req.RemoteAddr,
+		Details:  details,
+	})
+	if err != nil {
+		logger.Error("Failed to publish security event", zap.Error(err),
+			zap.String("type", eventType),
 			zap.String("user_guid", userGUID))
+	}
+}
+
+func passwordParams(cfg *config.Config) password.Params {
+	return password.Params{
+		Memory:      cfg.Password.Memory,
+		Iterations:  cfg.Password.Iterations,
+		Parallelism: cfg.Password.Parallelism,
+		SaltLength:  cfg.Password.SaltLength,
+		KeyLength:   cfg.Password.KeyLength,
+	}
+}
+
+func passwordAcceptable(cfg *config.Config, plain string) bool {
+	minLength := cfg.Password.MinLength
+	if minLength == 0 {
+		minLength = password.DefaultMinLength
+	}
+	return utf8.RuneCountInString(plain) >= minLength
+}
+
+/* Выдаёт токены пользователю, прошедшему первый фактор (amr - использованные способы входа).
+ * При require_verified_email пользователю с неподтверждённым email отвечаем 403.
+ * Если в amr уже есть "mfa" (например, passkey с проверкой пользователя), TOTP не запрашивается.
+ * Если у пользователя включена двухфакторная аутентификация, вместо токенов отдаётся mfa_token,
+ * который нужно обменять на токены вместе с кодом через HandleMFA.
+ * scope - запрошенные scope, nil - все права пользователя. */
+func (service *AuthService) issueTokens(user *model.User, amr []string, scope *string, w http.ResponseWriter, req *http.Request) {
+	if service.cfg.RequireVerifiedEmail && !user.EmailVerified {
+		service.fail(w, req, problem.EmailNotVerified, "Email is not verified",
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", user.GUID))
 		return
 	}
+	totp, err := service.totpRepo.GetByUserGUID(tenancy.FromContext(req.Context()).ID, user.GUID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	if err == nil && totp.Confirmed && !slices.Contains(amr, "mfa") {
+		service.requireMFA(user.GUID, amr, scope, w, req)
+		return
+	}
+	if service.createTokens(user.GUID, "", amr, scope, time.Now().Unix(), w, req) {
+		service.publishEvent(notify.EventTokenIssued, user.GUID, req, map[string]string{"amr": strings.Join(amr, " ")})
+	}
+}
+
+/* Выдаёт пару токенов и возвращает true, если ответ с ними отправлен */
+func (service *AuthService) createTokens(userGUID string, clientID string, amr []string, scope *string, authTime int64,
+	w http.ResponseWriter, req *http.Request) bool {
+	pair, _ := service.newPair(userGUID, clientID, amr, scope, authTime, w, req)
+	if pair == nil {
+		return false
+	}
 
 	/* Выдаём пару токенов в виде JSON */
 	result, err := pair.ToJson()
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		service.logger.Error("JSON failure", zap.Error(err))
-		return
+		service.fail(w, req, problem.Internal, "JSON failure", zap.Error(err))
+		return false
 	}
 	service.logger.Debug("New tokens were given")
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	w.Write(result)
+	return true
+}
+
+/* Выпускает пару токенов и сохраняет хэш refresh токена. authTime - время входа пользователя (unix), при обновлении
+ * токенов оно переносится из старого access токена. clientID - приложение, которому пользователь выдал токены через OAuth,
+ * у токенов самого пользователя он пустой. Возвращает пару и выданный scope
+ * (запрошенный, суженный до прав пользователя). Если что-то пошло не так, ответ клиенту уже записан и возвращается nil. */
+func (service *AuthService) newPair(userGUID string, clientID string, amr []string, scope *string, authTime int64,
+	w http.ResponseWriter, req *http.Request) (*token.Pair, string) {
+	tenant := tenancy.FromContext(req.Context())
+	grant, err := userGrant(service.roleRepo, tenant.ID, userGUID, scope)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("user_guid", userGUID))
+		return nil, ""
+	}
+	/* В access токене содержится guid, тенант (tid, iss), ip-адрес, время выпуска и входа, способы входа (amr), роли,
+	 * scope, приложение (client_id) + jti, который добавляется в token.NewPair; в refresh токене содержится только ip-адрес
+	 * и время выпуска. */
+	accessPayload := map[string]interface{}{
+		"guid":      userGUID,
+		"tid":       tenant.ID,
+		"ip":        req.RemoteAddr,
+		"iat":       time.Now().Unix(),
+		"auth_time": authTime,
+		"roles":     grant.Roles,
+		"scope":     grant.Scope,
+	}
+	if tenant.Issuer != "" {
+		accessPayload["iss"] = tenant.Issuer
+	}
+	if len(amr) > 0 {
+		accessPayload["amr"] = amr
+	}
+	if clientID != "" {
+		accessPayload["client_id"] = clientID
+	}
+	pair, err := token.NewPair(tenant.Secret, accessPayload,
+		map[string]interface{}{"ip": req.RemoteAddr, "iat": time.Now().Unix()})
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to generate token", zap.Error(err),
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", userGUID))
+		return nil, ""
+	}
+
+	/* Генерируем bcrypt хэш refresh токена */
+	refreshTokenHash, err := bcrypt.GenerateFromPassword(refreshTokenDigest(pair.Refresh), bcrypt.DefaultCost)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to generate bcrypt hash", zap.Error(err),
+			zap.String("refresh_token", string(pair.Refresh)),
+			zap.String("user_guid", userGUID))
+		return nil, ""
+	}
+
+	/* Записываем хэш refresh токена и guid пользователя в таблицу tokens */
+	err = service.tokenRepo.Create(tenant.ID, string(refreshTokenHash), userGUID)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to write bcrypt hash to database",
+			zap.Error(err), zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", userGUID))
+		return nil, ""
+	}
+	return pair, grant.Scope
 }
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"net/http"
@@ -9,28 +11,44 @@ import (
 func (service *AuthService) HandleCreate(w http.ResponseWriter, req *http.Request) {
 	/* Парсим запрос */
 	if err := req.ParseForm(); err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		service.logger.Error("Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		service.fail(w, req, problem.MalformedRequest, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+
+	/* Токены по GUID без пароля выдаются только клиенту, которому администратор разрешил этот grant */
+	client := service.authenticateClient(w, req, grantGUID)
+	if client == nil {
 		return
 	}
 
 	/* Проверяем GUID на соответствие своему типу */
 	userGUID := req.FormValue("guid")
 	if _, err := uuid.Parse(userGUID); err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		service.logger.Error("Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		service.fail(w, req, problem.MalformedRequest.With("guid must be a UUID"), "Bad request",
+			zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+	if !service.allowUser(userGUID, w, req) || !service.checkLockout(userGUID, w, req) {
 		return
 	}
 
 	/* Проверяем, существует ли пользователь с таким GUID */
-	if _, err := service.userRepo.GetByGUID(userGUID); err != nil {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		service.logger.Error("User not found", zap.Error(err),
+	user, err := service.userRepo.GetByGUID(tenancy.FromContext(req.Context()).ID, userGUID)
+	if err != nil {
+		service.fail(w, req, problem.UserUnavailable, "User not found", zap.Error(err),
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", userGUID))
+		return
+	}
+	/* Заблокированному пользователю отвечаем так же, как несуществующему */
+	if user.Disabled {
+		service.fail(w, req, problem.UserUnavailable, "User is disabled",
 			zap.String("ip", req.RemoteAddr),
 			zap.String("user_guid", userGUID))
 		return
 	}
 
 	/* Создаём пару токенов */
-	service.createTokens(userGUID, w, req)
+	service.logger.Info("Tokens are issued by GUID", zap.String("client_id", client.ID), zap.String("user_guid", userGUID))
+	service.issueTokens(user, nil, nil, w, req)
 }
@@ -0,0 +1,388 @@
+package service
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"go.uber.org/zap"
+)
+
+const (
+	grantDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+	/* RFC 8628, 3.2: по умолчанию устройство опрашивает токен-эндпоинт раз в 5 секунд */
+	defaultDevicePollInterval = 5
+	defaultDeviceCodeLifetime = 600
+	/* RFC 8628, 3.5: после slow_down интервал увеличивается на 5 секунд */
+	devicePollSlowDown = 5
+	/* Согласные без гласных (RFC 8628, 6.1): код не сложится в слово и его легко ввести с пульта */
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength   = 8
+)
+
+/* Ответ RFC 8628, 3.2 */
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+type deviceRequestInfo struct {
+	UserCode   string    `json:"user_code"`
+	ClientID   string    `json:"client_id"`
+	ClientName string    `json:"client_name"`
+	Scope      string    `json:"scope"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type deviceDecisionRequest struct {
+	UserCode string `json:"user_code"`
+	Approve  bool   `json:"approve"`
+}
+
+/* Первый шаг device authorization grant (RFC 8628, 3.1): устройство без браузера получает device_code
+ * для опроса токен-эндпоинта и user_code, который пользователь введёт на verification_uri с другого устройства. */
+func (service *AuthService) HandleDeviceAuthorization(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		service.oauthFail(w, req, problem.OAuthInvalidRequest, "Bad request", zap.Error(err),
+			zap.String("ip", req.RemoteAddr))
+		return
+	}
+	client := service.authenticateClient(w, req, grantDeviceCode)
+	if client == nil {
+		return
+	}
+	scope, ok := grantedScope(client.Scopes, req.PostForm.Get("scope"))
+	if !ok {
+		service.oauthFail(w, req, problem.OAuthInvalidScope, "Requested scope is not allowed for the client",
+			zap.String("client_id", client.ID),
+			zap.String("scope", req.PostForm.Get("scope")))
+		return
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		service.oauthFail(w, req, problem.Internal, "Failed to generate device code", zap.Error(err))
+		return
+	}
+	deviceCode := base64.RawURLEncoding.EncodeToString(random)
+	lifetime := service.cfg.OAuth.DeviceCodeLifetime
+	if lifetime <= 0 {
+		lifetime = defaultDeviceCodeLifetime
+	}
+	interval := service.cfg.OAuth.DevicePollInterval
+	if interval <= 0 {
+		interval = defaultDevicePollInterval
+	}
+	device := &model.DeviceAuthorization{
+		DeviceCodeHash: authorizationCodeHash(deviceCode),
+		ClientID:       client.ID,
+		Scope:          scope,
+		Status:         model.DeviceAuthorizationPending,
+		Interval:       interval,
+		ExpiresAt:      time.Now().Add(time.Duration(lifetime) * time.Second),
+	}
+	/* Коротких кодов немного, поэтому при совпадении с действующим просто берём другой */
+	tenantID := tenancy.FromContext(req.Context()).ID
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if device.UserCode, err = newUserCode(); err != nil {
+			break
+		}
+		if err = service.deviceRepo.Create(tenantID, device); !errors.Is(err, repository.ErrAlreadyExists) {
+			break
+		}
+	}
+	if err != nil {
+		service.oauthFail(w, req, problem.Internal, "Failed to create device authorization", zap.Error(err),
+			zap.String("client_id", client.ID))
+		return
+	}
+	service.logger.Info("Device authorization has been requested",
+		zap.String("client_id", client.ID),
+		zap.String("ip", req.RemoteAddr))
+
+	w.Header().Set("Cache-Control", "no-store")
+	err = writeJson(w, http.StatusOK, &deviceAuthorizationResponse{
+		DeviceCode:      deviceCode,
+		UserCode:        device.UserCode,
+		VerificationURI: service.cfg.OAuth.DeviceVerificationURL,
+		VerificationURIComplete: redirectWithParams(service.cfg.OAuth.DeviceVerificationURL,
+			url.Values{"user_code": {device.UserCode}}),
+		ExpiresIn: lifetime,
+		Interval:  interval,
+	})
+	if err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Страница verification_uri показывает пользователю, какое приложение и с какими scope просит доступ */
+func (service *AuthService) HandleDeviceGet(w http.ResponseWriter, req *http.Request) {
+	userGUID := userGUIDFromContext(req.Context())
+	if !service.allowUser(userGUID, w, req) {
+		return
+	}
+	device, ok := service.pendingDevice(normalizeUserCode(req.URL.Query().Get("user_code")), w, req)
+	if !ok {
+		return
+	}
+	client, err := service.clientRepo.GetByID(tenancy.FromContext(req.Context()).ID, device.ClientID)
+	if err != nil {
+		service.fail(w, req, problem.UserCodeInvalid, "OAuth client of the device is unavailable", zap.Error(err),
+			zap.String("client_id", device.ClientID))
+		return
+	}
+	err = writeJson(w, http.StatusOK, &deviceRequestInfo{
+		UserCode:   device.UserCode,
+		ClientID:   client.ID,
+		ClientName: client.Name,
+		Scope:      device.Scope,
+		ExpiresAt:  device.ExpiresAt,
+	})
+	if err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Пользователь с действующим access токеном разрешает или запрещает доступ устройству по user_code.
+ * Способы входа из его access токена переходят в токены устройства. */
+func (service *AuthService) HandleDeviceDecision(w http.ResponseWriter, req *http.Request) {
+	userGUID := userGUIDFromContext(req.Context())
+	if !service.allowUser(userGUID, w, req) {
+		return
+	}
+	body := deviceDecisionRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+	tenantID := tenancy.FromContext(req.Context()).ID
+	userCode := normalizeUserCode(body.UserCode)
+	device, ok := service.pendingDevice(userCode, w, req)
+	if !ok {
+		return
+	}
+
+	status := model.DeviceAuthorizationDenied
+	var amr []string
+	var authTime *time.Time
+	if body.Approve {
+		user, err := service.userRepo.GetByGUID(tenantID, userGUID)
+		if err != nil || user.Disabled {
+			service.fail(w, req, problem.UserUnavailable, "User not found or disabled", zap.Error(err),
+				zap.String("ip", req.RemoteAddr),
+				zap.String("user_guid", userGUID))
+			return
+		}
+		if service.cfg.RequireVerifiedEmail && !user.EmailVerified {
+			service.fail(w, req, problem.EmailNotVerified, "Email is not verified",
+				zap.String("ip", req.RemoteAddr),
+				zap.String("user_guid", userGUID))
+			return
+		}
+		status = model.DeviceAuthorizationApproved
+		claims := accessClaimsFromContext(req.Context())
+		amr = claimStrings(claims["amr"])
+		signedInAt := time.Unix(claimAuthTime(claims), 0)
+		authTime = &signedInAt
+	}
+	if err := service.deviceRepo.Decide(tenantID, userCode, status, userGUID, amr, authTime); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			service.fail(w, req, problem.UserCodeInvalid, "Device authorization is already decided or expired",
+				zap.String("user_guid", userGUID))
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return
+	}
+	service.logger.Info("Device authorization has been decided",
+		zap.String("client_id", device.ClientID),
+		zap.String("status", status),
+		zap.String("user_guid", userGUID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* Опрос токен-эндпоинта устройством (RFC 8628, 3.4 и 3.5). Пока пользователь не решил, отвечаем
+ * authorization_pending, слишком частый опрос - slow_down. После разрешения пара выдаётся один раз. */
+func (service *AuthService) pollDeviceCode(w http.ResponseWriter, req *http.Request) {
+	deviceCode := req.PostForm.Get("device_code")
+	if deviceCode == "" {
+		service.oauthFail(w, req, problem.OAuthInvalidRequest.With("device_code is required"),
+			"Bad request", zap.String("ip", req.RemoteAddr))
+		return
+	}
+	client := service.authenticateClient(w, req, grantDeviceCode)
+	if client == nil {
+		return
+	}
+	tenantID := tenancy.FromContext(req.Context()).ID
+	hash := authorizationCodeHash(deviceCode)
+	device, err := service.deviceRepo.GetByDeviceCode(tenantID, hash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			service.oauthFail(w, req, problem.OAuthInvalidGrant, "Device code is unknown or already used",
+				zap.String("client_id", client.ID),
+				zap.String("ip", req.RemoteAddr))
+		} else {
+			service.oauthFail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return
+	}
+	if device.ClientID != client.ID {
+		service.oauthFail(w, req, problem.OAuthInvalidGrant, "Device code was issued to another client",
+			zap.String("client_id", client.ID),
+			zap.String("ip", req.RemoteAddr))
+		return
+	}
+	now := time.Now()
+	if !now.Before(device.ExpiresAt) {
+		service.deleteDevice(tenantID, hash)
+		service.oauthFail(w, req, problem.OAuthExpiredToken, "Device code is expired",
+			zap.String("client_id", client.ID))
+		return
+	}
+
+	switch device.Status {
+	case model.DeviceAuthorizationPending:
+		failure := problem.OAuthAuthorizationPending
+		interval := device.Interval
+		if device.LastPolledAt != nil && now.Before(device.LastPolledAt.Add(time.Duration(interval)*time.Second)) {
+			failure = problem.OAuthSlowDown
+			interval += devicePollSlowDown
+		}
+		if err = service.deviceRepo.Polled(tenantID, hash, now, interval); err != nil {
+			service.oauthFail(w, req, problem.Internal, "SQL error", zap.Error(err))
+			return
+		}
+		/* Это обычный ответ при опросе, поэтому в лог не пишем */
+		w.Header().Set("Cache-Control", "no-store")
+		problem.WriteWith(w, req, failure, map[string]interface{}{
+			"error":             failure.Code,
+			"error_description": failure.Detail,
+		})
+	case model.DeviceAuthorizationDenied:
+		service.deleteDevice(tenantID, hash)
+		service.oauthFail(w, req, problem.OAuthAccessDenied, "Device authorization has been denied",
+			zap.String("client_id", client.ID),
+			zap.String("user_guid", device.UserGUID))
+	default:
+		service.issueDeviceTokens(hash, client.ID, w, req)
+	}
+}
+
+func (service *AuthService) issueDeviceTokens(hash string, clientID string, w http.ResponseWriter, req *http.Request) {
+	/* Удаление и выборка в одном запросе: из двух параллельных опросов токены получит только один */
+	device, err := service.deviceRepo.ConsumeApproved(tenancy.FromContext(req.Context()).ID, hash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			service.oauthFail(w, req, problem.OAuthInvalidGrant, "Device code is already used",
+				zap.String("client_id", clientID),
+				zap.String("ip", req.RemoteAddr))
+		} else {
+			service.oauthFail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return
+	}
+	/* Пользователя могли заблокировать, пока устройство ждало */
+	user, err := service.userRepo.GetByGUID(tenancy.FromContext(req.Context()).ID, device.UserGUID)
+	if err != nil || user.Disabled {
+		service.oauthFail(w, req, problem.OAuthInvalidGrant, "User not found or disabled", zap.Error(err),
+			zap.String("client_id", clientID),
+			zap.String("user_guid", device.UserGUID))
+		return
+	}
+
+	/* Запросы, одобренные до появления auth_time, считаем выполненными в момент выдачи токенов */
+	authTime := time.Now().Unix()
+	if device.AuthTime != nil {
+		authTime = device.AuthTime.Unix()
+	}
+	pair, scope := service.newPair(user.GUID, clientID, device.AMR, &device.Scope, authTime, w, req)
+	if pair == nil {
+		return
+	}
+	if !service.attachIDToken(pair, user, scope, clientID, "", authTime, device.AMR, w, req) {
+		return
+	}
+	result, err := pair.ToOAuthJson(tenancy.FromContext(req.Context()).AccessTokenLifetime, scope)
+	if err != nil {
+		service.oauthFail(w, req, problem.Internal, "JSON failure", zap.Error(err))
+		return
+	}
+	service.logger.Info("Tokens are issued to a device",
+		zap.String("client_id", clientID),
+		zap.String("user_guid", user.GUID),
+		zap.String("ip", req.RemoteAddr))
+	service.publishEvent(notify.EventTokenIssued, user.GUID, req, map[string]string{
+		"amr":        strings.Join(device.AMR, " "),
+		"grant_type": grantDeviceCode,
+		"client_id":  clientID,
+	})
+	writeTokenResponse(w, result)
+}
+
+/* Достаёт ожидающий решения запрос по user_code. Если что-то пошло не так,
+ * ответ клиенту уже записан и возвращается false. */
+func (service *AuthService) pendingDevice(userCode string, w http.ResponseWriter,
+	req *http.Request) (*model.DeviceAuthorization, bool) {
+	device, err := service.deviceRepo.GetPendingByUserCode(tenancy.FromContext(req.Context()).ID, userCode)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			service.fail(w, req, problem.UserCodeInvalid, "User code is unknown, expired or already used",
+				zap.String("ip", req.RemoteAddr),
+				zap.String("user_guid", userGUIDFromContext(req.Context())))
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return nil, false
+	}
+	return device, true
+}
+
+/* Решённый или истёкший запрос больше не нужен. Если удалить не вышло, его уберёт фоновая очистка. */
+func (service *AuthService) deleteDevice(tenantID string, hash string) {
+	if err := service.deviceRepo.Delete(tenantID, hash); err != nil {
+		service.logger.Error("Failed to delete device authorization", zap.Error(err))
+	}
+}
+
+/* user_code в виде XXXX-XXXX. Байты вне диапазона отбрасываются, чтобы буквы выпадали равновероятно. */
+func newUserCode() (string, error) {
+	code := make([]byte, 0, userCodeLength)
+	random := make([]byte, userCodeLength*2)
+	for len(code) < userCodeLength {
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+		for _, b := range random {
+			if int(b) < 256/len(userCodeAlphabet)*len(userCodeAlphabet) && len(code) < userCodeLength {
+				code = append(code, userCodeAlphabet[int(b)%len(userCodeAlphabet)])
+			}
+		}
+	}
+	return string(code[:userCodeLength/2]) + "-" + string(code[userCodeLength/2:]), nil
+}
+
+/* Пользователь может ввести код строчными буквами, без дефиса или с пробелами (RFC 8628, 6.1) */
+func normalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(userCode))
+	if len(userCode) != userCodeLength {
+		return userCode
+	}
+	return userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+}
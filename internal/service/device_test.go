@@ -0,0 +1,155 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newDeviceEnv(t *testing.T) *testEnv {
+	env := newTestEnv(t)
+	env.addPublicClient()
+	env.cfg.OAuth.DeviceVerificationURL = "https://acme.example/device"
+	env.router.Post("/oauth/device_authorization", env.service.HandleDeviceAuthorization)
+	env.router.Post("/oauth/token", env.service.HandleOAuthToken)
+	env.router.With(env.service.Authenticate).Post("/oauth/device", env.service.HandleDeviceDecision)
+	return env
+}
+
+/* Запрос device authorization от клиента spa */
+func (env *testEnv) deviceAuthorization() deviceAuthorizationResponse {
+	response := env.do("acme", http.MethodPost, "/oauth/device_authorization",
+		url.Values{"client_id": {"spa"}, "scope": {"openid"}}.Encode(), "")
+	if response.Code != http.StatusOK {
+		env.t.Fatalf("device authorization: %d %s", response.Code, response.Body.String())
+	}
+	var device deviceAuthorizationResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &device); err != nil {
+		env.t.Fatal(err)
+	}
+	return device
+}
+
+func (env *testEnv) pollDevice(deviceCode string) *httptest.ResponseRecorder {
+	return env.do("acme", http.MethodPost, "/oauth/token", url.Values{
+		"grant_type":  {grantDeviceCode},
+		"client_id":   {"spa"},
+		"device_code": {deviceCode},
+	}.Encode(), "")
+}
+
+func (env *testEnv) decideDevice(userCode string, approve bool, userToken string) {
+	body, _ := json.Marshal(&deviceDecisionRequest{UserCode: userCode, Approve: approve})
+	if response := env.do("acme", http.MethodPost, "/oauth/device", string(body), userToken); response.Code != http.StatusNoContent {
+		env.t.Fatalf("device decision: %d %s", response.Code, response.Body.String())
+	}
+}
+
+func expectPollError(t *testing.T, response *httptest.ResponseRecorder, code string) {
+	t.Helper()
+	if response.Code != http.StatusBadRequest || problemCode(t, response) != code {
+		t.Fatalf("poll: %d %s, want %s", response.Code, response.Body.String(), code)
+	}
+	if code == "authorization_pending" || code == "slow_down" {
+		if response.Header().Get("Cache-Control") != "no-store" {
+			t.Fatal("poll response is cacheable")
+		}
+	}
+}
+
+/* authorization_pending, slow_down с интервалом +5 секунд, снова pending по новому интервалу,
+ * а после разрешения пара выдаётся ровно один раз */
+func TestDevicePolling(t *testing.T) {
+	env := newDeviceEnv(t)
+	devices := env.service.deviceRepo.(*memDevices)
+	user := env.addUser("acme", "ivan@acme.example")
+	device := env.deviceAuthorization()
+	hash := authorizationCodeHash(device.DeviceCode)
+	if device.Interval != defaultDevicePollInterval {
+		t.Fatalf("interval %d, want %d", device.Interval, defaultDevicePollInterval)
+	}
+
+	expectPollError(t, env.pollDevice(device.DeviceCode), "authorization_pending")
+	expectPollError(t, env.pollDevice(device.DeviceCode), "slow_down")
+	stored, _ := devices.GetByDeviceCode("acme", hash)
+	if stored.Interval != defaultDevicePollInterval+devicePollSlowDown {
+		t.Fatalf("interval after slow_down %d, want %d", stored.Interval, defaultDevicePollInterval+devicePollSlowDown)
+	}
+
+	/* Опрос через прежние 5 секунд - снова slow_down, дальше устройство ждёт увеличенный интервал */
+	devices.rewind(hash, time.Duration(defaultDevicePollInterval+1)*time.Second)
+	expectPollError(t, env.pollDevice(device.DeviceCode), "slow_down")
+	devices.rewind(hash, time.Duration(defaultDevicePollInterval+2*devicePollSlowDown+1)*time.Second)
+	expectPollError(t, env.pollDevice(device.DeviceCode), "authorization_pending")
+
+	env.decideDevice(device.UserCode, true, env.accessToken("acme", user.GUID, nil))
+	response := env.pollDevice(device.DeviceCode)
+	if response.Code != http.StatusOK {
+		t.Fatalf("poll after approval: %d %s", response.Code, response.Body.String())
+	}
+	var tokens map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	claims := env.accessClaims("acme", tokens["access_token"].(string))
+	if claims["guid"] != user.GUID || claims["client_id"] != "spa" {
+		t.Fatalf("device token claims %v", claims)
+	}
+
+	expectPollError(t, env.pollDevice(device.DeviceCode), "invalid_grant")
+	if count := env.tokens.count("acme", user.GUID); count != 1 {
+		t.Fatalf("%d refresh tokens issued, want 1", count)
+	}
+}
+
+func TestDevicePollingDenied(t *testing.T) {
+	env := newDeviceEnv(t)
+	user := env.addUser("acme", "ivan@acme.example")
+	device := env.deviceAuthorization()
+
+	expectPollError(t, env.pollDevice(device.DeviceCode), "authorization_pending")
+	env.decideDevice(device.UserCode, false, env.accessToken("acme", user.GUID, nil))
+	expectPollError(t, env.pollDevice(device.DeviceCode), "access_denied")
+	/* Отказ удаляет запрос, следующий опрос его уже не найдёт */
+	expectPollError(t, env.pollDevice(device.DeviceCode), "invalid_grant")
+	if env.tokens.count("acme", user.GUID) != 0 {
+		t.Fatal("denied device got tokens")
+	}
+}
+
+func TestDevicePollingExpired(t *testing.T) {
+	env := newDeviceEnv(t)
+	devices := env.service.deviceRepo.(*memDevices)
+	user := env.addUser("acme", "ivan@acme.example")
+	device := env.deviceAuthorization()
+	hash := authorizationCodeHash(device.DeviceCode)
+
+	env.decideDevice(device.UserCode, true, env.accessToken("acme", user.GUID, nil))
+	devices.rewind(hash, time.Duration(defaultDeviceCodeLifetime+1)*time.Second)
+	/* Разрешение не спасает истёкший код */
+	expectPollError(t, env.pollDevice(device.DeviceCode), "expired_token")
+	expectPollError(t, env.pollDevice(device.DeviceCode), "invalid_grant")
+	if env.tokens.count("acme", user.GUID) != 0 {
+		t.Fatal("expired device got tokens")
+	}
+}
+
+/* Код устройства не действует в другом тенанте и без device_code */
+func TestDevicePollingRejected(t *testing.T) {
+	env := newDeviceEnv(t)
+	device := env.deviceAuthorization()
+
+	response := env.do("globex", http.MethodPost, "/oauth/token", url.Values{
+		"grant_type":  {grantDeviceCode},
+		"client_id":   {"spa"},
+		"device_code": {device.DeviceCode},
+	}.Encode(), "")
+	if response.Code == http.StatusOK {
+		t.Fatalf("device code of another tenant: %d %s", response.Code, response.Body.String())
+	}
+	expectPollError(t, env.pollDevice(""), "invalid_request")
+	expectPollError(t, env.pollDevice("unknown"), "invalid_grant")
+}
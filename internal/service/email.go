@@ -0,0 +1,53 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"go.uber.org/zap"
+)
+
+const emailVerificationPurpose = "email_verification"
+
+/* Отправляет ссылку для подтверждения email текущему пользователю (нужен access токен) */
+func (service *AuthService) HandleEmailVerificationRequest(w http.ResponseWriter, req *http.Request) {
+	userGUID := userGUIDFromContext(req.Context())
+	user, err := service.userRepo.GetByGUID(tenancy.FromContext(req.Context()).ID, userGUID)
+	if err != nil {
+		service.fail(w, req, problem.UserUnavailable, "User not found",
+			zap.Error(err), zap.String("user_guid", userGUID))
+		return
+	}
+	if user.EmailVerified {
+		service.fail(w, req, problem.EmailAlreadyVerified, "Email is already verified",
+			zap.String("user_guid", userGUID))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	service.sendLinkToken(user, emailVerificationPurpose, service.cfg.EmailVerification, req)
+}
+
+/* Переход по ссылке из письма. Токен принимается как из query, так и из тела формы. */
+func (service *AuthService) HandleEmailVerificationConfirm(w http.ResponseWriter, req *http.Request) {
+	linkToken, ok := service.consumeLinkToken(emailVerificationPurpose, req.FormValue("token"), w, req)
+	if !ok {
+		return
+	}
+
+	/* Если email успели сменить, ссылка на старый адрес его не подтверждает */
+	if err := service.userRepo.SetEmailVerified(tenancy.FromContext(req.Context()).ID, linkToken.UserGUID, linkToken.Email); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			service.fail(w, req, problem.LinkOutdated, "User or email has changed since the link was sent",
+				zap.String("ip", req.RemoteAddr),
+				zap.String("user_guid", linkToken.UserGUID))
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return
+	}
+	service.logger.Info("Email has been verified", zap.String("user_guid", linkToken.UserGUID))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/federation"
+	"github.com/TooLazyToCreate/auth-service/internal/mailer"
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+/* Способ входа в amr для входа через внешнего провайдера */
+const amrFederated = "fed"
+
+/* Сколько секунд по умолчанию пользователь может провести у провайдера */
+const defaultFederationStateLifetime = 600
+
+/* Начало входа через внешнего провайдера. GET сразу перенаправляет браузер к провайдеру,
+ * POST отдаёт адрес в JSON, как POST /oauth/authorize. state, nonce и code_verifier запоминаются до возврата. */
+func (service *AuthService) HandleFederatedLoginBegin(w http.ResponseWriter, req *http.Request) {
+	provider, ok := service.federationProvider(w, req)
+	if !ok {
+		return
+	}
+	random := make([]byte, 96)
+	if _, err := rand.Read(random); err != nil {
+		service.fail(w, req, problem.Internal, "Failed to generate federation state", zap.Error(err))
+		return
+	}
+	state := base64.RawURLEncoding.EncodeToString(random[:32])
+	nonce := base64.RawURLEncoding.EncodeToString(random[32:64])
+	verifier := base64.RawURLEncoding.EncodeToString(random[64:])
+	challenge := sha256.Sum256([]byte(verifier))
+
+	location, err := provider.AuthorizationURL(req.Context(), state, nonce, base64.RawURLEncoding.EncodeToString(challenge[:]))
+	if err != nil {
+		service.fail(w, req, problem.FederationUnavailable, "Failed to get provider metadata", zap.Error(err),
+			zap.String("provider", provider.ID()))
+		return
+	}
+	lifetime := service.cfg.Federation.StateLifetime
+	if lifetime <= 0 {
+		lifetime = defaultFederationStateLifetime
+	}
+	err = service.federationRepo.CreateState(&model.FederationState{
+		StateHash:    federationStateHash(state),
+		TenantID:     tenancy.FromContext(req.Context()).ID,
+		Provider:     provider.ID(),
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().Add(time.Duration(lifetime) * time.Second),
+	})
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	service.logger.Debug("Federated login has been started",
+		zap.String("provider", provider.ID()),
+		zap.String("ip", req.RemoteAddr))
+
+	if req.Method == http.MethodGet {
+		http.Redirect(w, req, location, http.StatusFound)
+		return
+	}
+	if err = writeJson(w, http.StatusOK, &authorizeResponse{RedirectTo: location}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Возврат от провайдера. code и state принимаются из query (провайдер вернул браузер прямо сюда)
+ * или из тела формы (их передала страница фронтенда). Выдаёт связку ключей, как обычный вход. */
+func (service *AuthService) HandleFederatedLoginCallback(w http.ResponseWriter, req *http.Request) {
+	provider, ok := service.federationProvider(w, req)
+	if !ok {
+		return
+	}
+	if errorCode := req.FormValue("error"); errorCode != "" {
+		service.fail(w, req, problem.FederationRejected, "Identity provider returned an error",
+			zap.String("provider", provider.ID()),
+			zap.String("error", errorCode),
+			zap.String("error_description", req.FormValue("error_description")),
+			zap.String("ip", req.RemoteAddr))
+		return
+	}
+	code, state := req.FormValue("code"), req.FormValue("state")
+	if code == "" || state == "" {
+		service.fail(w, req, problem.MalformedRequest.With("code and state are required"), "Bad request",
+			zap.String("provider", provider.ID()),
+			zap.String("ip", req.RemoteAddr))
+		return
+	}
+
+	/* state одноразовый и должен быть выдан этому же тенанту для этого же провайдера */
+	saved, err := service.federationRepo.ConsumeState(federationStateHash(state))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	if err != nil || saved.TenantID != tenancy.FromContext(req.Context()).ID || saved.Provider != provider.ID() {
+		service.fail(w, req, problem.FederationStateInvalid, "Federation state is invalid, expired or already used",
+			zap.String("provider", provider.ID()),
+			zap.String("ip", req.RemoteAddr))
+		return
+	}
+
+	identity, err := provider.Exchange(req.Context(), code, saved.CodeVerifier, saved.Nonce)
+	if err != nil {
+		failure := problem.FederationUnavailable
+		if errors.Is(err, federation.ErrRejected) {
+			failure = problem.FederationRejected
+		}
+		service.fail(w, req, failure, "Federated login failed", zap.Error(err),
+			zap.String("provider", provider.ID()),
+			zap.String("ip", req.RemoteAddr))
+		return
+	}
+	user, ok := service.federatedUser(provider, identity, w, req)
+	if !ok {
+		return
+	}
+	service.issueTokens(user, []string{amrFederated}, nil, w, req)
+}
+
+/* Пользователь, к которому привязан внешний аккаунт. Непривязанный аккаунт привязывается к пользователю
+ * с тем же email, если провайдер его подтвердил (link_by_email), или к новому пользователю (create_users).
+ * Если что-то пошло не так, ответ клиенту уже записан и возвращается false. */
+func (service *AuthService) federatedUser(provider *federation.Provider, identity *federation.Identity,
+	w http.ResponseWriter, req *http.Request) (*model.User, bool) {
+	tenantID := tenancy.FromContext(req.Context()).ID
+	linked, err := service.federationRepo.GetIdentity(tenantID, provider.ID(), identity.Subject)
+	if err == nil {
+		user, err := service.userRepo.GetByGUID(tenantID, linked.UserGUID)
+		if err != nil || user.Disabled {
+			service.fail(w, req, problem.UserUnavailable, "User not found or disabled", zap.Error(err),
+				zap.String("ip", req.RemoteAddr),
+				zap.String("user_guid", linked.UserGUID))
+			return nil, false
+		}
+		return user, true
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return nil, false
+	}
+
+	address, err := mail.ParseAddress(identity.Email)
+	validEmail := err == nil && address.Address == identity.Email
+	var user *model.User
+	if provider.LinkByEmail() && validEmail && identity.EmailVerified {
+		user, err = service.userRepo.GetByEmail(tenantID, identity.Email)
+		if errors.Is(err, sql.ErrNoRows) {
+			user = nil
+		} else if err != nil {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+			return nil, false
+		}
+	}
+	created := user == nil
+	if created {
+		if !provider.CreateUsers() {
+			service.fail(w, req, problem.FederatedAccountNotLinked, "External account is not linked to a user",
+				zap.String("provider", provider.ID()),
+				zap.String("subject", identity.Subject),
+				zap.String("ip", req.RemoteAddr))
+			return nil, false
+		}
+		if !validEmail {
+			service.fail(w, req, problem.FederationRejected.With("Identity provider did not share a valid email"),
+				"Federated identity has no valid email",
+				zap.String("provider", provider.ID()),
+				zap.String("subject", identity.Subject))
+			return nil, false
+		}
+		user = &model.User{
+			FirstName:     identity.GivenName,
+			LastName:      identity.FamilyName,
+			Email:         identity.Email,
+			EmailVerified: identity.EmailVerified,
+		}
+		if mailer.ValidLocale(identity.Locale) {
+			user.Locale = identity.Locale
+		}
+		if err = service.userRepo.Create(tenantID, user); err != nil {
+			/* Пользователь с таким email уже есть, но привязывать к нему аккаунт не разрешено */
+			if errors.Is(err, repository.ErrAlreadyExists) {
+				service.fail(w, req, problem.EmailTaken, "Federated user email is taken",
+					zap.String("provider", provider.ID()),
+					zap.String("subject", identity.Subject))
+			} else {
+				service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+			}
+			return nil, false
+		}
+	} else if user.Disabled {
+		service.fail(w, req, problem.UserUnavailable, "User is disabled",
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", user.GUID))
+		return nil, false
+	}
+
+	err = service.federationRepo.CreateIdentity(tenantID, &model.FederatedIdentity{
+		Provider: provider.ID(),
+		Subject:  identity.Subject,
+		UserGUID: user.GUID,
+		Email:    identity.Email,
+	})
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err), zap.String("user_guid", user.GUID))
+		return nil, false
+	}
+	service.logger.Info("External account has been linked",
+		zap.String("provider", provider.ID()),
+		zap.String("subject", identity.Subject),
+		zap.String("user_guid", user.GUID),
+		zap.Bool("created", created))
+	service.publishEvent(notify.EventIdentityLinked, user.GUID, req, map[string]string{
+		"provider":     provider.ID(),
+		"subject":      identity.Subject,
+		"user_created": strconv.FormatBool(created),
+	})
+	return user, true
+}
+
+/* Провайдер из пути. Если такого нет, ответ клиенту уже записан и возвращается false. */
+func (service *AuthService) federationProvider(w http.ResponseWriter, req *http.Request) (*federation.Provider, bool) {
+	id := chi.URLParam(req, "provider")
+	provider, ok := service.providers[id]
+	if !ok {
+		service.fail(w, req, problem.FederationProviderUnknown, "Unknown federation provider",
+			zap.String("provider", id),
+			zap.String("ip", req.RemoteAddr))
+	}
+	return provider, ok
+}
+
+func federationStateHash(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
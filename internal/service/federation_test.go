@@ -0,0 +1,382 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/config"
+	"github.com/TooLazyToCreate/auth-service/internal/federation"
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
+)
+
+type testIdentity struct {
+	tenantID string
+	identity model.FederatedIdentity
+}
+
+type memFederation struct {
+	repository.FederationRepository
+	mutex      sync.Mutex
+	identities []testIdentity
+	states     map[string]model.FederationState
+}
+
+func (repo *memFederation) GetIdentity(tenantID string, provider string, subject string) (*model.FederatedIdentity, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for _, stored := range repo.identities {
+		if stored.tenantID == tenantID && stored.identity.Provider == provider && stored.identity.Subject == subject {
+			identity := stored.identity
+			return &identity, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (repo *memFederation) CreateIdentity(tenantID string, identity *model.FederatedIdentity) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for _, stored := range repo.identities {
+		if stored.tenantID == tenantID && stored.identity.Provider == identity.Provider &&
+			stored.identity.Subject == identity.Subject {
+			return repository.ErrAlreadyExists
+		}
+	}
+	identity.CreatedAt = time.Now()
+	repo.identities = append(repo.identities, testIdentity{tenantID, *identity})
+	return nil
+}
+
+func (repo *memFederation) CreateState(state *model.FederationState) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.states[state.StateHash] = *state
+	return nil
+}
+
+func (repo *memFederation) ConsumeState(stateHash string) (*model.FederationState, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	state, ok := repo.states[stateHash]
+	delete(repo.states, stateHash)
+	if !ok || !state.ExpiresAt.After(time.Now()) {
+		return nil, sql.ErrNoRows
+	}
+	return &state, nil
+}
+
+/* Привязки внешних аккаунтов тенанта */
+func (repo *memFederation) count(tenantID string) int {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	count := 0
+	for _, stored := range repo.identities {
+		if stored.tenantID == tenantID {
+			count++
+		}
+	}
+	return count
+}
+
+type stubCode struct {
+	nonce     string
+	challenge string
+}
+
+/* Провайдер OpenID Connect с discovery, JWKS и токен-эндпоинтом. Браузерную часть (/authorize) тест проходит
+ * вызовом authorize. id_token для каждого кода можно испортить через tamper, а forger подписывает его
+ * чужим ключом, оставляя в заголовке kid опубликованного ключа. */
+type stubIdP struct {
+	t      *testing.T
+	server *httptest.Server
+	signer *token.IDTokenSigner
+
+	mutex   sync.Mutex
+	issued  int
+	codes   map[string]stubCode
+	subject string
+	tamper  func(claims map[string]interface{})
+	forger  *token.IDTokenSigner
+}
+
+func newStubSigner(t *testing.T) *token.IDTokenSigner {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := token.NewIDTokenSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	idp := &stubIdP{t: t, signer: newStubSigner(t), codes: map[string]stubCode{}, subject: "ext-1"}
+	idp.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			writeJson(w, http.StatusOK, map[string]string{
+				"issuer":                 idp.server.URL,
+				"authorization_endpoint": idp.server.URL + "/authorize",
+				"token_endpoint":         idp.server.URL + "/token",
+				"jwks_uri":               idp.server.URL + "/jwks",
+			})
+		case "/jwks":
+			writeJson(w, http.StatusOK, idp.signer.JWKS())
+		case "/token":
+			idp.handleToken(w, req)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+/* Пользователь вошёл у провайдера по адресу location: провайдер запоминает nonce и code_challenge
+ * и возвращает code и state, с которыми браузер пришёл бы обратно */
+func (idp *stubIdP) authorize(location string) (code string, state string) {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("client_id") != "svc" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		idp.t.Fatalf("unexpected authorization request %s", location)
+	}
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
+	idp.issued++
+	code = "code-" + strconv.Itoa(idp.issued)
+	idp.codes[code] = stubCode{query.Get("nonce"), query.Get("code_challenge")}
+	return code, query.Get("state")
+}
+
+func (idp *stubIdP) handleToken(w http.ResponseWriter, req *http.Request) {
+	fail := func(status int, errorCode string) {
+		writeJson(w, status, map[string]string{"error": errorCode})
+	}
+	clientID, secret, ok := req.BasicAuth()
+	if !ok || clientID != "svc" || secret != "secret" {
+		fail(http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if err := req.ParseForm(); err != nil || req.PostForm.Get("grant_type") != "authorization_code" {
+		fail(http.StatusBadRequest, "invalid_request")
+		return
+	}
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
+	code, ok := idp.codes[req.PostForm.Get("code")]
+	delete(idp.codes, req.PostForm.Get("code"))
+	verifier := sha256.Sum256([]byte(req.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+		fail(http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"iss":            idp.server.URL,
+		"aud":            "svc",
+		"sub":            idp.subject,
+		"iat":            now,
+		"exp":            now + 60,
+		"nonce":          code.nonce,
+		"email":          idp.subject + "@corp.example",
+		"email_verified": true,
+		"given_name":     "Anna",
+	}
+	if idp.tamper != nil {
+		idp.tamper(claims)
+	}
+	idToken, err := idp.signer.Sign(claims)
+	if err == nil && idp.forger != nil {
+		var forged []byte
+		forged, err = idp.forger.Sign(claims)
+		idToken = append(idToken[:strings.LastIndexByte(string(idToken), '.')],
+			forged[strings.LastIndexByte(string(forged), '.'):]...)
+	}
+	if err != nil {
+		idp.t.Error(err)
+		fail(http.StatusInternalServerError, "server_error")
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]string{"access_token": "upstream", "token_type": "Bearer", "id_token": string(idToken)})
+}
+
+/* Провайдер corp, который создаёт пользователей при первом входе */
+func newFederationEnv(t *testing.T) (*testEnv, *stubIdP, *memFederation) {
+	env := newTestEnv(t)
+	idp := newStubIdP(t)
+	providers, err := federation.Load([]config.FederationProvider{{
+		ID:           "corp",
+		Issuer:       idp.server.URL,
+		ClientID:     "svc",
+		ClientSecret: "secret",
+		RedirectURI:  "https://app.example/federated",
+		CreateUsers:  true,
+	}}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	federationRepo := &memFederation{states: map[string]model.FederationState{}}
+	env.service.providers = providers
+	env.service.federationRepo = federationRepo
+	env.router.Post("/user/login/federated/{provider}", env.service.HandleFederatedLoginBegin)
+	env.router.Post("/user/login/federated/{provider}/callback", env.service.HandleFederatedLoginCallback)
+	return env, idp, federationRepo
+}
+
+/* Начинает вход в тенанте tenantID и возвращает адрес провайдера */
+func (env *testEnv) beginFederatedLogin(tenantID string) string {
+	response := env.do(tenantID, http.MethodPost, "/user/login/federated/corp", "", "")
+	if response.Code != http.StatusOK {
+		env.t.Fatalf("begin: %d %s", response.Code, response.Body.String())
+	}
+	var begin authorizeResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &begin); err != nil {
+		env.t.Fatal(err)
+	}
+	return begin.RedirectTo
+}
+
+func (env *testEnv) federatedCallback(tenantID string, code string, state string) *httptest.ResponseRecorder {
+	return env.do(tenantID, http.MethodPost, "/user/login/federated/corp/callback",
+		url.Values{"code": {code}, "state": {state}}.Encode(), "")
+}
+
+/* Первый вход создаёт пользователя и ровно одну привязку в тенанте, повторный находит их же.
+ * Тот же внешний аккаунт в другом тенанте - другой пользователь со своей привязкой. */
+func TestFederatedLoginCreatesIdentityPerTenant(t *testing.T) {
+	env, idp, federationRepo := newFederationEnv(t)
+
+	var guids []string
+	for _, tenantID := range []string{"acme", "acme", "globex"} {
+		code, state := idp.authorize(env.beginFederatedLogin(tenantID))
+		response := env.federatedCallback(tenantID, code, state)
+		if response.Code != http.StatusCreated {
+			t.Fatalf("%s: %d %s", tenantID, response.Code, response.Body.String())
+		}
+		var pair map[string]string
+		if err := json.Unmarshal(response.Body.Bytes(), &pair); err != nil {
+			t.Fatal(err)
+		}
+		claims := env.accessClaims(tenantID, pair["access_token"])
+		if amr, _ := claims["amr"].([]interface{}); len(amr) != 1 || amr[0] != amrFederated {
+			t.Errorf("%s: amr = %v", tenantID, claims["amr"])
+		}
+		guids = append(guids, claims["guid"].(string))
+	}
+	if guids[0] != guids[1] || guids[0] == guids[2] {
+		t.Errorf("users: %v", guids)
+	}
+	if acme, globex := federationRepo.count("acme"), federationRepo.count("globex"); acme != 1 || globex != 1 {
+		t.Errorf("identities: acme %d, globex %d", acme, globex)
+	}
+	user, err := env.users.GetByGUID("acme", guids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "ext-1@corp.example" || !user.EmailVerified || user.FirstName != "Anna" {
+		t.Errorf("user: %+v", user)
+	}
+	if events := env.events(notify.EventIdentityLinked); len(events) != 2 {
+		t.Errorf("identity.linked events: %d", len(events))
+	}
+}
+
+/* Недействительный id_token не даёт ни входа, ни пользователя, ни привязки */
+func TestFederatedLoginRejected(t *testing.T) {
+	env, idp, federationRepo := newFederationEnv(t)
+	now := time.Now().Unix()
+	tests := []struct {
+		name   string
+		tamper func(claims map[string]interface{})
+		forged bool
+	}{
+		{"bad signature", nil, true},
+		{"wrong aud", func(claims map[string]interface{}) { claims["aud"] = "other" }, false},
+		{"wrong iss", func(claims map[string]interface{}) { claims["iss"] = "https://evil.example" }, false},
+		{"wrong nonce", func(claims map[string]interface{}) { claims["nonce"] = "replayed" }, false},
+		{"missing nonce", func(claims map[string]interface{}) { delete(claims, "nonce") }, false},
+		{"expired", func(claims map[string]interface{}) {
+			claims["iat"] = now - 600
+			claims["exp"] = now - 300
+		}, false},
+	}
+	for _, test := range tests {
+		idp.tamper, idp.forger = test.tamper, nil
+		if test.forged {
+			idp.forger = newStubSigner(t)
+		}
+		code, state := idp.authorize(env.beginFederatedLogin("acme"))
+		response := env.federatedCallback("acme", code, state)
+		if response.Code != http.StatusUnauthorized || problemCode(t, response) != "federation_rejected" {
+			t.Errorf("%s: %d %s", test.name, response.Code, response.Body.String())
+		}
+	}
+	if count := federationRepo.count("acme"); count != 0 || len(env.users.users) != 0 {
+		t.Errorf("identities: %d, users: %d", count, len(env.users.users))
+	}
+}
+
+/* code, выданный для одного входа, нельзя предъявить со state другого: у второго входа свой code_verifier,
+ * и провайдер не примет его по PKCE */
+func TestFederatedLoginPKCEMismatch(t *testing.T) {
+	env, idp, federationRepo := newFederationEnv(t)
+	code, _ := idp.authorize(env.beginFederatedLogin("acme"))
+	_, otherState := idp.authorize(env.beginFederatedLogin("acme"))
+
+	response := env.federatedCallback("acme", code, otherState)
+	if response.Code != http.StatusUnauthorized || problemCode(t, response) != "federation_rejected" {
+		t.Errorf("%d %s", response.Code, response.Body.String())
+	}
+	if count := federationRepo.count("acme"); count != 0 {
+		t.Errorf("identities: %d", count)
+	}
+}
+
+func TestFederatedLoginStateInvalid(t *testing.T) {
+	env, idp, _ := newFederationEnv(t)
+
+	code, state := idp.authorize(env.beginFederatedLogin("acme"))
+	if response := env.federatedCallback("acme", code, state); response.Code != http.StatusCreated {
+		t.Fatalf("first callback: %d %s", response.Code, response.Body.String())
+	}
+	code, _ = idp.authorize(env.beginFederatedLogin("acme"))
+	globexCode, globexState := idp.authorize(env.beginFederatedLogin("globex"))
+
+	tests := []struct {
+		name  string
+		code  string
+		state string
+	}{
+		{"unknown state", code, "unknown"},
+		{"replayed state", code, state},
+		{"state of other tenant", globexCode, globexState},
+	}
+	for _, test := range tests {
+		response := env.federatedCallback("acme", test.code, test.state)
+		if response.Code != http.StatusUnauthorized || problemCode(t, response) != "federation_state_invalid" {
+			t.Errorf("%s: %d %s", test.name, response.Code, response.Body.String())
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
+	"go.uber.org/zap"
+)
+
+/* Claims access токена, которые отдаются в ответе introspection как есть */
+var introspectedClaims = []string{"scope", "client_id", "iss", "jti", "roles", "amr", "act", "api_key_id"}
+
+/* Token introspection (RFC 7662): сервис, принимающий токены, спрашивает, действителен ли токен, и получает его данные.
+ * Принимает access токены тенанта и API ключи, так что сервису не нужно отдельно обменивать ключ на токен.
+ * Спрашивать может только клиент с секретом или ключом: публичному клиенту незачем проверять чужие токены.
+ * Почему токен недействителен, не сообщается - ответ просто {"active": false}. */
+func (service *AuthService) HandleOAuthIntrospect(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		service.oauthFail(w, req, problem.OAuthInvalidRequest, "Bad request", zap.Error(err),
+			zap.String("ip", req.RemoteAddr))
+		return
+	}
+	client := service.identifyClient(w, req)
+	if client == nil {
+		return
+	}
+	if client.AuthMethod == authMethodNone {
+		service.oauthFail(w, req, problem.OAuthInvalidClient.With("Public clients cannot introspect tokens"),
+			"Public client tried to introspect a token", zap.String("client_id", client.ID))
+		return
+	}
+	raw := req.PostForm.Get("token")
+	if raw == "" {
+		service.oauthFail(w, req, problem.OAuthInvalidRequest.With("token is required"), "Bad request: token is missing",
+			zap.String("client_id", client.ID))
+		return
+	}
+
+	tenant := tenancy.FromContext(req.Context())
+	var result map[string]interface{}
+	var err error
+	if _, ok := parseAPIKey(service.apiKeyPrefix(), raw); ok {
+		result, err = service.introspectAPIKey(tenant, raw)
+	} else {
+		result, err = service.introspectAccessToken(tenant, raw)
+	}
+	if err != nil {
+		service.oauthFail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	if result == nil {
+		result = map[string]interface{}{"active": false}
+	}
+	service.logger.Debug("Token has been introspected",
+		zap.String("client_id", client.ID),
+		zap.Bool("active", result["active"] == true))
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		service.oauthFail(w, req, problem.Internal, "JSON failure", zap.Error(err))
+		return
+	}
+	writeTokenResponse(w, body)
+}
+
+/* Проверяет access токен так же, как Authenticate. Токен без exp живёт lifetime.access_token от iat,
+ * токен удалённого или заблокированного пользователя, как и токен отозванного API ключа, недействителен сразу.
+ * Для недействительного токена возвращает nil без ошибки, ошибка - только сбой базы. */
+func (service *AuthService) introspectAccessToken(tenant *tenancy.Tenant, raw string) (map[string]interface{}, error) {
+	claims, err := (&token.Pair{Access: []byte(raw)}).AccessTokenPayload(tenant.Secret)
+	if err != nil || !tokenOfTenant(claims, tenant) {
+		return nil, nil
+	}
+	iat, ok := claimInt64(claims["iat"])
+	if !ok {
+		return nil, nil
+	}
+	exp, ok := claimInt64(claims["exp"])
+	if !ok {
+		exp = iat + tenant.AccessTokenLifetime
+	}
+	if time.Now().Unix() > exp {
+		return nil, nil
+	}
+	if guid, ok := claims["guid"].(string); ok {
+		user, err := service.userRepo.GetByGUID(tenant.ID, guid)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if user.Disabled {
+			return nil, nil
+		}
+	}
+	if alive, err := service.apiKeyAlive(tenant.ID, claims); err != nil || !alive {
+		return nil, err
+	}
+	result := map[string]interface{}{
+		"active":     true,
+		"token_type": "Bearer",
+		"iat":        iat,
+		"exp":        exp,
+	}
+	/* У токенов пользователя sub - его GUID, у токенов client_credentials - client_id */
+	if guid, ok := claims["guid"].(string); ok {
+		result["sub"] = guid
+	} else if sub, ok := claims["sub"].(string); ok {
+		result["sub"] = sub
+	}
+	for _, name := range introspectedClaims {
+		if value, ok := claims[name]; ok {
+			result[name] = value
+		}
+	}
+	return result, nil
+}
+
+/* Для недействительного ключа возвращает nil без ошибки, ошибка - только сбой базы */
+func (service *AuthService) introspectAPIKey(tenant *tenancy.Tenant, raw string) (map[string]interface{}, error) {
+	key, user, err := service.lookupAPIKey(tenant.ID, raw)
+	if errors.Is(err, errAPIKeyInvalid) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	grant, err := service.apiKeyGrant(tenant.ID, key, "")
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{
+		"active":     true,
+		"token_type": "api_key",
+		"sub":        user.GUID,
+		"iat":        key.CreatedAt.Unix(),
+		"scope":      grant.Scope,
+		"roles":      grant.Roles,
+		"api_key_id": key.ID,
+	}
+	if key.ExpiresAt != nil {
+		result["exp"] = key.ExpiresAt.Unix()
+	}
+	if tenant.Issuer != "" {
+		result["iss"] = tenant.Issuer
+	}
+	return result, nil
+}
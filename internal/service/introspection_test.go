@@ -0,0 +1,195 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+)
+
+type testAPIKey struct {
+	tenantID string
+	key      model.APIKey
+}
+
+type memAPIKeys struct {
+	repository.APIKeyRepository
+	mutex sync.Mutex
+	keys  map[string]testAPIKey
+}
+
+func (repo *memAPIKeys) GetByID(tenantID string, id string) (*model.APIKey, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, ok := repo.keys[id]
+	if !ok || stored.tenantID != tenantID {
+		return nil, sql.ErrNoRows
+	}
+	key := stored.key
+	return &key, nil
+}
+
+func (repo *memAPIKeys) Touch(tenantID string, id string, usedAt time.Time) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, ok := repo.keys[id]
+	if !ok || stored.tenantID != tenantID {
+		return sql.ErrNoRows
+	}
+	stored.key.LastUsedAt = &usedAt
+	repo.keys[id] = stored
+	return nil
+}
+
+func (repo *memAPIKeys) Delete(tenantID string, userGUID string, id string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, ok := repo.keys[id]
+	if !ok || stored.tenantID != tenantID || stored.key.UserGUID != userGUID {
+		return sql.ErrNoRows
+	}
+	delete(repo.keys, id)
+	return nil
+}
+
+/* Клиент rs тенанта acme с секретом, как у сервиса, принимающего токены, и публичный клиент spa */
+func newIntrospectionEnv(t *testing.T) (*testEnv, *memAPIKeys) {
+	env := newTestEnv(t)
+	env.addPublicClient()
+	env.service.clientRepo.(*memClients).clients["rs"] = testClient{"acme", model.OAuthClient{
+		ID:         "rs",
+		AuthMethod: authMethodSecretBasic,
+		SecretHash: clientSecretHash("secret"),
+	}}
+	apiKeys := &memAPIKeys{keys: map[string]testAPIKey{}}
+	env.service.apiKeyRepo = apiKeys
+	env.router.Post("/oauth/introspect", env.service.HandleOAuthIntrospect)
+	return env, apiKeys
+}
+
+func (env *testEnv) addAPIKey(apiKeys *memAPIKeys, tenantID string, user *model.User) (string, string) {
+	key, id, err := env.service.newAPIKey()
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	apiKeys.keys[id] = testAPIKey{tenantID, model.APIKey{
+		ID:        id,
+		UserGUID:  user.GUID,
+		Name:      "ci",
+		Hash:      clientSecretHash(key),
+		CreatedAt: time.Now(),
+	}}
+	return key, id
+}
+
+/* Спрашивает тенант acme о токене от имени клиента clientID. Без секрета клиент приходит как публичный. */
+func (env *testEnv) introspect(clientID string, secret string, raw string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	form := url.Values{"token": {raw}}
+	if secret == "" {
+		form.Set("client_id", clientID)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/oauth/introspect", strings.NewReader(form.Encode()))
+	req.RemoteAddr = "192.0.2.1"
+	req.Header.Set("X-Tenant-ID", "acme")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if secret != "" {
+		req.SetBasicAuth(clientID, secret)
+	}
+	recorder := httptest.NewRecorder()
+	env.router.ServeHTTP(recorder, req)
+	result := map[string]interface{}{}
+	if recorder.Code == http.StatusOK {
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			env.t.Fatal(err)
+		}
+	}
+	return recorder, result
+}
+
+func TestIntrospectActive(t *testing.T) {
+	env, apiKeys := newIntrospectionEnv(t)
+	user := env.addUser("acme", "ivan@acme.example")
+
+	response, result := env.introspect("rs", "secret", env.accessToken("acme", user.GUID, nil))
+	if response.Code != http.StatusOK || result["active"] != true || result["sub"] != user.GUID {
+		t.Fatalf("access token: %d %s", response.Code, response.Body.String())
+	}
+
+	key, id := env.addAPIKey(apiKeys, "acme", user)
+	response, result = env.introspect("rs", "secret", key)
+	if response.Code != http.StatusOK || result["active"] != true || result["api_key_id"] != id {
+		t.Fatalf("API key: %d %s", response.Code, response.Body.String())
+	}
+}
+
+/* Почему токен недействителен, не сообщается: на всё отвечается {"active": false} */
+func TestIntrospectInactive(t *testing.T) {
+	env, apiKeys := newIntrospectionEnv(t)
+	user := env.addUser("acme", "ivan@acme.example")
+	disabled := env.addUser("acme", "petr@acme.example")
+	stranger := env.addUser("globex", "ivan@globex.example")
+
+	revoked, revokedID := env.addAPIKey(apiKeys, "acme", user)
+	if err := apiKeys.Delete("acme", user.GUID, revokedID); err != nil {
+		t.Fatal(err)
+	}
+	disabledKey, _ := env.addAPIKey(apiKeys, "acme", disabled)
+	strangerKey, _ := env.addAPIKey(apiKeys, "globex", stranger)
+	expiredKey, expiredID := env.addAPIKey(apiKeys, "acme", user)
+	expiredAt := time.Now().Add(-time.Minute)
+	stored := apiKeys.keys[expiredID]
+	stored.key.ExpiresAt = &expiredAt
+	apiKeys.keys[expiredID] = stored
+	disabledToken := env.accessToken("acme", disabled.GUID, nil)
+	if err := env.users.SetDisabled("acme", disabled.GUID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		/* Подпись тенанта globex не подходит к acme, а tid чужого тенанта не принимается даже с подписью acme */
+		{"other tenant token", env.accessToken("globex", stranger.GUID, nil)},
+		{"other tenant tid", env.accessToken("acme", stranger.GUID, map[string]interface{}{"tid": "globex"})},
+		{"expired token", env.accessToken("acme", user.GUID, map[string]interface{}{
+			"iat": time.Now().Add(-time.Hour).Unix(),
+		})},
+		{"disabled user token", disabledToken},
+		{"deleted user token", env.accessToken("acme", "00000000-0000-0000-0000-000000000000", nil)},
+		{"garbage", "not a token"},
+		{"revoked API key", revoked},
+		{"API key of disabled user", disabledKey},
+		{"API key of other tenant", strangerKey},
+		{"expired API key", expiredKey},
+	}
+	for _, test := range tests {
+		response, result := env.introspect("rs", "secret", test.token)
+		if response.Code != http.StatusOK || result["active"] != false || len(result) != 1 {
+			t.Errorf("%s: %d %s", test.name, response.Code, response.Body.String())
+		}
+	}
+}
+
+func TestIntrospectClientRejected(t *testing.T) {
+	env, _ := newIntrospectionEnv(t)
+	user := env.addUser("acme", "ivan@acme.example")
+	accessToken := env.accessToken("acme", user.GUID, nil)
+
+	response, _ := env.introspect("spa", "", accessToken)
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("public client: %d %s", response.Code, response.Body.String())
+	}
+	response, _ = env.introspect("rs", "wrong", accessToken)
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("wrong secret: %d %s", response.Code, response.Body.String())
+	}
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/config"
+	"github.com/TooLazyToCreate/auth-service/internal/mailer"
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
+	"go.uber.org/zap"
+)
+
+/* Создаёт одноразовую ссылку и отправляет её пользователю на почту. Письма на один адрес
+ * ограничиваются настройками link.RateLimit и link.RateWindow. Ошибки только логируются:
+ * вызывающий обработчик отвечает клиенту одинаково, чтобы ответ не раскрывал существование адреса.
+ * Время ответа его раскрывает: для известного адреса здесь идут лишние запросы к базе и сборка письма. */
+func (service *AuthService) sendLinkToken(user *model.User, purpose string, link config.Link, req *http.Request) {
+	window := time.Duration(link.RateWindow) * time.Second
+	tenantID := tenancy.FromContext(req.Context()).ID
+	count, err := service.linkTokenRepo.CountSince(tenantID, purpose, user.Email, time.Now().Add(-window))
+	if err != nil {
+		service.logger.Error("SQL error", zap.Error(err))
+		return
+	}
+	if count >= link.RateLimit {
+		service.logger.Warn("Link rate limit exceeded",
+			zap.String("purpose", purpose),
+			zap.String("ip", req.RemoteAddr),
+			zap.String("email", user.Email))
+		return
+	}
+
+	/* В базу пишем только хэш, сам токен уходит в письме */
+	linkToken, hash, err := token.NewLinkToken(tenancy.FromContext(req.Context()).Secret, purpose)
+	if err != nil {
+		service.logger.Error("Failed to generate link token", zap.Error(err))
+		return
+	}
+	lifetime := time.Duration(link.Lifetime) * time.Second
+	err = service.linkTokenRepo.Create(tenantID, &model.LinkToken{
+		Hash:      hash,
+		Purpose:   purpose,
+		UserGUID:  user.GUID,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(lifetime),
+	})
+	if err != nil {
+		service.logger.Error("Failed to save link token", zap.Error(err), zap.String("user_guid", user.GUID))
+		return
+	}
+
+	/* Письмо только ставится в очередь, SMTP не задерживает ответ */
+	service.notifyUser(tenancy.FromContext(req.Context()), user, purpose, mailer.Data{
+		IP:       req.RemoteAddr,
+		Link:     link.URL + "?token=" + url.QueryEscape(linkToken),
+		Lifetime: int64(lifetime.Minutes()),
+	})
+}
+
+/* Проверяет подпись токена из ссылки и помечает ссылку использованной.
+ * Если что-то пошло не так, ответ клиенту уже записан и возвращается false. */
+func (service *AuthService) consumeLinkToken(purpose string, linkToken string, w http.ResponseWriter, req *http.Request) (*model.LinkToken, bool) {
+	hash, err := token.VerifyLinkToken(tenancy.FromContext(req.Context()).Secret, purpose, linkToken)
+	if err != nil {
+		service.fail(w, req, problem.LinkInvalid, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return nil, false
+	}
+
+	/* Повторный переход или просроченная ссылка дадут sql.ErrNoRows */
+	consumed, err := service.linkTokenRepo.Consume(tenancy.FromContext(req.Context()).ID, hash, purpose)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			service.fail(w, req, problem.LinkInvalid, "Link is invalid, expired or already used",
+				zap.String("purpose", purpose),
+				zap.String("ip", req.RemoteAddr))
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return nil, false
+	}
+	return consumed, true
+}
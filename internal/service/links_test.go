@@ -0,0 +1,113 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
+)
+
+/* Ссылка, как её создаёт sendLinkToken, но без письма */
+func (env *testEnv) addLinkToken(tenantID string, user *model.User, purpose string, lifetime time.Duration) string {
+	linkToken, hash, err := token.NewLinkToken(env.tenant(tenantID).Secret, purpose)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	err = env.links.Create(tenantID, &model.LinkToken{
+		Hash:      hash,
+		Purpose:   purpose,
+		UserGUID:  user.GUID,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(lifetime),
+	})
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	return linkToken
+}
+
+func TestMagicLinkSingleUse(t *testing.T) {
+	env := newTestEnv(t)
+	env.router.Post("/user/login/magic", env.service.HandleMagicLinkLogin)
+	user := env.addUser("acme", "ivan@acme.example")
+	linkToken := env.addLinkToken("acme", user, magicLinkPurpose, time.Hour)
+	body := url.Values{"token": {linkToken}}.Encode()
+
+	response := env.do("acme", http.MethodPost, "/user/login/magic", body, "")
+	if response.Code != http.StatusCreated {
+		t.Fatalf("first use: %d %s", response.Code, response.Body.String())
+	}
+	if env.tokens.count("acme", user.GUID) != 1 {
+		t.Fatal("refresh token was not saved")
+	}
+
+	response = env.do("acme", http.MethodPost, "/user/login/magic", body, "")
+	if response.Code != http.StatusUnauthorized || problemCode(t, response) != "link_invalid" {
+		t.Fatalf("second use: %d %s", response.Code, response.Body.String())
+	}
+	if env.tokens.count("acme", user.GUID) != 1 {
+		t.Fatal("second use must not issue tokens")
+	}
+}
+
+func TestMagicLinkRejected(t *testing.T) {
+	env := newTestEnv(t)
+	env.router.Post("/user/login/magic", env.service.HandleMagicLinkLogin)
+	user := env.addUser("acme", "ivan@acme.example")
+
+	tests := []struct {
+		name      string
+		tenantID  string
+		linkToken string
+	}{
+		{"expired", "acme", env.addLinkToken("acme", user, magicLinkPurpose, -time.Second)},
+		{"other purpose", "acme", env.addLinkToken("acme", user, passwordResetPurpose, time.Hour)},
+		/* Подпись ссылки привязана к ключу тенанта */
+		{"other tenant", "globex", env.addLinkToken("acme", user, magicLinkPurpose, time.Hour)},
+		{"unknown", "acme", "bm90LWEtdG9rZW4.c2lnbmF0dXJl"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := env.do(test.tenantID, http.MethodPost, "/user/login/magic",
+				url.Values{"token": {test.linkToken}}.Encode(), "")
+			if response.Code != http.StatusUnauthorized || problemCode(t, response) != "link_invalid" {
+				t.Fatalf("%d %s", response.Code, response.Body.String())
+			}
+		})
+	}
+	if env.tokens.count("acme", user.GUID) != 0 {
+		t.Fatal("rejected links must not issue tokens")
+	}
+}
+
+/* Ссылка на сброс пароля действует, только пока у пользователя тот адрес, на который её отправили */
+func TestPasswordResetEmailChanged(t *testing.T) {
+	env := newTestEnv(t)
+	env.router.Post("/user/password/reset", env.service.HandlePasswordReset)
+	user := env.addUser("acme", "ivan@acme.example")
+	reset := func(linkToken string) *httptest.ResponseRecorder {
+		return env.do("acme", http.MethodPost, "/user/password/reset",
+			`{"token":"`+linkToken+`","password":"correct horse battery staple"}`, "")
+	}
+
+	if response := reset(env.addLinkToken("acme", user, passwordResetPurpose, time.Hour)); response.Code != http.StatusNoContent {
+		t.Fatalf("reset: %d %s", response.Code, response.Body.String())
+	}
+	staleLink := env.addLinkToken("acme", user, passwordResetPurpose, time.Hour)
+	env.users.mutex.Lock()
+	env.users.users[user.GUID].user.Email = "ivan@new.example"
+	env.users.mutex.Unlock()
+	env.credentials.hashes = map[string]string{}
+
+	response := reset(staleLink)
+	if response.Code != http.StatusUnauthorized || problemCode(t, response) != "user_unavailable" {
+		t.Fatalf("reset by link sent to the previous address: %d %s", response.Code, response.Body.String())
+	}
+	if len(env.credentials.hashes) != 0 {
+		t.Fatal("password must not change by link sent to the previous address")
+	}
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/mailer"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"go.uber.org/zap"
+)
+
+/* Если аккаунт временно заблокирован после неудачных попыток входа, отвечает 423 с Retry-After
+ * и возвращает false. Ошибка базы вход не блокирует, от перебора в этом случае защищает rate limit. */
+func (service *AuthService) checkLockout(userGUID string, w http.ResponseWriter, req *http.Request) bool {
+	if service.cfg.Lockout.Threshold <= 0 {
+		return true
+	}
+	lockout, err := service.lockoutRepo.Get(tenancy.FromContext(req.Context()).ID, userGUID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			service.logger.Error("SQL error", zap.Error(err))
+		}
+		return true
+	}
+	if lockout.LockedUntil == nil || !lockout.LockedUntil.After(time.Now()) {
+		return true
+	}
+	retryAfter := math.Ceil(time.Until(*lockout.LockedUntil).Seconds())
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+	problem.Write(w, req, problem.AccountLocked)
+	service.logger.Warn("User is locked out", correlationField(req),
+		zap.String("ip", req.RemoteAddr),
+		zap.String("user_guid", userGUID),
+		zap.Time("locked_until", *lockout.LockedUntil))
+	return false
+}
+
+/* Учитывает неудачную попытку входа. Начиная с lockout.threshold неудач подряд аккаунт блокируется
+ * на lockout.duration секунд, и каждая следующая неудача удваивает блокировку до lockout.max_duration. */
+func (service *AuthService) registerFailure(userGUID string, reason string, req *http.Request) {
+	/* Письмо отправляется только при первой блокировке в серии, чтобы не заваливать почту */
+	if service.countFailure(userGUID, reason, req) {
+		service.notifyUserByGUID(tenancy.FromContext(req.Context()), userGUID, notify.KindLockout,
+			mailer.Data{IP: req.RemoteAddr, Failures: service.cfg.Lockout.Threshold})
+	}
+}
+
+/* registerFailure без письма. Возвращает true, если эта неудача начала блокировку. */
+func (service *AuthService) countFailure(userGUID string, reason string, req *http.Request) bool {
+	cfg := service.cfg.Lockout
+	if cfg.Threshold <= 0 {
+		return false
+	}
+	resetBefore := time.Now().Add(-time.Duration(cfg.ResetAfter) * time.Second)
+	tenantID := tenancy.FromContext(req.Context()).ID
+	lockout, err := service.lockoutRepo.AddFailure(tenantID, userGUID, resetBefore)
+	if err != nil {
+		service.logger.Error("Failed to count login failure", zap.Error(err), zap.String("user_guid", userGUID))
+		return false
+	}
+	if lockout.Failures < cfg.Threshold {
+		return false
+	}
+
+	lockedUntil := time.Now().Add(service.lockoutDuration(lockout.Failures))
+	if err = service.lockoutRepo.Lock(tenantID, userGUID, lockedUntil); err != nil {
+		service.logger.Error("Failed to lock user", zap.Error(err), zap.String("user_guid", userGUID))
+		return false
+	}
+	service.logger.Warn("User has been locked out",
+		zap.String("reason", reason),
+		zap.String("ip", req.RemoteAddr),
+		zap.String("user_guid", userGUID),
+		zap.Int("failures", lockout.Failures),
+		zap.Time("locked_until", lockedUntil))
+	return lockout.Failures == cfg.Threshold
+}
+
+/* Длительность блокировки после failures неудач подряд: lockout.duration на пороге, дальше удваивается
+ * с каждой неудачей. max_duration = 0 не ограничивает длительность. */
+func (service *AuthService) lockoutDuration(failures int) time.Duration {
+	cfg := service.cfg.Lockout
+	/* Сдвиг ограничен, чтобы длительность не переполнилась при большом числе неудач */
+	duration := time.Duration(cfg.Duration) * time.Second << min(failures-cfg.Threshold, 16)
+	if cfg.MaxDuration > 0 {
+		duration = min(duration, time.Duration(cfg.MaxDuration)*time.Second)
+	}
+	return duration
+}
+
+/* Успешный вход обнуляет счётчик неудач */
+func (service *AuthService) clearFailures(userGUID string, req *http.Request) {
+	if service.cfg.Lockout.Threshold <= 0 {
+		return
+	}
+	tenantID := tenancy.FromContext(req.Context()).ID
+	if err := service.lockoutRepo.Delete(tenantID, userGUID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		service.logger.Error("Failed to clear login failures", zap.Error(err), zap.String("user_guid", userGUID))
+	}
+}
@@ -0,0 +1,262 @@
+package service
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/ratelimit"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+type memLockouts struct {
+	repository.LockoutRepository
+	mutex    sync.Mutex
+	lockouts map[string]*model.Lockout
+}
+
+func (repo *memLockouts) Get(tenantID string, userGUID string) (*model.Lockout, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, ok := repo.lockouts[tenantID+"/"+userGUID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	lockout := *stored
+	return &lockout, nil
+}
+
+func (repo *memLockouts) AddFailure(tenantID string, userGUID string, resetBefore time.Time) (*model.Lockout, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, ok := repo.lockouts[tenantID+"/"+userGUID]
+	if !ok || stored.LastFailureAt.Before(resetBefore) {
+		stored = &model.Lockout{UserGUID: userGUID}
+		repo.lockouts[tenantID+"/"+userGUID] = stored
+	}
+	stored.Failures++
+	stored.LastFailureAt = time.Now()
+	lockout := *stored
+	return &lockout, nil
+}
+
+func (repo *memLockouts) Lock(tenantID string, userGUID string, until time.Time) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.lockouts[tenantID+"/"+userGUID].LockedUntil = &until
+	return nil
+}
+
+func (repo *memLockouts) Delete(tenantID string, userGUID string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if _, ok := repo.lockouts[tenantID+"/"+userGUID]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(repo.lockouts, tenantID+"/"+userGUID)
+	return nil
+}
+
+/* Блокировка после 3 неудач на минуту с удвоением до часа; /fail засчитывает неудачу, /check проверяет блокировку */
+func newLockoutEnv(t *testing.T) (*testEnv, *memLockouts) {
+	env := newTestEnv(t)
+	env.cfg.Lockout.Threshold = 3
+	env.cfg.Lockout.Duration = 60
+	env.cfg.Lockout.MaxDuration = 3600
+	env.cfg.Lockout.ResetAfter = 86400
+	lockouts := &memLockouts{lockouts: map[string]*model.Lockout{}}
+	env.service.lockoutRepo = lockouts
+	env.router.Post("/fail/{guid}", func(w http.ResponseWriter, req *http.Request) {
+		env.service.registerFailure(chi.URLParam(req, "guid"), "test", req)
+	})
+	env.router.Post("/check/{guid}", func(w http.ResponseWriter, req *http.Request) {
+		if env.service.checkLockout(chi.URLParam(req, "guid"), w, req) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	return env, lockouts
+}
+
+func TestLockoutDuration(t *testing.T) {
+	env, _ := newLockoutEnv(t)
+	tests := []struct {
+		failures    int
+		maxDuration int64
+		duration    time.Duration
+	}{
+		{3, 3600, time.Minute},
+		{4, 3600, 2 * time.Minute},
+		{5, 3600, 4 * time.Minute},
+		{8, 3600, 32 * time.Minute},
+		/* 64 минуты упираются в max_duration */
+		{9, 3600, time.Hour},
+		{1000, 3600, time.Hour},
+		/* Без предела сдвиг всё равно ограничен 16 удвоениями и не переполняется */
+		{9, 0, 64 * time.Minute},
+		{19, 0, time.Minute << 16},
+		{1000, 0, time.Minute << 16},
+	}
+	for _, test := range tests {
+		env.cfg.Lockout.MaxDuration = test.maxDuration
+		if duration := env.service.lockoutDuration(test.failures); duration != test.duration {
+			t.Errorf("failures %d, max %d: %v, want %v", test.failures, test.maxDuration, duration, test.duration)
+		}
+	}
+}
+
+/* До порога аккаунт не блокируется, на пороге блокируется на duration, дальше блокировка удваивается.
+ * Письмо приходит один раз за серию. */
+func TestLockoutThreshold(t *testing.T) {
+	env, lockouts := newLockoutEnv(t)
+	user := env.addUser("acme", "ivan@acme.example")
+	tests := []struct {
+		failures int
+		locked   time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+	}
+	for _, test := range tests {
+		env.do("acme", http.MethodPost, "/fail/"+user.GUID, "", "")
+		lockout, err := lockouts.Get("acme", user.GUID)
+		if err != nil || lockout.Failures != test.failures {
+			t.Fatalf("failures = %+v, %v; want %d", lockout, err, test.failures)
+		}
+		response := env.do("acme", http.MethodPost, "/check/"+user.GUID, "", "")
+		if test.locked == 0 {
+			if lockout.LockedUntil != nil || response.Code != http.StatusNoContent {
+				t.Fatalf("failure %d: locked until %v, check %d", test.failures, lockout.LockedUntil, response.Code)
+			}
+			continue
+		}
+		if lockout.LockedUntil == nil {
+			t.Fatalf("failure %d: not locked", test.failures)
+		}
+		if until := time.Until(*lockout.LockedUntil); until > test.locked || until < test.locked-5*time.Second {
+			t.Fatalf("failure %d: locked for %v, want %v", test.failures, until, test.locked)
+		}
+		retryAfter, _ := strconv.Atoi(response.Header().Get("Retry-After"))
+		if response.Code != http.StatusLocked || problemCode(t, response) != "account_locked" ||
+			time.Duration(retryAfter)*time.Second > test.locked || retryAfter <= 0 {
+			t.Fatalf("failure %d: check %d, Retry-After %s", test.failures, response.Code, response.Header().Get("Retry-After"))
+		}
+	}
+	if mails := env.mails(notify.KindLockout); len(mails) != 1 || mails[0].To != user.Email {
+		t.Fatalf("lockout mails: %+v", mails)
+	}
+
+	/* Успешный вход начинает серию заново, и следующая блокировка снова сопровождается письмом */
+	env.router.Post("/success/{guid}", func(w http.ResponseWriter, req *http.Request) {
+		env.service.clearFailures(chi.URLParam(req, "guid"), req)
+	})
+	env.do("acme", http.MethodPost, "/success/"+user.GUID, "", "")
+	if response := env.do("acme", http.MethodPost, "/check/"+user.GUID, "", ""); response.Code != http.StatusNoContent {
+		t.Fatalf("check after success: %d", response.Code)
+	}
+	for i := 0; i < 3; i++ {
+		env.do("acme", http.MethodPost, "/fail/"+user.GUID, "", "")
+	}
+	if mails := env.mails(notify.KindLockout); len(mails) != 2 {
+		t.Fatalf("lockout mails after new series: %d", len(mails))
+	}
+}
+
+/* Истёкшая блокировка не мешает входу, а threshold = 0 выключает учёт совсем */
+func TestLockoutExpiredAndDisabled(t *testing.T) {
+	env, lockouts := newLockoutEnv(t)
+	user := env.addUser("acme", "ivan@acme.example")
+	past := time.Now().Add(-time.Second)
+	lockouts.lockouts["acme/"+user.GUID] = &model.Lockout{UserGUID: user.GUID, Failures: 7, LockedUntil: &past}
+	if response := env.do("acme", http.MethodPost, "/check/"+user.GUID, "", ""); response.Code != http.StatusNoContent {
+		t.Fatalf("expired lockout: %d", response.Code)
+	}
+	/* Блокировка одного тенанта не касается пользователя с тем же GUID в другом */
+	future := time.Now().Add(time.Hour)
+	lockouts.lockouts["globex/"+user.GUID] = &model.Lockout{UserGUID: user.GUID, Failures: 3, LockedUntil: &future}
+	if response := env.do("acme", http.MethodPost, "/check/"+user.GUID, "", ""); response.Code != http.StatusNoContent {
+		t.Fatalf("lockout of other tenant: %d", response.Code)
+	}
+
+	env.cfg.Lockout.Threshold = 0
+	env.service.lockoutRepo = nil
+	for i := 0; i < 5; i++ {
+		env.do("acme", http.MethodPost, "/fail/"+user.GUID, "", "")
+	}
+	if response := env.do("globex", http.MethodPost, "/check/"+user.GUID, "", ""); response.Code != http.StatusNoContent {
+		t.Fatalf("disabled lockout: %d", response.Code)
+	}
+}
+
+/* Незарегистрированный адрес и аккаунт без пароля блокируются так же, как аккаунт с неверным паролем:
+ * по 423 нельзя отличить зарегистрированные адреса */
+func TestLoginLockoutWithoutAccount(t *testing.T) {
+	env, lockouts := newLockoutEnv(t)
+	env.router.Post("/user/login", env.service.HandleLogin)
+	withPassword := env.addUser("acme", "ivan@acme.example")
+	env.setPassword("acme", withPassword, "correct horse")
+	env.addUser("acme", "passkey@acme.example")
+
+	for _, email := range []string{"ivan@acme.example", "passkey@acme.example", "ghost@acme.example"} {
+		t.Run(email, func(t *testing.T) {
+			body := `{"email": "` + email + `", "password": "wrong password"}`
+			for i := 1; i <= 3; i++ {
+				response := env.do("acme", http.MethodPost, "/user/login", body, "")
+				if response.Code != http.StatusUnauthorized || problemCode(t, response) != "invalid_credentials" {
+					t.Fatalf("attempt %d: %d %s", i, response.Code, response.Body.String())
+				}
+			}
+			response := env.do("acme", http.MethodPost, "/user/login", body, "")
+			if response.Code != http.StatusLocked || response.Header().Get("Retry-After") == "" {
+				t.Fatalf("after threshold: %d %s", response.Code, response.Body.String())
+			}
+		})
+	}
+
+	/* Адрес сравнивается без учёта регистра, как и при поиске пользователя */
+	response := env.do("acme", http.MethodPost, "/user/login", `{"email": "GHOST@acme.example", "password": "x"}`, "")
+	if response.Code != http.StatusLocked {
+		t.Fatalf("same address in other case: %d %s", response.Code, response.Body.String())
+	}
+	/* Счётчик незарегистрированного адреса не пересекается с другими тенантами и не содержит адрес */
+	ghostGUID := unknownUserGUID(env.tenant("acme").Secret, "ghost@acme.example")
+	if ghostGUID == unknownUserGUID(env.tenant("globex").Secret, "ghost@acme.example") {
+		t.Fatal("unknown address has the same GUID in different tenants")
+	}
+	if lockout, err := lockouts.Get("acme", ghostGUID); err != nil || lockout.LockedUntil == nil {
+		t.Fatalf("unknown address lockout: %+v, %v", lockout, err)
+	}
+	/* Письмо о блокировке получают только существующие пользователи */
+	if mails := env.mails(notify.KindLockout); len(mails) != 2 {
+		t.Fatalf("lockout mails: %+v", mails)
+	}
+}
+
+/* Лимит rate_limit.user действует и на незарегистрированный адрес */
+func TestLoginRateLimitWithoutAccount(t *testing.T) {
+	env := newTestEnv(t)
+	env.service.limiter = ratelimit.NewLimiter(zap.NewNop(), ratelimit.NewMemoryStore(),
+		ratelimit.Rule{}, ratelimit.Rule{Rate: 0.001, Burst: 2}, ratelimit.Rule{})
+	env.router.Post("/user/login", env.service.HandleLogin)
+	user := env.addUser("acme", "ivan@acme.example")
+	env.setPassword("acme", user, "correct horse")
+
+	for _, email := range []string{"ivan@acme.example", "ghost@acme.example"} {
+		body := `{"email": "` + email + `", "password": "wrong password"}`
+		codes := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}
+		for i, code := range codes {
+			if response := env.do("acme", http.MethodPost, "/user/login", body, ""); response.Code != code {
+				t.Fatalf("%s, attempt %d: %d, want %d", email, i+1, response.Code, code)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/TooLazyToCreate/auth-service/internal/keys"
+	"github.com/TooLazyToCreate/auth-service/internal/password"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+type loginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	/* Необязательные scope через пробел, без них выдаются все права пользователя */
+	Scope *string `json:"scope"`
+}
+
+/* Ключ для GUID незарегистрированных адресов */
+const unknownEmailPurpose = "unknown-email"
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+func (service *AuthService) HandleLogin(w http.ResponseWriter, req *http.Request) {
+	/* Парсим email и пароль из JSON */
+	body := loginRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Email == "" || body.Password == "" {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+
+	/* Ищем пользователя по email. Если его нет, всё равно считаем хэш,
+	 * чтобы по времени ответа нельзя было понять, зарегистрирован ли email. */
+	tenantID := tenancy.FromContext(req.Context()).ID
+	user, err := service.userRepo.GetByEmail(tenantID, body.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		service.failUnknownEmail(body.Email, body.Password, w, req)
+		return
+	}
+	if err != nil {
+		service.verifyDummyPassword(body.Password)
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	if !service.allowUser(user.GUID, w, req) || !service.checkLockout(user.GUID, w, req) {
+		return
+	}
+
+	credential, err := service.credentialRepo.GetByUserGUID(tenantID, user.GUID)
+	if err != nil {
+		service.verifyDummyPassword(body.Password)
+		if errors.Is(err, sql.ErrNoRows) {
+			service.fail(w, req, problem.InvalidCredentials, "User has no password",
+				zap.String("ip", req.RemoteAddr), zap.String("user_guid", user.GUID))
+			/* Иначе аккаунт без пароля отличался бы от остальных тем, что никогда не блокируется */
+			service.registerFailure(user.GUID, "no password", req)
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return
+	}
+
+	/* Сверяем пароль с argon2id хэшем */
+	params := passwordParams(service.cfg)
+	match, rehash, err := password.Verify(body.Password, credential.Hash, params)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Stored password hash is broken",
+			zap.Error(err), zap.String("user_guid", user.GUID))
+		return
+	}
+	if !match {
+		service.fail(w, req, problem.InvalidCredentials, "Wrong password",
+			zap.String("ip", req.RemoteAddr), zap.String("user_guid", user.GUID))
+		service.registerFailure(user.GUID, "wrong password", req)
+		return
+	}
+	/* Пароль проверяем раньше флага блокировки, чтобы не раскрывать его подбирающему пароль */
+	if user.Disabled {
+		service.fail(w, req, problem.UserUnavailable, "User is disabled",
+			zap.String("ip", req.RemoteAddr), zap.String("user_guid", user.GUID))
+		return
+	}
+	service.clearFailures(user.GUID, req)
+
+	/* Параметры хэширования поменялись - пересчитываем хэш, пока пароль на руках.
+	 * Ошибка здесь не мешает входу, старый хэш остаётся рабочим. */
+	if rehash {
+		if hash, err := password.Hash(body.Password, params); err != nil {
+			service.logger.Error("Failed to rehash password", zap.Error(err), zap.String("user_guid", user.GUID))
+		} else if err = service.credentialRepo.Set(tenantID, user.GUID, hash); err != nil {
+			service.logger.Error("Failed to save rehashed password", zap.Error(err), zap.String("user_guid", user.GUID))
+		} else {
+			service.logger.Info("Password has been rehashed with new parameters", zap.String("user_guid", user.GUID))
+		}
+	}
+
+	/* Создаём пару токенов */
+	service.issueTokens(user, []string{"pwd"}, body.Scope, w, req)
+}
+
+/* Вход на незарегистрированный адрес проходит те же шаги, что и вход с неверным паролем: лимит запросов,
+ * проверка блокировки и счётчик неудач. Иначе 429 и 423 получали бы только существующие аккаунты, и по ним
+ * адреса можно было бы перебрать. Счётчики ведутся под GUID, выведенным из адреса, а письмо о блокировке слать некому. */
+func (service *AuthService) failUnknownEmail(email string, plain string, w http.ResponseWriter, req *http.Request) {
+	userGUID := unknownUserGUID(tenancy.FromContext(req.Context()).Secret, email)
+	if !service.allowUser(userGUID, w, req) || !service.checkLockout(userGUID, w, req) {
+		return
+	}
+	service.verifyDummyPassword(plain)
+	service.fail(w, req, problem.InvalidCredentials, "User not found",
+		zap.String("ip", req.RemoteAddr), zap.String("email", email))
+	service.countFailure(userGUID, "unknown email", req)
+}
+
+/* GUID счётчиков незарегистрированного адреса. HMAC с ключом тенанта: по записям в lockouts адреса не подобрать. */
+func unknownUserGUID(secret []byte, email string) string {
+	mac := hmac.New(sha256.New, keys.Derive(secret, unknownEmailPurpose))
+	return uuid.NewHash(mac, uuid.Nil, []byte(strings.ToLower(email)), 5).String()
+}
+
+func (service *AuthService) verifyDummyPassword(plain string) {
+	params := passwordParams(service.cfg)
+	dummyHashOnce.Do(func() {
+		var err error
+		if dummyHash, err = password.Hash("dummy password", params); err != nil {
+			service.logger.Error("Failed to generate dummy password hash", zap.Error(err))
+		}
+	})
+	_, _, _ = password.Verify(plain, dummyHash, params)
+}
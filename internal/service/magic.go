@@ -0,0 +1,71 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"go.uber.org/zap"
+)
+
+const magicLinkPurpose = "magic_login"
+
+type emailRequest struct {
+	Email string `json:"email"`
+}
+
+/* На запрос ссылки всегда отвечаем 202, даже если пользователя нет или лимит исчерпан,
+ * чтобы по ответу нельзя было проверять, зарегистрирован ли email. По времени ответа это видно (см. sendLinkToken). */
+func (service *AuthService) HandleMagicLinkRequest(w http.ResponseWriter, req *http.Request) {
+	body := emailRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Email == "" {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+
+	user, err := service.userRepo.GetByEmail(tenancy.FromContext(req.Context()).ID, body.Email)
+	if err != nil {
+		service.logger.Error("Magic link requested for unknown email", zap.Error(err),
+			zap.String("ip", req.RemoteAddr),
+			zap.String("email", body.Email))
+		return
+	}
+	if user.Disabled {
+		service.logger.Error("Magic link requested for disabled user",
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", user.GUID))
+		return
+	}
+	service.sendLinkToken(user, magicLinkPurpose, service.cfg.MagicLink, req)
+}
+
+/* Токен принимается как из query (переход по ссылке), так и из тела формы */
+func (service *AuthService) HandleMagicLinkLogin(w http.ResponseWriter, req *http.Request) {
+	linkToken, ok := service.consumeLinkToken(magicLinkPurpose, req.FormValue("token"), w, req)
+	if !ok {
+		return
+	}
+
+	/* Пользователя могли удалить, заблокировать или сменить ему email, пока письмо шло */
+	user, err := service.userRepo.GetByGUID(tenancy.FromContext(req.Context()).ID, linkToken.UserGUID)
+	if err != nil || user.Disabled || user.Email != linkToken.Email {
+		service.fail(w, req, problem.UserUnavailable, "Magic link user is not available anymore", zap.Error(err),
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", linkToken.UserGUID))
+		return
+	}
+
+	/* Переход по ссылке из письма заодно подтверждает email */
+	if !user.EmailVerified {
+		if err = service.userRepo.SetEmailVerified(tenancy.FromContext(req.Context()).ID, user.GUID, linkToken.Email); err != nil {
+			service.logger.Error("Failed to mark email as verified", zap.Error(err), zap.String("user_guid", user.GUID))
+		} else {
+			user.EmailVerified = true
+		}
+	}
+
+	/* Создаём пару токенов */
+	service.issueTokens(user, []string{"email"}, nil, w, req)
+}
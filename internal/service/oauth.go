@@ -0,0 +1,359 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"go.uber.org/zap"
+)
+
+const (
+	grantAuthorizationCode = "authorization_code"
+	pkceMethodS256         = "S256"
+	/* RFC 6749 советует не больше 10 минут, на практике хватает минуты */
+	defaultCodeLifetime = 60
+)
+
+/* code_verifier из RFC 7636, 4.1 и code_challenge - BASE64URL(SHA256) без паддинга, всегда 43 символа */
+var (
+	pkceVerifierPattern  = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+	pkceChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+)
+
+/* Параметры запроса авторизации (RFC 6749, 4.1.1 и RFC 7636, 4.3) */
+type authorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+}
+
+type authorizeResponse struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+/* Первый шаг authorization code flow: браузер приходит сюда от приложения. Проверив запрос,
+ * отправляем пользователя на страницу входа фронтенда с теми же параметрами. */
+func (service *AuthService) HandleOAuthAuthorize(w http.ResponseWriter, req *http.Request) {
+	if _, ok := service.authorizeRequest(w, req); !ok {
+		return
+	}
+	http.Redirect(w, req, service.cfg.OAuth.LoginURL+"?"+req.URL.RawQuery, http.StatusFound)
+}
+
+/* Страница входа после входа пользователя отправляет сюда параметры авторизации с его access токеном.
+ * В ответ - адрес возврата в приложение с одноразовым кодом, на который страница и переходит. */
+func (service *AuthService) HandleOAuthAuthorizeConsent(w http.ResponseWriter, req *http.Request) {
+	authorize, ok := service.authorizeRequest(w, req)
+	if !ok {
+		return
+	}
+	userGUID := userGUIDFromContext(req.Context())
+	tenantID := tenancy.FromContext(req.Context()).ID
+	user, err := service.userRepo.GetByGUID(tenantID, userGUID)
+	if err != nil || user.Disabled {
+		service.fail(w, req, problem.UserUnavailable, "User not found or disabled", zap.Error(err),
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", userGUID))
+		return
+	}
+	if service.cfg.RequireVerifiedEmail && !user.EmailVerified {
+		service.fail(w, req, problem.EmailNotVerified, "Email is not verified",
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", userGUID))
+		return
+	}
+
+	random := make([]byte, 32)
+	if _, err = rand.Read(random); err != nil {
+		service.fail(w, req, problem.Internal, "Failed to generate authorization code", zap.Error(err))
+		return
+	}
+	code := base64.RawURLEncoding.EncodeToString(random)
+	lifetime := service.cfg.OAuth.CodeLifetime
+	if lifetime <= 0 {
+		lifetime = defaultCodeLifetime
+	}
+	accessClaims := accessClaimsFromContext(req.Context())
+	err = service.authCodeRepo.Create(tenantID, &model.AuthorizationCode{
+		Hash:          authorizationCodeHash(code),
+		ClientID:      authorize.ClientID,
+		UserGUID:      userGUID,
+		RedirectURI:   authorize.RedirectURI,
+		CodeChallenge: authorize.CodeChallenge,
+		Scope:         authorize.Scope,
+		AMR:           claimStrings(accessClaims["amr"]),
+		AuthTime:      time.Unix(claimAuthTime(accessClaims), 0),
+		Nonce:         authorize.Nonce,
+		ExpiresAt:     time.Now().Add(time.Duration(lifetime) * time.Second),
+	})
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	service.logger.Info("Authorization code has been issued",
+		zap.String("client_id", authorize.ClientID),
+		zap.String("user_guid", userGUID))
+	err = writeJson(w, http.StatusOK, &authorizeResponse{
+		RedirectTo: redirectWithParams(authorize.RedirectURI, url.Values{"code": {code}, "state": {authorize.State}}),
+	})
+	if err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Токен-эндпоинт OAuth 2.0. Параметры приходят в application/x-www-form-urlencoded (RFC 6749, 4.1.3). */
+func (service *AuthService) HandleOAuthToken(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		service.oauthFail(w, req, problem.OAuthInvalidRequest, "Bad request", zap.Error(err),
+			zap.String("ip", req.RemoteAddr))
+		return
+	}
+	switch grantType := req.PostForm.Get("grant_type"); grantType {
+	case grantAuthorizationCode:
+		service.exchangeAuthorizationCode(w, req)
+	case grantClientCredentials:
+		service.issueClientCredentials(w, req)
+	case grantDeviceCode:
+		service.pollDeviceCode(w, req)
+	case grantAPIKey:
+		service.exchangeAPIKey(w, req)
+	default:
+		service.oauthFail(w, req, problem.OAuthUnsupportedGrantType, "Unsupported grant type",
+			zap.String("grant_type", grantType),
+			zap.String("ip", req.RemoteAddr))
+	}
+}
+
+func (service *AuthService) exchangeAuthorizationCode(w http.ResponseWriter, req *http.Request) {
+	code := req.PostForm.Get("code")
+	redirectURI := req.PostForm.Get("redirect_uri")
+	verifier := req.PostForm.Get("code_verifier")
+	if code == "" || redirectURI == "" {
+		service.oauthFail(w, req, problem.OAuthInvalidRequest.With("code and redirect_uri are required"),
+			"Bad request", zap.String("ip", req.RemoteAddr))
+		return
+	}
+	if !pkceVerifierPattern.MatchString(verifier) {
+		service.oauthFail(w, req, problem.OAuthInvalidRequest.With("code_verifier is missing or malformed"),
+			"Bad request", zap.String("ip", req.RemoteAddr))
+		return
+	}
+	client := service.authenticateClient(w, req, grantAuthorizationCode)
+	if client == nil {
+		return
+	}
+	clientID := client.ID
+
+	/* Код удаляется при первом же обмене, даже неудачном: подобранный или перехваченный код не пригодится */
+	tenantID := tenancy.FromContext(req.Context()).ID
+	authCode, err := service.authCodeRepo.Consume(tenantID, authorizationCodeHash(code))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			service.oauthFail(w, req, problem.OAuthInvalidGrant, "Authorization code is invalid, expired or already used",
+				zap.String("client_id", clientID),
+				zap.String("ip", req.RemoteAddr))
+		} else {
+			service.oauthFail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return
+	}
+	if authCode.ClientID != clientID || authCode.RedirectURI != redirectURI {
+		service.oauthFail(w, req, problem.OAuthInvalidGrant, "Authorization code was issued to another client or redirect_uri",
+			zap.String("client_id", clientID),
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", authCode.UserGUID))
+		return
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(challenge[:])),
+		[]byte(authCode.CodeChallenge)) != 1 {
+		service.oauthFail(w, req, problem.OAuthInvalidGrant.With("code_verifier does not match code_challenge"),
+			"PKCE verification failed",
+			zap.String("client_id", clientID),
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", authCode.UserGUID))
+		return
+	}
+	/* Пользователя могли заблокировать, пока код ждал обмена */
+	user, err := service.userRepo.GetByGUID(tenantID, authCode.UserGUID)
+	if err != nil || user.Disabled {
+		service.oauthFail(w, req, problem.OAuthInvalidGrant, "User not found or disabled", zap.Error(err),
+			zap.String("client_id", clientID),
+			zap.String("user_guid", authCode.UserGUID))
+		return
+	}
+
+	authTime := authCode.AuthTime.Unix()
+	pair, scope := service.newPair(user.GUID, clientID, authCode.AMR, &authCode.Scope, authTime, w, req)
+	if pair == nil {
+		return
+	}
+	if !service.attachIDToken(pair, user, scope, clientID, authCode.Nonce, authTime, authCode.AMR, w, req) {
+		return
+	}
+	result, err := pair.ToOAuthJson(tenancy.FromContext(req.Context()).AccessTokenLifetime, scope)
+	if err != nil {
+		service.oauthFail(w, req, problem.Internal, "JSON failure", zap.Error(err))
+		return
+	}
+	service.publishEvent(notify.EventTokenIssued, user.GUID, req, map[string]string{
+		"amr":        strings.Join(authCode.AMR, " "),
+		"grant_type": grantAuthorizationCode,
+		"client_id":  clientID,
+	})
+	writeTokenResponse(w, result)
+}
+
+/* Разбирает и проверяет параметры авторизации из строки запроса и тела.
+ * Пока client_id и redirect_uri не проверены, перенаправлять пользователя нельзя (RFC 6749, 4.1.2.1),
+ * поэтому такие ошибки отдаются как есть, а остальные - перенаправлением с параметром error. */
+func (service *AuthService) authorizeRequest(w http.ResponseWriter, req *http.Request) (*authorizeRequest, bool) {
+	if err := req.ParseForm(); err != nil {
+		service.fail(w, req, problem.OAuthInvalidRequest, "Bad request", zap.Error(err),
+			zap.String("ip", req.RemoteAddr))
+		return nil, false
+	}
+	authorize := &authorizeRequest{
+		ResponseType:        req.Form.Get("response_type"),
+		ClientID:            req.Form.Get("client_id"),
+		RedirectURI:         req.Form.Get("redirect_uri"),
+		Scope:               req.Form.Get("scope"),
+		State:               req.Form.Get("state"),
+		CodeChallenge:       req.Form.Get("code_challenge"),
+		CodeChallengeMethod: req.Form.Get("code_challenge_method"),
+		Nonce:               req.Form.Get("nonce"),
+	}
+	client, err := service.clientRepo.GetByID(tenancy.FromContext(req.Context()).ID, authorize.ClientID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			service.fail(w, req, problem.OAuthInvalidRequest.With("Unknown client_id"), "Unknown OAuth client",
+				zap.String("client_id", authorize.ClientID),
+				zap.String("ip", req.RemoteAddr))
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return nil, false
+	}
+	if !slices.Contains(client.RedirectURIs, authorize.RedirectURI) {
+		service.fail(w, req, problem.OAuthInvalidRequest.With("redirect_uri is not registered for the client"),
+			"OAuth redirect_uri mismatch",
+			zap.String("client_id", authorize.ClientID),
+			zap.String("redirect_uri", authorize.RedirectURI),
+			zap.String("ip", req.RemoteAddr))
+		return nil, false
+	}
+
+	if authorize.ResponseType != "code" {
+		service.redirectError(w, req, authorize, problem.OAuthUnsupportedResponseType)
+		return nil, false
+	}
+	if !slices.Contains(client.GrantTypes, grantAuthorizationCode) {
+		service.redirectError(w, req, authorize, problem.OAuthUnauthorizedClient)
+		return nil, false
+	}
+	scope, ok := grantedScope(client.Scopes, authorize.Scope)
+	if !ok {
+		service.redirectError(w, req, authorize, problem.OAuthInvalidScope)
+		return nil, false
+	}
+	authorize.Scope = scope
+	if len(authorize.Nonce) > maxNonceLength {
+		service.redirectError(w, req, authorize, problem.OAuthInvalidRequest.With("nonce is too long"))
+		return nil, false
+	}
+	if authorize.CodeChallengeMethod != pkceMethodS256 || !pkceChallengePattern.MatchString(authorize.CodeChallenge) {
+		service.redirectError(w, req, authorize,
+			problem.OAuthInvalidRequest.With("PKCE is required: code_challenge with code_challenge_method=S256"))
+		return nil, false
+	}
+	return authorize, true
+}
+
+/* Ошибка авторизации возвращается в приложение через redirect_uri (RFC 6749, 4.1.2.1).
+ * Страница входа получает адрес в JSON, как и при успехе. */
+func (service *AuthService) redirectError(w http.ResponseWriter, req *http.Request, authorize *authorizeRequest,
+	failure *problem.Problem) {
+	service.logger.Error("OAuth authorization request is invalid", correlationField(req),
+		zap.String("error", failure.Code),
+		zap.String("error_description", failure.Detail),
+		zap.String("client_id", authorize.ClientID),
+		zap.String("ip", req.RemoteAddr))
+	location := redirectWithParams(authorize.RedirectURI, url.Values{
+		"error":             {failure.Code},
+		"error_description": {failure.Detail},
+		"state":             {authorize.State},
+	})
+	if req.Method == http.MethodGet {
+		http.Redirect(w, req, location, http.StatusFound)
+		return
+	}
+	if err := writeJson(w, http.StatusOK, &authorizeResponse{RedirectTo: location}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Ошибка токен-эндпоинта: problem+json с полями error и error_description из RFC 6749, 5.2,
+ * их понимают стандартные OAuth библиотеки */
+func (service *AuthService) oauthFail(w http.ResponseWriter, req *http.Request, failure *problem.Problem,
+	message string, fields ...zap.Field) {
+	errorCode := failure.Code
+	if failure.Status >= http.StatusInternalServerError {
+		errorCode = "server_error"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	problem.WriteWith(w, req, failure, map[string]interface{}{
+		"error":             errorCode,
+		"error_description": failure.Detail,
+	})
+	service.logger.Error(message, append(fields, correlationField(req))...)
+}
+
+/* Ответ с токенами нельзя кэшировать (RFC 6749, 5.1) */
+func writeTokenResponse(w http.ResponseWriter, result []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write(result)
+}
+
+/* Добавляет параметры к redirect_uri, сохраняя его собственные. Пустые значения (например, state) пропускаются. */
+func redirectWithParams(redirectURI string, params url.Values) string {
+	location, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	query := location.Query()
+	for key, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query.Set(key, values[0])
+		}
+	}
+	location.RawQuery = query.Encode()
+	return location.String()
+}
+
+func authorizationCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
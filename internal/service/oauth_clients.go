@@ -0,0 +1,260 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/config"
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
+	"github.com/kataras/jwt"
+	"go.uber.org/zap"
+)
+
+const (
+	/* Способы аутентификации клиента на токен-эндпоинте (token_endpoint_auth_method из RFC 7591) */
+	authMethodNone          = "none"
+	authMethodSecretBasic   = "client_secret_basic"
+	authMethodPrivateKeyJWT = "private_key_jwt"
+
+	clientAssertionTypeJWT = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	/* Назначение в таблице использованных jti */
+	clientAssertionPurpose = "client-assertion"
+	/* Выдача токенов по GUID пользователя без пароля (/user/tokens/create). Разрешается только администратором. */
+	grantGUID = "urn:auth-service:grant-type:guid"
+)
+
+var (
+	clientAuthMethods = []string{authMethodNone, authMethodSecretBasic, authMethodPrivateKeyJWT}
+	clientGrantTypes  = []string{grantAuthorizationCode, grantClientCredentials, grantDeviceCode, grantGUID}
+)
+
+/* Аутентифицирует клиента и проверяет, что ему разрешён grantType.
+ * Если что-то пошло не так, ответ клиенту уже записан и возвращается nil. */
+func (service *AuthService) authenticateClient(w http.ResponseWriter, req *http.Request, grantType string) *model.OAuthClient {
+	client := service.identifyClient(w, req)
+	if client != nil && !slices.Contains(client.GrantTypes, grantType) {
+		service.oauthFail(w, req, problem.OAuthUnauthorizedClient, "Grant type is not allowed for the client",
+			zap.String("client_id", client.ID),
+			zap.String("grant_type", grantType))
+		return nil
+	}
+	return client
+}
+
+/* Определяет клиента и проверяет его тем способом, с которым он зарегистрирован: client_secret_basic (RFC 6749, 2.3.1),
+ * private_key_jwt (RFC 7523, 2.2) или none - тогда достаточно client_id, а обмен защищает PKCE.
+ * Если что-то пошло не так, ответ клиенту уже записан и возвращается nil. */
+func (service *AuthService) identifyClient(w http.ResponseWriter, req *http.Request) *model.OAuthClient {
+	method := authMethodNone
+	clientID := req.PostForm.Get("client_id")
+	var secret, assertion string
+	if basicID, basicSecret, ok := req.BasicAuth(); ok {
+		method = authMethodSecretBasic
+		/* Перед Base64 client_id и секрет кодируются как application/x-www-form-urlencoded */
+		var idErr, secretErr error
+		clientID, idErr = url.QueryUnescape(basicID)
+		secret, secretErr = url.QueryUnescape(basicSecret)
+		if idErr != nil || secretErr != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+			service.oauthFail(w, req, problem.OAuthInvalidClient, "Malformed client credentials",
+				zap.String("ip", req.RemoteAddr))
+			return nil
+		}
+	} else if req.PostForm.Get("client_assertion_type") == clientAssertionTypeJWT {
+		method = authMethodPrivateKeyJWT
+		assertion = req.PostForm.Get("client_assertion")
+		/* client_id в запросе необязателен (RFC 7523, 3), тогда клиента определяем по iss */
+		if clientID == "" {
+			clientID = token.AssertionIssuer([]byte(assertion))
+		}
+	}
+
+	client, err := service.clientRepo.GetByID(tenancy.FromContext(req.Context()).ID, clientID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		service.oauthFail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return nil
+	}
+	/* Клиент должен прийти именно тем способом, с которым зарегистрирован: клиент с секретом не может назваться публичным */
+	if err == nil && client.AuthMethod != method {
+		err = errors.New("client is registered with " + client.AuthMethod)
+	}
+	var assertionClaims *jwt.Claims
+	if err == nil {
+		assertionClaims, err = service.verifyClientCredentials(client, secret, assertion)
+	}
+	if err != nil {
+		if method == authMethodSecretBasic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		service.oauthFail(w, req, problem.OAuthInvalidClient, "Client authentication failed", zap.Error(err),
+			zap.String("client_id", clientID),
+			zap.String("auth_method", method),
+			zap.String("ip", req.RemoteAddr))
+		return nil
+	}
+	if assertionClaims != nil && !service.useClientAssertion(client.ID, assertionClaims, w, req) {
+		return nil
+	}
+	return client
+}
+
+/* Для private_key_jwt возвращает claims проверенного assertion, по ним проверяется повтор jti */
+func (service *AuthService) verifyClientCredentials(client *model.OAuthClient, secret, assertion string) (*jwt.Claims, error) {
+	switch client.AuthMethod {
+	case authMethodSecretBasic:
+		if !clientSecretMatches(client.SecretHash, secret) {
+			return nil, errors.New("client secret does not match")
+		}
+	case authMethodPrivateKeyJWT:
+		return token.VerifyClientAssertion([]byte(assertion), []byte(client.PublicKey), client.ID,
+			service.cfg.OAuth.TokenURL)
+	}
+	return nil, nil
+}
+
+/* assertion одноразовый (RFC 7523, 3): перехваченный нельзя предъявить ещё раз, пока он не истёк.
+ * jti выбирает сам клиент, поэтому он запоминается вместе с client_id. */
+func (service *AuthService) useClientAssertion(clientID string, claims *jwt.Claims, w http.ResponseWriter,
+	req *http.Request) bool {
+	err := service.replayRepo.Use(tenancy.FromContext(req.Context()).ID, clientAssertionPurpose, clientID+":"+claims.ID,
+		time.Unix(claims.Expiry, 0))
+	if errors.Is(err, repository.ErrAlreadyExists) {
+		service.oauthFail(w, req, problem.OAuthInvalidClient, "Client assertion has already been used",
+			zap.String("client_id", clientID),
+			zap.String("jti", claims.ID),
+			zap.String("ip", req.RemoteAddr))
+		return false
+	} else if err != nil {
+		service.oauthFail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return false
+	}
+	return true
+}
+
+/* Проверка метаданных клиента, общая для админского API и динамической регистрации.
+ * Возвращает ошибку для ответа или nil, если всё в порядке. */
+func validateClient(cfg *config.Config, client *model.OAuthClient) *problem.Problem {
+	if !slices.Contains(clientAuthMethods, client.AuthMethod) {
+		return problem.OAuthInvalidClientMetadata.With(
+			"token_endpoint_auth_method must be none, client_secret_basic or private_key_jwt")
+	}
+	if len(client.GrantTypes) == 0 {
+		return problem.OAuthInvalidClientMetadata.With("grant_types must not be empty")
+	}
+	for _, grantType := range client.GrantTypes {
+		if !slices.Contains(clientGrantTypes, grantType) {
+			return problem.OAuthInvalidClientMetadata.With("Unsupported grant type: " + grantType)
+		}
+		/* Токены для себя или по чужому GUID можно выдавать только клиенту, который докажет, что он - это он.
+		 * Публичным клиентам доступны только потоки, где доступ разрешает сам пользователь. */
+		if grantType != grantAuthorizationCode && grantType != grantDeviceCode && client.AuthMethod == authMethodNone {
+			return problem.OAuthInvalidClientMetadata.With(grantType + " requires client authentication")
+		}
+	}
+	if slices.Contains(client.GrantTypes, grantAuthorizationCode) && len(client.RedirectURIs) == 0 {
+		return problem.OAuthInvalidRedirectURI.With("authorization_code requires redirect_uris")
+	}
+	/* RFC 6749, 3.1.2: абсолютный адрес без фрагмента */
+	for _, redirectURI := range client.RedirectURIs {
+		location, err := url.Parse(redirectURI)
+		if err != nil || !location.IsAbs() || location.Fragment != "" {
+			return problem.OAuthInvalidRedirectURI.With("Redirect URI must be absolute and have no fragment: " + redirectURI)
+		}
+		if !redirectSchemeAllowed(cfg, location) {
+			return problem.OAuthInvalidRedirectURI.With(
+				"Redirect URI must use https, http on a loopback address or a permitted private-use scheme: " + redirectURI)
+		}
+	}
+	if client.AuthMethod == authMethodPrivateKeyJWT {
+		if _, err := token.ParsePublicKey([]byte(client.PublicKey)); err != nil {
+			return problem.OAuthInvalidClientMetadata.With("public_key must be a PEM encoded RSA, EC or Ed25519 public key")
+		}
+	}
+	if client.TokenLifetime < 0 {
+		return problem.OAuthInvalidClientMetadata.With("token_lifetime must not be negative")
+	}
+	return nil
+}
+
+/* RFC 8252: https, http только на loopback (нативное приложение слушает порт на этой же машине)
+ * и private-use схемы мобильных приложений из oauth.redirect_schemes. Всё остальное, включая javascript: и data:,
+ * отклоняется - код авторизации не должен уходить туда, где его исполнит или прочитает кто-то другой. */
+func redirectSchemeAllowed(cfg *config.Config, location *url.URL) bool {
+	switch location.Scheme {
+	case "https":
+		return location.Host != ""
+	case "http":
+		hostname := location.Hostname()
+		if hostname == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(hostname)
+		return ip != nil && ip.IsLoopback()
+	}
+	for _, scheme := range cfg.OAuth.RedirectSchemes {
+		if strings.EqualFold(scheme, location.Scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Новый секрет отдаётся клиенту один раз, в базе остаётся только его sha256 */
+func newClientSecret() (secret string, hash string, err error) {
+	random := make([]byte, 32)
+	if _, err = rand.Read(random); err != nil {
+		return "", "", err
+	}
+	secret = base64.RawURLEncoding.EncodeToString(random)
+	return secret, clientSecretHash(secret), nil
+}
+
+func newClientID() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+func clientSecretHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+/* У клиентов без секрета хэш пустой, и с ним ничего не совпадает */
+func clientSecretMatches(hash, secret string) bool {
+	if hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(clientSecretHash(secret)), []byte(hash)) == 1
+}
+
+/* Запрошенные scope (через пробел) должны входить в разрешённые клиенту. Без scope в запросе выдаются все разрешённые. */
+func grantedScope(allowed []string, requested string) (string, bool) {
+	if requested == "" {
+		return strings.Join(allowed, " "), true
+	}
+	scopes := strings.Fields(requested)
+	for _, scope := range scopes {
+		if !slices.Contains(allowed, scope) {
+			return "", false
+		}
+	}
+	return strings.Join(scopes, " "), true
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/config"
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/kataras/jwt"
+)
+
+func TestValidateClientRedirectURI(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.OAuth.RedirectSchemes = []string{"com.example.app"}
+	tests := []struct {
+		redirectURI string
+		valid       bool
+	}{
+		{"https://app.example/callback", true},
+		{"http://127.0.0.1:51000/callback", true},
+		{"http://[::1]:51000/callback", true},
+		{"http://localhost:3000/oauth/callback", true},
+		{"com.example.app:/oauth2redirect", true},
+		{"COM.EXAMPLE.APP:/oauth2redirect", true},
+		{"http://app.example/callback", false},
+		{"https:///callback", false},
+		{"com.other.app:/oauth2redirect", false},
+		{"javascript:alert(document.domain)//", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{"https://app.example/callback#fragment", false},
+		{"/callback", false},
+	}
+	for _, test := range tests {
+		client := &model.OAuthClient{
+			AuthMethod:   authMethodNone,
+			GrantTypes:   []string{grantAuthorizationCode},
+			RedirectURIs: []string{test.redirectURI},
+		}
+		if failure := validateClient(cfg, client); (failure == nil) != test.valid {
+			t.Errorf("%s: valid = %v, failure = %v", test.redirectURI, failure == nil, failure)
+		}
+	}
+}
+
+/* Клиент billing тенанта acme с private_key_jwt и подписанный его ключом assertion с заданным jti */
+func newAssertionEnv(t *testing.T) (*testEnv, func(jti string) string) {
+	env := newTestEnv(t)
+	env.cfg.OAuth.TokenURL = "https://auth.example/oauth/token"
+	env.router.Post("/oauth/token", env.service.HandleOAuthToken)
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.service.clientRepo = &memClients{clients: map[string]testClient{
+		"billing": {"acme", model.OAuthClient{
+			ID:         "billing",
+			AuthMethod: authMethodPrivateKeyJWT,
+			PublicKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})),
+			GrantTypes: []string{grantClientCredentials},
+		}},
+	}}
+	sign := func(jti string) string {
+		now := time.Now().Unix()
+		claims := map[string]interface{}{
+			"iss": "billing",
+			"sub": "billing",
+			"aud": env.cfg.OAuth.TokenURL,
+			"iat": now,
+			"exp": now + 60,
+		}
+		if jti != "" {
+			claims["jti"] = jti
+		}
+		assertion, err := jwt.Sign(jwt.ES256, private, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(assertion)
+	}
+	return env, sign
+}
+
+func (env *testEnv) clientCredentials(tenantID string, assertion string) *httptest.ResponseRecorder {
+	return env.do(tenantID, http.MethodPost, "/oauth/token", url.Values{
+		"grant_type":            {grantClientCredentials},
+		"client_assertion_type": {clientAssertionTypeJWT},
+		"client_assertion":      {assertion},
+	}.Encode(), "")
+}
+
+/* Перехваченный assertion нельзя предъявить повторно, пока он не истёк */
+func TestClientAssertionReplay(t *testing.T) {
+	env, sign := newAssertionEnv(t)
+
+	assertion := sign("jti-1")
+	if response := env.clientCredentials("acme", assertion); response.Code != http.StatusOK {
+		t.Fatalf("first use: %d %s", response.Code, response.Body.String())
+	}
+	response := env.clientCredentials("acme", assertion)
+	if response.Code != http.StatusUnauthorized || problemCode(t, response) != "invalid_client" {
+		t.Fatalf("replayed assertion: %d %s", response.Code, response.Body.String())
+	}
+	/* Новый assertion с тем же jti - тоже повтор */
+	if response = env.clientCredentials("acme", sign("jti-1")); response.Code != http.StatusUnauthorized {
+		t.Fatalf("reused jti: %d %s", response.Code, response.Body.String())
+	}
+	if response = env.clientCredentials("acme", sign("jti-2")); response.Code != http.StatusOK {
+		t.Fatalf("fresh jti: %d %s", response.Code, response.Body.String())
+	}
+	if response = env.clientCredentials("acme", sign("")); response.Code != http.StatusUnauthorized {
+		t.Fatalf("assertion without jti: %d %s", response.Code, response.Body.String())
+	}
+}
@@ -0,0 +1,538 @@
+package service
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
+	"github.com/go-chi/chi/v5"
+)
+
+type testClient struct {
+	tenantID string
+	client   model.OAuthClient
+}
+
+type memClients struct {
+	repository.OAuthClientRepository
+	clients map[string]testClient
+}
+
+func (repo *memClients) GetByID(tenantID string, clientID string) (*model.OAuthClient, error) {
+	stored, ok := repo.clients[clientID]
+	if !ok || stored.tenantID != tenantID {
+		return nil, sql.ErrNoRows
+	}
+	client := stored.client
+	return &client, nil
+}
+
+type testAuthCode struct {
+	tenantID string
+	code     model.AuthorizationCode
+}
+
+type memAuthCodes struct {
+	repository.AuthorizationCodeRepository
+	mutex sync.Mutex
+	codes map[string]testAuthCode
+}
+
+func (repo *memAuthCodes) Create(tenantID string, code *model.AuthorizationCode) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.codes[code.Hash] = testAuthCode{tenantID, *code}
+	return nil
+}
+
+func (repo *memAuthCodes) Consume(tenantID string, hash string) (*model.AuthorizationCode, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, ok := repo.codes[hash]
+	if !ok || stored.tenantID != tenantID {
+		return nil, sql.ErrNoRows
+	}
+	delete(repo.codes, hash)
+	if !stored.code.ExpiresAt.After(time.Now()) {
+		return nil, sql.ErrNoRows
+	}
+	code := stored.code
+	return &code, nil
+}
+
+type testDevice struct {
+	tenantID string
+	device   model.DeviceAuthorization
+}
+
+type memDevices struct {
+	repository.DeviceAuthorizationRepository
+	mutex   sync.Mutex
+	devices map[string]*testDevice
+}
+
+func (repo *memDevices) Create(tenantID string, device *model.DeviceAuthorization) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.devices[device.DeviceCodeHash] = &testDevice{tenantID, *device}
+	return nil
+}
+
+func (repo *memDevices) pending(tenantID string, userCode string) (*testDevice, bool) {
+	for _, stored := range repo.devices {
+		if stored.tenantID == tenantID && stored.device.UserCode == userCode &&
+			stored.device.Status == model.DeviceAuthorizationPending && stored.device.ExpiresAt.After(time.Now()) {
+			return stored, true
+		}
+	}
+	return nil, false
+}
+
+func (repo *memDevices) GetPendingByUserCode(tenantID string, userCode string) (*model.DeviceAuthorization, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, ok := repo.pending(tenantID, userCode)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	device := stored.device
+	return &device, nil
+}
+
+func (repo *memDevices) Decide(tenantID string, userCode string, status string, userGUID string, amr []string,
+	authTime *time.Time) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, ok := repo.pending(tenantID, userCode)
+	if !ok {
+		return sql.ErrNoRows
+	}
+	stored.device.Status, stored.device.UserGUID, stored.device.AMR, stored.device.AuthTime = status, userGUID, amr, authTime
+	return nil
+}
+
+func (repo *memDevices) GetByDeviceCode(tenantID string, deviceCodeHash string) (*model.DeviceAuthorization, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, ok := repo.devices[deviceCodeHash]
+	if !ok || stored.tenantID != tenantID {
+		return nil, sql.ErrNoRows
+	}
+	device := stored.device
+	return &device, nil
+}
+
+func (repo *memDevices) Polled(tenantID string, deviceCodeHash string, polledAt time.Time, interval int64) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if stored, ok := repo.devices[deviceCodeHash]; ok && stored.tenantID == tenantID {
+		stored.device.LastPolledAt, stored.device.Interval = &polledAt, interval
+	}
+	return nil
+}
+
+func (repo *memDevices) ConsumeApproved(tenantID string, deviceCodeHash string) (*model.DeviceAuthorization, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, ok := repo.devices[deviceCodeHash]
+	if !ok || stored.tenantID != tenantID || stored.device.Status != model.DeviceAuthorizationApproved {
+		return nil, sql.ErrNoRows
+	}
+	delete(repo.devices, deviceCodeHash)
+	device := stored.device
+	return &device, nil
+}
+
+func (repo *memDevices) Delete(tenantID string, deviceCodeHash string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	if stored, ok := repo.devices[deviceCodeHash]; ok && stored.tenantID == tenantID {
+		delete(repo.devices, deviceCodeHash)
+	}
+	return nil
+}
+
+/* Сдвигает время последнего опроса и срок запроса в прошлое, как будто прошло shift */
+func (repo *memDevices) rewind(deviceCodeHash string, shift time.Duration) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored := repo.devices[deviceCodeHash]
+	if stored.device.LastPolledAt != nil {
+		polledAt := stored.device.LastPolledAt.Add(-shift)
+		stored.device.LastPolledAt = &polledAt
+	}
+	stored.device.ExpiresAt = stored.device.ExpiresAt.Add(-shift)
+}
+
+/* Публичный клиент spa тенанта acme с authorization code и device grant и клиент mobile с тем же redirect_uri */
+func (env *testEnv) addPublicClient() {
+	env.service.clientRepo = &memClients{clients: map[string]testClient{
+		"spa": {"acme", model.OAuthClient{
+			ID:           "spa",
+			AuthMethod:   authMethodNone,
+			RedirectURIs: []string{"https://app.example/callback"},
+			GrantTypes:   []string{grantAuthorizationCode, grantDeviceCode},
+			Scopes:       []string{"openid", "profile"},
+		}},
+		/* Другое приложение с тем же адресом возврата: код spa ему не достаётся */
+		"mobile": {"acme", model.OAuthClient{
+			ID:           "mobile",
+			AuthMethod:   authMethodNone,
+			RedirectURIs: []string{"https://app.example/callback", "https://mobile.example/callback"},
+			GrantTypes:   []string{grantAuthorizationCode},
+			Scopes:       []string{"openid"},
+		}},
+	}}
+	env.service.authCodeRepo = &memAuthCodes{codes: map[string]testAuthCode{}}
+	env.service.deviceRepo = &memDevices{devices: map[string]*testDevice{}}
+}
+
+/* code_verifier, с которым тесты проходят authorization code flow */
+var testVerifier = strings.Repeat("v", 43)
+
+/* Код авторизации клиенту spa за пользователя с access токеном userToken, как его получает страница входа */
+func (env *testEnv) authorizationCode(userToken string) string {
+	challenge := sha256.Sum256([]byte(testVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"spa"},
+		"redirect_uri":          {"https://app.example/callback"},
+		"scope":                 {"openid"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {pkceMethodS256},
+	}
+	response := env.do("acme", http.MethodPost, "/oauth/authorize?"+query.Encode(), "", userToken)
+	if response.Code != http.StatusOK {
+		env.t.Fatalf("consent: %d %s", response.Code, response.Body.String())
+	}
+	var consent authorizeResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &consent); err != nil {
+		env.t.Fatal(err)
+	}
+	location, err := url.Parse(consent.RedirectTo)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	return location.Query().Get("code")
+}
+
+/* Обмен кода клиентом spa на токен-эндпоинте. Параметры из override заменяют верные. */
+func (env *testEnv) exchangeCode(code string, override url.Values) *httptest.ResponseRecorder {
+	params := url.Values{
+		"grant_type":    {grantAuthorizationCode},
+		"code":          {code},
+		"client_id":     {"spa"},
+		"redirect_uri":  {"https://app.example/callback"},
+		"code_verifier": {testVerifier},
+	}
+	for name, value := range override {
+		params[name] = value
+	}
+	return env.do("acme", http.MethodPost, "/oauth/token", params.Encode(), "")
+}
+
+/* Проходит authorization code flow за пользователя с access токеном userToken и возвращает ответ токен-эндпоинта */
+func (env *testEnv) authorizationCodeTokens(userToken string) map[string]interface{} {
+	response := env.exchangeCode(env.authorizationCode(userToken), nil)
+	if response.Code != http.StatusOK {
+		env.t.Fatalf("token: %d %s", response.Code, response.Body.String())
+	}
+	tokens := map[string]interface{}{}
+	if err := json.Unmarshal(response.Body.Bytes(), &tokens); err != nil {
+		env.t.Fatal(err)
+	}
+	return tokens
+}
+
+func (env *testEnv) accessClaims(tenantID string, accessToken string) map[string]interface{} {
+	claims, err := (&token.Pair{Access: []byte(accessToken)}).AccessTokenPayload(env.tenant(tenantID).Secret)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	return claims
+}
+
+/* Токен, выданный приложению, не годится для управления аккаунтом: иначе приложение с доступом
+ * к профилю завело бы себе passkey или API ключ */
+func TestDelegatedTokenRejected(t *testing.T) {
+	env := newTestEnv(t)
+	env.addPublicClient()
+	env.router.Post("/oauth/token", env.service.HandleOAuthToken)
+	reached := func(w http.ResponseWriter, req *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	env.router.Group(func(r chi.Router) {
+		r.Use(env.service.Authenticate)
+		r.Get("/userinfo", reached)
+		r.Group(func(r chi.Router) {
+			r.Use(env.service.RejectDelegated)
+			r.Get("/user/api-keys", reached)
+			r.Post("/user/api-keys", reached)
+			r.Post("/user/webauthn/register/begin", reached)
+			r.Post("/user/webauthn/register/finish", reached)
+			r.Post("/oauth/device", reached)
+			r.Post("/oauth/authorize", env.service.HandleOAuthAuthorizeConsent)
+		})
+	})
+	user := env.addUser("acme", "ivan@acme.example")
+	userToken := env.accessToken("acme", user.GUID, nil)
+
+	tokens := env.authorizationCodeTokens(userToken)
+	delegated, _ := tokens["access_token"].(string)
+	if clientID := env.accessClaims("acme", delegated)["client_id"]; clientID != "spa" {
+		t.Fatalf("client_id = %v", clientID)
+	}
+	if response := env.do("acme", http.MethodGet, "/userinfo", "", delegated); response.Code != http.StatusNoContent {
+		t.Fatalf("application must keep access to the data: %d", response.Code)
+	}
+
+	for _, route := range []struct{ method, path string }{
+		{http.MethodGet, "/user/api-keys"},
+		{http.MethodPost, "/user/api-keys"},
+		{http.MethodPost, "/user/webauthn/register/begin"},
+		{http.MethodPost, "/user/webauthn/register/finish"},
+		{http.MethodPost, "/oauth/device"},
+		{http.MethodPost, "/oauth/authorize"},
+	} {
+		response := env.do("acme", route.method, route.path, "", delegated)
+		if response.Code != http.StatusForbidden || problemCode(t, response) != "delegated_token_forbidden" {
+			t.Errorf("%s %s: %d %s", route.method, route.path, response.Code, response.Body.String())
+		}
+		if route.path == "/oauth/authorize" {
+			continue
+		}
+		if response = env.do("acme", route.method, route.path, "", userToken); response.Code != http.StatusNoContent {
+			t.Errorf("%s %s with the user's own token: %d", route.method, route.path, response.Code)
+		}
+	}
+}
+
+/* После обновления пары токен остаётся токеном приложения */
+func TestRefreshKeepsClientID(t *testing.T) {
+	env := newTestEnv(t)
+	env.addPublicClient()
+	env.router.Post("/oauth/token", env.service.HandleOAuthToken)
+	env.router.Post("/user/tokens/refresh", env.service.HandleRefresh)
+	env.router.With(env.service.Authenticate).Post("/oauth/authorize", env.service.HandleOAuthAuthorizeConsent)
+	user := env.addUser("acme", "ivan@acme.example")
+
+	tokens := env.authorizationCodeTokens(env.accessToken("acme", user.GUID, nil))
+	body, err := json.Marshal(map[string]interface{}{
+		"access_token":  tokens["access_token"],
+		"refresh_token": tokens["refresh_token"],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := env.do("acme", http.MethodPost, "/user/tokens/refresh", string(body), "")
+	if response.Code != http.StatusCreated {
+		t.Fatalf("refresh: %d %s", response.Code, response.Body.String())
+	}
+	var refreshed struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.Unmarshal(response.Body.Bytes(), &refreshed); err != nil {
+		t.Fatal(err)
+	}
+	if clientID := env.accessClaims("acme", refreshed.AccessToken)["client_id"]; clientID != "spa" {
+		t.Fatalf("client_id after refresh = %v", clientID)
+	}
+}
+
+/* user_code, выданный устройству одного тенанта, пользователь другого тенанта не видит и не может одобрить */
+func TestDeviceAuthorizationOfOtherTenant(t *testing.T) {
+	env := newTestEnv(t)
+	env.addPublicClient()
+	env.cfg.OAuth.DeviceVerificationURL = "https://acme.example/device"
+	env.router.Post("/oauth/device_authorization", env.service.HandleDeviceAuthorization)
+	env.router.Group(func(r chi.Router) {
+		r.Use(env.service.Authenticate)
+		r.Get("/oauth/device", env.service.HandleDeviceGet)
+		r.Post("/oauth/device", env.service.HandleDeviceDecision)
+	})
+
+	response := env.do("acme", http.MethodPost, "/oauth/device_authorization",
+		url.Values{"client_id": {"spa"}, "scope": {"openid"}}.Encode(), "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("device authorization: %d %s", response.Code, response.Body.String())
+	}
+	var device deviceAuthorizationResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &device); err != nil {
+		t.Fatal(err)
+	}
+
+	stranger := env.addUser("globex", "ivan@globex.example")
+	strangerToken := env.accessToken("globex", stranger.GUID, nil)
+	response = env.do("globex", http.MethodGet, "/oauth/device?user_code="+device.UserCode, "", strangerToken)
+	if response.Code != http.StatusNotFound || problemCode(t, response) != "user_code_invalid" {
+		t.Fatalf("device of another tenant is visible: %d %s", response.Code, response.Body.String())
+	}
+	decision := `{"user_code": "` + device.UserCode + `", "approve": true}`
+	response = env.do("globex", http.MethodPost, "/oauth/device", decision, strangerToken)
+	if response.Code != http.StatusNotFound || problemCode(t, response) != "user_code_invalid" {
+		t.Fatalf("device of another tenant is approved: %d %s", response.Code, response.Body.String())
+	}
+
+	owner := env.addUser("acme", "ivan@acme.example")
+	ownerToken := env.accessToken("acme", owner.GUID, nil)
+	response = env.do("acme", http.MethodGet, "/oauth/device?user_code="+device.UserCode, "", ownerToken)
+	if response.Code != http.StatusOK {
+		t.Fatalf("device of own tenant: %d %s", response.Code, response.Body.String())
+	}
+	if response = env.do("acme", http.MethodPost, "/oauth/device", decision, ownerToken); response.Code != http.StatusNoContent {
+		t.Fatalf("decision in own tenant: %d %s", response.Code, response.Body.String())
+	}
+}
+
+func newAuthorizationCodeEnv(t *testing.T) *testEnv {
+	env := newTestEnv(t)
+	env.addPublicClient()
+	env.cfg.OAuth.LoginURL = "https://acme.example/oauth/login"
+	env.router.Get("/oauth/authorize", env.service.HandleOAuthAuthorize)
+	env.router.With(env.service.Authenticate).Post("/oauth/authorize", env.service.HandleOAuthAuthorizeConsent)
+	env.router.Post("/oauth/token", env.service.HandleOAuthToken)
+	return env
+}
+
+func TestAuthorizationCodeSingleUse(t *testing.T) {
+	env := newAuthorizationCodeEnv(t)
+	user := env.addUser("acme", "ivan@acme.example")
+	code := env.authorizationCode(env.accessToken("acme", user.GUID, nil))
+
+	if response := env.exchangeCode(code, nil); response.Code != http.StatusOK {
+		t.Fatalf("first exchange: %d %s", response.Code, response.Body.String())
+	}
+	response := env.exchangeCode(code, nil)
+	if response.Code != http.StatusBadRequest || problemCode(t, response) != "invalid_grant" {
+		t.Fatalf("second exchange: %d %s", response.Code, response.Body.String())
+	}
+	if env.tokens.count("acme", user.GUID) != 1 {
+		t.Fatal("second exchange must not issue tokens")
+	}
+}
+
+/* Код, предъявленный не тем клиентом, с другим redirect_uri или без своего code_verifier, не обменивается
+ * и сгорает: после неудачной попытки его не обменять и с верными параметрами */
+func TestAuthorizationCodeExchangeRejected(t *testing.T) {
+	env := newAuthorizationCodeEnv(t)
+	user := env.addUser("acme", "ivan@acme.example")
+	userToken := env.accessToken("acme", user.GUID, nil)
+
+	tests := []struct {
+		name     string
+		override url.Values
+	}{
+		{"verifier mismatch", url.Values{"code_verifier": {strings.Repeat("w", 43)}}},
+		{"client_id mismatch", url.Values{"client_id": {"mobile"}}},
+		{"redirect_uri mismatch", url.Values{"redirect_uri": {"https://app.example/other"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code := env.authorizationCode(userToken)
+			response := env.exchangeCode(code, test.override)
+			if response.Code != http.StatusBadRequest || problemCode(t, response) != "invalid_grant" {
+				t.Fatalf("%d %s", response.Code, response.Body.String())
+			}
+			if response = env.exchangeCode(code, nil); response.Code != http.StatusBadRequest {
+				t.Fatalf("code must be burnt by a failed exchange: %d %s", response.Code, response.Body.String())
+			}
+		})
+	}
+	if env.tokens.count("acme", user.GUID) != 0 {
+		t.Fatal("rejected exchanges must not issue tokens")
+	}
+}
+
+/* Пока client_id и redirect_uri не проверены, ошибка отдаётся как есть: иначе сервис стал бы открытым редиректом */
+func TestAuthorizeRejectedWithoutRedirect(t *testing.T) {
+	env := newAuthorizationCodeEnv(t)
+	tests := []struct {
+		name        string
+		clientID    string
+		redirectURI string
+	}{
+		{"unregistered redirect_uri", "spa", "https://evil.example/callback"},
+		{"redirect_uri of another client", "spa", "https://mobile.example/callback"},
+		{"unknown client", "unknown", "https://app.example/callback"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := url.Values{
+				"response_type":         {"code"},
+				"client_id":             {test.clientID},
+				"redirect_uri":          {test.redirectURI},
+				"code_challenge":        {strings.Repeat("c", 43)},
+				"code_challenge_method": {pkceMethodS256},
+			}
+			response := env.do("acme", http.MethodGet, "/oauth/authorize?"+query.Encode(), "", "")
+			if response.Code != http.StatusBadRequest || problemCode(t, response) != "invalid_request" {
+				t.Fatalf("%d %s", response.Code, response.Body.String())
+			}
+			if location := response.Header().Get("Location"); location != "" {
+				t.Fatalf("redirected to %s", location)
+			}
+		})
+	}
+}
+
+/* Без PKCE с S256 код не выдаётся, а ошибка возвращается в приложение через redirect_uri */
+func TestAuthorizePKCERequired(t *testing.T) {
+	env := newAuthorizationCodeEnv(t)
+	tests := []struct {
+		name      string
+		challenge string
+		method    string
+	}{
+		{"plain", testVerifier, "plain"},
+		{"no method", strings.Repeat("c", 43), ""},
+		{"no challenge", "", pkceMethodS256},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := url.Values{
+				"response_type":         {"code"},
+				"client_id":             {"spa"},
+				"redirect_uri":          {"https://app.example/callback"},
+				"state":                 {"xyz"},
+				"code_challenge":        {test.challenge},
+				"code_challenge_method": {test.method},
+			}
+			response := env.do("acme", http.MethodGet, "/oauth/authorize?"+query.Encode(), "", "")
+			if response.Code != http.StatusFound {
+				t.Fatalf("%d %s", response.Code, response.Body.String())
+			}
+			location, err := url.Parse(response.Header().Get("Location"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if location.Host != "app.example" || location.Query().Get("error") != "invalid_request" ||
+				location.Query().Get("state") != "xyz" || location.Query().Get("code") != "" {
+				t.Fatalf("redirected to %s", location)
+			}
+		})
+	}
+
+	/* С S256 запрос уходит на страницу входа */
+	challenge := sha256.Sum256([]byte(testVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"spa"},
+		"redirect_uri":          {"https://app.example/callback"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {pkceMethodS256},
+	}
+	response := env.do("acme", http.MethodGet, "/oauth/authorize?"+query.Encode(), "", "")
+	if location := response.Header().Get("Location"); response.Code != http.StatusFound ||
+		!strings.HasPrefix(location, env.cfg.OAuth.LoginURL+"?") {
+		t.Fatalf("S256: %d %s", response.Code, location)
+	}
+}
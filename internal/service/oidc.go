@@ -0,0 +1,122 @@
+package service
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
+	"go.uber.org/zap"
+)
+
+/* Scope OpenID Connect. Это не права пользователя: они только разрешают приложению узнать, кто вошёл,
+ * поэтому выдаются любому пользователю, если приложение их запросило. */
+const (
+	scopeOpenID  = "openid"
+	scopeProfile = "profile"
+	scopeEmail   = "email"
+)
+
+var identityScopes = []string{scopeOpenID, scopeProfile, scopeEmail}
+
+/* nonce передаётся приложением как есть, ограничиваем только длину */
+const maxNonceLength = 255
+
+/* Добавляет к паре id_token (OpenID Connect Core 1.0, 2), если выдан scope openid и задан ключ oidc.key_file.
+ * aud - client_id приложения, nonce - из запроса авторизации. Данные профиля попадают в токен по scope profile и email.
+ * Если что-то пошло не так, ответ клиенту уже записан и возвращается false. */
+func (service *AuthService) attachIDToken(pair *token.Pair, user *model.User, scope string, audience string, nonce string,
+	authTime int64, amr []string, w http.ResponseWriter, req *http.Request) bool {
+	scopes := strings.Fields(scope)
+	if service.idTokens == nil || !slices.Contains(scopes, scopeOpenID) {
+		return true
+	}
+	tenant := tenancy.FromContext(req.Context())
+	now := time.Now().Unix()
+	claims := identityClaims(user, scopes)
+	claims["iss"] = tenant.Issuer
+	claims["aud"] = audience
+	claims["iat"] = now
+	claims["exp"] = now + tenant.AccessTokenLifetime
+	claims["auth_time"] = authTime
+	claims["at_hash"] = token.AccessTokenHash(pair.Access)
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	if len(amr) > 0 {
+		claims["amr"] = amr
+	}
+	idToken, err := service.idTokens.Sign(claims)
+	if err != nil {
+		service.oauthFail(w, req, problem.Internal, "Failed to sign ID token", zap.Error(err),
+			zap.String("client_id", audience),
+			zap.String("user_guid", user.GUID))
+		return false
+	}
+	pair.ID = idToken
+	return true
+}
+
+/* UserInfo (OpenID Connect Core 1.0, 5.3): данные пользователя по access токену со scope openid.
+ * Профиль и email отдаются, только если они есть в scope токена. */
+func (service *AuthService) HandleUserInfo(w http.ResponseWriter, req *http.Request) {
+	userGUID := userGUIDFromContext(req.Context())
+	scope := claimScope(accessClaimsFromContext(req.Context())["scope"])
+	var scopes []string
+	if scope != nil {
+		scopes = strings.Fields(*scope)
+	}
+	if !slices.Contains(scopes, scopeOpenID) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		service.fail(w, req, problem.InsufficientScope.With("Access token must have the openid scope"),
+			"UserInfo request without openid scope", zap.String("user_guid", userGUID))
+		return
+	}
+	user, err := service.userRepo.GetByGUID(tenancy.FromContext(req.Context()).ID, userGUID)
+	if err != nil || user.Disabled {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		service.fail(w, req, problem.UserUnavailable, "User not found or disabled", zap.Error(err),
+			zap.String("user_guid", userGUID))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if err = writeJson(w, http.StatusOK, identityClaims(user, scopes)); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Открытый ключ подписи id_token для приложений (RFC 7517). Поднимается, только если задан oidc.key_file. */
+func (service *AuthService) HandleJWKS(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if err := writeJson(w, http.StatusOK, service.idTokens.JWKS()); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Стандартные claims пользователя (OpenID Connect Core 1.0, 5.1, 5.4): sub всегда, профиль по scope profile,
+ * email по scope email. Пустые значения не отдаются. */
+func identityClaims(user *model.User, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": user.GUID}
+	if slices.Contains(scopes, scopeProfile) {
+		name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+		for claim, value := range map[string]string{
+			"name":        name,
+			"given_name":  user.FirstName,
+			"family_name": user.LastName,
+			"locale":      user.Locale,
+		} {
+			if value != "" {
+				claims[claim] = value
+			}
+		}
+	}
+	if slices.Contains(scopes, scopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerified
+	}
+	return claims
+}
@@ -2,77 +2,97 @@ package service
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"github.com/TooLazyToCreate/auth-service/internal/mailer"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
 	"github.com/TooLazyToCreate/auth-service/internal/token"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
-	"net/smtp"
 	"strconv"
+	"strings"
 	"time"
 )
 
+type refreshRequest struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	/* Необязательные scope через пробел: новая пара получит только те из них, что были у старой */
+	Scope *string `json:"scope"`
+}
+
 func (service *AuthService) HandleRefresh(w http.ResponseWriter, req *http.Request) {
 	/* Парсим пару токенов из JSON */
-	pair, err := token.PairFromStream(req.Body)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
-		service.logger.Error("Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+	body := refreshRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
 		return
 	}
+	pair := &token.Pair{Access: []byte(body.AccessToken), Refresh: []byte(body.RefreshToken)}
+	tenant := tenancy.FromContext(req.Context())
 
 	/* Получаем данные из refresh токена, заодно его проверяя */
-	refreshTokenPayload, err := pair.RefreshTokenPayload(service.cfg.Secret)
+	refreshTokenPayload, err := pair.RefreshTokenPayload(tenant.Secret)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		service.logger.Error("Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		service.fail(w, req, problem.RefreshTokenMalformed, "Bad request",
+			zap.Error(err), zap.String("ip", req.RemoteAddr))
 		return
 	}
 
 	/* Проверяем время жизни токена */
 	refreshIat, ok := refreshTokenPayload["iat"].(float64)
-	if !(ok && time.Now().Unix()-int64(refreshIat) < service.cfg.Lifetime.RefreshToken) {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		service.logger.Error("Refresh token is expired", zap.String("ip", req.RemoteAddr))
+	if !(ok && time.Now().Unix()-int64(refreshIat) < tenant.RefreshTokenLifetime) {
+		service.fail(w, req, problem.RefreshTokenExpired, "Refresh token is expired", zap.String("ip", req.RemoteAddr))
 		return
 	}
 
 	/* Получаем данные из access токена, заодно его проверяя */
-	accessTokenPayload, err := pair.AccessTokenPayload(service.cfg.Secret)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		service.logger.Error("Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
-		return
+	accessTokenPayload, err := pair.AccessTokenPayload(tenant.Secret)
+	if err == nil && !tokenOfTenant(accessTokenPayload, tenant) {
+		err = errTenantMismatch
 	}
-
-	/* Сверяем Ip адреса в двух токенах */
-	refreshIpAddress, rIpExists := refreshTokenPayload["ip"]
-	accessIpAddress, aIpExists := accessTokenPayload["ip"]
-	if !(rIpExists && aIpExists && accessIpAddress == refreshIpAddress) {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		service.logger.Error("Token payload mismatch", zap.String("ip", req.RemoteAddr))
+	if err != nil {
+		service.fail(w, req, problem.AccessTokenMalformed, "Bad request",
+			zap.Error(err), zap.String("ip", req.RemoteAddr))
 		return
 	}
 
-	/* Получаем GUID пользователя из access токена */
+	/* Получаем GUID пользователя из access токена. Его подпись уже проверена,
+	 * поэтому неудачи дальше можно засчитывать этому пользователю. */
 	userGUID, ok := accessTokenPayload["guid"].(string)
 	if !ok {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		service.logger.Error("Access token does not contain enough data",
+		service.fail(w, req, problem.AccessTokenInvalid, "Access token does not contain enough data",
 			zap.String("ip", req.RemoteAddr),
 			zap.String("access_token", string(pair.Access)))
 		return
 	}
+	/* Ограничиваем число попыток до сравнения bcrypt хэшей - это самая дорогая часть */
+	if !service.allowUser(userGUID, w, req) || !service.checkLockout(userGUID, w, req) {
+		return
+	}
+
+	/* Сверяем Ip адреса в двух токенах */
+	refreshIpAddress, rIpExists := refreshTokenPayload["ip"]
+	accessIpAddress, aIpExists := accessTokenPayload["ip"]
+	if !(rIpExists && aIpExists && accessIpAddress == refreshIpAddress) {
+		service.fail(w, req, problem.TokenPairMismatch, "Token payload mismatch", zap.String("ip", req.RemoteAddr))
+		service.registerFailure(userGUID, "token payload mismatch", req)
+		service.publishEvent(notify.EventTokenCompromised, userGUID, req, map[string]string{"reason": "token payload mismatch"})
+		return
+	}
 
 	/* Получаем все хэши refresh-токенов, выданные на конкретного пользователя */
-	tokenRows, err := service.tokenRepo.GetByGUID(userGUID)
+	tokenRows, err := service.tokenRepo.GetByGUID(tenant.ID, userGUID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			service.logger.Error("Refresh token is invalid", zap.Error(err), zap.String("ip", req.RemoteAddr))
+			service.fail(w, req, problem.RefreshTokenInvalid, "Refresh token is invalid",
+				zap.Error(err), zap.String("ip", req.RemoteAddr))
+			service.publishEvent(notify.EventRefreshReuse, userGUID, req, nil)
 		} else {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			service.logger.Error("SQL error", zap.Error(err))
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
 		}
 		return
 	}
@@ -83,14 +103,18 @@ func (service *AuthService) HandleRefresh(w http.ResponseWriter, req *http.Reque
 	/* Проверяем выборку из хэшей и надеемся выйти без ошибки из цикла */
 	for _, tokenRow := range tokenRows {
 		/* Сборщик токенов всегда будет запаздывать, поэтому проверяем дополнительно время создания. */
-		if tokenRow.CreatedAt.Unix()+service.cfg.Lifetime.RefreshToken > time.Now().Unix() {
+		if tokenRow.CreatedAt.Unix()+tenant.RefreshTokenLifetime > time.Now().Unix() {
 			/* Если в выдаче есть валидный хэш, удаляем его и выходим из цикла */
-			err = bcrypt.CompareHashAndPassword([]byte(tokenRow.Hash), pair.Refresh)
+			err = bcrypt.CompareHashAndPassword([]byte(tokenRow.Hash), refreshTokenDigest(pair.Refresh))
+			/* Токены, выданные до хэширования через sha256, захэшированы как есть. Все они не длиннее 72 байт:
+			 * более длинные bcrypt не принимал. */
+			if err != nil && len(pair.Refresh) <= 72 {
+				err = bcrypt.CompareHashAndPassword([]byte(tokenRow.Hash), pair.Refresh)
+			}
 			if err == nil {
-				err = service.tokenRepo.DeleteByHash(tokenRow.Hash)
+				err = service.tokenRepo.DeleteByHash(tenant.ID, tokenRow.Hash)
 				if err != nil {
-					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-					service.logger.Error("SQL error", zap.Error(err))
+					service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
 					return
 				}
 				break
@@ -99,35 +123,68 @@ func (service *AuthService) HandleRefresh(w http.ResponseWriter, req *http.Reque
 	}
 	/* Этот if запускается только если bcrypt.CompareHashAndPassword вернул error для каждого из хэшей */
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		service.logger.Error("Refresh token is invalid", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		service.fail(w, req, problem.RefreshTokenInvalid, "Refresh token is invalid",
+			zap.Error(err), zap.String("ip", req.RemoteAddr))
+		service.registerFailure(userGUID, "invalid refresh token", req)
+		/* Подпись и срок токена в порядке, но его хэша уже нет: токен использован повторно или отозван */
+		service.publishEvent(notify.EventRefreshReuse, userGUID, req, nil)
 		return
 	}
-	/* Если токены валидны и были выданы, но ip адреса не совпадают,
-	 * пишем об этом пользователю. */
-	if req.RemoteAddr != accessIpAddress {
-		user, err := service.userRepo.GetByGUID(userGUID)
-		if err != nil {
-			service.logger.Error("Access and Refresh tokens have been compromised, but user not found...",
+	/* Если токены валидны и были выданы, но ip адреса не совпадают, решение принимает
+	 * политика из config.json. Об отклонённых (и при политике notify - обо всех) сменах пишем пользователю. */
+	tokenIpAddress, _ := accessIpAddress.(string)
+	decision := service.ipPolicy.Evaluate(tokenIpAddress, req.RemoteAddr)
+	if decision.Changed {
+		service.publishEvent(notify.EventIPMismatch, userGUID, req, map[string]string{
+			"token_ip": tokenIpAddress,
+			"reason":   decision.Reason,
+			"allowed":  strconv.FormatBool(decision.Allowed),
+		})
+		if decision.Allowed {
+			service.logger.Info("IP address change has been allowed",
+				zap.String("reason", decision.Reason),
 				zap.String("ip", req.RemoteAddr),
+				zap.String("token_ip", tokenIpAddress),
 				zap.String("user_guid", userGUID))
 		} else {
-			service.logger.Error("Access and Refresh tokens have been compromised",
+			service.logger.Error("Access and Refresh tokens have been compromised", correlationField(req),
+				zap.String("reason", decision.Reason),
 				zap.String("ip", req.RemoteAddr),
-				zap.String("token_ip", accessIpAddress.(string)),
+				zap.String("token_ip", tokenIpAddress),
 				zap.String("user_guid", userGUID))
-			err = smtp.SendMail(service.cfg.Smtp.Host+":"+strconv.Itoa(service.cfg.Smtp.Port),
-				*service.smtpAuth, service.cfg.Smtp.Email, []string{user.Email},
-				[]byte("Кто-то пытался получить доступ к вашему аккаунту c IP адреса "+req.RemoteAddr+"!"))
-			if err != nil {
-				service.logger.Error("Could not send email to user", zap.Error(err),
-					zap.String("email", user.Email))
+		}
+		if decision.Notify {
+			kind := notify.KindCompromise
+			if decision.Allowed {
+				kind = notify.KindIPChange
 			}
+			service.notifyUserByGUID(tenant, userGUID, kind, mailer.Data{IP: req.RemoteAddr})
+		}
+		if !decision.Allowed {
+			problem.Write(w, req, problem.IPMismatch)
+			service.publishEvent(notify.EventTokenCompromised, userGUID, req, map[string]string{
+				"reason":   decision.Reason,
+				"token_ip": tokenIpAddress,
+			})
+			return
 		}
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return
 	}
 
-	/* Генерируем новую пару токенов */
-	service.createTokens(userGUID, w, req)
+	/* scope при обновлении не расширяется: запрошенные сужаются до прежних, а при выпуске - до текущих прав пользователя,
+	 * так что снятая роль пропадёт из токена при следующем обновлении */
+	scope := claimScope(accessTokenPayload["scope"])
+	if body.Scope != nil && scope != nil {
+		narrowed := narrowScope(strings.Fields(*scope), body.Scope)
+		scope = &narrowed
+	} else if body.Scope != nil {
+		scope = body.Scope
+	}
+
+	/* Генерируем новую пару токенов, способы и время входа и приложение переносим из старого access токена:
+	 * иначе приложение получило бы после обновления токен самого пользователя */
+	clientID, _ := accessTokenPayload["client_id"].(string)
+	if service.createTokens(userGUID, clientID, claimStrings(accessTokenPayload["amr"]), scope,
+		claimAuthTime(accessTokenPayload), w, req) {
+		service.publishEvent(notify.EventTokenRefreshed, userGUID, req, nil)
+	}
 }
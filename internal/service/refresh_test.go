@@ -0,0 +1,108 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/TooLazyToCreate/auth-service/internal/ippolicy"
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+)
+
+/* Сервис с политикой subnet и RemoteIP перед маршрутами, как в app.go. Пары выдаются по GUID клиенту backend. */
+func newRefreshEnv(t *testing.T) *testEnv {
+	env := newTestEnv(t)
+	policy, err := ippolicy.New(ippolicy.ModeSubnet, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.service.ipPolicy = policy
+	env.service.clientRepo = &memClients{clients: map[string]testClient{
+		"backend": {"acme", model.OAuthClient{
+			ID:         "backend",
+			AuthMethod: authMethodSecretBasic,
+			SecretHash: clientSecretHash("secret"),
+			GrantTypes: []string{grantGUID},
+		}},
+	}}
+	env.router.Use(ippolicy.RemoteIP(nil))
+	env.router.Post("/user/tokens/create", env.service.HandleCreate)
+	env.router.Post("/user/tokens/refresh", env.service.HandleRefresh)
+	return env
+}
+
+/* Запрос к тенанту acme с адреса remoteAddr (ip:port, как его отдаёт net/http) */
+func (env *testEnv) doFrom(remoteAddr string, path string, body string, basicAuth bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("X-Tenant-ID", "acme")
+	if strings.HasPrefix(body, "{") {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if basicAuth {
+		req.SetBasicAuth("backend", "secret")
+	}
+	recorder := httptest.NewRecorder()
+	env.router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+/* Тело запроса на обновление из ответа с парой токенов */
+func refreshBody(t *testing.T, response *httptest.ResponseRecorder) string {
+	if response.Code != http.StatusCreated {
+		t.Fatalf("tokens: %d %s", response.Code, response.Body.String())
+	}
+	var pair map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &pair); err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"access_token":  pair["access_token"],
+		"refresh_token": pair["refresh_token"],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+/* IPv6 адрес клиента сравнивается целиком: из [2001:db8:1:2::7]:51000 в токен попадает 2001:db8:1:2::7,
+ * смена адреса внутри /64 разрешена, а адрес другой сети с той же первой группой - нет */
+func TestRefreshIPv6(t *testing.T) {
+	env := newRefreshEnv(t)
+	user := env.addUser("acme", "ivan@acme.example")
+
+	body := refreshBody(t, env.doFrom("[2001:db8:1:2::7]:51000", "/user/tokens/create",
+		url.Values{"guid": {user.GUID}}.Encode(), true))
+	var pair map[string]string
+	if err := json.Unmarshal([]byte(body), &pair); err != nil {
+		t.Fatal(err)
+	}
+	if ip := env.accessClaims("acme", pair["access_token"])["ip"]; ip != "2001:db8:1:2::7" {
+		t.Fatalf("ip = %v", ip)
+	}
+
+	body = refreshBody(t, env.doFrom("[2001:db8:1:2::9]:443", "/user/tokens/refresh", body, false))
+	events := env.events(notify.EventIPMismatch)
+	if len(events) != 1 || events[0].Details["reason"] != "same /64 subnet" || events[0].Details["allowed"] != "true" {
+		t.Fatalf("ip mismatch events: %+v", events)
+	}
+
+	response := env.doFrom("[2001:db8:ffff::1]:443", "/user/tokens/refresh", body, false)
+	if response.Code != http.StatusUnauthorized || problemCode(t, response) != "ip_mismatch" {
+		t.Fatalf("refresh from another network: %d %s", response.Code, response.Body.String())
+	}
+	if events = env.events(notify.EventTokenCompromised); len(events) != 1 ||
+		events[0].Details["reason"] != "different /64 subnet" {
+		t.Errorf("compromise events: %+v", events)
+	}
+	if mails := env.mails(notify.KindCompromise); len(mails) != 1 || mails[0].To != user.Email {
+		t.Errorf("compromise mails: %+v", mails)
+	}
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"go.uber.org/zap"
+)
+
+/* Метаданные клиента из RFC 7591, 2. Остальные поля (jwks, logo_uri и прочие) не поддерживаются и игнорируются. */
+type registrationRequest struct {
+	RedirectURIs            []string `json:"redirect_uris"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	ClientName              string   `json:"client_name"`
+	Scope                   string   `json:"scope"`
+}
+
+/* Ответ RFC 7591, 3.2.1. client_secret_expires_at = 0 - секрет не истекает */
+type registrationResponse struct {
+	ClientID                string   `json:"client_id"`
+	ClientSecret            string   `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64    `json:"client_id_issued_at"`
+	ClientSecretExpiresAt   int64    `json:"client_secret_expires_at"`
+	ClientName              string   `json:"client_name,omitempty"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	Scope                   string   `json:"scope,omitempty"`
+}
+
+/* Динамическая регистрация клиента (RFC 7591). Регистрироваться может только тот, у кого есть initial access token
+ * (OAUTH_REGISTRATION_TOKEN). Так можно зарегистрировать публичный клиент или клиент с секретом;
+ * клиентов с private_key_jwt и выдачей токенов по GUID заводит администратор. */
+func (service *AuthService) HandleOAuthRegister(w http.ResponseWriter, req *http.Request) {
+	bearer, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || len(service.cfg.RegistrationToken) == 0 ||
+		subtle.ConstantTimeCompare([]byte(bearer), service.cfg.RegistrationToken) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		service.fail(w, req, problem.Unauthorized, "Initial access token is invalid", zap.String("ip", req.RemoteAddr))
+		return
+	}
+	body := registrationRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.oauthFail(w, req, problem.OAuthInvalidClientMetadata.With("Request body is not valid JSON"),
+			"Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+
+	/* Значения по умолчанию из RFC 7591, 2 */
+	client := &model.OAuthClient{
+		Name:         body.ClientName,
+		AuthMethod:   body.TokenEndpointAuthMethod,
+		RedirectURIs: body.RedirectURIs,
+		GrantTypes:   body.GrantTypes,
+		Scopes:       strings.Fields(body.Scope),
+	}
+	if client.AuthMethod == "" {
+		client.AuthMethod = authMethodSecretBasic
+	}
+	if len(client.GrantTypes) == 0 {
+		client.GrantTypes = []string{grantAuthorizationCode}
+	}
+	if failure := service.checkRegistration(client, body.ResponseTypes); failure != nil {
+		service.oauthFail(w, req, failure, "Bad request: invalid client metadata", zap.String("ip", req.RemoteAddr))
+		return
+	}
+
+	var err error
+	if client.ID, err = newClientID(); err != nil {
+		service.oauthFail(w, req, problem.Internal, "Failed to generate client_id", zap.Error(err))
+		return
+	}
+	var secret string
+	if client.AuthMethod == authMethodSecretBasic {
+		if secret, client.SecretHash, err = newClientSecret(); err != nil {
+			service.oauthFail(w, req, problem.Internal, "Failed to generate client secret", zap.Error(err))
+			return
+		}
+	}
+	if err = service.clientRepo.Create(tenancy.FromContext(req.Context()).ID, client); err != nil {
+		service.oauthFail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	service.logger.Info("OAuth client has been registered",
+		zap.String("client_id", client.ID),
+		zap.String("client_name", client.Name),
+		zap.String("ip", req.RemoteAddr))
+
+	responseTypes := []string{}
+	if slices.Contains(client.GrantTypes, grantAuthorizationCode) {
+		responseTypes = append(responseTypes, "code")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	err = writeJson(w, http.StatusCreated, &registrationResponse{
+		ClientID:                client.ID,
+		ClientSecret:            secret,
+		ClientIDIssuedAt:        client.CreatedAt.Unix(),
+		ClientName:              client.Name,
+		RedirectURIs:            client.RedirectURIs,
+		GrantTypes:              client.GrantTypes,
+		ResponseTypes:           responseTypes,
+		TokenEndpointAuthMethod: client.AuthMethod,
+		Scope:                   strings.Join(client.Scopes, " "),
+	})
+	if err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Ограничения динамической регистрации поверх общей проверки validateClient */
+func (service *AuthService) checkRegistration(client *model.OAuthClient, responseTypes []string) *problem.Problem {
+	if client.AuthMethod == authMethodPrivateKeyJWT {
+		return problem.OAuthInvalidClientMetadata.With("private_key_jwt clients are registered by an administrator")
+	}
+	if slices.Contains(client.GrantTypes, grantGUID) {
+		return problem.OAuthInvalidClientMetadata.With("Grant type " + grantGUID + " is granted by an administrator")
+	}
+	/* response_types должны соответствовать grant_types (RFC 7591, 2.1), у нас это только code */
+	for _, responseType := range responseTypes {
+		if responseType != "code" || !slices.Contains(client.GrantTypes, grantAuthorizationCode) {
+			return problem.OAuthInvalidClientMetadata.With("response_types must be [\"code\"] with authorization_code")
+		}
+	}
+	for _, scope := range client.Scopes {
+		if !slices.Contains(service.cfg.OAuth.RegistrationScopes, scope) {
+			return problem.OAuthInvalidClientMetadata.With("Scope is not allowed for registered clients: " + scope)
+		}
+	}
+	return validateClient(service.cfg, client)
+}
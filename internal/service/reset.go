@@ -0,0 +1,92 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/password"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"go.uber.org/zap"
+)
+
+const passwordResetPurpose = "password_reset"
+
+type passwordResetRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+/* Как и для magic link, всегда отвечаем 202, чтобы ответ не раскрывал, зарегистрирован ли email */
+func (service *AuthService) HandlePasswordForgot(w http.ResponseWriter, req *http.Request) {
+	body := emailRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Email == "" {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+
+	user, err := service.userRepo.GetByEmail(tenancy.FromContext(req.Context()).ID, body.Email)
+	if err != nil || user.Disabled {
+		service.logger.Error("Password reset requested for unknown or disabled user", zap.Error(err),
+			zap.String("ip", req.RemoteAddr),
+			zap.String("email", body.Email))
+		return
+	}
+	service.sendLinkToken(user, passwordResetPurpose, service.cfg.PasswordReset, req)
+}
+
+/* Устанавливает новый пароль по токену из письма и отзывает все refresh токены пользователя */
+func (service *AuthService) HandlePasswordReset(w http.ResponseWriter, req *http.Request) {
+	body := passwordResetRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+	/* Пароль проверяем до того, как потратить ссылку, чтобы из-за короткого пароля не пришлось запрашивать новую */
+	if !passwordAcceptable(service.cfg, body.Password) {
+		service.fail(w, req, problem.PasswordTooShort, "Bad request: password is too short",
+			zap.String("ip", req.RemoteAddr))
+		return
+	}
+
+	linkToken, ok := service.consumeLinkToken(passwordResetPurpose, body.Token, w, req)
+	if !ok {
+		return
+	}
+	/* Как и в magic link: письмо со ссылкой могло уйти на прежний адрес, которым владеет уже не пользователь */
+	tenantID := tenancy.FromContext(req.Context()).ID
+	user, err := service.userRepo.GetByGUID(tenantID, linkToken.UserGUID)
+	if err != nil || user.Disabled || user.Email != linkToken.Email {
+		service.fail(w, req, problem.UserUnavailable, "Password reset user is not available anymore", zap.Error(err),
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", linkToken.UserGUID))
+		return
+	}
+
+	hash, err := password.Hash(body.Password, passwordParams(service.cfg))
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to hash password", zap.Error(err))
+		return
+	}
+	if err = service.credentialRepo.Set(tenantID, user.GUID, hash); err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	/* Старые сессии могли принадлежать тому, из-за кого пароль и сбрасывают */
+	if err = service.tokenRepo.DeleteByUserGUID(tenantID, user.GUID); err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	/* Ссылка пришла на почту, значит адрес заодно подтверждён */
+	if !user.EmailVerified {
+		if err = service.userRepo.SetEmailVerified(tenantID, user.GUID, linkToken.Email); err != nil {
+			service.logger.Error("Failed to mark email as verified", zap.Error(err), zap.String("user_guid", user.GUID))
+		}
+	}
+
+	service.publishEvent(notify.EventTokenRevoked, user.GUID, req, map[string]string{"reason": "password_reset"})
+	service.logger.Info("Password has been reset, refresh tokens revoked", zap.String("user_guid", user.GUID))
+	w.WriteHeader(http.StatusNoContent)
+}
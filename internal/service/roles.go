@@ -0,0 +1,66 @@
+package service
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+)
+
+/* Роли и scope, которые попадают в access токен пользователя */
+type accessGrant struct {
+	Roles []string
+	Scope string
+}
+
+/* Собирает роли пользователя и сужает запрошенные scope до его прав.
+ * requested = nil - запроса не было, выдаются все права пользователя. */
+func userGrant(roleRepo repository.RoleRepository, tenantID string, userGUID string, requested *string) (*accessGrant, error) {
+	roles, err := roleRepo.GetUserRoles(tenantID, userGUID)
+	if err != nil {
+		return nil, err
+	}
+	grant := &accessGrant{Roles: []string{}}
+	var permissions []string
+	for _, role := range roles {
+		grant.Roles = append(grant.Roles, role.Name)
+		permissions = append(permissions, role.Permissions...)
+	}
+	allowed := uniqueSorted(permissions)
+	/* Scope OpenID Connect не выдаются ролями: их получает любой, кто явно запросил */
+	if requested != nil {
+		allowed = append(allowed, identityScopes...)
+	}
+	grant.Scope = narrowScope(allowed, requested)
+	return grant, nil
+}
+
+/* Оставляет из запрошенных scope (через пробел) только разрешённые. Лишние молча отбрасываются,
+ * итоговый scope виден в токене. Без запроса выдаются все разрешённые. */
+func narrowScope(allowed []string, requested *string) string {
+	if requested == nil {
+		return strings.Join(allowed, " ")
+	}
+	var scopes []string
+	for _, scope := range strings.Fields(*requested) {
+		if slices.Contains(allowed, scope) && !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+/* scope из claims токена. Токены, выпущенные до появления ролей, его не содержат - тогда nil. */
+func claimScope(value interface{}) *string {
+	scope, ok := value.(string)
+	if !ok {
+		return nil
+	}
+	return &scope
+}
+
+func uniqueSorted(values []string) []string {
+	result := slices.Clone(values)
+	slices.Sort(result)
+	return slices.Compact(result)
+}
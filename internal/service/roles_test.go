@@ -0,0 +1,180 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+)
+
+/* Роли пользователей, которые тест меняет по ходу дела */
+type memRoles struct {
+	repository.RoleRepository
+	mutex sync.Mutex
+	roles map[string][]model.Role
+}
+
+func (repo *memRoles) GetUserRoles(tenantID string, userGUID string) ([]model.Role, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	return slices.Clone(repo.roles[tenantID+"/"+userGUID]), nil
+}
+
+func (repo *memRoles) set(tenantID string, userGUID string, roles ...model.Role) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.roles[tenantID+"/"+userGUID] = roles
+}
+
+var (
+	roleEditor = model.Role{Name: "editor", Permissions: []string{"docs:write", "docs:read"}}
+	roleViewer = model.Role{Name: "viewer", Permissions: []string{"reports:read", "docs:read"}}
+)
+
+func TestNarrowScope(t *testing.T) {
+	allowed := []string{"docs:read", "docs:write", "openid"}
+	scope := func(value string) *string { return &value }
+	tests := []struct {
+		name      string
+		requested *string
+		scope     string
+	}{
+		{"not requested", nil, "docs:read docs:write openid"},
+		{"subset", scope("openid docs:read"), "openid docs:read"},
+		{"unknown dropped", scope("docs:read admin"), "docs:read"},
+		{"duplicates", scope("docs:read  docs:read"), "docs:read"},
+		{"nothing allowed", scope("admin"), ""},
+		{"empty", scope(""), ""},
+	}
+	for _, test := range tests {
+		if scope := narrowScope(allowed, test.requested); scope != test.scope {
+			t.Errorf("%s: scope = %q, want %q", test.name, scope, test.scope)
+		}
+	}
+}
+
+func TestUserGrant(t *testing.T) {
+	roles := &memRoles{roles: map[string][]model.Role{}}
+	roles.set("acme", "user", roleEditor, roleViewer)
+	scope := func(value string) *string { return &value }
+	tests := []struct {
+		name      string
+		tenantID  string
+		requested *string
+		roles     []string
+		scope     string
+	}{
+		/* Без запроса - все права ролей, но не scope OpenID Connect */
+		{"not requested", "acme", nil, []string{"editor", "viewer"}, "docs:read docs:write reports:read"},
+		{"requested", "acme", scope("openid docs:write"), []string{"editor", "viewer"}, "openid docs:write"},
+		{"unrequested dropped", "acme", scope("docs:read"), []string{"editor", "viewer"}, "docs:read"},
+		{"not granted dropped", "acme", scope("docs:read admin:users"), []string{"editor", "viewer"}, "docs:read"},
+		{"roles of other tenant", "globex", nil, []string{}, ""},
+	}
+	for _, test := range tests {
+		grant, err := userGrant(roles, test.tenantID, "user", test.requested)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(grant.Roles, test.roles) || grant.Scope != test.scope {
+			t.Errorf("%s: roles %v, scope %q; want %v, %q", test.name, grant.Roles, grant.Scope, test.roles, test.scope)
+		}
+	}
+}
+
+/* Вход по паролю и обновления пары с проверкой roles и scope каждого выданного токена */
+type scopeSession struct {
+	env  *testEnv
+	body string
+}
+
+func (env *testEnv) login(email string, plain string, scope *string) *scopeSession {
+	request, err := json.Marshal(loginRequest{Email: email, Password: plain, Scope: scope})
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	return &scopeSession{env, refreshBody(env.t, env.do("acme", http.MethodPost, "/user/login", string(request), ""))}
+}
+
+func (session *scopeSession) refresh(scope *string) {
+	body := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(session.body), &body); err != nil {
+		session.env.t.Fatal(err)
+	}
+	if scope != nil {
+		body["scope"] = *scope
+	}
+	request, err := json.Marshal(body)
+	if err != nil {
+		session.env.t.Fatal(err)
+	}
+	session.body = refreshBody(session.env.t,
+		session.env.do("acme", http.MethodPost, "/user/tokens/refresh", string(request), ""))
+}
+
+func (session *scopeSession) check(roles []string, scope string) {
+	session.env.t.Helper()
+	var pair map[string]string
+	if err := json.Unmarshal([]byte(session.body), &pair); err != nil {
+		session.env.t.Fatal(err)
+	}
+	claims := session.env.accessClaims("acme", pair["access_token"])
+	if got := claimStrings(claims["roles"]); !slices.Equal(got, roles) || claims["scope"] != scope {
+		session.env.t.Fatalf("roles %v, scope %q; want %v, %q", got, claims["scope"], roles, scope)
+	}
+}
+
+func newScopeEnv(t *testing.T) (*testEnv, *memRoles, *model.User) {
+	env := newTestEnv(t)
+	roles := &memRoles{roles: map[string][]model.Role{}}
+	env.service.roleRepo = roles
+	env.router.Post("/user/login", env.service.HandleLogin)
+	env.router.Post("/user/tokens/refresh", env.service.HandleRefresh)
+	user := env.addUser("acme", "ivan@acme.example")
+	env.setPassword("acme", user, "correct horse battery staple")
+	roles.set("acme", user.GUID, roleEditor, roleViewer)
+	return env, roles, user
+}
+
+/* Обновление сохраняет или сужает scope, но не расширяет его, даже до прав, которые у пользователя есть */
+func TestRefreshNeverWidensScope(t *testing.T) {
+	env, _, user := newScopeEnv(t)
+	scope := func(value string) *string { return &value }
+
+	session := env.login(user.Email, "correct horse battery staple", scope("docs:read docs:write openid"))
+	session.check([]string{"editor", "viewer"}, "docs:read docs:write openid")
+
+	session.refresh(nil)
+	session.check([]string{"editor", "viewer"}, "docs:read docs:write openid")
+
+	/* reports:read у пользователя есть, но в токене его не было */
+	session.refresh(scope("docs:read reports:read"))
+	session.check([]string{"editor", "viewer"}, "docs:read")
+
+	session.refresh(scope("docs:read docs:write openid"))
+	session.check([]string{"editor", "viewer"}, "docs:read")
+
+	session.refresh(nil)
+	session.check([]string{"editor", "viewer"}, "docs:read")
+}
+
+/* Снятая роль пропадает из токена при следующем обновлении вместе с правами, которые были только у неё */
+func TestRefreshDropsRemovedRole(t *testing.T) {
+	env, roles, user := newScopeEnv(t)
+
+	session := env.login(user.Email, "correct horse battery staple", nil)
+	session.check([]string{"editor", "viewer"}, "docs:read docs:write reports:read")
+
+	roles.set("acme", user.GUID, roleViewer)
+	session.refresh(nil)
+	session.check([]string{"viewer"}, "docs:read reports:read")
+
+	/* Вернувшаяся роль не возвращает право в уже суженный токен */
+	roles.set("acme", user.GUID, roleEditor, roleViewer)
+	session.refresh(nil)
+	session.check([]string{"editor", "viewer"}, "docs:read reports:read")
+}
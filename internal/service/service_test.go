@@ -0,0 +1,463 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/config"
+	"github.com/TooLazyToCreate/auth-service/internal/ippolicy"
+	"github.com/TooLazyToCreate/auth-service/internal/mailer"
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/password"
+	"github.com/TooLazyToCreate/auth-service/internal/ratelimit"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+/* Обвязка тестов обработчиков: сервис с репозиториями в памяти и двумя тенантами, acme и globex,
+ * которые выбираются заголовком X-Tenant-ID. Репозитории повторяют то поведение запросов из
+ * repository/postgres.go, на которое опираются обработчики: одноразовость, сроки и фильтр по тенанту.
+ * Остальные методы не реализованы, и их вызов уронит тест. */
+type testEnv struct {
+	t           *testing.T
+	cfg         *config.Config
+	registry    *tenancy.Registry
+	service     *AuthService
+	router      chi.Router
+	users       *memUsers
+	tokens      *memTokens
+	links       *memLinkTokens
+	credentials *memCredentials
+	outbox      *memOutbox
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	cfg := &config.Config{Secret: []byte("0123456789abcdef0123456789abcdef")}
+	cfg.Lifetime.AccessToken = 300
+	cfg.Lifetime.RefreshToken = 3600
+	cfg.Tenancy.Resolve = tenancy.ResolveHeader
+	cfg.Tenancy.Tenants = []config.Tenant{
+		{ID: "acme", Issuer: "https://acme.example"},
+		{ID: "globex", Issuer: "https://globex.example"},
+	}
+	registry, err := tenancy.NewRegistry(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipPolicy, err := ippolicy.New(ippolicy.ModeStrict, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := mailer.Load("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &testEnv{
+		t:           t,
+		cfg:         cfg,
+		registry:    registry,
+		users:       &memUsers{users: map[string]*testUser{}},
+		tokens:      &memTokens{},
+		links:       &memLinkTokens{links: map[string]*testLinkToken{}},
+		credentials: &memCredentials{hashes: map[string]string{}},
+		outbox:      &memOutbox{},
+	}
+	env.service = &AuthService{
+		logger:         zap.NewNop(),
+		cfg:            cfg,
+		userRepo:       env.users,
+		tokenRepo:      env.tokens,
+		linkTokenRepo:  env.links,
+		credentialRepo: env.credentials,
+		totpRepo:       noTOTP{},
+		roleRepo:       noRoles{},
+		replayRepo:     &memReplay{used: map[string]time.Time{}},
+		outbox:         notify.NewOutbox(env.outbox, []string{"mail"}),
+		templates:      templates,
+		events:         notify.NewEventPublisher(env.outbox, []notify.Subscription{{Name: "test"}}),
+		limiter: ratelimit.NewLimiter(zap.NewNop(), ratelimit.NewMemoryStore(),
+			ratelimit.Rule{}, ratelimit.Rule{}, ratelimit.Rule{}),
+		ipPolicy: ipPolicy,
+	}
+	env.router = chi.NewRouter()
+	env.router.Use(registry.Middleware)
+	return env
+}
+
+func (env *testEnv) tenant(id string) *tenancy.Tenant {
+	for _, tenant := range env.registry.All() {
+		if tenant.ID == id {
+			return tenant
+		}
+	}
+	env.t.Fatalf("unknown tenant %s", id)
+	return nil
+}
+
+func (env *testEnv) addUser(tenantID string, email string) *model.User {
+	user := &model.User{FirstName: "Ivan", LastName: "Petrov", Email: email, EmailVerified: true}
+	if err := env.users.Create(tenantID, user); err != nil {
+		env.t.Fatal(err)
+	}
+	return user
+}
+
+/* Пароль пользователя для входа через HandleLogin */
+func (env *testEnv) setPassword(tenantID string, user *model.User, plain string) {
+	hash, err := password.Hash(plain, passwordParams(env.cfg))
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	if err = env.credentials.Set(tenantID, user.GUID, hash); err != nil {
+		env.t.Fatal(err)
+	}
+}
+
+/* access токен, как его выпускает newPair, с дополнительными claims */
+func (env *testEnv) accessToken(tenantID string, userGUID string, extra map[string]interface{}) string {
+	claims := map[string]interface{}{
+		"guid":      userGUID,
+		"tid":       tenantID,
+		"ip":        "192.0.2.1",
+		"iat":       time.Now().Unix(),
+		"auth_time": time.Now().Unix(),
+		"amr":       []string{"pwd"},
+	}
+	for name, value := range extra {
+		claims[name] = value
+	}
+	accessToken, err := token.NewAccessToken(env.tenant(tenantID).Secret, claims)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	return string(accessToken)
+}
+
+/* Запрос к тенанту tenantID. Тело в виде формы, если оно не начинается с {. */
+func (env *testEnv) do(tenantID string, method string, path string, body string, bearer string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.RemoteAddr = "192.0.2.1"
+	req.Header.Set("X-Tenant-ID", tenantID)
+	if strings.HasPrefix(body, "{") {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	recorder := httptest.NewRecorder()
+	env.router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+/* Опубликованные события указанного типа */
+func (env *testEnv) events(eventType string) []notify.Event {
+	env.outbox.mutex.Lock()
+	defer env.outbox.mutex.Unlock()
+	var result []notify.Event
+	for _, message := range env.outbox.messages {
+		if !strings.HasPrefix(message.Channel, notify.EventChannelPrefix) {
+			continue
+		}
+		event := notify.Event{}
+		if err := json.Unmarshal(message.Payload, &event); err != nil {
+			env.t.Fatal(err)
+		}
+		if event.Type == eventType {
+			result = append(result, event)
+		}
+	}
+	return result
+}
+
+/* Письма указанного вида, поставленные в очередь */
+func (env *testEnv) mails(kind string) []notify.Message {
+	env.outbox.mutex.Lock()
+	defer env.outbox.mutex.Unlock()
+	var result []notify.Message
+	for _, outboxMessage := range env.outbox.messages {
+		if outboxMessage.Channel != "mail" {
+			continue
+		}
+		message := notify.Message{}
+		if err := json.Unmarshal(outboxMessage.Payload, &message); err != nil {
+			env.t.Fatal(err)
+		}
+		if message.Kind == kind {
+			result = append(result, message)
+		}
+	}
+	return result
+}
+
+/* Код ошибки из ответа problem+json */
+func problemCode(t *testing.T, recorder *httptest.ResponseRecorder) string {
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response is not JSON: %d %s", recorder.Code, recorder.Body.String())
+	}
+	return body.Code
+}
+
+type testUser struct {
+	tenantID string
+	user     model.User
+}
+
+type memUsers struct {
+	repository.UserRepository
+	mutex sync.Mutex
+	users map[string]*testUser
+}
+
+func (repo *memUsers) get(tenantID string, guid string) (*testUser, bool) {
+	stored, ok := repo.users[guid]
+	return stored, ok && stored.tenantID == tenantID
+}
+
+func (repo *memUsers) GetByGUID(tenantID string, guid string) (*model.User, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, ok := repo.get(tenantID, guid)
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	user := stored.user
+	return &user, nil
+}
+
+func (repo *memUsers) GetByEmail(tenantID string, email string) (*model.User, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for _, stored := range repo.users {
+		if stored.tenantID == tenantID && strings.EqualFold(stored.user.Email, email) {
+			user := stored.user
+			return &user, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (repo *memUsers) Create(tenantID string, user *model.User) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for _, stored := range repo.users {
+		if stored.tenantID == tenantID && strings.EqualFold(stored.user.Email, user.Email) {
+			return repository.ErrAlreadyExists
+		}
+	}
+	user.GUID = uuid.NewString()
+	repo.users[user.GUID] = &testUser{tenantID, *user}
+	return nil
+}
+
+func (repo *memUsers) SetEmailVerified(tenantID string, guid string, email string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, ok := repo.get(tenantID, guid)
+	if !ok || !strings.EqualFold(stored.user.Email, email) {
+		return sql.ErrNoRows
+	}
+	stored.user.EmailVerified = true
+	return nil
+}
+
+func (repo *memUsers) SetDisabled(tenantID string, guid string, disabled bool) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, ok := repo.get(tenantID, guid)
+	if !ok {
+		return sql.ErrNoRows
+	}
+	stored.user.Disabled = disabled
+	return nil
+}
+
+type testRefreshToken struct {
+	tenantID string
+	token    model.Token
+}
+
+type memTokens struct {
+	repository.TokenRepository
+	mutex  sync.Mutex
+	tokens []testRefreshToken
+}
+
+func (repo *memTokens) Create(tenantID string, hash string, userGUID string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.tokens = append(repo.tokens, testRefreshToken{tenantID, model.Token{UserGUID: userGUID, Hash: hash,
+		CreatedAt: time.Now()}})
+	return nil
+}
+
+func (repo *memTokens) GetByGUID(tenantID string, userGUID string) ([]model.Token, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	var result []model.Token
+	for _, stored := range repo.tokens {
+		if stored.tenantID == tenantID && stored.token.UserGUID == userGUID {
+			result = append(result, stored.token)
+		}
+	}
+	if len(result) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return result, nil
+}
+
+func (repo *memTokens) DeleteByHash(tenantID string, hash string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	for i, stored := range repo.tokens {
+		if stored.tenantID == tenantID && stored.token.Hash == hash {
+			repo.tokens = append(repo.tokens[:i], repo.tokens[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (repo *memTokens) DeleteByUserGUID(tenantID string, userGUID string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	kept := repo.tokens[:0]
+	for _, stored := range repo.tokens {
+		if stored.tenantID != tenantID || stored.token.UserGUID != userGUID {
+			kept = append(kept, stored)
+		}
+	}
+	repo.tokens = kept
+	return nil
+}
+
+func (repo *memTokens) count(tenantID string, userGUID string) int {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	count := 0
+	for _, stored := range repo.tokens {
+		if stored.tenantID == tenantID && stored.token.UserGUID == userGUID {
+			count++
+		}
+	}
+	return count
+}
+
+type testLinkToken struct {
+	tenantID  string
+	linkToken model.LinkToken
+}
+
+type memLinkTokens struct {
+	repository.LinkTokenRepository
+	mutex sync.Mutex
+	links map[string]*testLinkToken
+}
+
+func (repo *memLinkTokens) Create(tenantID string, linkToken *model.LinkToken) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored := &testLinkToken{tenantID, *linkToken}
+	stored.linkToken.CreatedAt = time.Now()
+	repo.links[linkToken.Hash] = stored
+	return nil
+}
+
+func (repo *memLinkTokens) Consume(tenantID string, hash string, purpose string) (*model.LinkToken, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	stored, ok := repo.links[hash]
+	if !ok || stored.tenantID != tenantID {
+		return nil, sql.ErrNoRows
+	}
+	linkToken := &stored.linkToken
+	if linkToken.Purpose != purpose || linkToken.UsedAt != nil || !linkToken.ExpiresAt.After(time.Now()) {
+		return nil, sql.ErrNoRows
+	}
+	usedAt := time.Now()
+	linkToken.UsedAt = &usedAt
+	consumed := *linkToken
+	return &consumed, nil
+}
+
+type noTOTP struct{ repository.TOTPRepository }
+
+func (noTOTP) GetByUserGUID(string, string) (*model.TOTP, error) {
+	return nil, sql.ErrNoRows
+}
+
+type memCredentials struct {
+	repository.CredentialRepository
+	mutex  sync.Mutex
+	hashes map[string]string
+}
+
+func (repo *memCredentials) GetByUserGUID(tenantID string, userGUID string) (*model.Credential, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	hash, ok := repo.hashes[tenantID+"/"+userGUID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &model.Credential{UserGUID: userGUID, Hash: hash}, nil
+}
+
+func (repo *memCredentials) Set(tenantID string, userGUID string, hash string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.hashes[tenantID+"/"+userGUID] = hash
+	return nil
+}
+
+type memReplay struct {
+	mutex sync.Mutex
+	used  map[string]time.Time
+}
+
+func (repo *memReplay) Use(tenantID string, purpose string, jti string, expiresAt time.Time) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	key := tenantID + "/" + purpose + "/" + jti
+	if until, ok := repo.used[key]; ok && until.After(time.Now()) {
+		return repository.ErrAlreadyExists
+	}
+	repo.used[key] = expiresAt
+	return nil
+}
+
+func (repo *memReplay) DeleteExpired(before time.Time) error {
+	return nil
+}
+
+type noRoles struct{ repository.RoleRepository }
+
+func (noRoles) GetUserRoles(string, string) ([]model.Role, error) {
+	return nil, nil
+}
+
+type memOutbox struct {
+	repository.OutboxRepository
+	mutex    sync.Mutex
+	messages []model.OutboxMessage
+}
+
+func (repo *memOutbox) Create(message *model.OutboxMessage) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	repo.messages = append(repo.messages, *message)
+	return nil
+}
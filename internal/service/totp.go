@@ -0,0 +1,378 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/keys"
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/notify"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/TooLazyToCreate/auth-service/internal/totp"
+	"github.com/kataras/jwt"
+	"go.uber.org/zap"
+)
+
+/* mfa_token подписывается ключом тенанта, а секреты TOTP шифруются ключом из общего SECRET:
+ * это данные в базе, и они не должны становиться нечитаемыми при смене настроек тенанта */
+const (
+	mfaKeyPurpose          = "mfa-challenge"
+	totpKeyPurpose         = "totp-secret"
+	recoveryCodeKeyPurpose = "recovery-code"
+	recoveryCodeCount      = 10
+	/* 80 бит случайности: коды не перебрать по хэшам, даже если вместе с базой утечёт и SECRET */
+	recoveryCodeBytes = 10
+	/* Длина кода без дефисов у кодов старого формата (5 байт), их хэш - sha256 без ключа */
+	legacyRecoveryCodeLength = 8
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/* Второй фактор в amr: код из приложения (RFC 8176) или резервный код. Вход по резервному коду
+ * отличается от обычного, чтобы сервисы могли, например, попросить пользователя заново настроить 2FA. */
+const (
+	amrOTP          = "otp"
+	amrRecoveryCode = "rc"
+)
+
+type mfaRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type totpEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+/* Первый шаг двухфакторного входа: вместо токенов отдаём короткоживущий mfa_token,
+ * подписанный отдельным ключом, чтобы его нельзя было использовать как access токен. */
+func (service *AuthService) requireMFA(userGUID string, amr []string, scope *string, w http.ResponseWriter, req *http.Request) {
+	jti, err := newMFATokenID()
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to generate mfa token",
+			zap.Error(err), zap.String("user_guid", userGUID))
+		return
+	}
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"jti":  jti,
+		"guid": userGUID,
+		"amr":  amr,
+		"iat":  now,
+		"exp":  now + service.cfg.TOTP.ChallengeLifetime,
+	}
+	/* Запрошенные при входе scope дожидаются второго фактора в mfa_token */
+	if scope != nil {
+		claims["scope"] = *scope
+	}
+	mfaToken, err := jwt.Sign(jwt.HS512, keys.Derive(tenancy.FromContext(req.Context()).Secret, mfaKeyPurpose), claims)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to generate mfa token",
+			zap.Error(err), zap.String("user_guid", userGUID))
+		return
+	}
+	service.logger.Debug("Second factor is required", zap.String("user_guid", userGUID))
+	/* Поле error оставлено для клиентов, которые появились раньше problem+json */
+	problem.WriteWith(w, req, problem.MFARequired, map[string]interface{}{
+		"error":     problem.MFARequired.Code,
+		"mfa_token": string(mfaToken),
+		"methods":   []string{"otp", "recovery_code"},
+	})
+}
+
+/* Второй шаг двухфакторного входа: mfa_token и код из приложения (или резервный код) меняются на токены */
+func (service *AuthService) HandleMFA(w http.ResponseWriter, req *http.Request) {
+	body := mfaRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+
+	/* Проверяем подпись и срок действия mfa_token */
+	verifiedToken, err := jwt.Verify(jwt.HS512, keys.Derive(tenancy.FromContext(req.Context()).Secret, mfaKeyPurpose),
+		[]byte(body.MFAToken))
+	claims := map[string]interface{}{}
+	if err == nil {
+		err = verifiedToken.Claims(&claims)
+	}
+	userGUID, ok := claims["guid"].(string)
+	/* jti и exp нужны, чтобы запомнить использованный mfa_token до конца его жизни */
+	jti, hasJTI := claims["jti"].(string)
+	exp, hasExp := claimInt64(claims["exp"])
+	if err != nil || !ok || !hasJTI || !hasExp {
+		service.fail(w, req, problem.MFATokenInvalid, "MFA token is invalid",
+			zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+	/* Без лимита шестизначный код можно было бы перебрать за время жизни mfa_token */
+	if !service.allowUser(userGUID, w, req) || !service.checkLockout(userGUID, w, req) {
+		return
+	}
+
+	user, err := service.userRepo.GetByGUID(tenancy.FromContext(req.Context()).ID, userGUID)
+	if err != nil || user.Disabled {
+		service.fail(w, req, problem.UserUnavailable, "User not found or disabled", zap.Error(err),
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", userGUID))
+		return
+	}
+
+	factor, ok := service.checkSecondFactor(userGUID, body.Code, w, req)
+	if !ok {
+		return
+	}
+	/* mfa_token одноразовый: иначе за время его жизни по нему можно войти ещё раз со следующим кодом */
+	err = service.replayRepo.Use(tenancy.FromContext(req.Context()).ID, mfaKeyPurpose, jti, time.Unix(exp, 0))
+	if errors.Is(err, repository.ErrAlreadyExists) {
+		service.fail(w, req, problem.MFATokenInvalid, "MFA token has already been used",
+			zap.String("ip", req.RemoteAddr), zap.String("user_guid", userGUID))
+		return
+	} else if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	service.clearFailures(userGUID, req)
+
+	/* Создаём пару токенов, добавив второй фактор к способам входа */
+	amr := append(claimStrings(claims["amr"]), factor, "mfa")
+	if service.createTokens(userGUID, "", amr, claimScope(claims["scope"]), time.Now().Unix(), w, req) {
+		service.publishEvent(notify.EventTokenIssued, userGUID, req, map[string]string{"amr": strings.Join(amr, " ")})
+	}
+}
+
+func (service *AuthService) HandleTOTPEnroll(w http.ResponseWriter, req *http.Request) {
+	userGUID := userGUIDFromContext(req.Context())
+	tenantID := tenancy.FromContext(req.Context()).ID
+	user, err := service.userRepo.GetByGUID(tenantID, userGUID)
+	if err != nil {
+		service.fail(w, req, problem.UserUnavailable, "User not found",
+			zap.Error(err), zap.String("user_guid", userGUID))
+		return
+	}
+
+	/* Перезаписать уже подтверждённый секрет можно только через отключение 2FA с вводом кода */
+	factor, err := service.totpRepo.GetByUserGUID(tenantID, userGUID)
+	if err == nil && factor.Confirmed {
+		service.fail(w, req, problem.TOTPAlreadyEnabled, "TOTP is already enabled", zap.String("user_guid", userGUID))
+		return
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+
+	/* Генерируем секрет и сохраняем его в зашифрованном виде */
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to generate TOTP secret", zap.Error(err))
+		return
+	}
+	sealed, err := keys.Seal(keys.Derive(service.cfg.Secret, totpKeyPurpose), secret)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to encrypt TOTP secret", zap.Error(err))
+		return
+	}
+	if err = service.totpRepo.Save(tenantID, &model.TOTP{UserGUID: userGUID, Secret: sealed}); err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+
+	service.logger.Info("TOTP enrollment has been started", zap.String("user_guid", userGUID))
+	err = writeJson(w, http.StatusCreated, &totpEnrollResponse{
+		Secret: totp.EncodeSecret(secret),
+		URI:    totp.URI(secret, service.cfg.TOTP.Issuer, user.Email),
+	})
+	if err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Подтверждение первым кодом из приложения. Только после него 2FA начинает требоваться при входе,
+ * а пользователь получает резервные коды (показываются один раз). */
+func (service *AuthService) HandleTOTPConfirm(w http.ResponseWriter, req *http.Request) {
+	userGUID := userGUIDFromContext(req.Context())
+	body := totpCodeRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+
+	tenantID := tenancy.FromContext(req.Context()).ID
+	factor, err := service.totpRepo.GetByUserGUID(tenantID, userGUID)
+	if err != nil || factor.Confirmed {
+		service.fail(w, req, problem.TOTPEnrollmentMissing, "There is no pending TOTP enrollment",
+			zap.Error(err), zap.String("user_guid", userGUID))
+		return
+	}
+	secret, err := keys.Open(keys.Derive(service.cfg.Secret, totpKeyPurpose), factor.Secret)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to decrypt TOTP secret",
+			zap.Error(err), zap.String("user_guid", userGUID))
+		return
+	}
+	step, ok := totp.Validate(secret, body.Code, time.Now(), service.cfg.TOTP.Skew)
+	if !ok {
+		service.fail(w, req, problem.InvalidCode, "Wrong TOTP code",
+			zap.String("ip", req.RemoteAddr), zap.String("user_guid", userGUID))
+		return
+	}
+
+	codes, hashes, err := service.generateRecoveryCodes()
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to generate recovery codes", zap.Error(err))
+		return
+	}
+	if err = service.totpRepo.ReplaceRecoveryCodes(tenantID, userGUID, hashes); err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	if err = service.totpRepo.Confirm(tenantID, userGUID, step); err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+
+	service.logger.Info("TOTP has been enabled", zap.String("user_guid", userGUID))
+	if err = writeJson(w, http.StatusOK, &recoveryCodesResponse{codes}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Отключить 2FA можно только действующим кодом, одного access токена недостаточно */
+func (service *AuthService) HandleTOTPDisable(w http.ResponseWriter, req *http.Request) {
+	userGUID := userGUIDFromContext(req.Context())
+	body := totpCodeRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+	if _, ok := service.checkSecondFactor(userGUID, body.Code, w, req); !ok {
+		return
+	}
+	if err := service.totpRepo.Delete(tenancy.FromContext(req.Context()).ID, userGUID); err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	service.logger.Info("TOTP has been disabled", zap.String("user_guid", userGUID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* Принимает либо код из приложения, либо неиспользованный резервный код, и возвращает способ входа для amr:
+ * otp или rc. Если код не подошёл, ответ клиенту уже записан и возвращается false. */
+func (service *AuthService) checkSecondFactor(userGUID string, code string, w http.ResponseWriter, req *http.Request) (string, bool) {
+	tenantID := tenancy.FromContext(req.Context()).ID
+	factor, err := service.totpRepo.GetByUserGUID(tenantID, userGUID)
+	if err != nil || !factor.Confirmed {
+		service.fail(w, req, problem.TOTPNotEnabled, "TOTP is not enabled",
+			zap.Error(err), zap.String("user_guid", userGUID))
+		return "", false
+	}
+	method := amrOTP
+
+	if len(code) == totp.Digits {
+		secret, err := keys.Open(keys.Derive(service.cfg.Secret, totpKeyPurpose), factor.Secret)
+		if err != nil {
+			service.fail(w, req, problem.Internal, "Failed to decrypt TOTP secret",
+				zap.Error(err), zap.String("user_guid", userGUID))
+			return "", false
+		}
+		step, ok := totp.Validate(secret, code, time.Now(), service.cfg.TOTP.Skew)
+		/* UseStep не даст принять один и тот же код дважды */
+		if ok {
+			err = service.totpRepo.UseStep(tenantID, userGUID, step)
+		}
+		if !ok || errors.Is(err, sql.ErrNoRows) {
+			service.fail(w, req, problem.InvalidCode, "Wrong or reused TOTP code",
+				zap.String("ip", req.RemoteAddr), zap.String("user_guid", userGUID))
+			service.registerFailure(userGUID, "wrong TOTP code", req)
+			return "", false
+		}
+	} else {
+		method = amrRecoveryCode
+		err = service.totpRepo.UseRecoveryCode(tenantID, userGUID, service.recoveryCodeHash(code))
+		/* Коды, выданные до перехода на HMAC, действуют до замены */
+		if errors.Is(err, sql.ErrNoRows) && len(normalizeRecoveryCode(code)) == legacyRecoveryCodeLength {
+			err = service.totpRepo.UseRecoveryCode(tenantID, userGUID, legacyRecoveryCodeHash(code))
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			service.fail(w, req, problem.InvalidCode, "Wrong or used recovery code",
+				zap.String("ip", req.RemoteAddr), zap.String("user_guid", userGUID))
+			service.registerFailure(userGUID, "wrong recovery code", req)
+			return "", false
+		}
+		if err == nil {
+			service.logger.Info("Recovery code has been used", zap.String("user_guid", userGUID))
+		}
+	}
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return "", false
+	}
+	return method, true
+}
+
+/* Резервные коды вида "abcd-efgh-ijkl-mnop". В базу уходит только HMAC-SHA256 кода на ключе из общего SECRET:
+ * без ключа по хэшам из базы коды не проверить. */
+func (service *AuthService) generateRecoveryCodes() (codes []string, hashes []string, err error) {
+	codes = make([]string, 0, recoveryCodeCount)
+	hashes = make([]string, 0, recoveryCodeCount)
+	random := make([]byte, recoveryCodeBytes)
+	for i := 0; i < recoveryCodeCount; i++ {
+		if _, err = io.ReadFull(rand.Reader, random); err != nil {
+			return nil, nil, err
+		}
+		encoded := strings.ToLower(recoveryCodeEncoding.EncodeToString(random))
+		groups := make([]string, 0, len(encoded)/4)
+		for start := 0; start < len(encoded); start += 4 {
+			groups = append(groups, encoded[start:start+4])
+		}
+		code := strings.Join(groups, "-")
+		codes = append(codes, code)
+		hashes = append(hashes, service.recoveryCodeHash(code))
+	}
+	return codes, hashes, nil
+}
+
+func (service *AuthService) recoveryCodeHash(code string) string {
+	mac := hmac.New(sha256.New, keys.Derive(service.cfg.Secret, recoveryCodeKeyPurpose))
+	mac.Write([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func legacyRecoveryCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+/* Пользователь может ввести код без дефисов, с пробелами или заглавными буквами */
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func newMFATokenID() (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/keys"
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"github.com/TooLazyToCreate/auth-service/internal/token"
+	"github.com/TooLazyToCreate/auth-service/internal/totp"
+	"github.com/kataras/jwt"
+)
+
+/* 2FA пользователей одного тенанта tenantID */
+type memTOTP struct {
+	repository.TOTPRepository
+	mutex         sync.Mutex
+	tenantID      string
+	factors       map[string]*model.TOTP
+	recoveryCodes map[string][]string
+}
+
+func (repo *memTOTP) GetByUserGUID(tenantID string, userGUID string) (*model.TOTP, error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	factor, ok := repo.factors[userGUID]
+	if !ok || tenantID != repo.tenantID {
+		return nil, sql.ErrNoRows
+	}
+	stored := *factor
+	return &stored, nil
+}
+
+func (repo *memTOTP) UseStep(tenantID string, userGUID string, step int64) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	factor, ok := repo.factors[userGUID]
+	if !ok || tenantID != repo.tenantID || factor.LastStep >= step {
+		return sql.ErrNoRows
+	}
+	factor.LastStep = step
+	return nil
+}
+
+func (repo *memTOTP) UseRecoveryCode(tenantID string, userGUID string, hash string) error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+	index := slices.Index(repo.recoveryCodes[userGUID], hash)
+	if index < 0 || tenantID != repo.tenantID {
+		return sql.ErrNoRows
+	}
+	repo.recoveryCodes[userGUID] = slices.Delete(repo.recoveryCodes[userGUID], index, index+1)
+	return nil
+}
+
+/* Резервный код в формате generateRecoveryCodes */
+const testRecoveryCode = "abcd-efgh-ijkl-mnop"
+
+/* Пользователь с подтверждённой 2FA и одним резервным кодом */
+func (env *testEnv) enableTOTP(user *model.User, recoveryCode string) (secret []byte) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	sealed, err := keys.Seal(keys.Derive(env.cfg.Secret, totpKeyPurpose), secret)
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	env.service.totpRepo = &memTOTP{
+		tenantID:      env.users.users[user.GUID].tenantID,
+		factors:       map[string]*model.TOTP{user.GUID: {UserGUID: user.GUID, Secret: sealed, Confirmed: true}},
+		recoveryCodes: map[string][]string{user.GUID: {env.service.recoveryCodeHash(recoveryCode)}},
+	}
+	return secret
+}
+
+/* mfa_token, как его выдаёт requireMFA после входа по паролю */
+func (env *testEnv) mfaToken(tenantID string, userGUID string) string {
+	now := time.Now().Unix()
+	jti, err := newMFATokenID()
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	mfaToken, err := jwt.Sign(jwt.HS512, keys.Derive(env.tenant(tenantID).Secret, mfaKeyPurpose), map[string]interface{}{
+		"jti":  jti,
+		"guid": userGUID,
+		"amr":  []string{"pwd"},
+		"iat":  now,
+		"exp":  now + 300,
+	})
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	return string(mfaToken)
+}
+
+/* amr из access токена ответа с парой токенов */
+func issuedAMR(t *testing.T, env *testEnv, tenantID string, body []byte) []string {
+	var pair struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &pair); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := (&token.Pair{Access: []byte(pair.AccessToken)}).AccessTokenPayload(env.tenant(tenantID).Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claimStrings(claims["amr"])
+}
+
+func TestMFAReplayedCode(t *testing.T) {
+	env := newTestEnv(t)
+	env.router.Post("/user/login/mfa", env.service.HandleMFA)
+	user := env.addUser("acme", "ivan@acme.example")
+	secret := env.enableTOTP(user, testRecoveryCode)
+	code := totp.Code(secret, totp.Step(time.Now()))
+
+	response := env.do("acme", http.MethodPost, "/user/login/mfa",
+		`{"mfa_token":"`+env.mfaToken("acme", user.GUID)+`","code":"`+code+`"}`, "")
+	if response.Code != http.StatusCreated {
+		t.Fatalf("first use: %d %s", response.Code, response.Body.String())
+	}
+	if amr := issuedAMR(t, env, "acme", response.Body.Bytes()); !slices.Equal(amr, []string{"pwd", "otp", "mfa"}) {
+		t.Fatalf("amr = %v", amr)
+	}
+
+	/* Перехваченный код не должен подойти ко второму mfa_token */
+	response = env.do("acme", http.MethodPost, "/user/login/mfa",
+		`{"mfa_token":"`+env.mfaToken("acme", user.GUID)+`","code":"`+code+`"}`, "")
+	if response.Code != http.StatusUnauthorized || problemCode(t, response) != "invalid_code" {
+		t.Fatalf("replay: %d %s", response.Code, response.Body.String())
+	}
+}
+
+func TestMFARecoveryCode(t *testing.T) {
+	env := newTestEnv(t)
+	env.router.Post("/user/login/mfa", env.service.HandleMFA)
+	user := env.addUser("acme", "ivan@acme.example")
+	env.enableTOTP(user, testRecoveryCode)
+
+	response := env.do("acme", http.MethodPost, "/user/login/mfa",
+		`{"mfa_token":"`+env.mfaToken("acme", user.GUID)+`","code":"`+testRecoveryCode+`"}`, "")
+	if response.Code != http.StatusCreated {
+		t.Fatalf("first use: %d %s", response.Code, response.Body.String())
+	}
+	if amr := issuedAMR(t, env, "acme", response.Body.Bytes()); !slices.Equal(amr, []string{"pwd", "rc", "mfa"}) {
+		t.Fatalf("amr = %v", amr)
+	}
+
+	response = env.do("acme", http.MethodPost, "/user/login/mfa",
+		`{"mfa_token":"`+env.mfaToken("acme", user.GUID)+`","code":"`+testRecoveryCode+`"}`, "")
+	if response.Code != http.StatusUnauthorized || problemCode(t, response) != "invalid_code" {
+		t.Fatalf("second use: %d %s", response.Code, response.Body.String())
+	}
+}
+
+func TestMFATokenOfOtherTenant(t *testing.T) {
+	env := newTestEnv(t)
+	env.router.Post("/user/login/mfa", env.service.HandleMFA)
+	user := env.addUser("acme", "ivan@acme.example")
+	secret := env.enableTOTP(user, testRecoveryCode)
+	code := totp.Code(secret, totp.Step(time.Now()))
+
+	response := env.do("globex", http.MethodPost, "/user/login/mfa",
+		`{"mfa_token":"`+env.mfaToken("acme", user.GUID)+`","code":"`+code+`"}`, "")
+	if response.Code != http.StatusUnauthorized || problemCode(t, response) != "mfa_token_invalid" {
+		t.Fatalf("%d %s", response.Code, response.Body.String())
+	}
+}
+
+/* Одним mfa_token можно войти только один раз, даже со следующим верным кодом */
+func TestMFATokenSingleUse(t *testing.T) {
+	env := newTestEnv(t)
+	env.router.Post("/user/login/mfa", env.service.HandleMFA)
+	user := env.addUser("acme", "ivan@acme.example")
+	secret := env.enableTOTP(user, testRecoveryCode)
+	mfaToken := env.mfaToken("acme", user.GUID)
+
+	response := env.do("acme", http.MethodPost, "/user/login/mfa",
+		`{"mfa_token":"`+mfaToken+`","code":"`+totp.Code(secret, totp.Step(time.Now()))+`"}`, "")
+	if response.Code != http.StatusCreated {
+		t.Fatalf("first use: %d %s", response.Code, response.Body.String())
+	}
+	response = env.do("acme", http.MethodPost, "/user/login/mfa",
+		`{"mfa_token":"`+mfaToken+`","code":"`+testRecoveryCode+`"}`, "")
+	if response.Code != http.StatusUnauthorized || problemCode(t, response) != "mfa_token_invalid" {
+		t.Fatalf("second use: %d %s", response.Code, response.Body.String())
+	}
+	if env.tokens.count("acme", user.GUID) != 1 {
+		t.Fatal("second use must not issue tokens")
+	}
+}
+
+/* Коды старого формата (40 бит, sha256) действуют, пока пользователь не получит новые */
+func TestMFALegacyRecoveryCode(t *testing.T) {
+	env := newTestEnv(t)
+	env.router.Post("/user/login/mfa", env.service.HandleMFA)
+	user := env.addUser("acme", "ivan@acme.example")
+	env.enableTOTP(user, testRecoveryCode)
+	repo := env.service.totpRepo.(*memTOTP)
+	repo.recoveryCodes[user.GUID] = []string{legacyRecoveryCodeHash("abcd-efgh")}
+
+	response := env.do("acme", http.MethodPost, "/user/login/mfa",
+		`{"mfa_token":"`+env.mfaToken("acme", user.GUID)+`","code":"ABCD EFGH"}`, "")
+	if response.Code != http.StatusCreated {
+		t.Fatalf("legacy code: %d %s", response.Code, response.Body.String())
+	}
+	if len(repo.recoveryCodes[user.GUID]) != 0 {
+		t.Fatal("legacy code must be used up")
+	}
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	env := newTestEnv(t)
+	codes, hashes, err := env.service.generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("%d codes, %d hashes", len(codes), len(hashes))
+	}
+	seen := map[string]bool{}
+	for i, code := range codes {
+		/* 16 символов base32 - 80 бит */
+		if len(code) != 19 || len(normalizeRecoveryCode(code)) != 16 || strings.Count(code, "-") != 3 {
+			t.Errorf("code %q has wrong format", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q is repeated", code)
+		}
+		seen[code] = true
+		if hashes[i] != env.service.recoveryCodeHash(strings.ToUpper(code)) || hashes[i] == legacyRecoveryCodeHash(code) {
+			t.Errorf("hash of %q is not an HMAC of the normalized code", code)
+		}
+	}
+
+	/* Хэш зависит от SECRET: без него по базе коды не проверить */
+	other := newTestEnv(t)
+	other.cfg.Secret = []byte("another-secret-another-secret-32")
+	if other.service.recoveryCodeHash(codes[0]) == hashes[0] {
+		t.Error("hash must depend on the secret")
+	}
+}
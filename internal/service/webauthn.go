@@ -0,0 +1,334 @@
+package service
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/TooLazyToCreate/auth-service/internal/model"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+	"github.com/TooLazyToCreate/auth-service/internal/repository"
+	"github.com/TooLazyToCreate/auth-service/internal/tenancy"
+	"github.com/TooLazyToCreate/auth-service/internal/webauthn"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	webauthnRegisterPurpose = "register"
+	webauthnLoginPurpose    = "login"
+)
+
+type webauthnRegisterRequest struct {
+	webauthn.CredentialResponse
+	Name string `json:"name"`
+}
+
+type webauthnLoginRequest struct {
+	Email string `json:"email"`
+}
+
+type webauthnCreationResponse struct {
+	PublicKey *webauthn.CreationOptions `json:"publicKey"`
+}
+
+type webauthnRequestResponse struct {
+	PublicKey *webauthn.RequestOptions `json:"publicKey"`
+}
+
+type webauthnCredentialResponse struct {
+	ID         webauthn.Base64URL `json:"id"`
+	Name       string             `json:"name"`
+	CreatedAt  time.Time          `json:"created_at"`
+	LastUsedAt *time.Time         `json:"last_used_at"`
+}
+
+func (service *AuthService) relyingParty() *webauthn.RelyingParty {
+	return &webauthn.RelyingParty{
+		ID:                      service.cfg.WebAuthn.RPID,
+		Name:                    service.cfg.WebAuthn.RPName,
+		Origins:                 service.cfg.WebAuthn.Origins,
+		RequireUserVerification: service.cfg.WebAuthn.RequireUserVerification,
+		Timeout:                 time.Duration(service.cfg.WebAuthn.Timeout) * time.Second,
+	}
+}
+
+/* Начало регистрации: выдаём challenge и параметры для navigator.credentials.create() */
+func (service *AuthService) HandleWebAuthnRegisterBegin(w http.ResponseWriter, req *http.Request) {
+	userGUID := userGUIDFromContext(req.Context())
+	tenantID := tenancy.FromContext(req.Context()).ID
+	user, err := service.userRepo.GetByGUID(tenantID, userGUID)
+	if err != nil {
+		service.fail(w, req, problem.UserUnavailable, "User not found",
+			zap.Error(err), zap.String("user_guid", userGUID))
+		return
+	}
+
+	/* Уже зарегистрированные ключи передаём в excludeCredentials, чтобы не завести дубль */
+	credentials, err := service.webauthnRepo.ListCredentials(tenantID, userGUID)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	exclude := make([][]byte, 0, len(credentials))
+	for _, credential := range credentials {
+		exclude = append(exclude, credential.ID)
+	}
+
+	challenge, ok := service.startWebAuthnSession(webauthnRegisterPurpose, userGUID, w, req)
+	if !ok {
+		return
+	}
+	userID, _ := uuid.Parse(userGUID)
+	rp := service.relyingParty()
+	options := rp.CreationOptions(challenge, userID[:], user.Email, user.FirstName+" "+user.LastName, exclude)
+	if err = writeJson(w, http.StatusOK, &webauthnCreationResponse{options}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Завершение регистрации: проверяем ответ аутентификатора и сохраняем его публичный ключ */
+func (service *AuthService) HandleWebAuthnRegisterFinish(w http.ResponseWriter, req *http.Request) {
+	userGUID := userGUIDFromContext(req.Context())
+	body := webauthnRegisterRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+
+	challenge, session, ok := service.consumeWebAuthnSession(webauthnRegisterPurpose, body.Response.ClientDataJSON, w, req)
+	if !ok {
+		return
+	}
+	if session.UserGUID != userGUID {
+		service.fail(w, req, problem.WebAuthnChallengeInvalid, "WebAuthn session belongs to another user",
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", userGUID))
+		return
+	}
+
+	credential, err := service.relyingParty().VerifyRegistration(challenge,
+		body.Response.ClientDataJSON, body.Response.AttestationObject)
+	if err != nil {
+		service.fail(w, req, problem.WebAuthnRegistrationFailed, "WebAuthn registration failed", zap.Error(err),
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", userGUID))
+		return
+	}
+
+	stored := &model.WebAuthnCredential{
+		ID:        credential.ID,
+		UserGUID:  userGUID,
+		Name:      body.Name,
+		PublicKey: credential.PublicKey,
+		SignCount: credential.SignCount,
+		CreatedAt: time.Now(),
+	}
+	if err = service.webauthnRepo.CreateCredential(tenancy.FromContext(req.Context()).ID, stored); err != nil {
+		if errors.Is(err, repository.ErrAlreadyExists) {
+			service.fail(w, req, problem.WebAuthnCredentialExists, "WebAuthn credential is already registered",
+				zap.String("user_guid", userGUID))
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return
+	}
+
+	service.logger.Info("WebAuthn credential has been registered", zap.String("user_guid", userGUID))
+	err = writeJson(w, http.StatusCreated, &webauthnCredentialResponse{stored.ID, stored.Name, stored.CreatedAt, nil})
+	if err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Начало входа. Email необязателен: без него браузер предложит любой passkey для этого сайта.
+ * Для неизвестного email отвечаем так же, как для известного, только без allowCredentials. */
+func (service *AuthService) HandleWebAuthnLoginBegin(w http.ResponseWriter, req *http.Request) {
+	body := webauthnLoginRequest{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+
+	userGUID := ""
+	allow := make([][]byte, 0, 4)
+	if body.Email != "" {
+		user, err := service.userRepo.GetByEmail(tenancy.FromContext(req.Context()).ID, body.Email)
+		if err == nil {
+			credentials, err := service.webauthnRepo.ListCredentials(tenancy.FromContext(req.Context()).ID, user.GUID)
+			if err != nil {
+				service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+				return
+			}
+			for _, credential := range credentials {
+				allow = append(allow, credential.ID)
+			}
+			userGUID = user.GUID
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+			return
+		}
+	}
+
+	challenge, ok := service.startWebAuthnSession(webauthnLoginPurpose, userGUID, w, req)
+	if !ok {
+		return
+	}
+	options := service.relyingParty().RequestOptions(challenge, allow)
+	if err := writeJson(w, http.StatusOK, &webauthnRequestResponse{options}); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+/* Завершение входа: проверяем подпись аутентификатора и выдаём токены */
+func (service *AuthService) HandleWebAuthnLoginFinish(w http.ResponseWriter, req *http.Request) {
+	body := webauthn.CredentialResponse{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		service.fail(w, req, problem.MalformedJSON, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return
+	}
+
+	challenge, session, ok := service.consumeWebAuthnSession(webauthnLoginPurpose, body.Response.ClientDataJSON, w, req)
+	if !ok {
+		return
+	}
+
+	/* Ключ должен принадлежать тому пользователю, для которого начинали вход (если он был указан),
+	 * а userHandle от аутентификатора - совпадать с его GUID */
+	tenantID := tenancy.FromContext(req.Context()).ID
+	credential, err := service.webauthnRepo.GetCredential(tenantID, body.RawID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			service.fail(w, req, problem.WebAuthnCredentialUnknown, "WebAuthn credential not found",
+				zap.String("ip", req.RemoteAddr))
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return
+	}
+	userID, _ := uuid.Parse(credential.UserGUID)
+	if (session.UserGUID != "" && session.UserGUID != credential.UserGUID) ||
+		(len(body.Response.UserHandle) > 0 && string(body.Response.UserHandle) != string(userID[:])) {
+		service.fail(w, req, problem.WebAuthnCredentialUnknown, "WebAuthn credential belongs to another user",
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", credential.UserGUID))
+		return
+	}
+
+	signCount, userVerified, err := service.relyingParty().VerifyAssertion(challenge, credential.PublicKey,
+		credential.SignCount, body.Response.ClientDataJSON, body.Response.AuthenticatorData, body.Response.Signature)
+	if err != nil {
+		service.fail(w, req, problem.WebAuthnAssertionFailed, "WebAuthn assertion failed", zap.Error(err),
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", credential.UserGUID))
+		return
+	}
+	if err = service.webauthnRepo.UpdateSignCount(tenantID, credential.ID, signCount); err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+
+	user, err := service.userRepo.GetByGUID(tenantID, credential.UserGUID)
+	if err != nil || user.Disabled {
+		service.fail(w, req, problem.UserUnavailable, "User not found or disabled", zap.Error(err),
+			zap.String("ip", req.RemoteAddr),
+			zap.String("user_guid", credential.UserGUID))
+		return
+	}
+
+	/* Ключ с проверкой пользователя (PIN, биометрия) сам по себе двухфакторный,
+	 * поэтому TOTP в этом случае не запрашиваем */
+	amr := []string{"hwk"}
+	if userVerified {
+		amr = append(amr, "mfa")
+	}
+	service.issueTokens(user, amr, nil, w, req)
+}
+
+func (service *AuthService) HandleWebAuthnCredentialList(w http.ResponseWriter, req *http.Request) {
+	userGUID := userGUIDFromContext(req.Context())
+	credentials, err := service.webauthnRepo.ListCredentials(tenancy.FromContext(req.Context()).ID, userGUID)
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return
+	}
+	result := make([]webauthnCredentialResponse, 0, len(credentials))
+	for _, credential := range credentials {
+		result = append(result, webauthnCredentialResponse{credential.ID, credential.Name, credential.CreatedAt, credential.LastUsedAt})
+	}
+	if err = writeJson(w, http.StatusOK, result); err != nil {
+		service.logger.Error("JSON failure", zap.Error(err))
+	}
+}
+
+func (service *AuthService) HandleWebAuthnCredentialDelete(w http.ResponseWriter, req *http.Request) {
+	userGUID := userGUIDFromContext(req.Context())
+	id, err := base64.RawURLEncoding.DecodeString(chi.URLParam(req, "id"))
+	if err != nil {
+		service.fail(w, req, problem.MalformedRequest, "Bad request", zap.Error(err))
+		return
+	}
+	if err = service.webauthnRepo.DeleteCredential(tenancy.FromContext(req.Context()).ID, userGUID, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			problem.Write(w, req, problem.NotFound.With("Credential not found"))
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return
+	}
+	service.logger.Info("WebAuthn credential has been deleted", zap.String("user_guid", userGUID))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/* Challenge хранится в базе в виде sha256, чтобы его можно было использовать только один раз */
+func (service *AuthService) startWebAuthnSession(purpose string, userGUID string, w http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		service.fail(w, req, problem.Internal, "Failed to generate WebAuthn challenge", zap.Error(err))
+		return nil, false
+	}
+	err = service.webauthnRepo.CreateSession(tenancy.FromContext(req.Context()).ID, &model.WebAuthnSession{
+		ChallengeHash: challengeHash(challenge),
+		Purpose:       purpose,
+		UserGUID:      userGUID,
+		ExpiresAt:     time.Now().Add(time.Duration(service.cfg.WebAuthn.Timeout) * time.Second),
+	})
+	if err != nil {
+		service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		return nil, false
+	}
+	return challenge, true
+}
+
+func (service *AuthService) consumeWebAuthnSession(purpose string, clientDataJSON []byte,
+	w http.ResponseWriter, req *http.Request) ([]byte, *model.WebAuthnSession, bool) {
+	challenge, err := webauthn.ChallengeFromClientData(clientDataJSON)
+	if err != nil {
+		service.fail(w, req, problem.MalformedRequest, "Bad request", zap.Error(err), zap.String("ip", req.RemoteAddr))
+		return nil, nil, false
+	}
+	tenantID := tenancy.FromContext(req.Context()).ID
+	session, err := service.webauthnRepo.ConsumeSession(tenantID, challengeHash(challenge), purpose)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			service.fail(w, req, problem.WebAuthnChallengeInvalid, "WebAuthn challenge is unknown, expired or already used",
+				zap.String("ip", req.RemoteAddr))
+		} else {
+			service.fail(w, req, problem.Internal, "SQL error", zap.Error(err))
+		}
+		return nil, nil, false
+	}
+	return challenge, session, true
+}
+
+func challengeHash(challenge []byte) string {
+	sum := sha256.Sum256(challenge)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,191 @@
+package tenancy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/TooLazyToCreate/auth-service/config"
+	"github.com/TooLazyToCreate/auth-service/internal/keys"
+	"github.com/TooLazyToCreate/auth-service/internal/problem"
+)
+
+/* Откуда берётся тенант запроса */
+const (
+	/* По заголовку Host */
+	ResolveHost = "host"
+	/* По заголовку, по умолчанию X-Tenant-ID */
+	ResolveHeader = "header"
+	/* По первому сегменту пути: /acme/user/login попадает в /user/login тенанта acme */
+	ResolvePath = "path"
+)
+
+/* Тенант, в котором работает сервис, если тенанты не настроены */
+const DefaultID = "default"
+
+const defaultHeader = "X-Tenant-ID"
+
+/* id попадает в путь запроса и в claim tid */
+var idPattern = regexp.MustCompile(`^[a-z0-9-]{1,64}$`)
+
+/* Тенант - отдельный продукт на общем развёртывании. Пользователи, refresh токены и клиенты OAuth
+ * у каждого тенанта свои, токены подписываются ключом тенанта и содержат его id в claim tid. */
+type Tenant struct {
+	ID string
+	/* iss в токенах, пустой - claim не добавляется */
+	Issuer string
+	Secret []byte
+	/* Время жизни токенов в секундах */
+	AccessTokenLifetime  int64
+	RefreshTokenLifetime int64
+	/* Отправитель писем */
+	MailFrom string
+}
+
+type Registry struct {
+	resolve  string
+	header   string
+	byID     map[string]*Tenant
+	byHost   map[string]*Tenant
+	fallback *Tenant
+	all      []*Tenant
+}
+
+type tenantKey struct{}
+
+/* Собирает тенантов из настроек. Пустые lifetime и отправитель берутся из общих настроек, ключ без secret_env
+ * выводится из SECRET. Если тенантов нет, все запросы попадают в тенант default с общими SECRET и настройками,
+ * так что токены, выданные до включения тенантов, продолжают работать. */
+func NewRegistry(cfg *config.Config) (*Registry, error) {
+	registry := &Registry{
+		resolve: cfg.Tenancy.Resolve,
+		header:  cfg.Tenancy.Header,
+		byID:    make(map[string]*Tenant),
+		byHost:  make(map[string]*Tenant),
+	}
+	if registry.header == "" {
+		registry.header = defaultHeader
+	}
+	if len(cfg.Tenancy.Tenants) == 0 {
+		registry.fallback = &Tenant{
+			ID:                   DefaultID,
+			Issuer:               cfg.Issuer,
+			Secret:               cfg.Secret,
+			AccessTokenLifetime:  cfg.Lifetime.AccessToken,
+			RefreshTokenLifetime: cfg.Lifetime.RefreshToken,
+			MailFrom:             cfg.Smtp.Email,
+		}
+		registry.resolve = ""
+		registry.byID[DefaultID] = registry.fallback
+		registry.all = append(registry.all, registry.fallback)
+		return registry, nil
+	}
+	switch registry.resolve {
+	case ResolveHost, ResolveHeader, ResolvePath:
+	default:
+		return nil, errors.New("unknown tenant resolve mode: " + registry.resolve)
+	}
+
+	for _, settings := range cfg.Tenancy.Tenants {
+		if !idPattern.MatchString(settings.ID) {
+			return nil, errors.New("tenant id must be 1-64 lowercase letters, digits or dashes: " + settings.ID)
+		}
+		if _, ok := registry.byID[settings.ID]; ok {
+			return nil, errors.New("duplicate tenant id: " + settings.ID)
+		}
+		tenant := &Tenant{
+			ID:                   settings.ID,
+			Issuer:               settings.Issuer,
+			Secret:               settings.Secret,
+			AccessTokenLifetime:  settings.Lifetime.AccessToken,
+			RefreshTokenLifetime: settings.Lifetime.RefreshToken,
+			MailFrom:             settings.MailFrom,
+		}
+		if settings.SecretEnv == "" {
+			tenant.Secret = keys.Derive(cfg.Secret, "tenant:"+settings.ID)
+		} else if len(tenant.Secret) == 0 {
+			return nil, errors.New("environment variable " + settings.SecretEnv + " of tenant " + settings.ID + " is empty")
+		}
+		if tenant.AccessTokenLifetime == 0 {
+			tenant.AccessTokenLifetime = cfg.Lifetime.AccessToken
+		}
+		if tenant.RefreshTokenLifetime == 0 {
+			tenant.RefreshTokenLifetime = cfg.Lifetime.RefreshToken
+		}
+		if tenant.MailFrom == "" {
+			tenant.MailFrom = cfg.Smtp.Email
+		}
+		for _, host := range settings.Hosts {
+			host = strings.ToLower(host)
+			if _, ok := registry.byHost[host]; ok {
+				return nil, errors.New("host " + host + " belongs to several tenants")
+			}
+			registry.byHost[host] = tenant
+		}
+		registry.byID[tenant.ID] = tenant
+		registry.all = append(registry.all, tenant)
+	}
+
+	if cfg.Tenancy.Default != "" {
+		fallback, ok := registry.byID[cfg.Tenancy.Default]
+		if !ok {
+			return nil, errors.New("unknown default tenant: " + cfg.Tenancy.Default)
+		}
+		registry.fallback = fallback
+	}
+	return registry, nil
+}
+
+/* Все тенанты, например для фоновой очистки */
+func (registry *Registry) All() []*Tenant {
+	return registry.all
+}
+
+/* Middleware, который определяет тенант запроса и кладёт его в контекст.
+ * Если тенант не определился и тенанта по умолчанию нет, отвечаем 404. */
+func (registry *Registry) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		tenant, req := registry.resolveRequest(req)
+		if tenant == nil {
+			problem.Write(w, req, problem.TenantNotFound)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), tenantKey{}, tenant)))
+	})
+}
+
+/* Возвращает тенант и запрос, из пути которого в режиме path убран сегмент тенанта */
+func (registry *Registry) resolveRequest(req *http.Request) (*Tenant, *http.Request) {
+	var tenant *Tenant
+	switch registry.resolve {
+	case ResolveHost:
+		host := req.Host
+		if withoutPort, _, err := net.SplitHostPort(host); err == nil {
+			host = withoutPort
+		}
+		tenant = registry.byHost[strings.ToLower(host)]
+	case ResolveHeader:
+		tenant = registry.byID[req.Header.Get(registry.header)]
+	case ResolvePath:
+		id, rest, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+		if tenant = registry.byID[id]; tenant != nil {
+			/* Маршрутизатор смотрит на путь уже после middleware, поэтому дальше запрос идёт без сегмента тенанта */
+			req = req.Clone(req.Context())
+			req.URL.Path = "/" + rest
+			req.URL.RawPath = ""
+		}
+	}
+	if tenant == nil {
+		tenant = registry.fallback
+	}
+	return tenant, req
+}
+
+/* Тенант, определённый Middleware */
+func FromContext(ctx context.Context) *Tenant {
+	tenant, _ := ctx.Value(tenantKey{}).(*Tenant)
+	return tenant
+}
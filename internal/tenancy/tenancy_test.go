@@ -0,0 +1,202 @@
+package tenancy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/TooLazyToCreate/auth-service/config"
+	"github.com/go-chi/chi/v5"
+)
+
+/* Два тенанта: acme с хостами и globex; defaultID - тенант для неопознанных запросов */
+func testConfig(resolve string, defaultID string) *config.Config {
+	cfg := &config.Config{Secret: []byte("0123456789abcdef0123456789abcdef")}
+	cfg.Tenancy.Resolve = resolve
+	cfg.Tenancy.Default = defaultID
+	cfg.Tenancy.Tenants = []config.Tenant{
+		{ID: "acme", Hosts: []string{"acme.example", "Login.Acme.Example"}},
+		{ID: "globex", Hosts: []string{"globex.example"}},
+	}
+	return cfg
+}
+
+func TestResolveRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		resolve   string
+		defaultID string
+		host      string
+		header    string
+		path      string
+		tenantID  string
+		rewritten string
+	}{
+		{"host", ResolveHost, "", "acme.example", "", "/user/login", "acme", "/user/login"},
+		{"host with port", ResolveHost, "", "globex.example:8443", "", "/user/login", "globex", "/user/login"},
+		{"host case", ResolveHost, "", "login.acme.example", "", "/user/login", "acme", "/user/login"},
+		/* В режиме host заголовок ничего не значит */
+		{"host ignores header", ResolveHost, "", "unknown.example", "acme", "/user/login", "", "/user/login"},
+		{"unknown host", ResolveHost, "", "unknown.example", "", "/user/login", "", "/user/login"},
+		{"unknown host with default", ResolveHost, "globex", "unknown.example", "", "/user/login", "globex", "/user/login"},
+		{"header", ResolveHeader, "", "acme.example", "globex", "/user/login", "globex", "/user/login"},
+		{"missing header", ResolveHeader, "", "acme.example", "", "/user/login", "", "/user/login"},
+		{"unknown header", ResolveHeader, "acme", "acme.example", "initech", "/user/login", "acme", "/user/login"},
+		{"path", ResolvePath, "", "auth.example", "", "/acme/user/login", "acme", "/user/login"},
+		{"path root", ResolvePath, "", "auth.example", "", "/globex", "globex", "/"},
+		/* Путь неопознанного тенанта не трогается: под default он ведёт на свой маршрут */
+		{"unknown path", ResolvePath, "", "auth.example", "", "/initech/user/login", "", "/initech/user/login"},
+		{"path with default", ResolvePath, "acme", "auth.example", "", "/user/login", "acme", "/user/login"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry, err := NewRegistry(testConfig(test.resolve, test.defaultID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodPost, test.path, nil)
+			req.Host = test.host
+			if test.header != "" {
+				req.Header.Set(defaultHeader, test.header)
+			}
+			tenant, resolved := registry.resolveRequest(req)
+			tenantID := ""
+			if tenant != nil {
+				tenantID = tenant.ID
+			}
+			if tenantID != test.tenantID || resolved.URL.Path != test.rewritten {
+				t.Fatalf("tenant %q, path %q; want %q, %q", tenantID, resolved.URL.Path, test.tenantID, test.rewritten)
+			}
+			if req.URL.Path != test.path {
+				t.Fatalf("original request was changed: %q", req.URL.Path)
+			}
+		})
+	}
+}
+
+/* Сегмент тенанта убирается до маршрутизации, так что маршруты объявляются без него */
+func TestMiddlewareBeforeRouter(t *testing.T) {
+	registry, err := NewRegistry(testConfig(ResolvePath, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := chi.NewRouter()
+	router.Use(registry.Middleware)
+	router.Post("/user/login", func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, FromContext(req.Context()).ID)
+	})
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/acme/user/login", http.StatusOK, "acme"},
+		{"/globex/user/login", http.StatusOK, "globex"},
+		{"/user/login", http.StatusNotFound, ""},
+		{"/initech/user/login", http.StatusNotFound, ""},
+		{"/acme/user/logout", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, test.path, nil))
+		if recorder.Code != test.status || (test.body != "" && recorder.Body.String() != test.body) {
+			t.Errorf("%s: %d %s", test.path, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+/* Без тенанта и тенанта по умолчанию - 404 tenant_not_found, обработчик не вызывается */
+func TestMiddlewareUnknownTenant(t *testing.T) {
+	for _, defaultID := range []string{"", "acme"} {
+		registry, err := NewRegistry(testConfig(ResolveHeader, defaultID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reached *Tenant
+		handler := registry.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			reached = FromContext(req.Context())
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(defaultHeader, "initech")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if defaultID == "" {
+			if recorder.Code != http.StatusNotFound || !bytes.Contains(recorder.Body.Bytes(), []byte("tenant_not_found")) ||
+				reached != nil {
+				t.Errorf("without default: %d %s", recorder.Code, recorder.Body.String())
+			}
+		} else if reached == nil || reached.ID != defaultID {
+			t.Errorf("with default: %d, tenant %v", recorder.Code, reached)
+		}
+	}
+}
+
+/* Ключи тенантов без secret_env выводятся из SECRET и у каждого свои: токен одного тенанта не подписан ключом другого */
+func TestTenantSecrets(t *testing.T) {
+	cfg := testConfig(ResolveHeader, "")
+	cfg.Tenancy.Tenants = append(cfg.Tenancy.Tenants,
+		config.Tenant{ID: "initech", SecretEnv: "INITECH_SECRET", Secret: []byte("initech-secret")})
+	registry, err := NewRegistry(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, globex, initech := registry.byID["acme"].Secret, registry.byID["globex"].Secret, registry.byID["initech"].Secret
+	if len(acme) == 0 || bytes.Equal(acme, globex) || bytes.Equal(acme, cfg.Secret) || bytes.Equal(globex, cfg.Secret) {
+		t.Fatalf("derived secrets must differ: acme %x, globex %x", acme, globex)
+	}
+	if string(initech) != "initech-secret" {
+		t.Fatalf("secret from environment = %q", initech)
+	}
+
+	/* Тот же SECRET - те же ключи после перезапуска */
+	again, err := NewRegistry(testConfig(ResolveHeader, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.byID["acme"].Secret, acme) {
+		t.Fatal("derived secret must be stable")
+	}
+
+	cfg.Tenancy.Tenants[2].Secret = nil
+	if _, err = NewRegistry(cfg); err == nil {
+		t.Fatal("empty secret_env variable must be rejected")
+	}
+}
+
+/* Без тенантов всё работает в тенанте default с общим SECRET, как до их появления */
+func TestRegistryWithoutTenants(t *testing.T) {
+	cfg := &config.Config{Secret: []byte("0123456789abcdef0123456789abcdef")}
+	cfg.Tenancy.Resolve = ResolvePath
+	registry, err := NewRegistry(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant, req := registry.resolveRequest(httptest.NewRequest(http.MethodGet, "/acme/user/login", nil))
+	if tenant.ID != DefaultID || !bytes.Equal(tenant.Secret, cfg.Secret) || req.URL.Path != "/acme/user/login" {
+		t.Fatalf("tenant %s, path %s", tenant.ID, req.URL.Path)
+	}
+}
+
+func TestRegistryInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *config.Config)
+	}{
+		{"unknown resolve", func(cfg *config.Config) { cfg.Tenancy.Resolve = "cookie" }},
+		{"bad id", func(cfg *config.Config) { cfg.Tenancy.Tenants[0].ID = "Acme" }},
+		{"duplicate id", func(cfg *config.Config) { cfg.Tenancy.Tenants[1].ID = "acme" }},
+		{"shared host", func(cfg *config.Config) { cfg.Tenancy.Tenants[1].Hosts = []string{"ACME.example"} }},
+		{"unknown default", func(cfg *config.Config) { cfg.Tenancy.Default = "initech" }},
+	}
+	for _, test := range tests {
+		cfg := testConfig(ResolveHost, "")
+		test.change(cfg)
+		if _, err := NewRegistry(cfg); err == nil {
+			t.Errorf("%s: want error", test.name)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/kataras/jwt"
+)
+
+/* Подписанный клиентом JWT не должен жить дольше этого, иначе перехваченный можно долго предъявлять повторно */
+const MaxAssertionLifetime = 5 * time.Minute
+
+/* Алгоритмы, которыми клиент может подписать assertion, в зависимости от типа его ключа.
+ * HS* и none не принимаются: ключ клиента всегда асимметричный. */
+var assertionAlgs = map[string]jwt.Alg{
+	"RS256": jwt.RS256, "RS384": jwt.RS384, "RS512": jwt.RS512,
+	"PS256": jwt.PS256, "PS384": jwt.PS384, "PS512": jwt.PS512,
+	"ES256": jwt.ES256, "ES384": jwt.ES384, "ES512": jwt.ES512,
+	"EdDSA": jwt.EdDSA,
+}
+
+/* Проверяет client_assertion из private_key_jwt (RFC 7523, 3): подпись открытым ключом клиента из PEM (PKIX),
+ * iss и sub равны client_id, aud содержит адрес токен-эндпоинта, exp есть и не дальше MaxAssertionLifetime, jti есть.
+ * Одноразовость jti проверяет вызывающий по возвращённым claims: для этого нужна база. */
+func VerifyClientAssertion(assertion []byte, publicKeyPEM []byte, clientID, audience string) (*jwt.Claims, error) {
+	key, err := ParsePublicKey(publicKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	verifiedToken, err := jwt.VerifyWithHeaderValidator(nil, key, assertion,
+		func(_ string, headerDecoded []byte) (jwt.Alg, jwt.PublicKey, jwt.InjectFunc, error) {
+			var header struct {
+				Alg string `json:"alg"`
+			}
+			if err := json.Unmarshal(headerDecoded, &header); err != nil {
+				return nil, nil, nil, err
+			}
+			alg, ok := assertionAlgs[header.Alg]
+			if !ok || !algMatchesKey(header.Alg, key) {
+				return nil, nil, nil, jwt.ErrTokenAlg
+			}
+			return alg, key, nil, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	claims := verifiedToken.StandardClaims
+	switch {
+	case claims.Issuer != clientID || claims.Subject != clientID:
+		return nil, errors.New("iss and sub must be the client_id")
+	case !slices.Contains(claims.Audience, audience):
+		return nil, errors.New("aud does not contain the token endpoint")
+	case claims.Expiry == 0:
+		return nil, errors.New("exp is required")
+	case time.Until(time.Unix(claims.Expiry, 0)) > MaxAssertionLifetime:
+		return nil, errors.New("exp is too far in the future")
+	case claims.ID == "":
+		return nil, errors.New("jti is required")
+	}
+	return &claims, nil
+}
+
+/* iss из ещё не проверенного assertion: по нему находим клиента и его ключ, если client_id не передан */
+func AssertionIssuer(assertion []byte) string {
+	unverified, err := jwt.Decode(assertion)
+	if err != nil {
+		return ""
+	}
+	var claims jwt.Claims
+	if json.Unmarshal(unverified.Payload, &claims) != nil {
+		return ""
+	}
+	return claims.Issuer
+}
+
+/* Открытый ключ клиента в PEM (PKIX): RSA, EC или Ed25519 */
+func ParsePublicKey(publicKeyPEM []byte) (interface{}, error) {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil {
+		return nil, errors.New("public key is not PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, errors.New("public key type is not supported")
+}
+
+func algMatchesKey(alg string, key interface{}) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return alg[0] == 'R' || alg[0] == 'P'
+	case *ecdsa.PublicKey:
+		return alg[0] == 'E' && alg != "EdDSA"
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
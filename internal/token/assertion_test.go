@@ -0,0 +1,183 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/kataras/jwt"
+)
+
+const (
+	assertionClientID = "billing"
+	assertionAudience = "https://auth.example.com/oauth/token"
+)
+
+type assertionKey struct {
+	private crypto.Signer
+	pem     []byte
+}
+
+func newAssertionKey(t *testing.T, private crypto.Signer) assertionKey {
+	der, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assertionKey{private, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})}
+}
+
+func assertionKeys(t *testing.T) (rsaKey, ecKey, edKey assertionKey) {
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newAssertionKey(t, rsaPrivate), newAssertionKey(t, ecPrivate), newAssertionKey(t, edPrivate)
+}
+
+/* Claims правильного assertion, которые тест портит по одному */
+func assertionClaims(mutate func(claims map[string]interface{})) map[string]interface{} {
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"iss": assertionClientID,
+		"sub": assertionClientID,
+		"aud": assertionAudience,
+		"iat": now,
+		"exp": now + 60,
+		"jti": "a1",
+	}
+	if mutate != nil {
+		mutate(claims)
+	}
+	return claims
+}
+
+func signAssertion(t *testing.T, alg jwt.Alg, key interface{}, claims map[string]interface{}) []byte {
+	assertion, err := jwt.Sign(alg, key, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assertion
+}
+
+/* Токен с произвольным заголовком и без подписи */
+func unsignedAssertion(t *testing.T, header map[string]interface{}, claims map[string]interface{}) []byte {
+	encode := func(value interface{}) string {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	return []byte(encode(header) + "." + encode(claims) + ".")
+}
+
+func TestVerifyClientAssertion(t *testing.T) {
+	rsaKey, ecKey, edKey := assertionKeys(t)
+	tests := []struct {
+		name string
+		alg  jwt.Alg
+		key  assertionKey
+	}{
+		{"RS256", jwt.RS256, rsaKey},
+		{"RS512", jwt.RS512, rsaKey},
+		{"PS256", jwt.PS256, rsaKey},
+		{"ES256", jwt.ES256, ecKey},
+		{"EdDSA", jwt.EdDSA, edKey},
+	}
+	for _, test := range tests {
+		assertion := signAssertion(t, test.alg, test.key.private, assertionClaims(nil))
+		claims, err := VerifyClientAssertion(assertion, test.key.pem, assertionClientID, assertionAudience)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if claims.ID != "a1" || claims.Expiry == 0 {
+			t.Errorf("%s: jti %q, exp %d", test.name, claims.ID, claims.Expiry)
+		}
+		if issuer := AssertionIssuer(assertion); issuer != assertionClientID {
+			t.Errorf("%s: AssertionIssuer = %q", test.name, issuer)
+		}
+	}
+
+	/* aud может быть и массивом */
+	assertion := signAssertion(t, jwt.ES256, ecKey.private, assertionClaims(func(claims map[string]interface{}) {
+		claims["aud"] = []string{"https://other.example.com", assertionAudience}
+	}))
+	if _, err := VerifyClientAssertion(assertion, ecKey.pem, assertionClientID, assertionAudience); err != nil {
+		t.Errorf("aud array: %v", err)
+	}
+}
+
+func TestVerifyClientAssertionRejected(t *testing.T) {
+	rsaKey, ecKey, edKey := assertionKeys(t)
+	otherRSA, _, _ := assertionKeys(t)
+	now := time.Now().Unix()
+	tests := []struct {
+		name      string
+		assertion []byte
+		key       []byte
+	}{
+		/* Алгоритм и тип ключа */
+		{"alg none", unsignedAssertion(t, map[string]interface{}{"alg": "none", "typ": "JWT"}, assertionClaims(nil)), rsaKey.pem},
+		/* HS256 с открытым ключом в качестве секрета - классическая подмена алгоритма */
+		{"HS256 with public key as secret", signAssertion(t, jwt.HS256, rsaKey.pem, assertionClaims(nil)), rsaKey.pem},
+		{"ES256 with RSA key", signAssertion(t, jwt.ES256, ecKey.private, assertionClaims(nil)), rsaKey.pem},
+		{"RS256 with EC key", signAssertion(t, jwt.RS256, rsaKey.private, assertionClaims(nil)), ecKey.pem},
+		{"EdDSA with EC key", signAssertion(t, jwt.EdDSA, edKey.private, assertionClaims(nil)), ecKey.pem},
+		{"another RSA key", signAssertion(t, jwt.RS256, rsaKey.private, assertionClaims(nil)), otherRSA.pem},
+		{"unknown alg", unsignedAssertion(t, map[string]interface{}{"alg": "RS1"}, assertionClaims(nil)), rsaKey.pem},
+
+		/* Claims */
+		{"wrong aud", signAssertion(t, jwt.ES256, ecKey.private, assertionClaims(func(claims map[string]interface{}) {
+			claims["aud"] = "https://auth.example.com/oauth/introspect"
+		})), ecKey.pem},
+		{"missing aud", signAssertion(t, jwt.ES256, ecKey.private, assertionClaims(func(claims map[string]interface{}) {
+			delete(claims, "aud")
+		})), ecKey.pem},
+		{"wrong iss", signAssertion(t, jwt.ES256, ecKey.private, assertionClaims(func(claims map[string]interface{}) {
+			claims["iss"] = "payments"
+		})), ecKey.pem},
+		{"wrong sub", signAssertion(t, jwt.ES256, ecKey.private, assertionClaims(func(claims map[string]interface{}) {
+			claims["sub"] = "payments"
+		})), ecKey.pem},
+		{"missing exp", signAssertion(t, jwt.ES256, ecKey.private, assertionClaims(func(claims map[string]interface{}) {
+			delete(claims, "exp")
+		})), ecKey.pem},
+		{"exp too far ahead", signAssertion(t, jwt.ES256, ecKey.private, assertionClaims(func(claims map[string]interface{}) {
+			claims["exp"] = now + int64((MaxAssertionLifetime + time.Minute).Seconds())
+		})), ecKey.pem},
+		{"missing jti", signAssertion(t, jwt.ES256, ecKey.private, assertionClaims(func(claims map[string]interface{}) {
+			delete(claims, "jti")
+		})), ecKey.pem},
+		{"expired", signAssertion(t, jwt.ES256, ecKey.private, assertionClaims(func(claims map[string]interface{}) {
+			claims["iat"] = now - 600
+			claims["exp"] = now - 300
+		})), ecKey.pem},
+
+		/* Ключ клиента */
+		{"public key is not PEM", signAssertion(t, jwt.ES256, ecKey.private, assertionClaims(nil)), []byte("not a key")},
+		{"malformed public key", signAssertion(t, jwt.ES256, ecKey.private, assertionClaims(nil)),
+			pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("garbage")})},
+		{"malformed assertion", []byte("not.a.jwt"), ecKey.pem},
+	}
+	for _, test := range tests {
+		if _, err := VerifyClientAssertion(test.assertion, test.key, assertionClientID, assertionAudience); err == nil {
+			t.Errorf("%s: assertion must be rejected", test.name)
+		}
+	}
+}
@@ -16,22 +16,16 @@ import (
 type Pair struct {
 	Access  []byte
 	Refresh []byte
+	/* id_token OpenID Connect, выдаётся вместе с парой только в OAuth потоках со scope openid */
+	ID []byte
 }
 
 func NewPair(secret []byte, accessPayload, refreshPayload map[string]interface{}) (*Pair, error) {
-	uniqueID, err := randomBytes(12)
-	if err != nil {
-		return nil, err
-	}
-	finalPayload := map[string]interface{}{
-		"jti": uniqueID,
-	}
-	maps.Copy(finalPayload, accessPayload)
-	tokenPair := &Pair{}
-	tokenPair.Access, err = generateAccessToken(secret, finalPayload)
+	access, err := NewAccessToken(secret, accessPayload)
 	if err != nil {
 		return nil, err
 	}
+	tokenPair := &Pair{Access: access}
 	if len(tokenPair.Access) < 12 {
 		return nil, errors.New("token is too short")
 	} else {
@@ -40,6 +34,19 @@ func NewPair(secret []byte, accessPayload, refreshPayload map[string]interface{}
 	return tokenPair, err
 }
 
+/* Access токен без refresh токена (например, для client_credentials), jti добавляется так же, как в NewPair */
+func NewAccessToken(secret []byte, payload map[string]interface{}) ([]byte, error) {
+	uniqueID, err := randomBytes(12)
+	if err != nil {
+		return nil, err
+	}
+	finalPayload := map[string]interface{}{
+		"jti": uniqueID,
+	}
+	maps.Copy(finalPayload, payload)
+	return generateAccessToken(secret, finalPayload)
+}
+
 func generateAccessToken(secret []byte, payload map[string]interface{}) (accessToken []byte, err error) {
 	accessToken, err = jwt.Sign(jwt.HS512, secret, payload)
 	return
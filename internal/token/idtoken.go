@@ -0,0 +1,111 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+
+	"github.com/kataras/jwt"
+)
+
+/* Подписывает id_token (OpenID Connect Core 1.0, 2). id_token проверяют сами приложения, у которых нет общего
+ * с сервисом секрета, поэтому ключ асимметричный: RSA (RS256) или EC P-256 (ES256). Открытая часть ключа
+ * публикуется в JWKS, kid - его отпечаток по RFC 7638, так что при замене ключа меняется и kid. */
+type IDTokenSigner struct {
+	alg jwt.Alg
+	key interface{}
+	/* Открытый ключ в формате JWK */
+	jwk map[string]string
+}
+
+/* Загружает закрытый ключ из PEM файла (PKCS#1, SEC 1 или PKCS#8) */
+func LoadIDTokenSigner(keyFile string) (*IDTokenSigner, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("ID token key file does not contain a PEM block")
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewIDTokenSigner(key)
+}
+
+func NewIDTokenSigner(key interface{}) (*IDTokenSigner, error) {
+	switch privateKey := key.(type) {
+	case *rsa.PrivateKey:
+		return &IDTokenSigner{jwt.RS256, privateKey, map[string]string{
+			"kty": "RSA",
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(privateKey.E)).Bytes()),
+			"n":   base64.RawURLEncoding.EncodeToString(privateKey.N.Bytes()),
+		}}, nil
+	case *ecdsa.PrivateKey:
+		if privateKey.Curve != elliptic.P256() {
+			return nil, errors.New("ID token EC key must use the P-256 curve")
+		}
+		/* Координаты дополняются нулями до размера поля кривой (RFC 7518, 6.2.1.2) */
+		x, y := make([]byte, 32), make([]byte, 32)
+		privateKey.X.FillBytes(x)
+		privateKey.Y.FillBytes(y)
+		return &IDTokenSigner{jwt.ES256, privateKey, map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(x),
+			"y":   base64.RawURLEncoding.EncodeToString(y),
+		}}, nil
+	}
+	return nil, errors.New("ID token key must be an RSA or EC P-256 private key")
+}
+
+func (signer *IDTokenSigner) Alg() string {
+	return signer.alg.Name()
+}
+
+/* Отпечаток JWK (RFC 7638): sha256 от обязательных полей ключа в лексикографическом порядке.
+ * encoding/json сортирует ключи map, так что Marshal даёт ровно каноническую форму. */
+func (signer *IDTokenSigner) KeyID() string {
+	canonical, _ := json.Marshal(signer.jwk)
+	sum := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (signer *IDTokenSigner) Sign(claims map[string]interface{}) ([]byte, error) {
+	header := map[string]string{"alg": signer.Alg(), "typ": "JWT", "kid": signer.KeyID()}
+	return jwt.SignWithHeader(signer.alg, signer.key, claims, header)
+}
+
+/* JWK Set (RFC 7517, 5) с открытым ключом, которым проверяются id_token */
+func (signer *IDTokenSigner) JWKS() map[string]interface{} {
+	key := map[string]string{"use": "sig", "alg": signer.Alg(), "kid": signer.KeyID()}
+	for name, value := range signer.jwk {
+		key[name] = value
+	}
+	return map[string]interface{}{"keys": []map[string]string{key}}
+}
+
+/* at_hash (OpenID Connect Core 1.0, 3.1.3.6): левая половина хэша access токена в base64url.
+ * Оба поддерживаемых алгоритма используют SHA-256. */
+func AccessTokenHash(accessToken []byte) string {
+	sum := sha256.Sum256(accessToken)
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
@@ -0,0 +1,119 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* Пример из OpenID Connect Core 1.0, A.3 */
+func TestAccessTokenHash(t *testing.T) {
+	if hash := AccessTokenHash([]byte("jHkWEdUXMU1BwAsC4vtUsZwnNvTIxEl0z9K3vx5KF0Y")); hash != "77QmUPtjPfzWtF2AnpK9RQ" {
+		t.Errorf("at_hash = %s", hash)
+	}
+}
+
+/* Ключ и отпечаток из RFC 7638, 3.1. Для отпечатка нужна только открытая часть ключа. */
+func TestKeyIDRFC7638(t *testing.T) {
+	n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewIDTokenSigner(&rsa.PrivateKey{PublicKey: rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := signer.KeyID(); kid != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("kid = %s", kid)
+	}
+}
+
+/* Координаты EC ключа в JWK и отпечатке дополняются нулями до 32 байт, иначе у части ключей kid разойдётся с тем,
+ * что посчитает приложение. Ключ с коротким x подбирается перебором: в среднем один из 256. */
+func TestKeyIDECPadding(t *testing.T) {
+	key := mustECKey(t, elliptic.P256())
+	for key.X.BitLen() > 248 {
+		key = mustECKey(t, elliptic.P256())
+	}
+	signer, err := NewIDTokenSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := make([]byte, 32), make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	canonical := `{"crv":"P-256","kty":"EC","x":"` + base64.RawURLEncoding.EncodeToString(x) +
+		`","y":"` + base64.RawURLEncoding.EncodeToString(y) + `"}`
+	sum := sha256.Sum256([]byte(canonical))
+	if kid := signer.KeyID(); kid != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Errorf("kid = %s for %s", kid, canonical)
+	}
+
+	if _, err = NewIDTokenSigner(mustECKey(t, elliptic.P384())); err == nil {
+		t.Error("P-384 key must be rejected")
+	}
+}
+
+func mustECKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+/* id_token проверяется по опубликованному JWKS так же, как его проверит приложение */
+func TestIDTokenSignerJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []interface{}{rsaKey, mustECKey(t, elliptic.P256())} {
+		signer, err := NewIDTokenSigner(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now().Unix()
+		idToken, err := signer.Sign(map[string]interface{}{
+			"iss": "https://acme.example", "sub": "user", "aud": "spa", "iat": now, "exp": now + 60,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header := struct {
+			Alg string `json:"alg"`
+			Kid string `json:"kid"`
+		}{}
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.Split(string(idToken), ".")[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(decoded, &header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Alg != signer.Alg() || header.Kid != signer.KeyID() {
+			t.Errorf("%s: header %s", signer.Alg(), decoded)
+		}
+
+		jwks, err := json.Marshal(signer.JWKS())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := ParseJWKS(jwks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = VerifyIDToken(idToken, keys, "https://acme.example", "spa"); err != nil {
+			t.Errorf("%s: %v", signer.Alg(), err)
+		}
+	}
+}
@@ -29,3 +29,24 @@ func (pair *Pair) ToJson() (result []byte, err error) {
 	}, "", "  ")
 	return
 }
+
+/* Ответ токен-эндпоинта OAuth 2.0 (RFC 6749, 5.1) */
+type oauthResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+func (pair *Pair) ToOAuthJson(expiresIn int64, scope string) ([]byte, error) {
+	return json.Marshal(&oauthResponse{
+		AccessToken:  string(pair.Access),
+		TokenType:    "Bearer",
+		ExpiresIn:    expiresIn,
+		RefreshToken: string(pair.Refresh),
+		Scope:        scope,
+		IDToken:      string(pair.ID),
+	})
+}
@@ -0,0 +1,50 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+/* Токены для одноразовых ссылок из писем: случайная часть и HMAC-SHA256 подпись от неё,
+ * разделённые точкой. Подпись привязана к назначению ссылки, поэтому токен от одной ссылки
+ * не подойдёт к другой. В базе хранится только sha256 от токена целиком. */
+
+var ErrInvalidLinkToken = errors.New("link token is malformed or has invalid signature")
+
+func NewLinkToken(secret []byte, purpose string) (linkToken string, hash string, err error) {
+	random, err := randomBytes(32)
+	if err != nil {
+		return "", "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(random)
+	linkToken = encoded + "." + base64.RawURLEncoding.EncodeToString(linkSignature(secret, purpose, encoded))
+	return linkToken, LinkTokenHash(linkToken), nil
+}
+
+/* Проверяет подпись токена и возвращает хэш, по которому его можно найти в базе */
+func VerifyLinkToken(secret []byte, purpose string, linkToken string) (hash string, err error) {
+	encoded, signature, found := strings.Cut(linkToken, ".")
+	if !found {
+		return "", ErrInvalidLinkToken
+	}
+	decodedSignature, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(decodedSignature, linkSignature(secret, purpose, encoded)) {
+		return "", ErrInvalidLinkToken
+	}
+	return LinkTokenHash(linkToken), nil
+}
+
+func LinkTokenHash(linkToken string) string {
+	sum := sha256.Sum256([]byte(linkToken))
+	return hex.EncodeToString(sum[:])
+}
+
+func linkSignature(secret []byte, purpose string, encoded string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose + "." + encoded))
+	return mac.Sum(nil)
+}
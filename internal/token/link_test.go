@@ -0,0 +1,67 @@
+package token
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLinkToken(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	linkToken, hash, err := NewLinkToken(secret, "magic_login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != LinkTokenHash(linkToken) {
+		t.Fatal("hash must be sha256 of the whole token")
+	}
+	verified, err := VerifyLinkToken(secret, "magic_login", linkToken)
+	if err != nil || verified != hash {
+		t.Fatalf("VerifyLinkToken = %q, %v; want %q, nil", verified, err, hash)
+	}
+
+	other, _, err := NewLinkToken(secret, "magic_login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == linkToken {
+		t.Fatal("link tokens must be random")
+	}
+}
+
+func TestVerifyLinkTokenRejects(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	linkToken, _, err := NewLinkToken(secret, "magic_login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	random, signature, _ := strings.Cut(linkToken, ".")
+	/* Меняем первый символ случайной части, подпись остаётся от исходной */
+	tampered := "A" + random[1:]
+	if tampered == random {
+		tampered = "B" + random[1:]
+	}
+
+	tests := []struct {
+		name      string
+		secret    []byte
+		purpose   string
+		linkToken string
+	}{
+		{"other purpose", secret, "password_reset", linkToken},
+		{"other secret", []byte("fedcba9876543210fedcba9876543210"), "magic_login", linkToken},
+		{"tampered random part", secret, "magic_login", tampered + "." + signature},
+		{"no signature", secret, "magic_login", random},
+		{"empty signature", secret, "magic_login", random + "."},
+		{"signature is not base64", secret, "magic_login", random + ".***"},
+		{"empty", secret, "magic_login", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hash, err := VerifyLinkToken(test.secret, test.purpose, test.linkToken)
+			if !errors.Is(err, ErrInvalidLinkToken) || hash != "" {
+				t.Fatalf("VerifyLinkToken = %q, %v; want ErrInvalidLinkToken", hash, err)
+			}
+		})
+	}
+}
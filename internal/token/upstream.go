@@ -0,0 +1,146 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"slices"
+	"time"
+
+	"github.com/kataras/jwt"
+)
+
+/* Ключа с kid из заголовка нет в JWKS провайдера: скорее всего, провайдер сменил ключ и JWKS пора перечитать */
+var ErrUnknownKeyID = errors.New("ID token is signed with an unknown key")
+
+/* Часы провайдера могут немного спешить: iat из будущего в пределах этого допуска не считается ошибкой */
+const idTokenClockSkew = time.Minute
+
+/* Разбирает JWK Set (RFC 7517, 5) внешнего провайдера в открытые ключи по kid. Ключи для шифрования
+ * и неподдерживаемых типов пропускаются, ключ без kid попадает под пустой kid. */
+func ParseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{})
+	for _, jwk := range set.Keys {
+		if use, _ := jwk["use"].(string); use != "" && use != "sig" {
+			continue
+		}
+		key, err := parseJWK(jwk)
+		if err != nil {
+			continue
+		}
+		kid, _ := jwk["kid"].(string)
+		keys[kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS does not contain supported signing keys")
+	}
+	return keys, nil
+}
+
+func parseJWK(jwk map[string]interface{}) (interface{}, error) {
+	field := func(name string) []byte {
+		value, _ := jwk[name].(string)
+		decoded, _ := base64.RawURLEncoding.DecodeString(value)
+		return decoded
+	}
+	kty, _ := jwk["kty"].(string)
+	crv, _ := jwk["crv"].(string)
+	switch kty {
+	case "RSA":
+		n, e := field("n"), field("e")
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("RSA key is malformed")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[crv]
+		x, y := field("x"), field("y")
+		if !ok || len(x) == 0 || len(y) == 0 {
+			return nil, errors.New("EC key is malformed")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC key is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		x := field("x")
+		if crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("OKP key is malformed")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New("key type is not supported")
+}
+
+/* Проверяет id_token внешнего провайдера (OpenID Connect Core 1.0, 3.1.3.7): подпись ключом из его JWKS,
+ * iss, aud (и azp, если получателей несколько), exp. Возвращает claims, nonce сверяет вызывающий. */
+func VerifyIDToken(idToken []byte, keys map[string]interface{}, issuer, clientID string) (map[string]interface{}, error) {
+	verifiedToken, err := jwt.VerifyWithHeaderValidator(nil, nil, idToken,
+		func(_ string, headerDecoded []byte) (jwt.Alg, jwt.PublicKey, jwt.InjectFunc, error) {
+			var header struct {
+				Alg string `json:"alg"`
+				Kid string `json:"kid"`
+			}
+			if err := json.Unmarshal(headerDecoded, &header); err != nil {
+				return nil, nil, nil, err
+			}
+			key, ok := keys[header.Kid]
+			if !ok {
+				/* Провайдер с единственным ключом может не указывать kid в JWKS */
+				key, ok = keys[""]
+			}
+			if !ok {
+				return nil, nil, nil, ErrUnknownKeyID
+			}
+			alg, ok := assertionAlgs[header.Alg]
+			if !ok || !algMatchesKey(header.Alg, key) {
+				return nil, nil, nil, jwt.ErrTokenAlg
+			}
+			return alg, key, nil, nil
+		},
+		jwt.TokenValidatorFunc(func(_ []byte, claims jwt.Claims, err error) error {
+			if errors.Is(err, jwt.ErrIssuedInTheFuture) && time.Until(time.Unix(claims.IssuedAt, 0)) <= idTokenClockSkew {
+				if claims.Expiry > 0 && time.Now().Unix() > claims.Expiry {
+					return jwt.ErrExpired
+				}
+				return nil
+			}
+			return err
+		}))
+	if err != nil {
+		return nil, err
+	}
+
+	standard := verifiedToken.StandardClaims
+	claims := map[string]interface{}{}
+	if err = json.Unmarshal(verifiedToken.Payload, &claims); err != nil {
+		return nil, err
+	}
+	azp, _ := claims["azp"].(string)
+	switch {
+	case standard.Issuer != issuer:
+		return nil, errors.New("iss does not match the provider")
+	case !slices.Contains(standard.Audience, clientID):
+		return nil, errors.New("aud does not contain the client_id")
+	case len(standard.Audience) > 1 && azp != clientID:
+		return nil, errors.New("azp must be the client_id when there are several audiences")
+	case standard.Expiry == 0:
+		return nil, errors.New("exp is required")
+	case standard.Subject == "":
+		return nil, errors.New("sub is required")
+	}
+	return claims, nil
+}
@@ -0,0 +1,81 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/* TOTP по RFC 6238 с параметрами, которые понимают все приложения-аутентификаторы:
+ * HMAC-SHA1, 6 цифр, шаг 30 секунд. */
+
+const (
+	Digits     = 6
+	Period     = 30
+	SecretSize = 20
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func GenerateSecret() ([]byte, error) {
+	secret := make([]byte, SecretSize)
+	_, err := io.ReadFull(rand.Reader, secret)
+	return secret, err
+}
+
+func EncodeSecret(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+/* Ссылка otpauth:// для QR-кода. account обычно email пользователя. */
+func URI(secret []byte, issuer string, account string) string {
+	query := url.Values{}
+	query.Set("secret", EncodeSecret(secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(Period))
+	/* Некоторые приложения не понимают "+" вместо пробела в параметрах */
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+/* Код для конкретного шага (HOTP от номера шага, RFC 4226) */
+func Code(secret []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%1000000)
+}
+
+/* Проверяет код в окне ±skew шагов и возвращает шаг, которому он соответствует.
+ * Шаг нужно сохранить и не принимать коды с шагом не больше сохранённого, иначе
+ * перехваченный код можно будет использовать повторно. */
+func Validate(secret []byte, code string, now time.Time, skew int64) (step int64, ok bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+	current := Step(now)
+	for delta := -skew; delta <= skew; delta++ {
+		if subtle.ConstantTimeCompare([]byte(Code(secret, current+delta)), []byte(code)) == 1 {
+			return current + delta, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,93 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+/* Ключ из приложений к RFC 4226 и RFC 6238 для HMAC-SHA1 */
+var rfcSecret = []byte("12345678901234567890")
+
+/* RFC 4226, приложение D: HOTP для счётчиков 0-9 */
+func TestCodeRFC4226(t *testing.T) {
+	expected := []string{"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range expected {
+		if got := Code(rfcSecret, int64(counter)); got != code {
+			t.Errorf("Code(%d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+/* RFC 6238, приложение B. В RFC коды из 8 цифр, у нас 6 - это их последние 6 цифр. */
+func TestValidateRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		step int64
+		code string
+	}{
+		{59, 0x1, "287082"},
+		{1111111109, 0x23523EC, "081804"},
+		{1111111111, 0x23523ED, "050471"},
+		{1234567890, 0x273EF07, "005924"},
+		{2000000000, 0x3F940AA, "279037"},
+		{20000000000, 0x27BC86AA, "353130"},
+	}
+	for _, test := range tests {
+		now := time.Unix(test.unix, 0)
+		if got := Step(now); got != test.step {
+			t.Errorf("Step(%d) = %X, want %X", test.unix, got, test.step)
+		}
+		if got := Code(rfcSecret, test.step); got != test.code {
+			t.Errorf("Code at %d = %s, want %s", test.unix, got, test.code)
+		}
+		step, ok := Validate(rfcSecret, test.code, now, 0)
+		if !ok || step != test.step {
+			t.Errorf("Validate at %d = %X, %v; want %X, true", test.unix, step, ok, test.step)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+	previous := Code(rfcSecret, current-1)
+	next := Code(rfcSecret, current+1)
+	farPrevious := Code(rfcSecret, current-2)
+
+	if _, ok := Validate(rfcSecret, previous, now, 0); ok {
+		t.Error("code of the previous step must be rejected without skew")
+	}
+	if step, ok := Validate(rfcSecret, previous, now, 1); !ok || step != current-1 {
+		t.Errorf("previous step with skew 1 = %d, %v; want %d, true", step, ok, current-1)
+	}
+	if step, ok := Validate(rfcSecret, next, now, 1); !ok || step != current+1 {
+		t.Errorf("next step with skew 1 = %d, %v; want %d, true", step, ok, current+1)
+	}
+	if _, ok := Validate(rfcSecret, farPrevious, now, 1); ok {
+		t.Error("code two steps back must be rejected with skew 1")
+	}
+}
+
+func TestValidateMalformed(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "2870820", "94287082", "abcdef", "287 82"} {
+		if _, ok := Validate(rfcSecret, code, now, 1); ok {
+			t.Errorf("Validate(%q) must fail", code)
+		}
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI(rfcSecret, "Auth Service", "ivan@example.com")
+	if !strings.HasPrefix(uri, "otpauth://totp/Auth%20Service:ivan@example.com?") {
+		t.Fatalf("unexpected label: %s", uri)
+	}
+	for _, parameter := range []string{"secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", "issuer=Auth%20Service",
+		"algorithm=SHA1", "digits=6", "period=30"} {
+		if !strings.Contains(uri, parameter) {
+			t.Errorf("URI %s has no %s", uri, parameter)
+		}
+	}
+}
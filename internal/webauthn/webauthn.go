@@ -0,0 +1,246 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"time"
+)
+
+/* Проверка церемоний регистрации и входа WebAuthn (https://www.w3.org/TR/webauthn-2/).
+ * Аттестация не проверяется: при регистрации запрашивается attestation "none",
+ * поэтому принимаются только ответы с fmt "none". Пакет ничего не знает о хранилище
+ * и HTTP, все данные передаются в функции явно. */
+
+const (
+	FlagUserPresent            = 0x01
+	FlagUserVerified           = 0x04
+	FlagAttestedCredentialData = 0x40
+	FlagExtensionData          = 0x80
+)
+
+var (
+	ErrInvalidClientData   = errors.New("client data does not match the ceremony")
+	ErrInvalidAuthData     = errors.New("authenticator data is malformed or does not match the relying party")
+	ErrUserNotPresent      = errors.New("user presence flag is not set")
+	ErrUserNotVerified     = errors.New("user verification is required")
+	ErrUnsupportedFormat   = errors.New("only \"none\" attestation format is supported")
+	ErrSignCountNotGreater = errors.New("sign count did not increase, authenticator may be cloned")
+)
+
+/* Base64URL кодируется в JSON как base64url без паддинга - так бинарные поля
+ * передаёт PublicKeyCredential.toJSON() в браузере */
+type Base64URL []byte
+
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	*b = decoded
+	return err
+}
+
+type RelyingParty struct {
+	ID                      string
+	Name                    string
+	Origins                 []string
+	RequireUserVerification bool
+	Timeout                 time.Duration
+}
+
+/* Новая зарегистрированная учётная запись аутентификатора */
+type Credential struct {
+	ID           []byte
+	PublicKey    []byte
+	SignCount    uint32
+	UserVerified bool
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, challenge)
+	return challenge, err
+}
+
+/* Достаёт challenge из clientDataJSON, не проверяя его. Нужен, чтобы найти сессию церемонии,
+ * после чего ответ проверяется целиком через VerifyRegistration или VerifyAssertion. */
+func ChallengeFromClientData(clientDataJSON []byte) ([]byte, error) {
+	data := clientData{}
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return nil, ErrInvalidClientData
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(data.Challenge)
+	if err != nil {
+		return nil, ErrInvalidClientData
+	}
+	return challenge, nil
+}
+
+func (rp *RelyingParty) VerifyRegistration(challenge []byte, clientDataJSON []byte, attestationObject []byte) (*Credential, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	value, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, err
+	}
+	attestation, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, errCBOR
+	}
+	if format, _ := attestation["fmt"].(string); format != "none" {
+		return nil, ErrUnsupportedFormat
+	}
+	rawAuthData, _ := attestation["authData"].([]byte)
+
+	authData, err := rp.verifyAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.flags&FlagAttestedCredentialData == 0 {
+		return nil, ErrInvalidAuthData
+	}
+	/* Убеждаемся, что ключ разбирается и алгоритм поддерживается, до того как сохранять его */
+	if _, err = parsePublicKey(authData.publicKey); err != nil {
+		return nil, err
+	}
+	return &Credential{
+		ID:           authData.credentialID,
+		PublicKey:    authData.publicKey,
+		SignCount:    authData.signCount,
+		UserVerified: authData.flags&FlagUserVerified != 0,
+	}, nil
+}
+
+/* Проверяет ответ аутентификатора при входе. storedSignCount - счётчик из базы;
+ * возвращается новый счётчик, который нужно сохранить. */
+func (rp *RelyingParty) VerifyAssertion(challenge []byte, publicKey []byte, storedSignCount uint32,
+	clientDataJSON []byte, rawAuthData []byte, signature []byte) (signCount uint32, userVerified bool, err error) {
+	if err = rp.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, false, err
+	}
+	authData, err := rp.verifyAuthData(rawAuthData)
+	if err != nil {
+		return 0, false, err
+	}
+
+	/* Подпись ставится на authenticatorData || sha256(clientDataJSON) */
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return 0, false, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), rawAuthData...), clientDataHash[:]...)
+	if err = key.verify(signed, signature); err != nil {
+		return 0, false, err
+	}
+
+	/* Синхронизируемые passkey всегда присылают 0, для них счётчик не проверяется */
+	if (authData.signCount != 0 || storedSignCount != 0) && authData.signCount <= storedSignCount {
+		return 0, false, ErrSignCountNotGreater
+	}
+	return authData.signCount, authData.flags&FlagUserVerified != 0, nil
+}
+
+func (rp *RelyingParty) verifyClientData(clientDataJSON []byte, ceremony string, challenge []byte) error {
+	data := clientData{}
+	if err := json.Unmarshal(clientDataJSON, &data); err != nil {
+		return ErrInvalidClientData
+	}
+	received, err := base64.RawURLEncoding.DecodeString(data.Challenge)
+	if err != nil || data.Type != ceremony || subtle.ConstantTimeCompare(received, challenge) != 1 ||
+		!slices.Contains(rp.Origins, data.Origin) {
+		return ErrInvalidClientData
+	}
+	return nil
+}
+
+func (rp *RelyingParty) verifyAuthData(raw []byte) (*authenticatorData, error) {
+	authData, err := parseAuthData(raw)
+	if err != nil {
+		return nil, err
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(authData.rpIDHash, rpIDHash[:]) {
+		return nil, ErrInvalidAuthData
+	}
+	if authData.flags&FlagUserPresent == 0 {
+		return nil, ErrUserNotPresent
+	}
+	if rp.RequireUserVerification && authData.flags&FlagUserVerified == 0 {
+		return nil, ErrUserNotVerified
+	}
+	return authData, nil
+}
+
+/* rpIdHash(32) | flags(1) | signCount(4) | [aaguid(16) | credIdLen(2) | credId | COSE ключ] | [расширения] */
+func parseAuthData(raw []byte) (*authenticatorData, error) {
+	if len(raw) < 37 {
+		return nil, ErrInvalidAuthData
+	}
+	authData := &authenticatorData{
+		rpIDHash:  raw[:32],
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	rest := raw[37:]
+	if authData.flags&FlagAttestedCredentialData != 0 {
+		if len(rest) < 18 {
+			return nil, ErrInvalidAuthData
+		}
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength == 0 || len(rest) < idLength {
+			return nil, ErrInvalidAuthData
+		}
+		authData.credentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		/* Длина COSE ключа не передаётся, узнаём её, разобрав CBOR */
+		_, afterKey, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, ErrInvalidAuthData
+		}
+		authData.publicKey = rest[:len(rest)-len(afterKey)]
+		rest = afterKey
+	}
+	if authData.flags&FlagExtensionData != 0 {
+		_, afterExtensions, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, ErrInvalidAuthData
+		}
+		rest = afterExtensions
+	}
+	if len(rest) != 0 {
+		return nil, ErrInvalidAuthData
+	}
+	return authData, nil
+}
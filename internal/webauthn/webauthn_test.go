@@ -0,0 +1,420 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+/* Программный аутентификатор: собирает attestationObject и подписи так же, как это делает ключ
+ * или платформенный аутентификатор браузера с attestation "none" */
+type softAuthenticator struct {
+	t            testing.TB
+	credentialID []byte
+	signer       crypto.Signer
+	alg          int64
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t testing.TB, alg int64) *softAuthenticator {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case AlgES256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	case AlgRS256:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softAuthenticator{t: t, credentialID: credentialID, signer: signer, alg: alg}
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	switch key := a.signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		return encodeCBOR(cborMap{
+			{int64(1), int64(2)}, {int64(3), a.alg}, {int64(-1), int64(1)},
+			{int64(-2), key.X.FillBytes(make([]byte, 32))}, {int64(-3), key.Y.FillBytes(make([]byte, 32))},
+		})
+	case ed25519.PublicKey:
+		return encodeCBOR(cborMap{{int64(1), int64(1)}, {int64(3), a.alg}, {int64(-1), int64(6)}, {int64(-2), []byte(key)}})
+	case *rsa.PublicKey:
+		return encodeCBOR(cborMap{
+			{int64(1), int64(3)}, {int64(3), a.alg},
+			{int64(-1), key.N.Bytes()}, {int64(-2), big.NewInt(int64(key.E)).Bytes()},
+		})
+	}
+	a.t.Fatal("unknown key type")
+	return nil
+}
+
+/* rpIdHash | flags | signCount | [aaguid | credIdLen | credId | COSE ключ] */
+func (a *softAuthenticator) authData(rpID string, flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte(nil), rpIDHash[:]...)
+	if attested {
+		flags |= FlagAttestedCredentialData
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) attestationObject(format string, authData []byte) []byte {
+	return encodeCBOR(cborMap{{"fmt", format}, {"attStmt", cborMap{}}, {"authData", authData}})
+}
+
+func (a *softAuthenticator) sign(authData []byte, clientDataJSON []byte) []byte {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), authData...), clientDataHash[:]...)
+	var signature []byte
+	var err error
+	switch a.alg {
+	case AlgEdDSA:
+		signature, err = a.signer.Sign(rand.Reader, signed, crypto.Hash(0))
+	default:
+		digest := sha256.Sum256(signed)
+		signature, err = a.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return signature
+}
+
+func clientDataJSON(ceremony string, challenge []byte, origin string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":        ceremony,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      origin,
+		"crossOrigin": false,
+	})
+	return data
+}
+
+func testRelyingParty() *RelyingParty {
+	return &RelyingParty{ID: "example.com", Name: "Example", Origins: []string{"https://example.com"}}
+}
+
+func mustChallenge(t *testing.T) []byte {
+	challenge, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return challenge
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	for name, alg := range map[string]int64{"ES256": AlgES256, "EdDSA": AlgEdDSA, "RS256": AlgRS256} {
+		t.Run(name, func(t *testing.T) {
+			rp := testRelyingParty()
+			authenticator := newSoftAuthenticator(t, alg)
+
+			challenge := mustChallenge(t)
+			clientData := clientDataJSON("webauthn.create", challenge, "https://example.com")
+			attestation := authenticator.attestationObject("none",
+				authenticator.authData("example.com", FlagUserPresent|FlagUserVerified, true))
+			credential, err := rp.VerifyRegistration(challenge, clientData, attestation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(credential.ID, authenticator.credentialID) || !credential.UserVerified ||
+				!bytes.Equal(credential.PublicKey, authenticator.coseKey()) {
+				t.Fatalf("unexpected credential: %+v", credential)
+			}
+			if found, err := ChallengeFromClientData(clientData); err != nil || !bytes.Equal(found, challenge) {
+				t.Fatalf("ChallengeFromClientData = %x, %v", found, err)
+			}
+
+			stored := credential.SignCount
+			for i := 0; i < 2; i++ {
+				authenticator.signCount++
+				challenge = mustChallenge(t)
+				clientData = clientDataJSON("webauthn.get", challenge, "https://example.com")
+				authData := authenticator.authData("example.com", FlagUserPresent, false)
+				signCount, userVerified, err := rp.VerifyAssertion(challenge, credential.PublicKey, stored,
+					clientData, authData, authenticator.sign(authData, clientData))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if signCount != authenticator.signCount || userVerified {
+					t.Fatalf("VerifyAssertion = %d, %v; want %d, false", signCount, userVerified, authenticator.signCount)
+				}
+				stored = signCount
+			}
+		})
+	}
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, AlgES256)
+	challenge := mustChallenge(t)
+	validClientData := clientDataJSON("webauthn.create", challenge, "https://example.com")
+	validAuthData := authenticator.authData("example.com", FlagUserPresent, true)
+
+	tests := []struct {
+		name              string
+		requireUV         bool
+		clientDataJSON    []byte
+		attestationObject []byte
+		err               error
+	}{
+		{"wrong challenge", false, clientDataJSON("webauthn.create", mustChallenge(t), "https://example.com"),
+			authenticator.attestationObject("none", validAuthData), ErrInvalidClientData},
+		{"wrong origin", false, clientDataJSON("webauthn.create", challenge, "https://evil.example"),
+			authenticator.attestationObject("none", validAuthData), ErrInvalidClientData},
+		{"assertion client data", false, clientDataJSON("webauthn.get", challenge, "https://example.com"),
+			authenticator.attestationObject("none", validAuthData), ErrInvalidClientData},
+		{"client data is not JSON", false, []byte("{"),
+			authenticator.attestationObject("none", validAuthData), ErrInvalidClientData},
+		{"wrong rpIdHash", false, validClientData,
+			authenticator.attestationObject("none", authenticator.authData("evil.example", FlagUserPresent, true)),
+			ErrInvalidAuthData},
+		{"user not present", false, validClientData,
+			authenticator.attestationObject("none", authenticator.authData("example.com", 0, true)), ErrUserNotPresent},
+		{"user not verified", true, validClientData,
+			authenticator.attestationObject("none", validAuthData), ErrUserNotVerified},
+		{"no attested credential", false, validClientData,
+			authenticator.attestationObject("none", authenticator.authData("example.com", FlagUserPresent, false)),
+			ErrInvalidAuthData},
+		{"packed attestation", false, validClientData,
+			authenticator.attestationObject("packed", validAuthData), ErrUnsupportedFormat},
+		{"trailing bytes in authData", false, validClientData,
+			authenticator.attestationObject("none", append(append([]byte(nil), validAuthData...), 0)), ErrInvalidAuthData},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rp := testRelyingParty()
+			rp.RequireUserVerification = test.requireUV
+			credential, err := rp.VerifyRegistration(challenge, test.clientDataJSON, test.attestationObject)
+			if !errors.Is(err, test.err) || credential != nil {
+				t.Fatalf("VerifyRegistration = %v, %v; want %v", credential, err, test.err)
+			}
+		})
+	}
+
+	/* Ключ с алгоритмом, который не предлагался при регистрации (ES384) */
+	unsupported := encodeCBOR(cborMap{{int64(1), int64(2)}, {int64(3), int64(-35)}, {int64(-1), int64(2)},
+		{int64(-2), make([]byte, 48)}, {int64(-3), make([]byte, 48)}})
+	authData := authenticator.authData("example.com", FlagUserPresent, true)
+	authData = append(authData[:len(authData)-len(authenticator.coseKey())], unsupported...)
+	_, err := testRelyingParty().VerifyRegistration(challenge, validClientData, authenticator.attestationObject("none", authData))
+	if !errors.Is(err, ErrUnsupportedKey) {
+		t.Fatalf("unsupported algorithm: %v", err)
+	}
+}
+
+func TestAssertionRejected(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, AlgES256)
+	publicKey := authenticator.coseKey()
+	challenge := mustChallenge(t)
+	authenticator.signCount = 10
+	validClientData := clientDataJSON("webauthn.get", challenge, "https://example.com")
+	validAuthData := authenticator.authData("example.com", FlagUserPresent, false)
+
+	type assertion struct {
+		clientDataJSON []byte
+		authData       []byte
+		signature      []byte
+	}
+	signed := func(clientDataJSON []byte, authData []byte) assertion {
+		return assertion{clientDataJSON, authData, authenticator.sign(authData, clientDataJSON)}
+	}
+	withSignCount := func(signCount uint32) assertion {
+		saved := authenticator.signCount
+		authenticator.signCount = signCount
+		defer func() { authenticator.signCount = saved }()
+		return signed(validClientData, authenticator.authData("example.com", FlagUserPresent, false))
+	}
+	otherKey := newSoftAuthenticator(t, AlgES256)
+
+	tests := []struct {
+		name      string
+		requireUV bool
+		stored    uint32
+		assertion assertion
+		err       error
+	}{
+		{"wrong challenge", false, 5,
+			signed(clientDataJSON("webauthn.get", mustChallenge(t), "https://example.com"), validAuthData), ErrInvalidClientData},
+		{"wrong origin", false, 5,
+			signed(clientDataJSON("webauthn.get", challenge, "https://evil.example"), validAuthData), ErrInvalidClientData},
+		{"registration client data", false, 5,
+			signed(clientDataJSON("webauthn.create", challenge, "https://example.com"), validAuthData), ErrInvalidClientData},
+		{"wrong rpIdHash", false, 5,
+			signed(validClientData, authenticator.authData("evil.example", FlagUserPresent, false)), ErrInvalidAuthData},
+		{"user not present", false, 5,
+			signed(validClientData, authenticator.authData("example.com", 0, false)), ErrUserNotPresent},
+		{"user not verified", true, 5, signed(validClientData, validAuthData), ErrUserNotVerified},
+		{"signed by another key", false, 5,
+			assertion{validClientData, validAuthData, otherKey.sign(validAuthData, validClientData)}, ErrBadSignature},
+		{"signature over other client data", false, 5,
+			assertion{validClientData, validAuthData, authenticator.sign(validAuthData, []byte("{}"))}, ErrBadSignature},
+		{"truncated authData", false, 5, signed(validClientData, validAuthData[:36]), ErrInvalidAuthData},
+		{"sign count did not change", false, 10, withSignCount(10), ErrSignCountNotGreater},
+		{"sign count went back", false, 10, withSignCount(3), ErrSignCountNotGreater},
+		{"sign count reset to zero", false, 10, withSignCount(0), ErrSignCountNotGreater},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rp := testRelyingParty()
+			rp.RequireUserVerification = test.requireUV
+			_, _, err := rp.VerifyAssertion(challenge, publicKey, test.stored,
+				test.assertion.clientDataJSON, test.assertion.authData, test.assertion.signature)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("VerifyAssertion error = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestAssertionUserVerification(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, AlgEdDSA)
+	rp := testRelyingParty()
+	rp.RequireUserVerification = true
+	challenge := mustChallenge(t)
+	clientData := clientDataJSON("webauthn.get", challenge, "https://example.com")
+	/* Синхронизируемые passkey не ведут счётчик и всегда присылают 0 */
+	authData := authenticator.authData("example.com", FlagUserPresent|FlagUserVerified, false)
+	signCount, userVerified, err := rp.VerifyAssertion(challenge, authenticator.coseKey(), 0,
+		clientData, authData, authenticator.sign(authData, clientData))
+	if err != nil || signCount != 0 || !userVerified {
+		t.Fatalf("VerifyAssertion = %d, %v, %v; want 0, true, nil", signCount, userVerified, err)
+	}
+}
+
+/* Обрезанный или испорченный attestationObject должен давать ошибку, а не панику */
+func TestMalformedAttestationObject(t *testing.T) {
+	authenticator := newSoftAuthenticator(t, AlgES256)
+	rp := testRelyingParty()
+	challenge := mustChallenge(t)
+	clientData := clientDataJSON("webauthn.create", challenge, "https://example.com")
+	authData := authenticator.authData("example.com", FlagUserPresent, true)
+	attestation := authenticator.attestationObject("none", authData)
+
+	for length := 0; length < len(attestation); length++ {
+		if _, err := rp.VerifyRegistration(challenge, clientData, attestation[:length]); err == nil {
+			t.Fatalf("attestation object truncated to %d bytes was accepted", length)
+		}
+	}
+	/* authData обрезается внутри корректного CBOR: ломается разбор COSE ключа и длины credentialId */
+	for length := 0; length < len(authData); length++ {
+		truncated := authenticator.attestationObject("none", authData[:length])
+		if _, err := rp.VerifyRegistration(challenge, clientData, truncated); err == nil {
+			t.Fatalf("authData truncated to %d bytes was accepted", length)
+		}
+	}
+	/* Каждый байт по очереди заменяется на 0xff */
+	for i := range attestation {
+		corrupted := append([]byte(nil), attestation...)
+		corrupted[i] = 0xff
+		rp.VerifyRegistration(challenge, clientData, corrupted)
+	}
+
+	for name, data := range map[string][]byte{
+		"not a map":               encodeCBOR([]byte("authData")),
+		"authData is not bytes":   encodeCBOR(cborMap{{"fmt", "none"}, {"attStmt", cborMap{}}, {"authData", "text"}}),
+		"no authData":             encodeCBOR(cborMap{{"fmt", "none"}, {"attStmt", cborMap{}}}),
+		"byte string past end":    {0xa1, 0x63, 'f', 'm', 't', 0x5a, 0xff, 0xff, 0xff, 0xff},
+		"array longer than input": {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"map longer than input":   {0xbb, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"indefinite length bytes": {0x5f, 0x41, 0x00, 0xff},
+		"bytes as map key":        {0xa1, 0x41, 0x00, 0x00},
+		"half float":              {0xf9, 0x3c, 0x00},
+		"negative int overflow":   {0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"deep nesting":            bytes.Repeat([]byte{0x81}, 64),
+		"deep tags":               append(bytes.Repeat([]byte{0xc6}, 64), 0x00),
+	} {
+		if _, err := rp.VerifyRegistration(challenge, clientData, data); err == nil {
+			t.Errorf("%s: malformed attestation object was accepted", name)
+		}
+	}
+}
+
+func TestMalformedPublicKey(t *testing.T) {
+	for name, key := range map[string][]byte{
+		"empty":        nil,
+		"not a map":    encodeCBOR(int64(1)),
+		"short EC x":   encodeCBOR(cborMap{{int64(1), int64(2)}, {int64(3), int64(AlgES256)}, {int64(-1), int64(1)}, {int64(-2), make([]byte, 31)}, {int64(-3), make([]byte, 32)}}),
+		"not on curve": encodeCBOR(cborMap{{int64(1), int64(2)}, {int64(3), int64(AlgES256)}, {int64(-1), int64(1)}, {int64(-2), make([]byte, 32)}, {int64(-3), make([]byte, 32)}}),
+		"short RSA n":  encodeCBOR(cborMap{{int64(1), int64(3)}, {int64(3), int64(AlgRS256)}, {int64(-1), make([]byte, 128)}, {int64(-2), []byte{1, 0, 1}}}),
+		"Ed448":        encodeCBOR(cborMap{{int64(1), int64(1)}, {int64(3), int64(AlgEdDSA)}, {int64(-1), int64(7)}, {int64(-2), make([]byte, 57)}}),
+	} {
+		if _, err := parsePublicKey(key); err == nil {
+			t.Errorf("%s: malformed key was accepted", name)
+		}
+	}
+}
+
+func FuzzDecodeCBOR(f *testing.F) {
+	authenticator := newSoftAuthenticator(f, AlgES256)
+	f.Add(authenticator.attestationObject("none", authenticator.authData("example.com", FlagUserPresent, true)))
+	f.Add(authenticator.coseKey())
+	f.Add([]byte{0xbb, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeCBOR(data)
+		parseAuthData(data)
+		parsePublicKey(data)
+	})
+}
+
+/* Кодировщик CBOR для тестов: словари с заданным порядком ключей, целые, строки и байты */
+type cborMap [][2]interface{}
+
+func encodeCBOR(value interface{}) []byte {
+	head := func(major byte, argument uint64) []byte {
+		switch {
+		case argument < 24:
+			return []byte{major<<5 | byte(argument)}
+		case argument <= 0xff:
+			return []byte{major<<5 | 24, byte(argument)}
+		case argument <= 0xffff:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(argument))
+		case argument <= 0xffffffff:
+			return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(argument))
+		}
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, argument)
+	}
+	switch v := value.(type) {
+	case int64:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case cborMap:
+		result := head(5, uint64(len(v)))
+		for _, pair := range v {
+			result = append(result, encodeCBOR(pair[0])...)
+			result = append(result, encodeCBOR(pair[1])...)
+		}
+		return result
+	}
+	panic("unsupported CBOR value")
+}